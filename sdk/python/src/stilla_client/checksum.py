@@ -0,0 +1,78 @@
+import hashlib
+import json
+import math
+from decimal import Decimal
+from typing import Any
+
+PREFIX = "sha256:"
+
+
+def _canonical_float(f: float) -> str:
+    """Formats a float the way the Stilla API writes JSON numbers."""
+    if not math.isfinite(f):
+        raise ValueError("JSON numbers must be finite.")
+    if f.is_integer() and abs(f) < 1e21:
+        return str(int(f))
+    if abs(f) < 1e-6 or abs(f) >= 1e21:
+        mantissa, exponent = repr(f).split("e")
+        return f"{mantissa}e{exponent[0]}{exponent[1:].lstrip('0')}"
+    return format(Decimal(repr(f)), "f")
+
+
+def _canonical(value: Any) -> str:
+    if isinstance(value, dict):
+        items = sorted(value.items())
+        return "{" + ",".join(f"{_canonical(str(k))}:{_canonical(v)}" for k, v in items) + "}"
+    if isinstance(value, (list, tuple)):
+        return "[" + ",".join(_canonical(v) for v in value) + "]"
+    if isinstance(value, float):
+        return _canonical_float(value)
+    # Go escapes the JavaScript line terminators even without HTML escaping
+    encoded = json.dumps(value, ensure_ascii=False)
+    return encoded.replace("\u2028", "\\u2028").replace("\u2029", "\\u2029")
+
+
+def canonical_json(config: Any) -> bytes:
+    """Returns the canonical JSON form of a configuration payload.
+
+    Object keys are sorted, there's no whitespace and numbers are
+    written as the Stilla API writes them.
+
+    Args:
+        config: The configuration payload.
+
+    Returns:
+        The canonical JSON, UTF-8 encoded.
+    """
+    return _canonical(config).encode("utf-8")
+
+
+def config_checksum(config: Any) -> str:
+    """Returns the content checksum of a configuration payload.
+
+    Args:
+        config: The configuration payload.
+
+    Returns:
+        sha256: followed by the hex SHA-256 of the canonical JSON.
+    """
+    return PREFIX + hashlib.sha256(canonical_json(config)).hexdigest()
+
+
+def verify_checksum(config: Any, checksum: str) -> bool:
+    """Verifies a configuration payload against its checksum.
+
+    Args:
+        config: The configuration payload, the config field of a version.
+        checksum: The checksum field of the version.
+
+    Returns:
+        Whether the payload matches the checksum.
+
+    Raises:
+        ValueError: If the checksum isn't a content checksum. Versions
+            stored before content checksums can't be verified.
+    """
+    if not checksum.startswith(PREFIX):
+        raise ValueError("The checksum isn't a content checksum.")
+    return config_checksum(config) == checksum
@@ -0,0 +1,50 @@
+from stilla_client.checksum import canonical_json, config_checksum, verify_checksum
+import pytest
+
+
+def test_canonical_json():
+    config = {
+        "b": 1,
+        "a": {"d": True, "c": None},
+        "url": "a?b=1&c=<d>",
+        "float": 1.5,
+        "small": 0.00001,
+        "tiny": 1e-7,
+        "name": "café",
+    }
+    expected = '{"a":{"c":null,"d":true},"b":1,"float":1.5,"name":"café","small":0.00001,"tiny":1e-7,"url":"a?b=1&c=<d>"}'
+    assert expected.encode("utf-8") == canonical_json(config)
+
+
+def test_config_checksum():
+    # the same vector as the service's checksum package
+    expected = "sha256:b9dfd9658f78451a4a126181e1798e01b637999def47957ae896bc1e8fbf248c"
+    assert expected == config_checksum({"port": 5432, "name": "db"})
+
+
+def test_canonical_json_line_terminators():
+    config = {"line\u2028": "a\u2028b\u2029"}
+    assert b'{"line\\u2028":"a\\u2028b\\u2029"}' == canonical_json(config)
+    # the service's checksum of the same payload
+    expected = "sha256:ee6a406f0247b37b3cf7c8aeca39ff8aa0645ab55c187745e37828683260a0c7"
+    assert expected == config_checksum(config)
+
+
+def test_canonical_json_control_characters():
+    # the fixture of TestCanonicalStrings in service/pkg/checksum
+    config = {"ctl\u0001": "\b\f\n\r\t\u0000\u001f\u007f\"\\/\u2028\u2029\u00e9"}
+    expected_json = '{"ctl\\u0001":"\\b\\f\\n\\r\\t\\u0000\\u001f\u007f\\"\\\\/\\u2028\\u2029\u00e9"}'
+    assert expected_json.encode("utf-8") == canonical_json(config)
+    expected = "sha256:ffb3139128ad4ff87d675036b56354da4fd028611cf3d3943ef27f84300006ad"
+    assert expected == config_checksum(config)
+
+
+def test_verify_checksum():
+    checksum = config_checksum({"enabled": True})
+    assert verify_checksum({"enabled": True}, checksum)
+    assert not verify_checksum({"enabled": False}, checksum)
+
+
+def test_verify_checksum_legacy():
+    with pytest.raises(ValueError):
+        verify_checksum({}, "3f2a")
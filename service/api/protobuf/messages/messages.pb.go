@@ -22,15 +22,13 @@ const (
 	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
 )
 
-// AuditLog_MessageType ...
 type AuditLog_MessageType int32
 
-// AuditLog_AUDIT ...
 const (
 	AuditLog_AUDIT AuditLog_MessageType = 0
 )
 
-// AuditLog_MessageType_name Enum value maps for AuditLog_MessageType.
+// Enum value maps for AuditLog_MessageType.
 var (
 	AuditLog_MessageType_name = map[int32]string{
 		0: "AUDIT",
@@ -40,52 +38,96 @@ var (
 	}
 )
 
-// Enum ...
 func (x AuditLog_MessageType) Enum() *AuditLog_MessageType {
 	p := new(AuditLog_MessageType)
 	*p = x
 	return p
 }
 
-// String ...
 func (x AuditLog_MessageType) String() string {
 	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
 }
 
-// Descriptor ...
 func (AuditLog_MessageType) Descriptor() protoreflect.EnumDescriptor {
 	return file_messages_proto_enumTypes[0].Descriptor()
 }
 
-// Type ...
 func (AuditLog_MessageType) Type() protoreflect.EnumType {
 	return &file_messages_proto_enumTypes[0]
 }
 
-// Number ...
 func (x AuditLog_MessageType) Number() protoreflect.EnumNumber {
 	return protoreflect.EnumNumber(x)
 }
 
-// EnumDescriptor Deprecated: Use AuditLog_MessageType.Descriptor instead.
+// Deprecated: Use AuditLog_MessageType.Descriptor instead.
 func (AuditLog_MessageType) EnumDescriptor() ([]byte, []int) {
 	return file_messages_proto_rawDescGZIP(), []int{0, 0}
 }
 
-// AuditLog ...
+type ConfigDiff_Operation int32
+
+const (
+	ConfigDiff_ADD     ConfigDiff_Operation = 0
+	ConfigDiff_REMOVE  ConfigDiff_Operation = 1
+	ConfigDiff_REPLACE ConfigDiff_Operation = 2
+)
+
+// Enum value maps for ConfigDiff_Operation.
+var (
+	ConfigDiff_Operation_name = map[int32]string{
+		0: "ADD",
+		1: "REMOVE",
+		2: "REPLACE",
+	}
+	ConfigDiff_Operation_value = map[string]int32{
+		"ADD":     0,
+		"REMOVE":  1,
+		"REPLACE": 2,
+	}
+)
+
+func (x ConfigDiff_Operation) Enum() *ConfigDiff_Operation {
+	p := new(ConfigDiff_Operation)
+	*p = x
+	return p
+}
+
+func (x ConfigDiff_Operation) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (ConfigDiff_Operation) Descriptor() protoreflect.EnumDescriptor {
+	return file_messages_proto_enumTypes[1].Descriptor()
+}
+
+func (ConfigDiff_Operation) Type() protoreflect.EnumType {
+	return &file_messages_proto_enumTypes[1]
+}
+
+func (x ConfigDiff_Operation) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use ConfigDiff_Operation.Descriptor instead.
+func (ConfigDiff_Operation) EnumDescriptor() ([]byte, []int) {
+	return file_messages_proto_rawDescGZIP(), []int{2, 0}
+}
+
 type AuditLog struct {
 	state         protoimpl.MessageState
-	Message       *structpb.Struct       `protobuf:"bytes,5,opt,name=message,proto3" json:"message,omitempty"`
-	Sent          *timestamppb.Timestamp `protobuf:"bytes,6,opt,name=sent,proto3" json:"sent,omitempty"`
-	Topic         string                 `protobuf:"bytes,1,opt,name=topic,proto3" json:"topic,omitempty"`
-	FuncName      string                 `protobuf:"bytes,2,opt,name=funcName,proto3" json:"funcName,omitempty"`
-	Service       string                 `protobuf:"bytes,3,opt,name=service,proto3" json:"service,omitempty"`
-	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
-	MessageType   AuditLog_MessageType `protobuf:"varint,4,opt,name=messageType,proto3,enum=tutorial.AuditLog_MessageType" json:"messageType,omitempty"`
+	unknownFields protoimpl.UnknownFields
+
+	Topic       string               `protobuf:"bytes,1,opt,name=topic,proto3" json:"topic,omitempty"`
+	FuncName    string               `protobuf:"bytes,2,opt,name=funcName,proto3" json:"funcName,omitempty"`
+	Service     string               `protobuf:"bytes,3,opt,name=service,proto3" json:"service,omitempty"`
+	MessageType AuditLog_MessageType `protobuf:"varint,4,opt,name=messageType,proto3,enum=tutorial.AuditLog_MessageType" json:"messageType,omitempty"`
+	Message     *structpb.Struct     `protobuf:"bytes,5,opt,name=message,proto3" json:"message,omitempty"`
+	// repeated google.protobuf.Any message = 5;
+	Sent *timestamppb.Timestamp `protobuf:"bytes,6,opt,name=sent,proto3" json:"sent,omitempty"`
 }
 
-// Reset ...
 func (x *AuditLog) Reset() {
 	*x = AuditLog{}
 	if protoimpl.UnsafeEnabled {
@@ -95,15 +137,12 @@ func (x *AuditLog) Reset() {
 	}
 }
 
-// String ...
 func (x *AuditLog) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-// ProtoMessage ...
 func (*AuditLog) ProtoMessage() {}
 
-// ProtoReflect ...
 func (x *AuditLog) ProtoReflect() protoreflect.Message {
 	mi := &file_messages_proto_msgTypes[0]
 	if protoimpl.UnsafeEnabled && x != nil {
@@ -116,12 +155,11 @@ func (x *AuditLog) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Descriptor Deprecated: Use AuditLog.ProtoReflect.Descriptor instead.
+// Deprecated: Use AuditLog.ProtoReflect.Descriptor instead.
 func (*AuditLog) Descriptor() ([]byte, []int) {
 	return file_messages_proto_rawDescGZIP(), []int{0}
 }
 
-// GetTopic ...
 func (x *AuditLog) GetTopic() string {
 	if x != nil {
 		return x.Topic
@@ -129,7 +167,6 @@ func (x *AuditLog) GetTopic() string {
 	return ""
 }
 
-// GetFuncName ...
 func (x *AuditLog) GetFuncName() string {
 	if x != nil {
 		return x.FuncName
@@ -137,7 +174,6 @@ func (x *AuditLog) GetFuncName() string {
 	return ""
 }
 
-// GetService ...
 func (x *AuditLog) GetService() string {
 	if x != nil {
 		return x.Service
@@ -145,7 +181,6 @@ func (x *AuditLog) GetService() string {
 	return ""
 }
 
-// GetMessageType ...
 func (x *AuditLog) GetMessageType() AuditLog_MessageType {
 	if x != nil {
 		return x.MessageType
@@ -153,7 +188,6 @@ func (x *AuditLog) GetMessageType() AuditLog_MessageType {
 	return AuditLog_AUDIT
 }
 
-// GetMessage ...
 func (x *AuditLog) GetMessage() *structpb.Struct {
 	if x != nil {
 		return x.Message
@@ -161,7 +195,6 @@ func (x *AuditLog) GetMessage() *structpb.Struct {
 	return nil
 }
 
-// GetSent ...
 func (x *AuditLog) GetSent() *timestamppb.Timestamp {
 	if x != nil {
 		return x.Sent
@@ -169,7 +202,198 @@ func (x *AuditLog) GetSent() *timestamppb.Timestamp {
 	return nil
 }
 
-// File_messages_proto ...
+type ConfigChange struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	ConfigId   string `protobuf:"bytes,1,opt,name=configId,proto3" json:"configId,omitempty"`
+	ConfigName string `protobuf:"bytes,2,opt,name=configName,proto3" json:"configName,omitempty"`
+	// actor is the ID of the host that made the change
+	Actor      string                 `protobuf:"bytes,3,opt,name=actor,proto3" json:"actor,omitempty"`
+	FuncName   string                 `protobuf:"bytes,4,opt,name=funcName,proto3" json:"funcName,omitempty"`
+	Service    string                 `protobuf:"bytes,5,opt,name=service,proto3" json:"service,omitempty"`
+	OldVersion int32                  `protobuf:"varint,6,opt,name=oldVersion,proto3" json:"oldVersion,omitempty"`
+	NewVersion int32                  `protobuf:"varint,7,opt,name=newVersion,proto3" json:"newVersion,omitempty"`
+	Checksum   string                 `protobuf:"bytes,8,opt,name=checksum,proto3" json:"checksum,omitempty"`
+	Diff       []*ConfigDiff          `protobuf:"bytes,9,rep,name=diff,proto3" json:"diff,omitempty"`
+	Sent       *timestamppb.Timestamp `protobuf:"bytes,10,opt,name=sent,proto3" json:"sent,omitempty"`
+}
+
+func (x *ConfigChange) Reset() {
+	*x = ConfigChange{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_messages_proto_msgTypes[1]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ConfigChange) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ConfigChange) ProtoMessage() {}
+
+func (x *ConfigChange) ProtoReflect() protoreflect.Message {
+	mi := &file_messages_proto_msgTypes[1]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ConfigChange.ProtoReflect.Descriptor instead.
+func (*ConfigChange) Descriptor() ([]byte, []int) {
+	return file_messages_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *ConfigChange) GetConfigId() string {
+	if x != nil {
+		return x.ConfigId
+	}
+	return ""
+}
+
+func (x *ConfigChange) GetConfigName() string {
+	if x != nil {
+		return x.ConfigName
+	}
+	return ""
+}
+
+func (x *ConfigChange) GetActor() string {
+	if x != nil {
+		return x.Actor
+	}
+	return ""
+}
+
+func (x *ConfigChange) GetFuncName() string {
+	if x != nil {
+		return x.FuncName
+	}
+	return ""
+}
+
+func (x *ConfigChange) GetService() string {
+	if x != nil {
+		return x.Service
+	}
+	return ""
+}
+
+func (x *ConfigChange) GetOldVersion() int32 {
+	if x != nil {
+		return x.OldVersion
+	}
+	return 0
+}
+
+func (x *ConfigChange) GetNewVersion() int32 {
+	if x != nil {
+		return x.NewVersion
+	}
+	return 0
+}
+
+func (x *ConfigChange) GetChecksum() string {
+	if x != nil {
+		return x.Checksum
+	}
+	return ""
+}
+
+func (x *ConfigChange) GetDiff() []*ConfigDiff {
+	if x != nil {
+		return x.Diff
+	}
+	return nil
+}
+
+func (x *ConfigChange) GetSent() *timestamppb.Timestamp {
+	if x != nil {
+		return x.Sent
+	}
+	return nil
+}
+
+type ConfigDiff struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	// path is a JSON pointer into the config payload
+	Path     string               `protobuf:"bytes,1,opt,name=path,proto3" json:"path,omitempty"`
+	Op       ConfigDiff_Operation `protobuf:"varint,2,opt,name=op,proto3,enum=tutorial.ConfigDiff_Operation" json:"op,omitempty"`
+	OldValue *structpb.Value      `protobuf:"bytes,3,opt,name=oldValue,proto3" json:"oldValue,omitempty"`
+	NewValue *structpb.Value      `protobuf:"bytes,4,opt,name=newValue,proto3" json:"newValue,omitempty"`
+}
+
+func (x *ConfigDiff) Reset() {
+	*x = ConfigDiff{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_messages_proto_msgTypes[2]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ConfigDiff) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ConfigDiff) ProtoMessage() {}
+
+func (x *ConfigDiff) ProtoReflect() protoreflect.Message {
+	mi := &file_messages_proto_msgTypes[2]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ConfigDiff.ProtoReflect.Descriptor instead.
+func (*ConfigDiff) Descriptor() ([]byte, []int) {
+	return file_messages_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *ConfigDiff) GetPath() string {
+	if x != nil {
+		return x.Path
+	}
+	return ""
+}
+
+func (x *ConfigDiff) GetOp() ConfigDiff_Operation {
+	if x != nil {
+		return x.Op
+	}
+	return ConfigDiff_ADD
+}
+
+func (x *ConfigDiff) GetOldValue() *structpb.Value {
+	if x != nil {
+		return x.OldValue
+	}
+	return nil
+}
+
+func (x *ConfigDiff) GetNewValue() *structpb.Value {
+	if x != nil {
+		return x.NewValue
+	}
+	return nil
+}
+
 var File_messages_proto protoreflect.FileDescriptor
 
 var file_messages_proto_rawDesc = []byte{
@@ -196,10 +420,46 @@ var file_messages_proto_rawDesc = []byte{
 	0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x54, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d,
 	0x70, 0x52, 0x04, 0x73, 0x65, 0x6e, 0x74, 0x22, 0x18, 0x0a, 0x0b, 0x4d, 0x65, 0x73, 0x73, 0x61,
 	0x67, 0x65, 0x54, 0x79, 0x70, 0x65, 0x12, 0x09, 0x0a, 0x05, 0x41, 0x55, 0x44, 0x49, 0x54, 0x10,
-	0x00, 0x42, 0x31, 0x5a, 0x2f, 0x67, 0x69, 0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f,
-	0x61, 0x65, 0x65, 0x6b, 0x61, 0x79, 0x79, 0x2f, 0x73, 0x74, 0x69, 0x6c, 0x6c, 0x61, 0x2f, 0x61,
-	0x70, 0x69, 0x2f, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2f, 0x6d, 0x65, 0x73, 0x73,
-	0x61, 0x67, 0x65, 0x73, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+	0x00, 0x22, 0xcc, 0x02, 0x0a, 0x0c, 0x43, 0x6f, 0x6e, 0x66, 0x69, 0x67, 0x43, 0x68, 0x61, 0x6e,
+	0x67, 0x65, 0x12, 0x1a, 0x0a, 0x08, 0x63, 0x6f, 0x6e, 0x66, 0x69, 0x67, 0x49, 0x64, 0x18, 0x01,
+	0x20, 0x01, 0x28, 0x09, 0x52, 0x08, 0x63, 0x6f, 0x6e, 0x66, 0x69, 0x67, 0x49, 0x64, 0x12, 0x1e,
+	0x0a, 0x0a, 0x63, 0x6f, 0x6e, 0x66, 0x69, 0x67, 0x4e, 0x61, 0x6d, 0x65, 0x18, 0x02, 0x20, 0x01,
+	0x28, 0x09, 0x52, 0x0a, 0x63, 0x6f, 0x6e, 0x66, 0x69, 0x67, 0x4e, 0x61, 0x6d, 0x65, 0x12, 0x14,
+	0x0a, 0x05, 0x61, 0x63, 0x74, 0x6f, 0x72, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x61,
+	0x63, 0x74, 0x6f, 0x72, 0x12, 0x1a, 0x0a, 0x08, 0x66, 0x75, 0x6e, 0x63, 0x4e, 0x61, 0x6d, 0x65,
+	0x18, 0x04, 0x20, 0x01, 0x28, 0x09, 0x52, 0x08, 0x66, 0x75, 0x6e, 0x63, 0x4e, 0x61, 0x6d, 0x65,
+	0x12, 0x18, 0x0a, 0x07, 0x73, 0x65, 0x72, 0x76, 0x69, 0x63, 0x65, 0x18, 0x05, 0x20, 0x01, 0x28,
+	0x09, 0x52, 0x07, 0x73, 0x65, 0x72, 0x76, 0x69, 0x63, 0x65, 0x12, 0x1e, 0x0a, 0x0a, 0x6f, 0x6c,
+	0x64, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x18, 0x06, 0x20, 0x01, 0x28, 0x05, 0x52, 0x0a,
+	0x6f, 0x6c, 0x64, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x1e, 0x0a, 0x0a, 0x6e, 0x65,
+	0x77, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x18, 0x07, 0x20, 0x01, 0x28, 0x05, 0x52, 0x0a,
+	0x6e, 0x65, 0x77, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x12, 0x1a, 0x0a, 0x08, 0x63, 0x68,
+	0x65, 0x63, 0x6b, 0x73, 0x75, 0x6d, 0x18, 0x08, 0x20, 0x01, 0x28, 0x09, 0x52, 0x08, 0x63, 0x68,
+	0x65, 0x63, 0x6b, 0x73, 0x75, 0x6d, 0x12, 0x28, 0x0a, 0x04, 0x64, 0x69, 0x66, 0x66, 0x18, 0x09,
+	0x20, 0x03, 0x28, 0x0b, 0x32, 0x14, 0x2e, 0x74, 0x75, 0x74, 0x6f, 0x72, 0x69, 0x61, 0x6c, 0x2e,
+	0x43, 0x6f, 0x6e, 0x66, 0x69, 0x67, 0x44, 0x69, 0x66, 0x66, 0x52, 0x04, 0x64, 0x69, 0x66, 0x66,
+	0x12, 0x2e, 0x0a, 0x04, 0x73, 0x65, 0x6e, 0x74, 0x18, 0x0a, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x1a,
+	0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66,
+	0x2e, 0x54, 0x69, 0x6d, 0x65, 0x73, 0x74, 0x61, 0x6d, 0x70, 0x52, 0x04, 0x73, 0x65, 0x6e, 0x74,
+	0x22, 0xe7, 0x01, 0x0a, 0x0a, 0x43, 0x6f, 0x6e, 0x66, 0x69, 0x67, 0x44, 0x69, 0x66, 0x66, 0x12,
+	0x12, 0x0a, 0x04, 0x70, 0x61, 0x74, 0x68, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x70,
+	0x61, 0x74, 0x68, 0x12, 0x2e, 0x0a, 0x02, 0x6f, 0x70, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0e, 0x32,
+	0x1e, 0x2e, 0x74, 0x75, 0x74, 0x6f, 0x72, 0x69, 0x61, 0x6c, 0x2e, 0x43, 0x6f, 0x6e, 0x66, 0x69,
+	0x67, 0x44, 0x69, 0x66, 0x66, 0x2e, 0x4f, 0x70, 0x65, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x52,
+	0x02, 0x6f, 0x70, 0x12, 0x32, 0x0a, 0x08, 0x6f, 0x6c, 0x64, 0x56, 0x61, 0x6c, 0x75, 0x65, 0x18,
+	0x03, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x16, 0x2e, 0x67, 0x6f, 0x6f, 0x67, 0x6c, 0x65, 0x2e, 0x70,
+	0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x56, 0x61, 0x6c, 0x75, 0x65, 0x52, 0x08, 0x6f,
+	0x6c, 0x64, 0x56, 0x61, 0x6c, 0x75, 0x65, 0x12, 0x32, 0x0a, 0x08, 0x6e, 0x65, 0x77, 0x56, 0x61,
+	0x6c, 0x75, 0x65, 0x18, 0x04, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x16, 0x2e, 0x67, 0x6f, 0x6f, 0x67,
+	0x6c, 0x65, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2e, 0x56, 0x61, 0x6c, 0x75,
+	0x65, 0x52, 0x08, 0x6e, 0x65, 0x77, 0x56, 0x61, 0x6c, 0x75, 0x65, 0x22, 0x2d, 0x0a, 0x09, 0x4f,
+	0x70, 0x65, 0x72, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x12, 0x07, 0x0a, 0x03, 0x41, 0x44, 0x44, 0x10,
+	0x00, 0x12, 0x0a, 0x0a, 0x06, 0x52, 0x45, 0x4d, 0x4f, 0x56, 0x45, 0x10, 0x01, 0x12, 0x0b, 0x0a,
+	0x07, 0x52, 0x45, 0x50, 0x4c, 0x41, 0x43, 0x45, 0x10, 0x02, 0x42, 0x39, 0x5a, 0x37, 0x67, 0x69,
+	0x74, 0x68, 0x75, 0x62, 0x2e, 0x63, 0x6f, 0x6d, 0x2f, 0x61, 0x65, 0x65, 0x6b, 0x61, 0x79, 0x79,
+	0x2f, 0x73, 0x74, 0x69, 0x6c, 0x6c, 0x61, 0x2f, 0x73, 0x65, 0x72, 0x76, 0x69, 0x63, 0x65, 0x2f,
+	0x61, 0x70, 0x69, 0x2f, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x62, 0x75, 0x66, 0x2f, 0x6d, 0x65, 0x73,
+	0x73, 0x61, 0x67, 0x65, 0x73, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
 }
 
 var (
@@ -214,23 +474,32 @@ func file_messages_proto_rawDescGZIP() []byte {
 	return file_messages_proto_rawDescData
 }
 
-var file_messages_proto_enumTypes = make([]protoimpl.EnumInfo, 1)
-var file_messages_proto_msgTypes = make([]protoimpl.MessageInfo, 1)
+var file_messages_proto_enumTypes = make([]protoimpl.EnumInfo, 2)
+var file_messages_proto_msgTypes = make([]protoimpl.MessageInfo, 3)
 var file_messages_proto_goTypes = []interface{}{
 	(AuditLog_MessageType)(0),     // 0: tutorial.AuditLog.MessageType
-	(*AuditLog)(nil),              // 1: tutorial.AuditLog
-	(*structpb.Struct)(nil),       // 2: google.protobuf.Struct
-	(*timestamppb.Timestamp)(nil), // 3: google.protobuf.Timestamp
+	(ConfigDiff_Operation)(0),     // 1: tutorial.ConfigDiff.Operation
+	(*AuditLog)(nil),              // 2: tutorial.AuditLog
+	(*ConfigChange)(nil),          // 3: tutorial.ConfigChange
+	(*ConfigDiff)(nil),            // 4: tutorial.ConfigDiff
+	(*structpb.Struct)(nil),       // 5: google.protobuf.Struct
+	(*timestamppb.Timestamp)(nil), // 6: google.protobuf.Timestamp
+	(*structpb.Value)(nil),        // 7: google.protobuf.Value
 }
 var file_messages_proto_depIdxs = []int32{
 	0, // 0: tutorial.AuditLog.messageType:type_name -> tutorial.AuditLog.MessageType
-	2, // 1: tutorial.AuditLog.message:type_name -> google.protobuf.Struct
-	3, // 2: tutorial.AuditLog.sent:type_name -> google.protobuf.Timestamp
-	3, // [3:3] is the sub-list for method output_type
-	3, // [3:3] is the sub-list for method input_type
-	3, // [3:3] is the sub-list for extension type_name
-	3, // [3:3] is the sub-list for extension extendee
-	0, // [0:3] is the sub-list for field type_name
+	5, // 1: tutorial.AuditLog.message:type_name -> google.protobuf.Struct
+	6, // 2: tutorial.AuditLog.sent:type_name -> google.protobuf.Timestamp
+	4, // 3: tutorial.ConfigChange.diff:type_name -> tutorial.ConfigDiff
+	6, // 4: tutorial.ConfigChange.sent:type_name -> google.protobuf.Timestamp
+	1, // 5: tutorial.ConfigDiff.op:type_name -> tutorial.ConfigDiff.Operation
+	7, // 6: tutorial.ConfigDiff.oldValue:type_name -> google.protobuf.Value
+	7, // 7: tutorial.ConfigDiff.newValue:type_name -> google.protobuf.Value
+	8, // [8:8] is the sub-list for method output_type
+	8, // [8:8] is the sub-list for method input_type
+	8, // [8:8] is the sub-list for extension type_name
+	8, // [8:8] is the sub-list for extension extendee
+	0, // [0:8] is the sub-list for field type_name
 }
 
 func init() { file_messages_proto_init() }
@@ -251,14 +520,38 @@ func file_messages_proto_init() {
 				return nil
 			}
 		}
+		file_messages_proto_msgTypes[1].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ConfigChange); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_messages_proto_msgTypes[2].Exporter = func(v interface{}, i int) interface{} {
+			switch v := v.(*ConfigDiff); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
 	}
 	type x struct{}
 	out := protoimpl.TypeBuilder{
 		File: protoimpl.DescBuilder{
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: file_messages_proto_rawDesc,
-			NumEnums:      1,
-			NumMessages:   1,
+			NumEnums:      2,
+			NumMessages:   3,
 			NumExtensions: 0,
 			NumServices:   0,
 		},
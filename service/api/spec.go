@@ -0,0 +1,9 @@
+// Package api holds the API definitions of the service
+package api
+
+import _ "embed"
+
+// OpenAPI the OpenAPI spec of the REST API, as YAML
+//
+//go:embed openapi.yaml
+var OpenAPI []byte
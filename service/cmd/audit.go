@@ -0,0 +1,98 @@
+// Package cmd CLI for Stilla
+/*
+Copyright © 2023 Farye Nwede <farye@aeekay.com>
+*/
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+
+	"github.com/aeekayy/stilla/service/lib/db"
+	"github.com/aeekayy/stilla/service/pkg/models"
+	"github.com/aeekayy/stilla/service/pkg/retention"
+)
+
+var (
+	archiveDryRun bool
+	archiveDir    string
+)
+
+// auditCmd groups the audit record commands
+var auditCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "Manage audit records",
+}
+
+// auditArchiveCmd archives expired audit records on demand
+var auditArchiveCmd = &cobra.Command{
+	Use:   "archive",
+	Short: "Archive and delete expired audit records",
+	Long: `Archive audit records that are older than the retention policies in
+stilla.yaml to compressed NDJSON files and delete them from the database.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runAuditArchive()
+	},
+}
+
+// init is called before main
+func init() {
+	auditArchiveCmd.Flags().BoolVar(&archiveDryRun, "dry-run", false, "count the expired audit records without archiving them")
+	auditArchiveCmd.Flags().StringVar(&archiveDir, "archive-dir", "", "directory for the archive files. Overrides audit_retention.archive_dir")
+
+	auditCmd.AddCommand(auditArchiveCmd)
+	rootCmd.AddCommand(auditCmd)
+}
+
+// runAuditArchive archives the expired audit records once
+func runAuditArchive() error {
+	ctx := context.Background()
+
+	logger, err := zap.NewProduction()
+	if err != nil {
+		return fmt.Errorf("error starting the logger, exiting")
+	}
+	defer logger.Sync()
+	sugar := logger.Sugar()
+
+	config, err := models.GetConfig(configFile)
+	if err != nil {
+		return fmt.Errorf("error retrieving the configuration: %s", err)
+	}
+
+	if archiveDir != "" {
+		config.Retention.ArchiveDir = archiveDir
+	}
+
+	dbConn, err := db.Connect(&ctx, config.Database.Username, config.Database.Password, config.Database.Host, config.Database.Name, config.Database.Parameters)
+	if err != nil {
+		return fmt.Errorf("couldn't connect to the database at %s: %s", config.Database.Host, err)
+	}
+	defer dbConn.Close()
+
+	archiver, err := retention.New(*dbConn, sugar, config.Retention)
+	if err != nil {
+		return err
+	}
+	archiver.DryRun = archiveDryRun
+
+	// the run takes the lock background runs take, so they don't overlap
+	results, err := archiver.RunOnce(ctx)
+	if errors.Is(err, retention.ErrLocked) {
+		return fmt.Errorf("audit records weren't archived, another replica is archiving them. Try again later")
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if encErr := enc.Encode(results); encErr != nil {
+		return encErr
+	}
+
+	return err
+}
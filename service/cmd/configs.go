@@ -0,0 +1,360 @@
+// Package cmd CLI for Stilla
+/*
+Copyright © 2023 Farye Nwede <farye@aeekay.com>
+*/
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	apimodels "github.com/aeekayy/stilla/service/pkg/api/models"
+	"github.com/aeekayy/stilla/service/pkg/bundle"
+	"github.com/aeekayy/stilla/service/pkg/importer"
+	"github.com/aeekayy/stilla/service/pkg/utils"
+)
+
+var (
+	configsURL    string
+	configsHostID string
+	configsToken  string
+
+	exportFormat     string
+	exportHistory    bool
+	exportOutput     string
+	exportNamePrefix string
+	exportTags       []string
+
+	importFile       string
+	importFormatName string
+	importDryRun     bool
+	importOnConflict string
+
+	importFromPrefix string
+	importFromOwner  string
+	importFromTags   []string
+	importFromDryRun bool
+)
+
+// configsClient the HTTP client for the configs commands
+var configsClient = &http.Client{Timeout: 5 * time.Minute}
+
+// configsCmd groups the bulk config commands
+var configsCmd = &cobra.Command{
+	Use:   "configs",
+	Short: "Import and export configs in bulk",
+}
+
+// configsExportCmd downloads a bundle of configs
+var configsExportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export configs to an NDJSON or tar bundle",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runConfigsExport()
+	},
+}
+
+// configsImportCmd uploads a bundle of configs
+var configsImportCmd = &cobra.Command{
+	Use:   "import",
+	Short: "Import configs from an NDJSON or tar bundle",
+	Long: `Import configs from a bundle made by "stilla configs export". Existing
+configs are skipped unless --on-conflict is overwrite or new-version. Use
+--dry-run to see what would change.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runConfigsImport()
+	},
+}
+
+// configsImportFromCmd adds configs read from other formats and systems
+var configsImportFromCmd = &cobra.Command{
+	Use:   "import-from SOURCE PATH",
+	Short: "Import configs from YAML, JSON, TOML, .env, Spring properties, ConfigMaps or a Consul KV export",
+	Long: `Read configs from a file or a directory and add each one as a config or a
+new version of an existing config. SOURCE is one of:
+
+  files      YAML, JSON and TOML files. services/payments.yaml -> services/payments
+  dotenv     .env files. payments/.env -> payments, payments/.env.prod -> payments/prod
+  spring     Spring properties. payments/application-prod.properties -> payments/prod
+  configmap  Kubernetes ConfigMap manifests, named {namespace}/{name}
+  consul     consul kv export output. config/payments/port -> port in config/payments
+
+--prefix is prepended to every name. Use --dry-run to print the configs
+without adding them.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runConfigsImportFrom(args[0], args[1])
+	},
+}
+
+// importFromResult the outcome of adding one config
+type importFromResult struct {
+	ConfigName      string                 `json:"config_name"`
+	Path            string                 `json:"path"`
+	Action          string                 `json:"action"`
+	ConfigID        string                 `json:"config_id,omitempty"`
+	ChangeRequestID string                 `json:"change_request_id,omitempty"`
+	Config          map[string]interface{} `json:"config,omitempty"`
+	Error           string                 `json:"error,omitempty"`
+}
+
+// init is called before main
+func init() {
+	configsCmd.PersistentFlags().StringVar(&configsURL, "url", utils.GetEnv("STILLA_URL", "http://localhost:8080"), "address of the Stilla API")
+	configsCmd.PersistentFlags().StringVar(&configsHostID, "host-id", utils.GetEnv("STILLA_HOST_ID", ""), "host ID sent in the HostID header")
+	configsCmd.PersistentFlags().StringVar(&configsToken, "token", utils.GetEnv("STILLA_TOKEN", ""), "API token")
+
+	configsExportCmd.Flags().StringVar(&exportFormat, "format", "ndjson", "bundle format, ndjson or tar")
+	configsExportCmd.Flags().BoolVar(&exportHistory, "history", false, "include the version history of each config")
+	configsExportCmd.Flags().StringVarP(&exportOutput, "output", "o", "-", "file to write the bundle to. - writes to stdout")
+	configsExportCmd.Flags().StringVar(&exportNamePrefix, "name-prefix", "", "only export configs whose name starts with the prefix")
+	configsExportCmd.Flags().StringSliceVar(&exportTags, "tag", nil, "only export configs with every tag")
+
+	configsImportCmd.Flags().StringVarP(&importFile, "file", "f", "-", "bundle to import. - reads from stdin")
+	configsImportCmd.Flags().StringVar(&importFormatName, "format", "", "bundle format, ndjson or tar. Defaults to the file extension")
+	configsImportCmd.Flags().BoolVar(&importDryRun, "dry-run", false, "report what would be imported without writing anything")
+	configsImportCmd.Flags().StringVar(&importOnConflict, "on-conflict", "skip", "what to do with existing configs: skip, overwrite or new-version")
+
+	configsImportFromCmd.Flags().StringVar(&importFromPrefix, "prefix", "", "prefix for every config name, joined with /")
+	configsImportFromCmd.Flags().StringVar(&importFromOwner, "owner", utils.GetEnv("USER", ""), "owner of the configs")
+	configsImportFromCmd.Flags().StringSliceVar(&importFromTags, "tag", nil, "tag to add to every config")
+	configsImportFromCmd.Flags().BoolVar(&importFromDryRun, "dry-run", false, "print the configs that would be added without adding them")
+
+	configsCmd.AddCommand(configsExportCmd)
+	configsCmd.AddCommand(configsImportCmd)
+	configsCmd.AddCommand(configsImportFromCmd)
+	rootCmd.AddCommand(configsCmd)
+}
+
+// runConfigsExport writes a bundle of configs to a file or stdout
+func runConfigsExport() error {
+	format, err := bundle.ParseFormat(exportFormat)
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	query.Set("format", string(format))
+	query.Set("history", strconv.FormatBool(exportHistory))
+	if exportNamePrefix != "" {
+		query.Set("name_prefix", exportNamePrefix)
+	}
+	for _, tag := range exportTags {
+		query.Add("tag", tag)
+	}
+
+	resp, err := configsRequest(http.MethodGet, "/api/v1/configs/export", query, "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	out := io.Writer(os.Stdout)
+	if exportOutput != "-" {
+		f, err := os.Create(exportOutput)
+		if err != nil {
+			return fmt.Errorf("unable to create %s: %s", exportOutput, err)
+		}
+		defer f.Close()
+		out = f
+	}
+
+	if _, err := io.Copy(out, resp.Body); err != nil {
+		return fmt.Errorf("unable to write the bundle: %s", err)
+	}
+
+	return nil
+}
+
+// runConfigsImport uploads a bundle and prints the import report
+func runConfigsImport() error {
+	name := importFormatName
+	if name == "" && importFile != "-" {
+		name = strings.TrimPrefix(filepath.Ext(importFile), ".")
+	}
+
+	format, err := bundle.ParseFormat(name)
+	if err != nil {
+		return err
+	}
+
+	in := io.Reader(os.Stdin)
+	if importFile != "-" {
+		f, err := os.Open(importFile)
+		if err != nil {
+			return fmt.Errorf("unable to open %s: %s", importFile, err)
+		}
+		defer f.Close()
+		in = f
+	}
+
+	query := url.Values{}
+	query.Set("on_conflict", importOnConflict)
+	query.Set("dry_run", strconv.FormatBool(importDryRun))
+
+	resp, err := configsRequest(http.MethodPost, "/api/v1/configs/import", query, format.ContentType(), in)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var report bytes.Buffer
+	if err := json.Indent(&report, mustReadAll(resp.Body), "", "  "); err != nil {
+		return fmt.Errorf("unable to read the import report: %s", err)
+	}
+	report.WriteByte('\n')
+
+	_, err = report.WriteTo(os.Stdout)
+	return err
+}
+
+// runConfigsImportFrom adds the configs of a source one by one and prints
+// the outcome of each. It fails if any config can't be added
+func runConfigsImportFrom(sourceName, root string) error {
+	source, err := importer.ParseSource(sourceName)
+	if err != nil {
+		return err
+	}
+
+	configs, err := importer.Read(source, root)
+	if err != nil {
+		return err
+	}
+
+	results := make([]importFromResult, 0, len(configs))
+	failed := 0
+	for _, config := range configs {
+		name := config.Name
+		if importFromPrefix != "" {
+			name = path.Join(importFromPrefix, name)
+		}
+
+		result := importFromResult{ConfigName: name, Path: config.Path}
+		if importFromDryRun {
+			result.Action = "would_add"
+			result.Config = config.Config
+			results = append(results, result)
+			continue
+		}
+
+		err = addConfig(&result, apimodels.ConfigIn{
+			ConfigName: name,
+			Owner:      importFromOwner,
+			Config:     config.Config,
+			Tags:       importFromTags,
+		})
+		if err != nil {
+			result.Action = "failed"
+			result.Error = err.Error()
+			failed++
+		}
+		results = append(results, result)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(results); err != nil {
+		return err
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d configs could not be added", failed, len(configs))
+	}
+
+	return nil
+}
+
+// addConfig adds a config, or a new version of it when the name exists, and
+// records the outcome in result. A write to a protected config is pending
+// until its change request is approved
+func addConfig(result *importFromResult, config apimodels.ConfigIn) error {
+	body, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+
+	resp, err := configsRequest(http.MethodPost, "/api/v1/config/", url.Values{}, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNoContent:
+		result.Action = "updated"
+		return nil
+	case http.StatusAccepted:
+		var pending struct {
+			Data apimodels.ChangeRequest `json:"data"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&pending); err != nil {
+			return fmt.Errorf("unable to read the response: %s", err)
+		}
+
+		result.Action = "pending"
+		result.ChangeRequestID = pending.Data.ID.Hex()
+		return nil
+	}
+
+	var created struct {
+		Data string `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		return fmt.Errorf("unable to read the response: %s", err)
+	}
+
+	result.Action = "created"
+	result.ConfigID = created.Data
+	return nil
+}
+
+// configsRequest sends an authenticated request to the Stilla API. Error
+// responses are returned as errors
+func configsRequest(method, path string, query url.Values, contentType string, body io.Reader) (*http.Response, error) {
+	endpoint := strings.TrimSuffix(configsURL, "/") + path + "?" + query.Encode()
+
+	req, err := http.NewRequest(method, endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if configsToken != "" {
+		req.Header.Set("Authorization", "Bearer "+configsToken)
+	}
+	if configsHostID != "" {
+		req.Header.Set("HostID", configsHostID)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := configsClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to reach %s: %s", configsURL, err)
+	}
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		defer resp.Body.Close()
+		return nil, fmt.Errorf("%s %s returned %s: %s", method, path, resp.Status, strings.TrimSpace(string(mustReadAll(resp.Body))))
+	}
+
+	return resp, nil
+}
+
+// mustReadAll reads a response body, returning what was read before an error
+func mustReadAll(r io.Reader) []byte {
+	b, _ := io.ReadAll(r)
+	return b
+}
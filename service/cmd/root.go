@@ -47,7 +47,7 @@ func Execute() {
 
 // init is called before main
 func init() {
-	rootCmd.Flags().StringVar(&configFile, "config", "", "Configuration file for Stilla")
+	rootCmd.PersistentFlags().StringVar(&configFile, "config", "", "Configuration file for Stilla")
 
 	// Profiling cli flags
 	rootCmd.PersistentFlags().BoolVar(&cpuProfile, "cpu-profile", false, "write cpu profile to file")
@@ -31,6 +31,8 @@ type DBIface interface {
 	QueryRow(ctx context.Context, sql string, optionsAndArgs ...any) pgx.Row
 	GenerateAPIKey(name string, tags []string) (string, string, error)
 	ValidateAPIKey(id, token string) (string, error)
+	GetHostTags(id string) ([]string, error)
+	WithAdvisoryLock(ctx context.Context, key int64, fn func(context.Context) error) (bool, error)
 }
 
 // Conn database connection pool and context
@@ -171,6 +173,41 @@ func (d Conn) ValidateAPIKey(id, token string) (string, error) {
 	return hostname, err
 }
 
+// GetHostTags returns the tags a host was registered with
+func (d Conn) GetHostTags(id string) ([]string, error) {
+	var tags []string
+
+	err := d.Pool.QueryRow(d.Context, "SELECT tags FROM api_keys WHERE id=$1;", id).Scan(&tags)
+
+	return tags, err
+}
+
+// WithAdvisoryLock runs fn while holding the session advisory lock key, so
+// only one replica of the service runs it at a time. It returns false
+// without running fn when another session holds the lock
+func (d Conn) WithAdvisoryLock(ctx context.Context, key int64, fn func(context.Context) error) (bool, error) {
+	conn, err := d.Pool.Acquire(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Release()
+
+	var locked bool
+	if err := conn.QueryRow(ctx, "SELECT pg_try_advisory_lock($1);", key).Scan(&locked); err != nil {
+		return false, err
+	}
+
+	if !locked {
+		return false, nil
+	}
+
+	// the lock is released with a fresh context, so it's released when ctx
+	// is done
+	defer conn.Exec(context.Background(), "SELECT pg_advisory_unlock($1);", key)
+
+	return true, fn(ctx)
+}
+
 // ValidateConnection validates the pool with a ping
 func (d *Conn) ValidateConnection() error {
 	return d.Pool.Ping(d.Context)
@@ -26,7 +26,7 @@ func GetRecords(dal *DAL) gin.HandlerFunc {
 
 		if err != nil {
 			dal.Logger.Errorf("unable to retrieve audit logs: %v", err)
-			c.JSON(http.StatusBadRequest, gin.H{"error": "unable to retrieve audit logs"})
+			writeError(c, err, "unable to retrieve audit logs")
 			return
 		}
 
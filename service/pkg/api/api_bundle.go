@@ -0,0 +1,127 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/aeekayy/stilla/service/pkg/api/models"
+	"github.com/aeekayy/stilla/service/pkg/bundle"
+)
+
+// maxImportSize the largest bundle that can be imported
+const maxImportSize = 64 << 20
+
+// ExportConfigs - Export configurations as a bundle
+func ExportConfigs(dal *DAL) gin.HandlerFunc {
+	fn := func(c *gin.Context) {
+		var query models.ConfigListQuery
+
+		if err := c.ShouldBindQuery(&query); err != nil {
+			dal.Logger.Errorf("unable to parse request: %v", err)
+			writeProblem(c, http.StatusBadRequest, "invalid_query", "unable to parse the query")
+			return
+		}
+
+		format, err := bundle.ParseFormat(c.Query("format"))
+		if err != nil {
+			writeProblem(c, http.StatusBadRequest, "unsupported_format", err.Error())
+			return
+		}
+
+		history, err := strconv.ParseBool(c.DefaultQuery("history", "false"))
+		if err != nil {
+			writeProblem(c, http.StatusBadRequest, "invalid_query", "history must be true or false")
+			return
+		}
+
+		c.Header("Content-Type", format.ContentType())
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="stilla-configs%s"`, format.Extension()))
+
+		count, err := dal.ExportConfigs(c, query, history, format, c.Writer, c.Request)
+		if err != nil && c.Writer.Written() {
+			// the bundle is cut short. The status has already been sent
+			dal.Logger.Errorf("export failed after %d configs: %v", count, err)
+			c.Abort()
+			return
+		} else if err != nil {
+			c.Writer.Header().Del("Content-Type")
+			c.Writer.Header().Del("Content-Disposition")
+
+			dal.Logger.Errorf("unable to export configurations: %v", err)
+			writeError(c, err, "unable to export configurations")
+			return
+		}
+
+		dal.Logger.Infof("exported %d configs", count)
+	}
+
+	return gin.HandlerFunc(fn)
+}
+
+// ImportConfigs - Import configurations from a bundle
+func ImportConfigs(dal *DAL) gin.HandlerFunc {
+	fn := func(c *gin.Context) {
+		onConflict := c.DefaultQuery("on_conflict", ImportSkip)
+		if _, err := importAction(false, onConflict); err != nil {
+			writeError(c, err, "unable to import configurations")
+			return
+		}
+
+		dryRun, err := strconv.ParseBool(c.DefaultQuery("dry_run", "false"))
+		if err != nil {
+			writeProblem(c, http.StatusBadRequest, "invalid_query", "dry_run must be true or false")
+			return
+		}
+
+		// overwriting replaces version history, so it's limited like a purge
+		if onConflict == ImportOverwrite && !dryRun && !isAdmin(dal, c) {
+			dal.EmitMessage("config.audit", "AuthFailure", dal.requestDetails(c.Request))
+			writeProblem(c, http.StatusForbidden, "forbidden", "only admin hosts can overwrite configs")
+			return
+		}
+
+		format, err := importFormat(c)
+		if err != nil {
+			writeProblem(c, http.StatusUnsupportedMediaType, "unsupported_media_type", err.Error())
+			return
+		}
+
+		body := http.MaxBytesReader(c.Writer, c.Request.Body, maxImportSize)
+		_, configs, err := bundle.ReadAll(format, body)
+		if err != nil {
+			dal.Logger.Errorf("unable to read the bundle: %v", err)
+			writeBodyError(c, "invalid_bundle", err.Error(), err)
+			return
+		}
+
+		report, err := dal.ImportConfigs(c, configs, onConflict, dryRun, c.Request)
+		if err != nil {
+			dal.Logger.Errorf("unable to import configurations: %v", err)
+			writeError(c, err, "unable to import configurations")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"data": report,
+		})
+	}
+
+	return gin.HandlerFunc(fn)
+}
+
+// importFormat returns the format of an uploaded bundle. The format query
+// parameter takes precedence over the Content-Type header
+func importFormat(c *gin.Context) (bundle.Format, error) {
+	if name := c.Query("format"); name != "" {
+		return bundle.ParseFormat(name)
+	}
+
+	if contentType := c.GetHeader("Content-Type"); contentType != "" {
+		return bundle.ForContentType(contentType)
+	}
+
+	return bundle.FormatNDJSON, nil
+}
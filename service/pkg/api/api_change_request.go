@@ -0,0 +1,187 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/aeekayy/stilla/service/pkg/api/models"
+)
+
+// SetConfigProtection - Protect a configuration so writes to it need an
+// approved change request. Admin only
+func SetConfigProtection(dal *DAL) gin.HandlerFunc {
+	fn := func(c *gin.Context) {
+		configID := c.Param("configId")
+		var req models.ConfigProtectionIn
+
+		if !isAdmin(dal, c) {
+			dal.EmitMessage("config.audit", "AuthFailure", dal.requestDetails(c.Request))
+			writeProblem(c, http.StatusForbidden, "forbidden", "only admin hosts can protect configs")
+			return
+		}
+
+		if err := c.ShouldBindJSON(&req); err != nil {
+			dal.Logger.Errorf("unable to parse request: %v", err)
+			writeProblem(c, http.StatusBadRequest, "invalid_request", "unable to parse the request body")
+			return
+		}
+
+		if err := dal.SetConfigProtection(c, configID, *req.Protected, c.Request); err != nil {
+			dal.Logger.Errorf("unable to set config protection: %v", dal.Redactor.Error(err, configID))
+			writeError(c, err, "unable to set the protection")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"data": gin.H{"config_id": configID, "protected": *req.Protected},
+		})
+	}
+
+	return gin.HandlerFunc(fn)
+}
+
+// GetChangeRequests - List change requests by status
+func GetChangeRequests(dal *DAL) gin.HandlerFunc {
+	fn := func(c *gin.Context) {
+		var query models.ChangeRequestQuery
+
+		if err := c.ShouldBindQuery(&query); err != nil {
+			dal.Logger.Errorf("unable to parse request: %v", err)
+			writeProblem(c, http.StatusBadRequest, "invalid_query", "unable to parse the query")
+			return
+		}
+
+		requests, err := dal.GetChangeRequests(c, query, c.Request)
+		if err != nil {
+			dal.Logger.Errorf("unable to list change requests: %v", err)
+			writeError(c, err, "unable to list the change requests")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"data": requests,
+		})
+	}
+
+	return gin.HandlerFunc(fn)
+}
+
+// GetChangeRequest - Get a change request of a configuration
+func GetChangeRequest(dal *DAL) gin.HandlerFunc {
+	fn := func(c *gin.Context) {
+		configID := c.Param("configId")
+		changeID := c.Param("changeId")
+
+		request, err := dal.GetChangeRequest(c, configID, changeID, c.Request)
+		if err != nil {
+			dal.Logger.Errorf("unable to get change request: %v", dal.Redactor.Error(err, configID))
+			writeError(c, err, "unable to get the change request")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"data": request,
+		})
+	}
+
+	return gin.HandlerFunc(fn)
+}
+
+// ApproveChangeRequest - Approve a change request and apply it
+func ApproveChangeRequest(dal *DAL) gin.HandlerFunc {
+	fn := func(c *gin.Context) {
+		configID := c.Param("configId")
+		changeID := c.Param("changeId")
+		var req models.ChangeRequestReviewIn
+
+		if !bindReview(dal, c, &req) {
+			return
+		}
+
+		request, err := dal.ApproveChangeRequest(c, configID, changeID, req, c.Request)
+		if err != nil {
+			dal.Logger.Errorf("unable to approve change request: %v", dal.Redactor.Error(err, configID))
+			writeError(c, err, "unable to approve the change request")
+			return
+		}
+
+		c.Header(configVersionHeader, strconv.Itoa(int(request.Version)))
+		c.JSON(http.StatusOK, gin.H{
+			"data": request,
+		})
+	}
+
+	return gin.HandlerFunc(fn)
+}
+
+// RejectChangeRequest - Reject or withdraw a change request
+func RejectChangeRequest(dal *DAL) gin.HandlerFunc {
+	fn := func(c *gin.Context) {
+		configID := c.Param("configId")
+		changeID := c.Param("changeId")
+		var req models.ChangeRequestReviewIn
+
+		if !bindReview(dal, c, &req) {
+			return
+		}
+
+		request, err := dal.RejectChangeRequest(c, configID, changeID, req, c.Request)
+		if err != nil {
+			dal.Logger.Errorf("unable to reject change request: %v", dal.Redactor.Error(err, configID))
+			writeError(c, err, "unable to reject the change request")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"data": request,
+		})
+	}
+
+	return gin.HandlerFunc(fn)
+}
+
+// CommentChangeRequest - Comment on a change request
+func CommentChangeRequest(dal *DAL) gin.HandlerFunc {
+	fn := func(c *gin.Context) {
+		configID := c.Param("configId")
+		changeID := c.Param("changeId")
+		var req models.ChangeRequestCommentIn
+
+		if err := c.ShouldBindJSON(&req); err != nil {
+			dal.Logger.Errorf("unable to parse request: %v", err)
+			writeProblem(c, http.StatusBadRequest, "invalid_request", "unable to parse the request body")
+			return
+		}
+
+		request, err := dal.CommentChangeRequest(c, configID, changeID, req, c.Request)
+		if err != nil {
+			dal.Logger.Errorf("unable to comment on change request: %v", dal.Redactor.Error(err, configID))
+			writeError(c, err, "unable to comment on the change request")
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{
+			"data": request,
+		})
+	}
+
+	return gin.HandlerFunc(fn)
+}
+
+// bindReview reads the optional body of an approval or a rejection. It
+// writes the problem and returns false when the body can't be read
+func bindReview(dal *DAL, c *gin.Context, req *models.ChangeRequestReviewIn) bool {
+	if c.Request.ContentLength == 0 {
+		return true
+	}
+
+	if err := c.ShouldBindJSON(req); err != nil {
+		dal.Logger.Errorf("unable to parse request: %v", err)
+		writeProblem(c, http.StatusBadRequest, "invalid_request", "unable to parse the request body")
+		return false
+	}
+
+	return true
+}
@@ -11,13 +11,33 @@
 package api
 
 import (
+	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"strconv"
 
 	// "github.com/getsentry/sentry-go"
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
 
 	"github.com/aeekayy/stilla/service/pkg/api/models"
-	"github.com/aeekayy/stilla/service/pkg/utils"
+	"github.com/aeekayy/stilla/service/pkg/patch"
+	"github.com/aeekayy/stilla/service/pkg/pointer"
+	"github.com/aeekayy/stilla/service/pkg/render"
+)
+
+const (
+	// configVersionHeader the header with the version a config write left
+	// the config at
+	configVersionHeader = "X-Stilla-Version"
+	// configChecksumHeader the header with the content checksum of a config
+	// write
+	configChecksumHeader = "X-Stilla-Checksum"
+	// maxPatchSize the largest patch document that's read
+	maxPatchSize = 16 << 20
+	// acceptPatch the patch formats of UpdateConfigByID
+	acceptPatch = patch.MediaTypeMergePatch + ", " + patch.MediaTypeJSONPatch
 )
 
 // AddConfig - Create a new configuration and configuration value
@@ -27,29 +47,33 @@ func AddConfig(dal *DAL) gin.HandlerFunc {
 
 		if err := c.ShouldBind(&req); err != nil {
 			dal.Logger.Errorf("unable to parse request: %v", err)
-			c.JSON(http.StatusBadRequest, gin.H{"error": "unable to insert configuration"})
+			writeProblem(c, http.StatusBadRequest, "invalid_request", "unable to parse the request body")
 			return
 		}
 
 		// span := sentry.StartSpan(c, "config.insert")
-		configID, upsertedRecord, err := dal.InsertConfig(c, req, c.Request)
+		write, err := dal.InsertConfig(c, req, c.Request)
 		// span.Finish()
 
 		if err != nil {
-			output := utils.SanitizeErrorMessage(err, req.ConfigName)
+			output := dal.Redactor.Error(err, req.ConfigName)
 			dal.Logger.Errorf("unable to insert config: %v", output)
-			c.JSON(http.StatusBadRequest, gin.H{"error": "unable to insert configuration"})
+			writeError(c, err, "unable to insert configuration")
 			return
 		}
 
-		if ! upsertedRecord {
+		c.Header(configVersionHeader, strconv.Itoa(int(write.Version)))
+		c.Header(configChecksumHeader, write.Checksum)
+
+		// new versions and unchanged configs have no body
+		if !write.Created {
 			c.Status(http.StatusNoContent)
 			return
 		}
 
-		dal.Logger.Infof("created config object %s", configID)
+		dal.Logger.Infof("created config object %s", write.ConfigID)
 		c.JSON(http.StatusCreated, gin.H{
-			"data": configID,
+			"data": write.ConfigID,
 		})
 	}
 
@@ -64,7 +88,19 @@ func GetConfigByID(dal *DAL) gin.HandlerFunc {
 
 		if configID == "" {
 			dal.Logger.Errorf("unable to parse request")
-			c.JSON(http.StatusBadRequest, gin.H{"error": "unable to retrieve configuration"})
+			writeProblem(c, http.StatusBadRequest, "invalid_request", "a config ID is required")
+			return
+		}
+
+		format, err := negotiateFormat(c)
+		if err != nil {
+			writeProblem(c, http.StatusNotAcceptable, "not_acceptable", err.Error())
+			return
+		}
+
+		resolve, err := renderQuery(c)
+		if err != nil {
+			writeProblem(c, http.StatusBadRequest, "invalid_request", "render must be true or false")
 			return
 		}
 
@@ -73,9 +109,65 @@ func GetConfigByID(dal *DAL) gin.HandlerFunc {
 		// span.Finish()
 
 		if err != nil {
-			output := utils.SanitizeErrorMessage(err, configID)
+			output := dal.Redactor.Error(err, configID)
 			dal.Logger.Errorf("unable to retrieve config: %v", output)
-			c.JSON(http.StatusBadRequest, gin.H{"error": "unable to retrieve configuration"})
+			writeError(c, err, "unable to retrieve configuration")
+			return
+		}
+
+		// mark copies served while the document store is unavailable
+		if config.Stale {
+			c.Header("Warning", `110 - "Response is Stale"`)
+			c.Header("X-Stilla-Stale", "true")
+		}
+
+		c.Header("Vary", "Accept")
+
+		// references are resolved for the host that reads the config
+		if resolve {
+			config, err = dal.RenderConfig(c, config, c.Request)
+			if err != nil {
+				output := dal.Redactor.Error(err, configID)
+				dal.Logger.Errorf("unable to resolve the config references: %v", output)
+				writeError(c, err, "unable to resolve the config references")
+				return
+			}
+		}
+
+		// a path narrows the response to the value it references
+		if path, ok := configPath(c); ok {
+			value, err := pointer.Get(config.Config.Config, path)
+			if errors.Is(err, pointer.ErrNotFound) {
+				// the path is the resource here, so it's not found rather
+				// than unprocessable
+				writeProblem(c, http.StatusNotFound, "path_not_found", err.Error())
+				return
+			} else if err != nil {
+				dal.Logger.Errorf("unable to read the path %s: %v", path, err)
+				writeError(c, err, "unable to read the path")
+				return
+			}
+
+			writeConfigValue(dal, c, format, value)
+			return
+		}
+
+		// other formats render the payload on its own
+		if format != render.FormatJSON {
+			payload := config.Config.Config
+			if payload == nil {
+				payload = map[string]interface{}{}
+			}
+
+			body, err := render.Render(format, payload)
+			if err != nil {
+				dal.Logger.Errorf("unable to render config as %s: %v", format, err)
+				writeProblem(c, http.StatusUnprocessableEntity, "unrenderable_config", err.Error())
+				return
+			}
+
+			dal.Logger.Infof("retrieved config as %s", format)
+			c.Data(http.StatusOK, format.ContentType(), body)
 			return
 		}
 
@@ -88,25 +180,94 @@ func GetConfigByID(dal *DAL) gin.HandlerFunc {
 	return fn
 }
 
+// renderQuery returns whether a read resolves the references in the
+// payload, from the render query parameter
+func renderQuery(c *gin.Context) (bool, error) {
+	value, ok := c.GetQuery("render")
+	if !ok {
+		return false, nil
+	}
+
+	return strconv.ParseBool(value)
+}
+
+// configPath returns the JSON pointer of a partial read, from the /value
+// route or the path query parameter
+func configPath(c *gin.Context) (string, bool) {
+	if path := c.Param("path"); path != "" {
+		// /value/ reads the whole payload
+		if path == "/" {
+			return "", true
+		}
+		return path, true
+	}
+
+	return c.GetQuery("path")
+}
+
+// writeConfigValue writes the value at a path. JSON is wrapped in
+// {"data": ...} and other formats are rendered on their own
+func writeConfigValue(dal *DAL, c *gin.Context, format render.Format, value interface{}) {
+	if format == render.FormatJSON {
+		dal.Logger.Infof("retrieved config path")
+		c.JSON(http.StatusOK, gin.H{
+			"data": value,
+		})
+		return
+	}
+
+	body, err := render.Render(format, value)
+	if err != nil {
+		dal.Logger.Errorf("unable to render config path as %s: %v", format, err)
+		writeProblem(c, http.StatusUnprocessableEntity, "unrenderable_config", err.Error())
+		return
+	}
+
+	dal.Logger.Infof("retrieved config path as %s", format)
+	c.Data(http.StatusOK, format.ContentType(), body)
+}
+
+// negotiateFormat returns the format of a config response. The format query
+// parameter takes precedence over the Accept header
+func negotiateFormat(c *gin.Context) (render.Format, error) {
+	if name := c.Query("format"); name != "" {
+		return render.ParseFormat(name)
+	}
+
+	if c.GetHeader("Accept") == "" {
+		return render.FormatJSON, nil
+	}
+
+	mediaType := c.NegotiateFormat(render.MediaTypes()...)
+	if mediaType == "" {
+		return "", fmt.Errorf("%w: %s", render.ErrUnsupportedFormat, c.GetHeader("Accept"))
+	}
+
+	return render.ForMediaType(mediaType)
+}
+
 // GetConfigs - Get a paginated list of configurations
 func GetConfigs(dal *DAL) gin.HandlerFunc {
 	fn := func(c *gin.Context) {
-		offset := c.Query("offset")
-		limit := c.Query("limit")
+		var query models.ConfigListQuery
+
+		if err := c.ShouldBindQuery(&query); err != nil {
+			dal.Logger.Errorf("unable to parse request: %v", err)
+			writeProblem(c, http.StatusBadRequest, "invalid_query", "unable to parse the query")
+			return
+		}
 
 		// span := sentry.StartSpan(c, "config.get_all")
-		configs, err := dal.GetConfigs(c, offset, limit, c.Request)
+		configs, err := dal.GetConfigs(c, query, c.Request)
 		// span.Finish()
 
 		if err != nil {
 			dal.Logger.Errorf("unable to retrieve configurations: %v", err)
-			c.JSON(http.StatusBadRequest, gin.H{"error": "unable to retrieve configurations"})
+			writeError(c, err, "unable to retrieve configurations")
 			return
 		}
 
-		c.JSON(http.StatusOK, gin.H{
-			"data": configs,
-		})
+		c.JSON(http.StatusOK, configs)
 	}
 
 	return gin.HandlerFunc(fn)
@@ -116,31 +277,51 @@ func GetConfigs(dal *DAL) gin.HandlerFunc {
 func UpdateConfigByID(dal *DAL) gin.HandlerFunc {
 	fn := func(c *gin.Context) {
 		configID := c.Param("configId")
-		var req models.UpdateConfigIn
 
 		if configID == "" {
 			dal.Logger.Errorf("unable to parse request")
-			c.JSON(http.StatusBadRequest, gin.H{"error": "unable to update configuration"})
+			writeProblem(c, http.StatusBadRequest, "invalid_request", "a config ID is required")
 			return
 		}
 
-		if err := c.ShouldBind(&req); err != nil {
-			dal.Logger.Errorf("unable to parse request: %v", err)
-			c.JSON(http.StatusBadRequest, gin.H{"error": "unable to update configuration"})
-			return
-		}
+		var config models.ConfigResponse
+		var err error
 
 		// span := sentry.StartSpan(c, "config.update")
-		config, err := dal.UpdateConfigByID(c, configID, req, c.Request)
+		switch mediaType := c.ContentType(); mediaType {
+		case patch.MediaTypeMergePatch, patch.MediaTypeJSONPatch:
+			body, readErr := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxPatchSize))
+			if readErr != nil {
+				dal.Logger.Errorf("unable to read the patch: %v", readErr)
+				writeBodyError(c, "invalid_request", "unable to read the patch", readErr)
+				return
+			}
+
+			config, err = dal.PatchConfig(c, configID, mediaType, body, c.Request)
+		case "", binding.MIMEJSON:
+			// a plain JSON body replaces the payload
+			var req models.UpdateConfigIn
+			if err := c.ShouldBindJSON(&req); err != nil {
+				dal.Logger.Errorf("unable to parse request: %v", err)
+				writeProblem(c, http.StatusBadRequest, "invalid_request", "unable to parse the request body")
+				return
+			}
+
+			config, err = dal.UpdateConfigByID(c, configID, req, c.Request)
+		default:
+			c.Header("Accept-Patch", acceptPatch)
+			writeProblem(c, http.StatusUnsupportedMediaType, "unsupported_media_type", fmt.Sprintf("unsupported media type %q", mediaType))
+			return
+		}
 		// span.Finish()
 
 		if err != nil {
-			dal.Logger.Errorf("unable to retrieve config: %v", err)
-			c.JSON(http.StatusBadRequest, gin.H{"error": "unable to retrieve configuration"})
+			dal.Logger.Errorf("unable to update config: %v", dal.Redactor.Error(err, configID))
+			writeError(c, err, "unable to update configuration")
 			return
 		}
 
-		dal.Logger.Infof("retrieved config")
+		dal.Logger.Infof("updated config")
 		c.JSON(http.StatusOK, gin.H{
 			"data": config,
 		})
@@ -148,3 +329,99 @@ func UpdateConfigByID(dal *DAL) gin.HandlerFunc {
 
 	return fn
 }
+
+// DeleteConfigByID - Delete a configuration. The configuration can be restored
+func DeleteConfigByID(dal *DAL) gin.HandlerFunc {
+	fn := func(c *gin.Context) {
+		configID := c.Param("configId")
+
+		err := dal.DeleteConfig(c, configID, c.Request)
+		if err != nil {
+			dal.Logger.Errorf("unable to delete config: %v", dal.Redactor.Error(err, configID))
+			writeError(c, err, "unable to delete configuration")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"data": configID,
+		})
+	}
+
+	return gin.HandlerFunc(fn)
+}
+
+// RestoreConfigByID - Restore a deleted configuration
+func RestoreConfigByID(dal *DAL) gin.HandlerFunc {
+	fn := func(c *gin.Context) {
+		configID := c.Param("configId")
+
+		err := dal.RestoreConfig(c, configID, c.Request)
+		if errors.Is(err, errConfigNotFound) {
+			writeProblem(c, http.StatusNotFound, "config_not_found", "deleted configuration not found")
+			return
+		} else if err != nil {
+			dal.Logger.Errorf("unable to restore config: %v", dal.Redactor.Error(err, configID))
+			writeError(c, err, "unable to restore configuration")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"data": configID,
+		})
+	}
+
+	return gin.HandlerFunc(fn)
+}
+
+// PurgeConfigByID - Permanently remove a configuration and its versions. Admin only
+func PurgeConfigByID(dal *DAL) gin.HandlerFunc {
+	fn := func(c *gin.Context) {
+		configID := c.Param("configId")
+
+		if !isAdmin(dal, c) {
+			dal.EmitMessage("config.audit", "AuthFailure", dal.requestDetails(c.Request))
+			writeProblem(c, http.StatusForbidden, "forbidden", "only admin hosts can purge configs")
+			return
+		}
+
+		versions, err := dal.PurgeConfig(c, configID, c.Request)
+		if err != nil {
+			dal.Logger.Errorf("unable to purge config: %v", dal.Redactor.Error(err, configID))
+			writeError(c, err, "unable to purge configuration")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"data": gin.H{"config_id": configID, "versions": versions},
+		})
+	}
+
+	return gin.HandlerFunc(fn)
+}
+
+// UpdateConfigTags - Replace the tags of a configuration
+func UpdateConfigTags(dal *DAL) gin.HandlerFunc {
+	fn := func(c *gin.Context) {
+		configID := c.Param("configId")
+		var req models.ConfigTagsIn
+
+		if err := c.ShouldBind(&req); err != nil {
+			dal.Logger.Errorf("unable to parse request: %v", err)
+			writeProblem(c, http.StatusBadRequest, "invalid_request", "unable to parse the request body")
+			return
+		}
+
+		tags, err := dal.UpdateConfigTags(c, configID, req.Tags, c.Request)
+		if err != nil {
+			dal.Logger.Errorf("unable to update tags: %v", dal.Redactor.Error(err, configID))
+			writeError(c, err, "unable to update tags")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"data": tags,
+		})
+	}
+
+	return gin.HandlerFunc(fn)
+}
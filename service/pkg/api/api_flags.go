@@ -0,0 +1,153 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/aeekayy/stilla/service/pkg/api/models"
+	"github.com/aeekayy/stilla/service/pkg/flags"
+)
+
+// PutFlag - Create a flag or store a new version of it
+func PutFlag(dal *DAL) gin.HandlerFunc {
+	fn := func(c *gin.Context) {
+		key := c.Param("flagKey")
+		var req flags.Flag
+
+		if err := c.ShouldBindJSON(&req); err != nil {
+			dal.Logger.Errorf("unable to parse request: %v", err)
+			writeProblem(c, http.StatusBadRequest, "invalid_request", "unable to parse the request body")
+			return
+		}
+
+		if req.Key == "" {
+			req.Key = key
+		} else if req.Key != key {
+			writeProblem(c, http.StatusBadRequest, "invalid_request", "the flag key doesn't match the path")
+			return
+		}
+
+		flag, write, err := dal.PutFlag(c, req, c.Request)
+		if err != nil {
+			dal.Logger.Errorf("unable to store flag: %v", dal.Redactor.Error(err, key))
+			writeError(c, err, "unable to store flag")
+			return
+		}
+
+		c.Header(configVersionHeader, strconv.Itoa(int(write.Version)))
+		c.Header(configChecksumHeader, write.Checksum)
+
+		status := http.StatusOK
+		if write.Created {
+			status = http.StatusCreated
+		}
+
+		c.JSON(status, gin.H{
+			"data":    flag,
+			"version": write.Version,
+		})
+	}
+
+	return gin.HandlerFunc(fn)
+}
+
+// GetFlag - Get the current version of a flag
+func GetFlag(dal *DAL) gin.HandlerFunc {
+	fn := func(c *gin.Context) {
+		key := c.Param("flagKey")
+
+		flag, version, err := dal.GetFlag(c, key, c.Request)
+		if err != nil {
+			dal.Logger.Errorf("unable to get flag: %v", dal.Redactor.Error(err, key))
+			writeError(c, err, "unable to get flag")
+			return
+		}
+
+		c.Header(configVersionHeader, strconv.Itoa(int(version)))
+		c.JSON(http.StatusOK, gin.H{
+			"data":    flag,
+			"version": version,
+		})
+	}
+
+	return gin.HandlerFunc(fn)
+}
+
+// SetFlagEnabled - Turn a flag on or off
+func SetFlagEnabled(dal *DAL) gin.HandlerFunc {
+	fn := func(c *gin.Context) {
+		key := c.Param("flagKey")
+		var req models.FlagEnabledIn
+
+		if err := c.ShouldBindJSON(&req); err != nil {
+			dal.Logger.Errorf("unable to parse request: %v", err)
+			writeProblem(c, http.StatusBadRequest, "invalid_request", "unable to parse the request body")
+			return
+		}
+
+		flag, version, err := dal.SetFlagEnabled(c, key, *req.Enabled, c.Request)
+		if err != nil {
+			dal.Logger.Errorf("unable to set flag: %v", dal.Redactor.Error(err, key))
+			writeError(c, err, "unable to set flag")
+			return
+		}
+
+		c.Header(configVersionHeader, strconv.Itoa(int(version)))
+		c.JSON(http.StatusOK, gin.H{
+			"data":    flag,
+			"version": version,
+		})
+	}
+
+	return gin.HandlerFunc(fn)
+}
+
+// EvaluateFlag - Evaluate a flag for the requesting host
+func EvaluateFlag(dal *DAL) gin.HandlerFunc {
+	fn := func(c *gin.Context) {
+		key := c.Param("flagKey")
+
+		evaluations, err := dal.EvaluateFlags(c, []string{key}, c.Request)
+		if err != nil {
+			dal.Logger.Errorf("unable to evaluate flag: %v", dal.Redactor.Error(err, key))
+			writeError(c, err, "unable to evaluate flag")
+			return
+		}
+
+		// the only flag that was asked for can't be evaluated
+		if evaluation := evaluations[key]; evaluation.Reason == flags.ReasonError {
+			dal.Logger.Errorf("unable to evaluate flag: %s", evaluation.Error)
+			writeProblem(c, kindStatus[errUnusableFlag.kind], errUnusableFlag.code, evaluation.Error)
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"data": evaluations[key],
+		})
+	}
+
+	return gin.HandlerFunc(fn)
+}
+
+// EvaluateFlags - Evaluate flags for the requesting host. Every flag is
+// evaluated unless keys are given
+func EvaluateFlags(dal *DAL) gin.HandlerFunc {
+	fn := func(c *gin.Context) {
+		keys := c.QueryArray("key")
+
+		evaluations, err := dal.EvaluateFlags(c, keys, c.Request)
+		if err != nil {
+			dal.Logger.Errorf("unable to evaluate flags: %v", err)
+			writeError(c, err, "unable to evaluate flags")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"data": evaluations,
+		})
+	}
+
+	return gin.HandlerFunc(fn)
+}
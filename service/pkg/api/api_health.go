@@ -26,3 +26,25 @@ func PingGet(dal *DAL) gin.HandlerFunc {
 
 	return gin.HandlerFunc(fn)
 }
+
+// CacheStats - Cache hit and miss statistics
+func CacheStats(dal *DAL) gin.HandlerFunc {
+	fn := func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{
+			"data": dal.CacheStats(),
+		})
+	}
+
+	return gin.HandlerFunc(fn)
+}
+
+// BreakerStates - State of the circuit breakers
+func BreakerStates(dal *DAL) gin.HandlerFunc {
+	fn := func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{
+			"data": dal.BreakerStates(),
+		})
+	}
+
+	return gin.HandlerFunc(fn)
+}
@@ -17,7 +17,6 @@ import (
 	"github.com/gin-gonic/gin"
 
 	"github.com/aeekayy/stilla/service/pkg/api/models"
-	"github.com/aeekayy/stilla/service/pkg/utils"
 )
 
 // HostRegister - Register host for an API key
@@ -27,16 +26,16 @@ func HostRegister(dal *DAL) gin.HandlerFunc {
 
 		if err := c.ShouldBind(&req); err != nil {
 			dal.Logger.Errorf("unable to parse request: %v", err)
-			c.JSON(http.StatusBadRequest, gin.H{"error": "unable to register host"})
+			writeProblem(c, http.StatusBadRequest, "invalid_request", "unable to parse the request body")
 			return
 		}
 
 		_, apiKey, err := dal.RegisterHost(c, req, c.Request)
 
 		if err != nil {
-			output := utils.SanitizeLogMessage(req.Name, req.Name)
+			output := dal.Redactor.Scrub(req.Name, req.Name)
 			dal.Logger.Errorf("unable to register host: %v", output)
-			c.JSON(http.StatusBadRequest, gin.H{"error": "unable to register host"})
+			writeError(c, err, "unable to register host")
 			return
 		}
 
@@ -56,7 +55,7 @@ func HostLogin(dal *DAL) gin.HandlerFunc {
 
 		if err := c.ShouldBind(&req); err != nil {
 			dal.Logger.Errorf("unable to parse request: %v", err)
-			c.JSON(http.StatusBadRequest, gin.H{"error": "unable to login host"})
+			writeProblem(c, http.StatusBadRequest, "invalid_request", "unable to parse the request body")
 			return
 		}
 
@@ -66,14 +65,15 @@ func HostLogin(dal *DAL) gin.HandlerFunc {
 
 		if err != nil {
 			dal.Logger.Errorf("unable to login host: %v", err)
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "unable to login host"})
+			writeProblem(c, http.StatusUnauthorized, "unauthorized", "invalid host or API key")
 			return
 		}
 
 		// Save the host ID in the session
 		session.Set(hostKey, hostID) // In real world usage you'd set this to the users ID
 		if err := session.Save(); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save session"})
+			dal.Logger.Errorf("unable to save the session: %v", err)
+			writeProblem(c, http.StatusInternalServerError, "internal_error", "unable to save the session")
 			return
 		}
 
@@ -0,0 +1,79 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/aeekayy/stilla/service/pkg/api/models"
+)
+
+// ApplyOverride - Override a configuration until a TTL ends
+func ApplyOverride(dal *DAL) gin.HandlerFunc {
+	fn := func(c *gin.Context) {
+		configID := c.Param("configId")
+		var req models.ConfigOverrideIn
+
+		if err := c.ShouldBindJSON(&req); err != nil {
+			dal.Logger.Errorf("unable to parse request: %v", err)
+			writeProblem(c, http.StatusBadRequest, "invalid_request", "unable to parse the request body")
+			return
+		}
+
+		override, err := dal.ApplyOverride(c, configID, req, c.Request)
+		if err != nil {
+			dal.Logger.Errorf("unable to apply override: %v", dal.Redactor.Error(err, configID))
+			writeError(c, err, "unable to apply the override")
+			return
+		}
+
+		c.Header(configVersionHeader, strconv.Itoa(int(override.Version)))
+		c.JSON(http.StatusCreated, gin.H{
+			"data": override,
+		})
+	}
+
+	return gin.HandlerFunc(fn)
+}
+
+// RevertOverride - Revert an active override of a configuration before its
+// TTL ends
+func RevertOverride(dal *DAL) gin.HandlerFunc {
+	fn := func(c *gin.Context) {
+		configID := c.Param("configId")
+		overrideID := c.Param("overrideId")
+
+		override, err := dal.RevertOverride(c, configID, overrideID, c.Request)
+		if err != nil {
+			dal.Logger.Errorf("unable to revert override: %v", dal.Redactor.Error(err, configID))
+			writeError(c, err, "unable to revert the override")
+			return
+		}
+
+		c.Header(configVersionHeader, strconv.Itoa(int(override.RevertedVersion)))
+		c.JSON(http.StatusOK, gin.H{
+			"data": override,
+		})
+	}
+
+	return gin.HandlerFunc(fn)
+}
+
+// GetActiveOverrides - List the active overrides of every configuration
+func GetActiveOverrides(dal *DAL) gin.HandlerFunc {
+	fn := func(c *gin.Context) {
+		overrides, err := dal.GetActiveOverrides(c, c.Request)
+		if err != nil {
+			dal.Logger.Errorf("unable to list overrides: %v", err)
+			writeError(c, err, "unable to list the overrides")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"data": overrides,
+		})
+	}
+
+	return gin.HandlerFunc(fn)
+}
@@ -0,0 +1,82 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/aeekayy/stilla/service/pkg/api/models"
+)
+
+// ScheduleConfig - Schedule a new version of a configuration
+func ScheduleConfig(dal *DAL) gin.HandlerFunc {
+	fn := func(c *gin.Context) {
+		configID := c.Param("configId")
+		var req models.ConfigScheduleIn
+
+		if err := c.ShouldBindJSON(&req); err != nil {
+			dal.Logger.Errorf("unable to parse request: %v", err)
+			writeProblem(c, http.StatusBadRequest, "invalid_request", "unable to parse the request body")
+			return
+		}
+
+		schedule, err := dal.ScheduleConfig(c, configID, req, c.Request)
+		if err != nil {
+			dal.Logger.Errorf("unable to schedule config: %v", dal.Redactor.Error(err, configID))
+			writeError(c, err, "unable to schedule the configuration change")
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{
+			"data": schedule,
+		})
+	}
+
+	return gin.HandlerFunc(fn)
+}
+
+// CancelSchedule - Cancel a pending scheduled change of a configuration
+func CancelSchedule(dal *DAL) gin.HandlerFunc {
+	fn := func(c *gin.Context) {
+		configID := c.Param("configId")
+		scheduleID := c.Param("scheduleId")
+
+		schedule, err := dal.CancelSchedule(c, configID, scheduleID, c.Request)
+		if err != nil {
+			dal.Logger.Errorf("unable to cancel scheduled change: %v", dal.Redactor.Error(err, configID))
+			writeError(c, err, "unable to cancel the scheduled change")
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"data": schedule,
+		})
+	}
+
+	return gin.HandlerFunc(fn)
+}
+
+// GetConfigHistory - Get the versions and the scheduled changes of a
+// configuration
+func GetConfigHistory(dal *DAL) gin.HandlerFunc {
+	fn := func(c *gin.Context) {
+		configID := c.Param("configId")
+
+		history, err := dal.GetConfigHistory(c, configID, c.Request)
+		if err != nil {
+			dal.Logger.Errorf("unable to get config history: %v", dal.Redactor.Error(err, configID))
+			writeError(c, err, "unable to get the configuration history")
+			return
+		}
+
+		if history.Versions == nil {
+			history.Versions = []models.ConfigResponse{}
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"data": history,
+		})
+	}
+
+	return gin.HandlerFunc(fn)
+}
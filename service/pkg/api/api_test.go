@@ -2,23 +2,31 @@
 package api
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strings"
 	"testing"
 
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 
+	apimodels "github.com/aeekayy/stilla/service/pkg/api/models"
 	"github.com/aeekayy/stilla/service/pkg/models"
+	"github.com/aeekayy/stilla/service/pkg/patch"
+	"github.com/aeekayy/stilla/service/pkg/pointer"
+	"github.com/aeekayy/stilla/service/pkg/render"
 )
 
 const (
-	pageNotFoundErrMsg = "404 page not found"
 	v1ApiPrefix = "/api/v1"
 	responseLookupPrefix = "lookup:"
+	responseProblemPrefix = "problem:"
 )
 
 // GetTestGinContext creates a Gin context for tests
@@ -29,11 +37,30 @@ func GetTestGinContext() *gin.Context {
 	ctx, _ := gin.CreateTestContext(w)
 	ctx.Request = &http.Request{
 		Header: make(http.Header),
+		URL:    &url.URL{},
 	}
 
 	return ctx
 }
 
+// handlerContext creates a Gin context for calling a handler directly, with
+// the request ID the RequestID middleware sets. A body is sent as JSON
+func handlerContext(method, target, body string, params ...gin.Param) (*gin.Context, *httptest.ResponseRecorder) {
+	gin.SetMode(gin.TestMode)
+
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = httptest.NewRequest(method, target, strings.NewReader(body))
+	if body != "" {
+		ctx.Request.Header.Set("Content-Type", "application/json")
+	}
+	ctx.Params = params
+	ctx.Set(requestIDKey, "request-1")
+	ctx.Header(requestIDHeader, "request-1")
+
+	return ctx, w
+}
+
 func getConfig() *models.Config {
 	return models.NewConfig()
 }
@@ -57,9 +84,9 @@ func TestAPIRoutes(t *testing.T) {
 		expectResponseBody string
 	}{
 		{"testPingRoutePositive", http.MethodGet, "/health/", nil, http.StatusOK, "{\"message\":\"pong\"}"},
-		{"testBadPathNegative", http.MethodGet, "/bad-path", nil, http.StatusNotFound, pageNotFoundErrMsg },
+		{"testBadPathNegative", http.MethodGet, "/bad-path", nil, http.StatusNotFound, responseProblemPrefix + "route_not_found"},
 		{"testRegisterHostPositive", http.MethodPost, "/host/register", rbHostRegister, http.StatusCreated, fmt.Sprintf("%s%s", responseLookupPrefix, "ApiKey")},
-		{"testRegisterHostNegative", http.MethodPost, "/host/register", nil, http.StatusBadRequest, "{\"error\":\"unable to register host\"}"},
+		{"testRegisterHostNegative", http.MethodPost, "/host/register", nil, http.StatusBadRequest, responseProblemPrefix + "invalid_request"},
 	}
 
 	for _, tc := range table {
@@ -75,6 +102,8 @@ func TestAPIRoutes(t *testing.T) {
 				value := mDB.Lookup["ApiKey"]
 				expectedResponse := fmt.Sprintf("{\"data\":\"%s\"}", value)
 				assert.Equal(t, expectedResponse, w.Body.String())
+			} else if strings.HasPrefix(tc.expectResponseBody, responseProblemPrefix) {
+				assertProblem(t, w, strings.TrimPrefix(tc.expectResponseBody, responseProblemPrefix))
 			} else {
 				assert.Equal(t, tc.expectResponseBody, w.Body.String())
 			}
@@ -95,7 +124,7 @@ func TestAPIRoutes(t *testing.T) {
 		expectResponseBody string
 	}{
 		{"testLoginHostPositive", http.MethodPost, "/host/login", rbHostLogin, http.StatusOK, responseHostLogin },
-		{"testLoginHostNegative", http.MethodPost, "/host/login", nil, http.StatusBadRequest, "{\"error\":\"unable to login host\"}" },
+		{"testLoginHostNegative", http.MethodPost, "/host/login", nil, http.StatusBadRequest, responseProblemPrefix + "invalid_request"},
 	}
 
 	for _, tc := range tableSet2 {
@@ -106,7 +135,291 @@ func TestAPIRoutes(t *testing.T) {
 			router.ServeHTTP(w, req)
 
 			assert.Equal(t, tc.expectResponseCode, w.Code)
-			assert.Equal(t, tc.expectResponseBody, w.Body.String())
+			if strings.HasPrefix(tc.expectResponseBody, responseProblemPrefix) {
+				assertProblem(t, w, strings.TrimPrefix(tc.expectResponseBody, responseProblemPrefix))
+			} else {
+				assert.Equal(t, tc.expectResponseBody, w.Body.String())
+			}
 		})
 	}
 }
+
+// assertProblem validates that a response is a problem with a code and a
+// request ID
+func assertProblem(t *testing.T, w *httptest.ResponseRecorder, code string) {
+	assert.Equal(t, problemContentType, w.Header().Get("Content-Type"))
+
+	var problem apimodels.Error
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &problem))
+	assert.Equal(t, code, problem.Code)
+	assert.Equal(t, w.Code, problem.Status)
+	assert.NotEmpty(t, problem.RequestID)
+	assert.Equal(t, problem.RequestID, w.Header().Get(requestIDHeader))
+}
+
+// TestRequestID validates that request IDs are passed through when valid
+// and made otherwise
+func TestRequestID(t *testing.T) {
+	router := gin.New()
+	router.Use(RequestID())
+	router.GET("/", func(c *gin.Context) {
+		c.String(http.StatusOK, c.GetString(requestIDKey))
+	})
+
+	table := []struct {
+		name   string
+		header string
+		keep   bool
+	}{
+		{"valid", "req-1.a:b_c", true},
+		{"missing", "", false},
+		{"invalid", "bad id\n", false},
+		{"too long", strings.Repeat("a", 129), false},
+	}
+
+	for _, tc := range table {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodGet, "/", nil)
+			if tc.header != "" {
+				req.Header.Set(requestIDHeader, tc.header)
+			}
+			router.ServeHTTP(w, req)
+
+			id := w.Header().Get(requestIDHeader)
+			assert.NotEmpty(t, id)
+			assert.Equal(t, id, w.Body.String())
+			if tc.keep {
+				assert.Equal(t, tc.header, id)
+			} else {
+				assert.NotEqual(t, tc.header, id)
+			}
+		})
+	}
+}
+
+// TestPurgeConfigForbidden validates that only admin hosts can purge configs
+func TestPurgeConfigForbidden(t *testing.T) {
+	dal := setupDep(t)
+	dal.Config.AdminHosts = []string{"admin-host"}
+
+	ctx := GetTestGinContext()
+	ctx.Params = gin.Params{{Key: "configId", Value: "configTest"}}
+	ctx.Set("x-host-id", "other-host")
+	PurgeConfigByID(dal)(ctx)
+	assert.Equal(t, http.StatusForbidden, ctx.Writer.Status())
+
+	ctx = GetTestGinContext()
+	ctx.Set("x-host", "admin-host")
+	assert.True(t, isAdmin(dal, ctx))
+
+	ctx = GetTestGinContext()
+	assert.False(t, isAdmin(dal, ctx))
+}
+
+// TestUpdateConfigTagsInvalid validates that bad tags are rejected
+func TestUpdateConfigTagsInvalid(t *testing.T) {
+	dal := setupDep(t)
+
+	for _, body := range []string{`{}`, `{"tags": ["team:core", ""]}`} {
+		ctx := GetTestGinContext()
+		ctx.Params = gin.Params{{Key: "configId", Value: "configTest"}}
+		ctx.Request.Method = http.MethodPut
+		ctx.Request.Header.Set("Content-Type", "application/json")
+		ctx.Request.Body = io.NopCloser(strings.NewReader(body))
+		UpdateConfigTags(dal)(ctx)
+		assert.Equal(t, http.StatusBadRequest, ctx.Writer.Status(), body)
+	}
+}
+
+// TestNegotiateFormat validates the format query parameter and Accept header
+func TestNegotiateFormat(t *testing.T) {
+	table := []struct {
+		name   string
+		query  string
+		accept string
+		format render.Format
+		ok     bool
+	}{
+		{"TestNegotiateFormatDefault", "", "", render.FormatJSON, true},
+		{"TestNegotiateFormatAny", "", "*/*", render.FormatJSON, true},
+		{"TestNegotiateFormatAccept", "", "application/x-yaml", render.FormatYAML, true},
+		{"TestNegotiateFormatQuery", "format=properties", "application/json", render.FormatProperties, true},
+		{"TestNegotiateFormatUnknownQuery", "format=xml", "", "", false},
+		{"TestNegotiateFormatNotAcceptable", "", "application/xml", "", false},
+	}
+
+	for _, tc := range table {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := GetTestGinContext()
+			ctx.Request.URL.RawQuery = tc.query
+			if tc.accept != "" {
+				ctx.Request.Header.Set("Accept", tc.accept)
+			}
+
+			format, err := negotiateFormat(ctx)
+			assert.Equal(t, tc.ok, err == nil)
+			assert.Equal(t, tc.format, format)
+		})
+	}
+}
+
+// TestImportConfigsInvalid validates the import requests that are rejected
+// before anything is read from the document store
+func TestImportConfigsInvalid(t *testing.T) {
+	dal := setupDep(t)
+
+	table := []struct {
+		name        string
+		query       string
+		contentType string
+		body        string
+		code        int
+	}{
+		{"TestImportInvalidConflict", "on_conflict=replace", "", "", http.StatusBadRequest},
+		{"TestImportInvalidDryRun", "dry_run=maybe", "", "", http.StatusBadRequest},
+		{"TestImportOverwriteForbidden", "on_conflict=overwrite", "", "", http.StatusForbidden},
+		{"TestImportUnsupportedType", "", "text/csv", "", http.StatusUnsupportedMediaType},
+		{"TestImportMalformedBundle", "", "application/x-ndjson", `{"config": {}}`, http.StatusBadRequest},
+	}
+
+	for _, tc := range table {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := GetTestGinContext()
+			ctx.Request.Method = http.MethodPost
+			ctx.Request.URL.RawQuery = tc.query
+			ctx.Request.Body = io.NopCloser(strings.NewReader(tc.body))
+			if tc.contentType != "" {
+				ctx.Request.Header.Set("Content-Type", tc.contentType)
+			}
+
+			ImportConfigs(dal)(ctx)
+			assert.Equal(t, tc.code, ctx.Writer.Status())
+		})
+	}
+}
+
+// TestExportConfigsInvalid validates that unknown bundle formats are rejected
+func TestExportConfigsInvalid(t *testing.T) {
+	dal := setupDep(t)
+
+	for _, query := range []string{"format=zip", "history=maybe"} {
+		ctx := GetTestGinContext()
+		ctx.Request.URL.RawQuery = query
+		ExportConfigs(dal)(ctx)
+		assert.Equal(t, http.StatusBadRequest, ctx.Writer.Status(), query)
+	}
+}
+
+// TestUpdateConfigUnsupportedType validates that unknown patch formats are
+// rejected with the formats that are accepted
+func TestUpdateConfigUnsupportedType(t *testing.T) {
+	dal := setupDep(t)
+
+	ctx := GetTestGinContext()
+	ctx.Request.Method = http.MethodPatch
+	ctx.Request.Header.Set("Content-Type", "application/xml")
+	ctx.Params = gin.Params{{Key: "configId", Value: "configTest"}}
+
+	UpdateConfigByID(dal)(ctx)
+	assert.Equal(t, http.StatusUnsupportedMediaType, ctx.Writer.Status())
+	assert.Equal(t, "application/merge-patch+json, application/json-patch+json", ctx.Writer.Header().Get("Accept-Patch"))
+}
+
+// TestErrorProblem validates the status and code of DAL errors
+func TestErrorProblem(t *testing.T) {
+	table := []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{errConfigNotFound, http.StatusNotFound, "config_not_found"},
+		{fmt.Errorf("%w: timeout", errDocumentStoreUnavailable), http.StatusServiceUnavailable, "document_store_unavailable"},
+		{fmt.Errorf("operation 0 (test /a): %w", patch.ErrTestFailed), http.StatusConflict, "patch_test_failed"},
+		{fmt.Errorf("%w: expected version 2, found 3", errVersionConflict), http.StatusConflict, "version_conflict"},
+		{fmt.Errorf("%w: unknown op", patch.ErrInvalidPatch), http.StatusBadRequest, "invalid_patch"},
+		{fmt.Errorf("%w: /a", pointer.ErrNotFound), http.StatusUnprocessableEntity, "path_not_found"},
+		{errPatchNotObject, http.StatusUnprocessableEntity, "patch_not_object"},
+		{errConfigProtected, http.StatusConflict, "config_protected"},
+		{&pendingChange{}, http.StatusConflict, "change_request_pending"},
+		{errors.New("connection refused"), http.StatusInternalServerError, "internal_error"},
+	}
+
+	for _, tc := range table {
+		status, code, detail := errorProblem(tc.err, "unable to update configuration")
+		assert.Equal(t, tc.status, status, tc.err.Error())
+		assert.Equal(t, tc.code, code, tc.err.Error())
+		assert.NotEmpty(t, detail)
+	}
+
+	// internal errors aren't exposed
+	_, _, detail := errorProblem(errors.New("connection refused"), "unable to update configuration")
+	assert.Equal(t, "unable to update configuration", detail)
+}
+
+// TestWriteProblem validates the problem+json body of errors
+func TestWriteProblem(t *testing.T) {
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = httptest.NewRequest(http.MethodGet, "/api/v1/config/payments", nil)
+	ctx.Set(requestIDKey, "req-1")
+
+	writeError(ctx, fmt.Errorf("%w: payments", errConfigNotFound), "unable to retrieve configuration")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, problemContentType, w.Header().Get("Content-Type"))
+
+	var problem apimodels.Error
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &problem))
+	assert.Equal(t, "config_not_found", problem.Code)
+	assert.Equal(t, "req-1", problem.RequestID)
+	assert.Equal(t, "/api/v1/config/payments", problem.Instance)
+	assert.Equal(t, http.StatusNotFound, problem.Status)
+	assert.Equal(t, problemTypePrefix+"config_not_found", problem.Type)
+}
+
+// TestWritePendingChange validates that writes to protected configs are
+// accepted with their change request
+func TestWritePendingChange(t *testing.T) {
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = httptest.NewRequest(http.MethodPut, "/api/v1/config/payments", nil)
+
+	id := primitive.NewObjectID()
+	request := apimodels.ChangeRequest{ID: id, ConfigName: "prod/payments", Status: apimodels.ChangePending}
+	writeError(ctx, fmt.Errorf("unable to patch: %w", &pendingChange{request: request}), "unable to update configuration")
+
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	assert.Equal(t, "/api/v1/config/prod%2Fpayments/changes/"+id.Hex(), w.Header().Get("Location"))
+
+	var body struct {
+		Data apimodels.ChangeRequest `json:"data"`
+	}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, id, body.Data.ID)
+	assert.Equal(t, apimodels.ChangePending, body.Data.Status)
+}
+
+// TestSetConfigProtectionForbidden validates that only admin hosts can
+// protect configs and who may review change requests
+func TestSetConfigProtectionForbidden(t *testing.T) {
+	dal := setupDep(t)
+	dal.Config.AdminHosts = []string{"admin-host"}
+	dal.Config.ApproverHosts = []string{"approver-host"}
+
+	ctx, w := handlerContext(http.MethodPut, "/api/v1/config/payments/protection", `{"protected":true}`, gin.Param{Key: "configId", Value: "payments"})
+	ctx.Set("x-host-id", "approver-host")
+
+	SetConfigProtection(dal)(ctx)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assertProblem(t, w, "forbidden")
+
+	assert.True(t, isApprover(dal, ctx))
+
+	ctx = GetTestGinContext()
+	ctx.Set("x-host-id", "admin-host")
+	assert.True(t, isApprover(dal, ctx))
+
+	ctx = GetTestGinContext()
+	ctx.Set("x-host-id", "other-host")
+	assert.False(t, isApprover(dal, ctx))
+}
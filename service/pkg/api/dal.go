@@ -4,13 +4,11 @@ package api
 import (
 	"bytes"
 	"context"
-	"crypto/sha256"
-	b64 "encoding/base64"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
-	"sync"
 	"time"
 
 	"github.com/confluentinc/confluent-kafka-go/kafka"
@@ -23,12 +21,17 @@ import (
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.uber.org/zap"
+	"golang.org/x/sync/singleflight"
 	"google.golang.org/protobuf/proto"
 
 	pb "github.com/aeekayy/stilla/service/api/protobuf/messages"
 	"github.com/aeekayy/stilla/service/lib/db"
 	"github.com/aeekayy/stilla/service/pkg/api/models"
+	"github.com/aeekayy/stilla/service/pkg/breaker"
+	"github.com/aeekayy/stilla/service/pkg/cache"
+	"github.com/aeekayy/stilla/service/pkg/checksum"
 	svcmodels "github.com/aeekayy/stilla/service/pkg/models"
+	"github.com/aeekayy/stilla/service/pkg/redact"
 	"github.com/aeekayy/stilla/service/pkg/utils"
 )
 
@@ -41,6 +44,10 @@ const (
 	dateFormat                     = "2021-02-03T04:55:46.607+08:00"
 )
 
+// maxWriteAttempts how many times a write that isn't based on a version is
+// tried when other writes change the config first
+const maxWriteAttempts = 3
+
 // MongoQueryResult used to manage Mongo query results from channels
 type MongoQueryResult struct {
 	Result interface{} `json:"result"`
@@ -51,6 +58,7 @@ type MongoQueryResult struct {
 // data store connections for Stilla
 type DAL struct {
 	Cache         *persistence.RedisStore `json:"cache"`
+	Redis         *cache.Redis            `json:"-"`
 	Config        *svcmodels.Config       `json:"config"`
 	Database      db.DBIface                `json:"database"`
 	Context       *context.Context        `json:"context"`
@@ -58,9 +66,24 @@ type DAL struct {
 	Logger        *zap.SugaredLogger      `json:"logger"`
 	Producer      *kafka.Producer         `json:"producer"`
 	APM           *newrelic.Application   `json:"apm"`
+	Redactor      *redact.Redactor        `json:"-"`
+	LocalCache    *cache.LRU              `json:"-"`
+	CacheTTL      time.Duration           `json:"cache_ttl"`
+	StaleTTL      time.Duration           `json:"stale_ttl"`
+	IdempotencyTTL time.Duration          `json:"idempotency_ttl"`
+	DocBreaker    *breaker.Breaker        `json:"-"`
+	CacheBreaker  *breaker.Breaker        `json:"-"`
 	Collection    string                  `json:"collection,omitempty"`
 	SessionKey    string                  `json:"session_key"`
 	CacheEnabled  bool                    `json:"cache_enabled"`
+	StaleEnabled  bool                    `json:"stale_enabled"`
+
+	cacheStats cache.Stats
+	flight     singleflight.Group
+	watchers   configWatchers
+	// onMessage sees every emitted message before it's produced. Tests
+	// record audit events with it
+	onMessage func(messageType, funcName string, body map[string]interface{})
 }
 
 // AuditEvent audit event struct for sending messages of service events
@@ -77,19 +100,70 @@ type HostCache struct {
 }
 
 // NewDAL returns a new DAL
-func NewDAL(ctx *context.Context, sugar *zap.SugaredLogger, apm *newrelic.Application, config *svcmodels.Config, dbConn db.Conn, docStore *mongo.Client, store *persistence.RedisStore, producer *kafka.Producer, collection, sessionKey string) *DAL {
+func NewDAL(ctx *context.Context, sugar *zap.SugaredLogger, apm *newrelic.Application, config *svcmodels.Config, dbConn db.Conn, docStore *mongo.Client, redisClient *cache.Redis, producer *kafka.Producer, collection, sessionKey string) *DAL {
+	redactor, err := redact.New(config.Redaction)
+	if err != nil {
+		sugar.Errorf("invalid redaction policy, using the default policy: %s", err)
+		redactor = redact.Default()
+	}
+
+	cacheTTL, err := config.Cache.GetTTL()
+	if err != nil {
+		sugar.Errorf("invalid cache ttl, using %s: %s", cacheTTL, err)
+	}
+
+	var localCache *cache.LRU
+	if size := config.Cache.Local.GetSize(); size > 0 {
+		localTTL, err := config.Cache.Local.GetTTL()
+		if err != nil {
+			sugar.Errorf("invalid local cache ttl, using %s: %s", localTTL, err)
+		}
+		localCache = cache.NewLRU(size, localTTL)
+	}
+
+	staleTTL, err := config.Cache.Stale.GetTTL()
+	if err != nil {
+		sugar.Errorf("invalid stale cache ttl, using %s: %s", staleTTL, err)
+	}
+
+	idempotencyTTL, err := config.Idempotency.GetTTL()
+	if err != nil {
+		sugar.Errorf("invalid idempotency ttl, using %s: %s", idempotencyTTL, err)
+	}
+
+	breakerTimeout, err := config.Breaker.GetTimeout()
+	if err != nil {
+		sugar.Errorf("invalid circuit breaker timeout, using %s: %s", breakerTimeout, err)
+	}
+	logStateChange := func(name string, from, to breaker.State) {
+		sugar.Warnf("the %s circuit breaker changed from %s to %s", name, from, to)
+	}
+	docBreaker := breaker.New("docdb", config.Breaker.GetThreshold(), breakerTimeout)
+	docBreaker.OnStateChange = logStateChange
+	cacheBreaker := breaker.New("redis", config.Breaker.GetThreshold(), breakerTimeout)
+	cacheBreaker.OnStateChange = logStateChange
+
 	return &DAL{
 		Context:       ctx,
 		Config:        config,
 		Database:      dbConn,
 		DocumentStore: docStore,
-		Cache:         store,
+		Cache:         persistence.NewRedisCacheWithPool(redisClient.Pool, time.Second),
+		Redis:         redisClient,
 		Collection:    collection,
 		Logger:        sugar,
 		Producer:      producer,
 		SessionKey:    sessionKey,
 		APM:           apm,
-		CacheEnabled:  true, // default the cache to 'true' for now. TODO: Make this configurable.
+		Redactor:      redactor,
+		LocalCache:    localCache,
+		CacheTTL:      cacheTTL,
+		CacheEnabled:  config.Cache.IsEnabled(),
+		StaleTTL:      staleTTL,
+		StaleEnabled:  config.Cache.Stale.IsEnabled(),
+		IdempotencyTTL: idempotencyTTL,
+		DocBreaker:    docBreaker,
+		CacheBreaker:  cacheBreaker,
 	}
 }
 
@@ -101,19 +175,27 @@ func (a *AuditEvent) ToByteSlice() ([]byte, error) {
 	return buf.Bytes(), err
 }
 
-// RegisterHost registers a host and provides the requestor an API key
-func (d *DAL) RegisterHost(ctx *gin.Context, hostRegisterIn models.HostRegisterIn, req interface{}) (string, string, error) {
+// requestDetails collects the details of a request for an audit event.
+// Headers are redacted with the DAL's redaction policy
+func (d *DAL) requestDetails(req interface{}) map[string]interface{} {
 	requestDetails := make(map[string]interface{})
 
 	httpReq := req.(*http.Request)
 	requestDetails["request.method"] = utils.SanitizeMessageValue(httpReq.Method)
-	requestDetails["request.header"] = utils.SanitizeMessageValue(httpReq.Header)
+	requestDetails["request.header"] = d.Redactor.Headers(httpReq.Header)
 	requestDetails["request.protocol"] = utils.SanitizeMessageValue(httpReq.Proto)
 	requestDetails["request.contentlength"] = utils.SanitizeMessageValue(httpReq.ContentLength)
 	requestDetails["request.host"] = utils.SanitizeMessageValue(httpReq.Host)
-	requestDetails["request.uri"] = utils.SanitizeMessageValue(httpReq.RequestURI)
+	requestDetails["request.uri"] = d.Redactor.Text(httpReq.RequestURI)
 	requestDetails["request.remoteaddr"] = utils.SanitizeMessageValue(httpReq.RemoteAddr)
-	requestDetails["host"] = utils.SanitizeMessageValue(hostRegisterIn)
+
+	return requestDetails
+}
+
+// RegisterHost registers a host and provides the requestor an API key
+func (d *DAL) RegisterHost(ctx *gin.Context, hostRegisterIn models.HostRegisterIn, req interface{}) (string, string, error) {
+	requestDetails := d.requestDetails(req)
+	requestDetails["host"] = d.Redactor.Field("host", hostRegisterIn)
 
 	d.EmitMessage("config.audit", "HostRegister", requestDetails)
 
@@ -129,23 +211,15 @@ func (d *DAL) RegisterHost(ctx *gin.Context, hostRegisterIn models.HostRegisterI
 
 // LoginHost uses the API Key of a host and validates it. Creates a new session if the key is valid
 func (d *DAL) LoginHost(ctx *gin.Context, hostLoginIn models.HostLoginIn, req interface{}) (string, error) {
-	requestDetails := make(map[string]interface{})
-
-	httpReq := req.(*http.Request)
-	requestDetails["request.method"] = utils.SanitizeMessageValue(httpReq.Method)
-	requestDetails["request.header"] = utils.SanitizeMessageValue(httpReq.Header)
-	requestDetails["request.protocol"] = utils.SanitizeMessageValue(httpReq.Proto)
-	requestDetails["request.contentlength"] = utils.SanitizeMessageValue(httpReq.ContentLength)
-	requestDetails["request.host"] = utils.SanitizeMessageValue(httpReq.Host)
-	requestDetails["request.uri"] = utils.SanitizeMessageValue(httpReq.RequestURI)
-	requestDetails["request.remoteaddr"] = utils.SanitizeMessageValue(httpReq.RemoteAddr)
-	requestDetails["host"] = utils.SanitizeMessageValue(hostLoginIn)
+	requestDetails := d.requestDetails(req)
+	requestDetails["host"] = d.Redactor.Field("host", hostLoginIn)
 
 	d.EmitMessage("config.audit", "HostLogin", requestDetails)
 
 	hostKey, err := d.Database.ValidateAPIKey(hostLoginIn.APIKey, hostLoginIn.Host)
 
 	if err != nil {
+		d.EmitMessage("config.audit", "AuthFailure", requestDetails)
 		return "", fmt.Errorf("invalid api key for host: %s", err)
 	}
 
@@ -157,26 +231,54 @@ func (d *DAL) LoginHost(ctx *gin.Context, hostLoginIn models.HostLoginIn, req in
 // InsertConfig insert a configuration object into the document store. This
 // creates a new ConfigVersion object. The ObjectID of the ConfigVersion is then
 // used to update the Config object reference for ConfigVersion
-func (d *DAL) InsertConfig(ctx *gin.Context, configIn models.ConfigIn, req interface{}) (string, bool, error) {
-	requestDetails := make(map[string]interface{})
-	upsertedRecord := false
-
-	httpReq := req.(*http.Request)
-	requestDetails["request.method"] = utils.SanitizeMessageValue(httpReq.Method)
-	requestDetails["request.header"] = utils.SanitizeMessageValue(httpReq.Header)
-	requestDetails["request.protocol"] = utils.SanitizeMessageValue(httpReq.Proto)
-	requestDetails["request.contentlength"] = utils.SanitizeMessageValue(httpReq.ContentLength)
-	requestDetails["request.host"] = utils.SanitizeMessageValue(httpReq.Host)
-	requestDetails["request.uri"] = utils.SanitizeMessageValue(httpReq.RequestURI)
-	requestDetails["request.remoteaddr"] = utils.SanitizeMessageValue(httpReq.RemoteAddr)
-	requestDetails["config"] = utils.SanitizeMessageValue(configIn)
-	// get the host
-	hostID := ctx.GetString("x-host-id")
+func (d *DAL) InsertConfig(ctx context.Context, configIn models.ConfigIn, req interface{}) (ConfigWrite, error) {
+	requestDetails := d.requestDetails(req)
+	requestDetails["config"] = d.Redactor.Field("config", configIn)
 
 	// select database and collection ith Client.Database method
 	// and Database.Collection method
 	d.EmitMessage("config.audit", "InsertConfig", requestDetails)
 
+	return d.insertConfig(ctx, requestHost(ctx), configIn, 0, "InsertConfig")
+}
+
+// ConfigWrite the outcome of storing a config
+type ConfigWrite struct {
+	ConfigID string
+	// Version the config's version after the write
+	Version int32
+	// Checksum the content checksum of the config's payload
+	Checksum string
+	// Created set when the config didn't exist
+	Created bool
+	// Unchanged set when the config already had the content, so no version
+	// was stored
+	Unchanged bool
+}
+
+// insertConfig stores a config as its next version written by hostID. When
+// expectedVersion isn't 0 the config's current version must match it,
+// otherwise errVersionConflict is returned. A config that already has the payload,
+// parents and tags isn't written again. A write to a protected config is
+// stored as a change request and returns a *pendingChange. funcName labels
+// the change event
+func (d *DAL) insertConfig(ctx context.Context, hostID string, configIn models.ConfigIn, expectedVersion int32, funcName string) (ConfigWrite, error) {
+	for attempt := 1; ; attempt++ {
+		write, err := d.writeConfig(ctx, hostID, configIn, expectedVersion, funcName)
+
+		// a write that isn't based on a version is made again against the
+		// version another write stored first
+		if expectedVersion != 0 || attempt == maxWriteAttempts || !errors.Is(err, errVersionConflict) {
+			return write, err
+		}
+	}
+}
+
+// writeConfig makes one attempt at storing a config as its next version.
+// It returns errVersionConflict when another write changed the config first
+func (d *DAL) writeConfig(ctx context.Context, hostID string, configIn models.ConfigIn, expectedVersion int32, funcName string) (ConfigWrite, error) {
+	var write ConfigWrite
+
 	// TODO: Abstract this portion of code
 	// We want to support PostgreSQL in addition to MongoDB
 	configCollection := d.DocumentStore.Database(configDB).Collection(configCollection)
@@ -186,14 +288,21 @@ func (d *DAL) InsertConfig(ctx *gin.Context, configIn models.ConfigIn, req inter
 
 	sanitizedConfigName := utils.SanitizeMongoInput(configIn.ConfigName)
 
+	// a config that's added again without tags keeps its tags
+	var tags []string
+	if configIn.Tags != nil {
+		var err error
+		if tags, err = normalizeTags(configIn.Tags); err != nil {
+			return write, err
+		}
+	}
+
 	// the $where function is not support on the Atlas free tier
 	// https://www.mongodb.com/docs/atlas/reference/free-shared-limitations/?_ga=2.189348331.1715576176.1677375251-1973124898.1674435602
 	filter := bson.D{
 		{Key: "config_name", Value: fmt.Sprintf("%s", sanitizedConfigName)},
 	}
 
-	opts := options.Update().SetUpsert(true)
-
 	// see if there's an existing record
 	err := configCollection.FindOne(
 		ctx,
@@ -204,21 +313,22 @@ func (d *DAL) InsertConfig(ctx *gin.Context, configIn models.ConfigIn, req inter
 		// ErrNoDocuments means that the filter did not match any documents in
 		// the collection.
 		if err != mongo.ErrNoDocuments {
-			return "", upsertedRecord, fmt.Errorf("error accessing the collection: %s", err)
+			return write, fmt.Errorf("error accessing the collection: %s", err)
 		}
 	}
 
 	var configID string
 	var version int32
 	var created time.Time
-	var wg sync.WaitGroup
-	chConfigVersion := make(chan MongoQueryResult)
-	chConfig := make(chan MongoQueryResult)
+
+	// the config is written only while it's at the version that was read
+	versionFilter := bson.M{"version": bson.M{"$exists": false}}
 
 	if version = 1; result != nil {
 		checkVersion := result["version"]
 		if checkVersion != nil {
 			version = checkVersion.(int32) + 1
+			versionFilter = bson.M{"version": checkVersion}
 		}
 
 		checkConfigID := result["config_id"]
@@ -234,16 +344,49 @@ func (d *DAL) InsertConfig(ctx *gin.Context, configIn models.ConfigIn, req inter
 		}
 	}
 
+	// a patch is based on the version it read
+	if _, current := storedConfigPayload(result); expectedVersion != 0 && current != expectedVersion {
+		return write, fmt.Errorf("%w: expected version %d, found %d", errVersionConflict, expectedVersion, current)
+	}
+
+	sum, err := checksum.Of(configIn.Config)
+	if err != nil {
+		return write, err
+	}
+
+	if err := d.checkShareTags(hostID, result, tags); err != nil {
+		return write, err
+	}
+
+	if unchangedConfig(result, configIn, tags, sum) {
+		_, current := storedConfigPayload(result)
+		d.Logger.Infof("config %s is unchanged at version %d", configID, current)
+		return ConfigWrite{ConfigID: configID, Version: current, Checksum: sum, Unchanged: true}, nil
+	}
+
+	// a protected config is changed once another host approves the change
+	if isProtected(result) && !isApproved(ctx) {
+		request, err := d.requestChange(ctx, hostID, result, configIn, tags, sum, funcName)
+		if err != nil {
+			return write, err
+		}
+		return write, &pendingChange{request: request}
+	}
+
 	if configID == "" {
 		configID = uuid.NewString()
 	}
 
 	updated := time.Now()
-	checksum := sha256.Sum256([]byte(fmt.Sprintf("%s:%s+%s:%s", configIn.ConfigName, configIn.Owner, created.String(), updated.String())))
+
+	// a new config, or one stored without a creation time, is created now
+	if created.IsZero() {
+		created = updated
+	}
 
 	configVersionIn := bson.D{
 		{"config", configIn.Config},
-		{"checksum", fmt.Sprintf("%x", checksum)},
+		{"checksum", sum},
 	}
 
 	configAdd := bson.D{
@@ -258,298 +401,235 @@ func (d *DAL) InsertConfig(ctx *gin.Context, configIn models.ConfigIn, req inter
 		{"version", version},
 	}
 
-	wg.Add(2)
+	if tags != nil {
+		configAdd = append(configAdd, bson.E{"tags", tags})
+	}
 
-	go func() {
-		defer wg.Done()
-		// create a new configVersion
-		configVersion, err := configVersionCollection.InsertOne(ctx, configAdd)
+	// concurrent writes can't both store the next version, and a new config
+	// is created once. Adding a deleted config brings it back
+	configFilter := bson.D{{"$and", []interface{}{filter, versionFilter}}}
+	// the host that creates a config owns it. Later writers don't
+	updateDoc := bson.D{{"$set", configAdd}, {"$unset", deletedFields}, {"$setOnInsert", bson.D{{"owner_host", hostID}}}}
+	configResult, err := configCollection.UpdateOne(ctx, configFilter, updateDoc, options.Update().SetUpsert(result == nil))
+	if mongo.IsDuplicateKeyError(err) {
+		return write, fmt.Errorf("%w: the config was created by another write", errVersionConflict)
+	} else if err != nil {
+		d.Logger.Errorf("unable to insert config: %v", err)
+		return write, fmt.Errorf("unable to insert config: %s", err)
+	}
 
-		qr := MongoQueryResult{
-			Result: configVersion,
-			Error:  err,
-		}
+	if configResult.MatchedCount == 0 && configResult.UpsertedCount == 0 {
+		return write, fmt.Errorf("%w: the config changed while it was written", errVersionConflict)
+	}
 
-		chConfigVersion <- qr
-	}()
+	// the version is stored once the config was moved to it
+	if _, err := configVersionCollection.InsertOne(ctx, configAdd); err != nil {
+		d.Logger.Errorf("unable to insert configVersion: %v", err)
+		return write, fmt.Errorf("unable to ingest configVersion object: %s", err)
+	}
 
-	go func() {
-		defer wg.Done()
-		// UpdateOne accept two argument of type Context
-		// and of empty interface
-		updateDoc := bson.D{{"$set", configAdd}}
-		config, err := configCollection.UpdateOne(ctx, filter, updateDoc, opts)
-
-		qr := MongoQueryResult{
-			Result: config,
-			Error:  err,
+	d.Logger.Infof("inserted configVersion %s", configID)
+	d.Logger.Infof("inserted config object %s", configID)
+
+	oldConfig, oldVersion := storedConfigPayload(result)
+	d.EmitConfigChange(ConfigChange{
+		Old:        oldConfig,
+		New:        configIn.Config,
+		FuncName:   funcName,
+		ConfigID:   configID,
+		ConfigName: configIn.ConfigName,
+		Actor:      hostID,
+		Checksum:   sum,
+		OldVersion: oldVersion,
+		NewVersion: version,
+	})
+
+	write = ConfigWrite{
+		ConfigID: configID,
+		Version:  version,
+		Checksum: sum,
+		Created:  configResult.UpsertedCount != 0,
+	}
+
+	// drop every cached variant of an existing config. The next read
+	// caches the new version
+	if result != nil {
+		if err := d.invalidateConfig(result); err != nil {
+			d.Logger.Errorf("unable to invalidate the cache: %v", err)
 		}
+	}
 
-		chConfig <- qr
-	}()
+	return write, nil
+}
 
-	qrConfigVersion := <-chConfigVersion
+// unchangedConfig returns whether a write would store the payload, parents
+// and tags a config already has. A deleted config is brought back, so it's
+// always written
+func unchangedConfig(stored bson.M, configIn models.ConfigIn, tags []string, sum string) bool {
+	if stored == nil || stored["deleted"] != nil {
+		return false
+	}
 
-	if qrConfigVersion.Error != nil {
-		d.Logger.Errorf("unable to insert configVersion: %v", qrConfigVersion.Error)
-		return "", upsertedRecord, fmt.Errorf("unable to ingest configVersion object: %s", qrConfigVersion.Error)
+	var current models.ConfigResponse
+	if err := current.Ingest(stored); err != nil {
+		return false
 	}
 
-	qrConfig := <-chConfig
+	// configs stored before content checksums are hashed again
+	currentSum := string(current.Config.Checksum)
+	if !checksum.IsContent(currentSum) {
+		var err error
+		if currentSum, err = checksum.Of(current.Config.Config); err != nil {
+			return false
+		}
+	}
 
-	if qrConfig.Error != nil {
-		d.Logger.Errorf("unable to insert config: %v", qrConfig.Error)
-		return "", upsertedRecord, fmt.Errorf("unable to insert config: %s", qrConfig.Error)
+	if currentSum != sum || !equalStrings(current.Parents, configIn.Parents) {
+		return false
 	}
 
-	d.Logger.Infof("inserted configVersion %s", configID)
-	d.Logger.Infof("inserted config object %s", configID)
+	return tags == nil || equalStrings(current.Tags, tags)
+}
 
-	// write the configuration to the cache
-	configResult := qrConfig.Result.(*mongo.UpdateResult)
-	if configResult.UpsertedCount != 0 {
-		var cacheResponse bson.M
+// equalStrings returns whether two string slices have the same items in
+// the same order. nil and empty slices are equal
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
 
-		err = configCollection.FindOne(
-			ctx,
-			bson.D{{"_id", configResult.UpsertedID}},
-		).Decode(&cacheResponse)
-		err = d.writeToCache(configID, hostID, cacheResponse)
-		upsertedRecord = true
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
 	}
 
-	return configID, upsertedRecord, err
+	return true
 }
 
 // GetConfig returns a Config with the latest version of the ConfigVersion
-func (d *DAL) GetConfig(ctx *gin.Context, configID string, hostID string, req interface{}) (models.ConfigResponse, error) {
-	requestDetails := make(map[string]interface{})
-	var configResponse models.ConfigResponse
-
-	httpReq := req.(*http.Request)
-	requestDetails["request.method"] = utils.SanitizeMessageValue(httpReq.Method)
-	requestDetails["request.header"] = utils.SanitizeMessageValue(httpReq.Header)
-	requestDetails["request.protocol"] = utils.SanitizeMessageValue(httpReq.Proto)
-	requestDetails["request.contentlength"] = utils.SanitizeMessageValue(httpReq.ContentLength)
-	requestDetails["request.host"] = utils.SanitizeMessageValue(httpReq.Host)
-	requestDetails["request.uri"] = utils.SanitizeMessageValue(httpReq.RequestURI)
-	requestDetails["request.remoteaddr"] = utils.SanitizeMessageValue(httpReq.RemoteAddr)
+func (d *DAL) GetConfig(ctx context.Context, configID string, hostID string, req interface{}) (models.ConfigResponse, error) {
+	requestDetails := d.requestDetails(req)
 
 	// select database and collection ith Client.Database method
 	// and Database.Collection method
 	// check the cache first
 	d.EmitMessage("config.audit", "GetConfig", requestDetails)
 
-	// TODO: Abstract this portion of code
-	// We want to support PostgreSQL in addition to MongoDB
-	configCollection := d.DocumentStore.Database(configDB).Collection(configCollection)
+	return d.getConfig(ctx, configID, hostID)
+}
+
+// getConfig reads a config from the cache or the document store without
+// auditing the read
+func (d *DAL) getConfig(ctx context.Context, configID string, hostID string) (models.ConfigResponse, error) {
+	var configResponse models.ConfigResponse
+
 	cacheHit, cacheValue, err := d.readFromCache(configID, hostID)
 	if cacheHit {
 		configResponse.Ingest(cacheValue)
 		return configResponse, nil
-	} else if err != persistence.ErrCacheMiss {
-		return configResponse, err
+	} else if err != nil && !errors.Is(err, persistence.ErrCacheMiss) && !errors.Is(err, errCacheDisabled) {
+		// fall back to the document store when the cache is unavailable
+		d.Logger.Errorf("unable to read from the cache: %v", err)
 	}
 
-	var result bson.M
-	var metadataKey string
-	var metadataFilter bson.M
-	var queryFilter []bson.M
-
-	if primitive.IsValidObjectID(configID) {
-		metadataKey = "_id"
-		objID, err := primitive.ObjectIDFromHex(configID)
-
-		if err != nil {
-			return configResponse, fmt.Errorf("error setting objectid: %s, %s", configID, err)
-		}
-		metadataFilter = bson.M{"$eq": objID}
-		queryFilter = append(queryFilter, bson.M{metadataKey: metadataFilter})
-	} else {
-		metadataKey = "config_name"
-		metadataFilter = bson.M{"$eq": configID}
-		queryFilter = append(queryFilter, bson.M{metadataKey: metadataFilter})
-	}
-
-	if hostID != "" {
-		queryFilter = append(queryFilter, bson.M{"host": bson.M{"$eq": hostID}})
+	// concurrent misses for the same config share a single query
+	value, err, shared := d.flight.Do(getCacheKey(configID, hostID), func() (interface{}, error) {
+		return d.findConfig(ctx, configID, hostID)
+	})
+	if shared {
+		d.cacheStats.Coalesced()
 	}
 
-	d.Logger.Debugf("config search filter: %v", bson.D{{"$and", queryFilter}})
-
-	err = configCollection.FindOne(
-		ctx,
-		bson.D{{"$and", queryFilter}},
-	).Decode(&result)
-
 	if err != nil {
-		// ErrNoDocuments means that the filter did not match any documents in
-		// the collection.
-		if err == mongo.ErrNoDocuments {
-			return configResponse, fmt.Errorf("the config document does not exist: %s", err)
+		// serve the last known good copy while the document store is down
+		if errors.Is(err, errDocumentStoreUnavailable) {
+			if stale, ok := d.readStale(configID, hostID); ok {
+				configResponse.Ingest(stale)
+				configResponse.Stale = true
+				return configResponse, nil
+			}
 		}
 
-		return configResponse, fmt.Errorf("error accessing the config document: %s", err)
+		return configResponse, err
 	}
 
 	// TODO fix the response. The config version is empty
-	configResponse.Ingest(result)
-
-	err = d.writeToCache(configID, hostID, result)
+	configResponse.Ingest(value.(bson.M))
 
-	return configResponse, err
+	return configResponse, nil
 }
 
-// GetConfigs returns a paginated slice of Configs from the document store
-func (d *DAL) GetConfigs(ctx *gin.Context, offset string, limit string, req interface{}) ([]models.ConfigStore, error) {
-	requestDetails := make(map[string]interface{})
-
-	httpReq := req.(*http.Request)
-	requestDetails["limit"] = limit
-	requestDetails["offset"] = offset
-	requestDetails["request.method"] = utils.SanitizeMessageValue(httpReq.Method)
-	requestDetails["request.header"] = utils.SanitizeMessageValue(httpReq.Header)
-	requestDetails["request.protocol"] = utils.SanitizeMessageValue(httpReq.Proto)
-	requestDetails["request.contentlength"] = utils.SanitizeMessageValue(httpReq.ContentLength)
-	requestDetails["request.host"] = utils.SanitizeMessageValue(httpReq.Host)
-	requestDetails["request.uri"] = utils.SanitizeMessageValue(httpReq.RequestURI)
-	requestDetails["request.remoteaddr"] = utils.SanitizeMessageValue(httpReq.RemoteAddr)
-
-	d.EmitMessage("config.audit", "GetConfigs", requestDetails)
-
-	configCollection := d.DocumentStore.Database(configDB).Collection(configCollection)
-
-	if limit == "" {
-		limit = "100"
+// findConfig retrieves a config from the document store and writes it to the cache
+func (d *DAL) findConfig(ctx context.Context, configID string, hostID string) (bson.M, error) {
+	if err := d.DocBreaker.Allow(); err != nil {
+		return nil, fmt.Errorf("%w: %s", errDocumentStoreUnavailable, err)
 	}
 
-	if offset == "" {
-		offset = "0"
-	}
-
-	intLimit, err := strconv.ParseInt(limit, 10, 64)
-	if err != nil {
-		return nil, fmt.Errorf("error parsing the limit: %s", err)
-	}
-	intOffset, err := strconv.ParseInt(offset, 10, 64)
-	if err != nil {
-		return nil, fmt.Errorf("error parsing the offset: %s", err)
-	}
-
-	if intLimit > 100 {
-		intLimit = 100
-	}
-
-	findOptions := options.Find()
-	findOptions.SetLimit(intLimit)
-	findOptions.SetSkip(intOffset)
-	findOptions.SetProjection(bson.D{{"config_version", 0}})
-	var results []models.ConfigStore
-
 	// TODO: Abstract this portion of code
 	// We want to support PostgreSQL in addition to MongoDB
-	// see if there's an existing record
-	cursor, err := configCollection.Find(
-		ctx,
-		bson.D{{}},
-	)
+	configCollection := d.DocumentStore.Database(configDB).Collection(configCollection)
 
-	if err != nil {
-		// ErrNoDocuments means that the filter did not match any documents in
-		// the collection.
-		return nil, fmt.Errorf("error accessing the documents: %s", err)
-	}
+	var result bson.M
 
-	if err = cursor.All(ctx, &results); err != nil {
-		return nil, fmt.Errorf("error accessing the cursor: %s", err)
+	idFilter, err := configIDFilter(configID)
+	if err != nil {
+		d.DocBreaker.Release()
+		return nil, err
 	}
 
-	return results, nil
-}
+	// deleted configs are hidden until they're restored
+	queryFilter := []bson.M{idFilter, notDeletedFilter}
 
-// UpdateConfigByID Updates a configuration by the ID
-func (d *DAL) UpdateConfigByID(ctx *gin.Context, configID string, updateConfigIn models.UpdateConfigIn, req interface{}) (interface{}, error) {
-	requestDetails := make(map[string]interface{})
-
-	httpReq := req.(*http.Request)
-	requestDetails["request.method"] = utils.SanitizeMessageValue(httpReq.Method)
-	requestDetails["request.header"] = utils.SanitizeMessageValue(httpReq.Header)
-	requestDetails["request.protocol"] = utils.SanitizeMessageValue(httpReq.Proto)
-	requestDetails["request.contentlength"] = utils.SanitizeMessageValue(httpReq.ContentLength)
-	requestDetails["request.host"] = utils.SanitizeMessageValue(httpReq.Host)
-	requestDetails["request.uri"] = utils.SanitizeMessageValue(httpReq.RequestURI)
-	requestDetails["request.remoteaddr"] = utils.SanitizeMessageValue(httpReq.RemoteAddr)
-	requestDetails["updateConfig"] = utils.SanitizeMessageValue(updateConfigIn)
+	if hostID != "" {
+		queryFilter = append(queryFilter, bson.M{"host": bson.M{"$eq": hostID}})
+	}
 
-	// select database and collection ith Client.Database method
-	// and Database.Collection method
-	d.EmitMessage("config.audit", "UpdateConfigByID", requestDetails)
-	configCollection := d.DocumentStore.Database(configDB).Collection(configCollection)
-	configVersionCollection := d.DocumentStore.Database(configDB).Collection(configVersionCollectionlection)
+	d.Logger.Debugf("config search filter: %v", bson.D{{"$and", queryFilter}})
 
-	var existingConfig bson.M
+	// the generation is read first, so a config that's invalidated while
+	// it's read isn't cached at the old version
+	generation, genErr := d.cacheGeneration(configID)
 
-	sanitizedConfigID := utils.SanitizeMongoInput(configID)
-	filter := bson.D{
-		{Key: "_id", Value: sanitizedConfigID},
-	}
-	// see if there's an existing record
-	err := configCollection.FindOne(
+	err = configCollection.FindOne(
 		ctx,
-		filter,
-	).Decode(&existingConfig)
+		bson.D{{"$and", queryFilter}},
+	).Decode(&result)
 
-	if err == mongo.ErrNoDocuments {
+	if err != nil {
 		// ErrNoDocuments means that the filter did not match any documents in
 		// the collection.
-		return nil, fmt.Errorf("the document does not exist: %s", err)
-	} else if err != nil {
-		return nil, fmt.Errorf("error accessing the document: %s", err)
-	}
-
-	created := time.Now()
-	updated := time.Now()
-	checksum := sha256.Sum256([]byte(fmt.Sprintf("%s:%s+%s:%s", updateConfigIn.ConfigName, updateConfigIn.Requester, created.String(), updated.String())))
-
-	configVersionIn := bson.D{
-		{"config", updateConfigIn.Config},
-		{"config_name", updateConfigIn.ConfigName},
-		{"checksum", checksum},
-		{"created_by", updateConfigIn.Requester},
-		{"created", created},
-	}
-	// create a new configVersion
-	configVersion, err := configVersionCollection.InsertOne(ctx, configVersionIn)
-	if err != nil {
-		d.Logger.Errorf("unable to insert config_version: %v", err)
-		return nil, fmt.Errorf("unable to ingest config_version object: %s", err)
-	}
-
-	d.Logger.Infof("Inserted config_version %v", configVersion.InsertedID)
+		if err == mongo.ErrNoDocuments {
+			d.DocBreaker.Success()
+			return nil, fmt.Errorf("%w: %s", errConfigNotFound, err)
+		}
 
-	mapFilter := bson.M{"_id": sanitizedConfigID}
+		// a cancelled request says nothing about the document store
+		if ctx.Err() != nil {
+			d.DocBreaker.Release()
+			return nil, fmt.Errorf("error accessing the config document: %s", err)
+		}
 
-	// 6) Create the update
-	update := bson.M{
-		"$set": bson.M{"config_version": configVersion.InsertedID},
+		d.DocBreaker.Failure()
+		return nil, fmt.Errorf("%w: error accessing the config document: %s", errDocumentStoreUnavailable, err)
 	}
+	d.DocBreaker.Success()
 
-	upsert := false
-	after := options.After
-	opt := options.FindOneAndUpdateOptions{
-		ReturnDocument: &after,
-		Upsert:         &upsert,
+	if genErr != nil {
+		d.Logger.Errorf("unable to read the cache generation: %v", genErr)
+	} else if err := d.writeToCacheAt(configID, hostID, result, generation); err != nil && !errors.Is(err, errCacheDisabled) {
+		d.Logger.Errorf("unable to write to the cache: %v", err)
 	}
-	// FindOneAndUpdate accept two argument of type Context
-	// and of empty interface
-	configResp := configCollection.FindOneAndUpdate(ctx, mapFilter, update, &opt)
 
-	d.Logger.Infof("updated config object %s", configResp)
-	return configResp, nil
+	return result, nil
 }
 
 // EmitMessage emits a message for the service. Currently only manages AuditEvents
 func (d *DAL) EmitMessage(messageType, funcName string, body map[string]interface{}) {
+	if d.onMessage != nil {
+		d.onMessage(messageType, funcName, body)
+	}
+
 	go func() {
 		if d.Producer != nil {
 			gob.Register(pb.AuditLog{})
@@ -567,43 +647,41 @@ func (d *DAL) EmitMessage(messageType, funcName string, body map[string]interfac
 				Service:     serviceName,
 			}
 
-			// Write the new address book back to disk.
-			out, err := proto.Marshal(event)
+			d.produce(messageType, event)
+		}
+	}()
+}
 
-			if err != nil {
-				d.Logger.Errorf("error encoding message: %s", err)
-				return
-			}
+// produce encodes a protobuf message and sends it to a Kafka topic
+func (d *DAL) produce(topic string, event proto.Message) {
+	out, err := proto.Marshal(event)
 
-			//eventValue, _ := event.ToByteSlice()
-			deliveryChan := make(chan kafka.Event, 10000)
-			err = d.Producer.Produce(&kafka.Message{
-				TopicPartition: kafka.TopicPartition{Topic: &messageType, Partition: kafka.PartitionAny},
-				Value:          out},
-				deliveryChan,
-			)
+	if err != nil {
+		d.Logger.Errorf("error encoding message: %s", err)
+		return
+	}
 
-			if err != nil {
-				d.Logger.Errorf("unable to emit event: %s", err)
-			}
-		}
-	}()
+	deliveryChan := make(chan kafka.Event, 10000)
+	err = d.Producer.Produce(&kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
+		Value:          out},
+		deliveryChan,
+	)
+
+	if err != nil {
+		d.Logger.Errorf("unable to emit event: %s", err)
+	}
 }
 
+// errInvalidAuditQuery returned when the limit or offset of an audit log
+// query isn't a number
+var errInvalidAuditQuery = newDALError(kindValidation, "invalid_query", "invalid audit log query")
+
 // GetAuditLogs returns a pagination list of audit logs
 func (d *DAL) GetAuditLogs(ctx *gin.Context, offset string, limit string, req interface{}) ([]pb.AuditLog, error) {
-	requestDetails := make(map[string]interface{})
-
-	httpReq := req.(*http.Request)
+	requestDetails := d.requestDetails(req)
 	requestDetails["limit"] = limit
 	requestDetails["offset"] = offset
-	requestDetails["request.method"] = utils.SanitizeMessageValue(httpReq.Method)
-	requestDetails["request.header"] = utils.SanitizeMessageValue(httpReq.Header)
-	requestDetails["request.protocol"] = utils.SanitizeMessageValue(httpReq.Proto)
-	requestDetails["request.contentlength"] = utils.SanitizeMessageValue(httpReq.ContentLength)
-	requestDetails["request.host"] = utils.SanitizeMessageValue(httpReq.Host)
-	requestDetails["request.uri"] = utils.SanitizeMessageValue(httpReq.RequestURI)
-	requestDetails["request.remoteaddr"] = utils.SanitizeMessageValue(httpReq.RemoteAddr)
 
 	d.EmitMessage("config.audit", "GetAuditLogs", requestDetails)
 
@@ -617,11 +695,11 @@ func (d *DAL) GetAuditLogs(ctx *gin.Context, offset string, limit string, req in
 
 	intLimit, err := strconv.ParseInt(limit, 10, 64)
 	if err != nil {
-		return nil, fmt.Errorf("error parsing the limit: %s", err)
+		return nil, fmt.Errorf("%w: limit must be a number", errInvalidAuditQuery)
 	}
 	intOffset, err := strconv.ParseInt(offset, 10, 64)
 	if err != nil {
-		return nil, fmt.Errorf("error parsing the offset: %s", err)
+		return nil, fmt.Errorf("%w: offset must be a number", errInvalidAuditQuery)
 	}
 
 	if intLimit > 100 {
@@ -666,84 +744,3 @@ func ValidateToken(dal *DAL, hostID string, token string) (string, bool, error)
 
 	return "", false, fmt.Errorf("unable to retrieve host key: %s", err)
 }
-
-// readFromCache reads a configuration from the cache
-// response: cachehit, body, err
-func (d *DAL) readFromCache(configID, hostID string) (bool, bson.M, error) {
-	var cacheValue bson.M
-	var respEnc string
-	cacheHit := false
-
-	// if the cache is not enabled. Skip all of this.
-	if !d.CacheEnabled {
-		// TODO: this should not be an error
-		return cacheHit, cacheValue, fmt.Errorf("the cache is not enabled")
-	}
-
-	cacheKey := getCacheKey(configID, hostID)
-	err := d.Cache.Get(cacheKey, &respEnc)
-
-	if err == persistence.ErrCacheMiss {
-		d.Logger.Errorf("cache miss: %v", err)
-		return cacheHit, cacheValue, fmt.Errorf("cache miss: %v", err)
-	} else if err != nil {
-		d.Logger.Errorf("unable to retrieve config: %v", err)
-		return cacheHit, cacheValue, fmt.Errorf("unable to retrieve config: %v", err)
-	}
-
-	bsonBin, err := b64.StdEncoding.DecodeString(respEnc)
-	if err != nil {
-		d.Logger.Errorf("error decoding string: %v", err)
-		return cacheHit, cacheValue, fmt.Errorf("error decoding string: %v", err)
-	}
-	err = bson.Unmarshal(bsonBin, &cacheValue)
-	if err != nil {
-		d.Logger.Errorf("unable to unmarshal: %v", err)
-		return cacheHit, cacheValue, fmt.Errorf("unable to unmarshal: %v", err)
-	}
-
-	cacheHit = true
-
-	logLine := utils.SanitizeLogMessageF("cache hit for %s", cacheKey)
-	d.Logger.Info(logLine)
-	return cacheHit, cacheValue, nil
-}
-
-// writeToCache writes a configuration to the cache
-func (d *DAL) writeToCache(configID, hostID string, result bson.M) error {
-	if configID == "" {
-		d.Logger.Errorf("can not set cache for empty config ID")
-		return fmt.Errorf("can not set cache for empty config ID")
-	}
-
-	// set the cache key
-	cacheKey := getCacheKey(configID, hostID)
-
-	logLine := utils.SanitizeLogMessage("setting cache for %s", cacheKey)
-	d.Logger.Infof(logLine)
-	bsonBin, err := bson.Marshal(result)
-	if err != nil {
-		d.Logger.Errorf("error writing to cache: %v", err)
-		return fmt.Errorf("error writing to the cache %s", err)
-	}
-	cacheEnc := b64.StdEncoding.EncodeToString(bsonBin)
-	err = d.Cache.Set(cacheKey, cacheEnc, time.Hour)
-	if err != nil {
-		d.Logger.Errorf("error writing to cache: %v", err)
-		return fmt.Errorf("error writing to the cache %s", err)
-	}
-
-	return nil
-}
-
-// getCacheKey standardize the cache key for configs
-func getCacheKey(configID, hostID string) string {
-	var hostPrefix string
-
-	if hostID != "" {
-		hostPrefix = fmt.Sprintf("_%s", hostID)
-	}
-
-	// return the cache key
-	return fmt.Sprintf("config_%s%s", configID, hostPrefix)
-}
@@ -0,0 +1,500 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/aeekayy/stilla/service/pkg/api/models"
+	"github.com/aeekayy/stilla/service/pkg/bundle"
+	"github.com/aeekayy/stilla/service/pkg/checksum"
+)
+
+const (
+	// ImportSkip leaves existing configs as they are
+	ImportSkip = "skip"
+	// ImportOverwrite replaces existing configs and their version history
+	ImportOverwrite = "overwrite"
+	// ImportNewVersion adds the imported config as a new version
+	ImportNewVersion = "new-version"
+
+	importCreated     = "created"
+	importSkipped     = "skipped"
+	importOverwritten = "overwritten"
+	importNewVersion  = "new_version"
+	importPending     = "pending"
+	importFailed      = "failed"
+)
+
+// errInvalidImport returned when an import can't be started
+var errInvalidImport = newDALError(kindValidation, "invalid_import", "invalid import")
+
+// ExportConfigs writes the configs that match the query to a bundle, sorted
+// by name. Nothing is written to w if the configs can't be read. It returns
+// the number of configs written
+func (d *DAL) ExportConfigs(ctx *gin.Context, query models.ConfigListQuery, history bool, format bundle.Format, w io.Writer, req interface{}) (int, error) {
+	requestDetails := d.requestDetails(req)
+	requestDetails["query"] = d.Redactor.Field("query", query)
+	requestDetails["history"] = history
+	requestDetails["format"] = string(format)
+
+	d.EmitMessage("config.audit", "ExportConfigs", requestDetails)
+
+	filter, err := configListFilter(query)
+	if err != nil {
+		return 0, err
+	}
+
+	configCollection := d.DocumentStore.Database(configDB).Collection(configCollection)
+
+	findOptions := options.Find().SetSort(bson.D{{"config_name", 1}, {"_id", 1}})
+	cursor, err := configCollection.Find(ctx, filter, findOptions)
+	if err != nil {
+		return 0, fmt.Errorf("error accessing the documents: %s", err)
+	}
+	defer cursor.Close(ctx)
+
+	bw, err := bundle.NewWriter(format, w, bundle.Header{Exported: time.Now().UTC(), History: history})
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for cursor.Next(ctx) {
+		var doc bson.M
+		if err := cursor.Decode(&doc); err != nil {
+			return count, fmt.Errorf("error decoding the config: %s", err)
+		}
+
+		config, err := exportConfig(doc)
+		if err != nil {
+			return count, err
+		}
+
+		if history {
+			if config.Versions, err = d.exportVersions(ctx, doc); err != nil {
+				return count, err
+			}
+		}
+
+		if err := bw.Write(config); err != nil {
+			return count, fmt.Errorf("error writing the bundle: %s", err)
+		}
+		count++
+	}
+
+	if err := cursor.Err(); err != nil {
+		return count, fmt.Errorf("error accessing the cursor: %s", err)
+	}
+
+	return count, bw.Close()
+}
+
+// exportVersions returns the version history of a config, oldest first
+func (d *DAL) exportVersions(ctx *gin.Context, config bson.M) ([]bundle.Version, error) {
+	stored, err := d.configVersions(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make([]bundle.Version, 0, len(stored))
+	for _, v := range stored {
+		versions = append(versions, bundle.Version{
+			Version:  v.Version,
+			Owner:    v.CreatedBy,
+			Host:     v.Host,
+			Checksum: string(v.Config.Checksum),
+			Created:  v.Created,
+			Modified: v.Modified,
+			Config:   v.Config.Config,
+		})
+	}
+
+	return versions, nil
+}
+
+// ImportConfigs imports the configs of a bundle one at a time. A config that
+// fails is reported and the import carries on
+func (d *DAL) ImportConfigs(ctx *gin.Context, configs []bundle.Config, onConflict string, dryRun bool, req interface{}) (models.ImportReport, error) {
+	report := models.ImportReport{
+		DryRun:     dryRun,
+		OnConflict: onConflict,
+		Results:    make([]models.ImportResult, 0, len(configs)),
+		Summary:    make(map[string]int),
+	}
+
+	requestDetails := d.requestDetails(req)
+	requestDetails["configs"] = len(configs)
+	requestDetails["on_conflict"] = onConflict
+	requestDetails["dry_run"] = dryRun
+
+	d.EmitMessage("config.audit", "ImportConfigs", requestDetails)
+
+	if _, err := importAction(false, onConflict); err != nil {
+		return report, err
+	}
+
+	seen := make(map[string]bool, len(configs))
+	for _, config := range configs {
+		var result models.ImportResult
+		if seen[config.ConfigName] {
+			result = models.ImportResult{ConfigName: config.ConfigName, Action: importFailed, Error: "the config appears more than once in the bundle"}
+		} else {
+			result = d.importConfig(ctx, config, onConflict, dryRun, req)
+		}
+		seen[config.ConfigName] = true
+
+		report.Results = append(report.Results, result)
+		report.Summary[result.Action]++
+	}
+
+	d.Logger.Infof("imported %d configs: %v", len(configs), report.Summary)
+	return report, nil
+}
+
+// importConfig imports a single config
+func (d *DAL) importConfig(ctx *gin.Context, config bundle.Config, onConflict string, dryRun bool, req interface{}) models.ImportResult {
+	result := models.ImportResult{ConfigName: config.ConfigName}
+	fail := func(err error) models.ImportResult {
+		result.Action = importFailed
+		result.Error = err.Error()
+		return result
+	}
+
+	if config.Tags != nil {
+		tags, err := normalizeTags(config.Tags)
+		if err != nil {
+			return fail(err)
+		}
+		config.Tags = tags
+	}
+
+	config, err := contentChecksums(config)
+	if err != nil {
+		return fail(err)
+	}
+
+	configCollection := d.DocumentStore.Database(configDB).Collection(configCollection)
+
+	// deleted configs count as existing. Overwriting or adding a version
+	// brings them back
+	var existing bson.M
+	err = configCollection.FindOne(ctx, bson.M{"config_name": bson.M{"$eq": config.ConfigName}}).Decode(&existing)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return fail(fmt.Errorf("error accessing the collection: %s", err))
+	}
+
+	result.Action, _ = importAction(existing != nil, onConflict)
+	_, existingVersion := storedConfigPayload(existing)
+
+	switch result.Action {
+	case importSkipped:
+		result.Version = existingVersion
+		return result
+	case importNewVersion:
+		result.Version = existingVersion + 1
+		if dryRun {
+			return result
+		}
+
+		configIn := models.ConfigIn{
+			ConfigName: config.ConfigName,
+			Owner:      config.Owner,
+			Config:     config.Config,
+			Parents:    config.Parents,
+			Tags:       config.Tags,
+		}
+		write, err := d.InsertConfig(ctx, configIn, req)
+		// a protected config gets the version once the change request is
+		// approved
+		var pending *pendingChange
+		if errors.As(err, &pending) {
+			result.Action = importPending
+			result.Version = 0
+			result.ChangeRequestID = pending.request.ID.Hex()
+			return result
+		} else if err != nil {
+			return fail(err)
+		}
+		// a config that already has the bundle's content keeps its version
+		if write.Unchanged {
+			result.Action = importSkipped
+		}
+		result.Version = write.Version
+		return result
+	}
+
+	// overwriting replaces the history, so it can't wait for approval
+	if isProtected(existing) {
+		return fail(errConfigProtected)
+	}
+
+	current, versions, err := importVersions(config)
+	if err != nil {
+		return fail(err)
+	}
+	result.Version = current.Version
+	if dryRun {
+		return result
+	}
+
+	if err := d.writeImportedConfig(ctx, config, current, versions, existing); err != nil {
+		return fail(err)
+	}
+
+	return result
+}
+
+// writeImportedConfig stores an imported config and its versions. An
+// existing config keeps its document and config IDs, but its version
+// history is replaced. The new versions are written first and the old ones
+// are only deleted once the config was replaced, so a failed import never
+// leaves a config without its history
+func (d *DAL) writeImportedConfig(ctx *gin.Context, config bundle.Config, current bundle.Version, versions []bundle.Version, existing bson.M) error {
+	configCollection := d.DocumentStore.Database(configDB).Collection(configCollection)
+	configVersionCollection := d.DocumentStore.Database(configDB).Collection(configVersionCollectionlection)
+
+	hostID := ctx.GetString("x-host-id")
+	if config.Host == "" {
+		config.Host = hostID
+	}
+
+	configID := uuid.NewString()
+	if id, ok := existing["config_id"].(string); ok && id != "" {
+		configID = id
+	}
+
+	doc := importedDocument(config, configID, current)
+
+	// the importing host owns a new config. An overwrite keeps the owner
+	ownerHost := hostID
+	if existing != nil {
+		ownerHost, _ = existing["owner_host"].(string)
+	}
+	if ownerHost != "" {
+		doc = append(doc, bson.E{"owner_host", ownerHost})
+	}
+
+	versionIDs := make([]primitive.ObjectID, 0, len(versions))
+	versionDocs := make([]interface{}, 0, len(versions))
+	for _, version := range versions {
+		id := primitive.NewObjectID()
+		versionIDs = append(versionIDs, id)
+		versionDocs = append(versionDocs, append(bson.D{{"_id", id}}, importedDocument(config, configID, version)...))
+	}
+	if _, err := configVersionCollection.InsertMany(ctx, versionDocs); err != nil {
+		return fmt.Errorf("unable to insert the config versions: %s", err)
+	}
+
+	// the versions that were written are removed again when the config
+	// can't be stored
+	discard := func() {
+		if _, err := configVersionCollection.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": versionIDs}}); err != nil {
+			d.Logger.Errorf("unable to remove the versions of a failed import of %s: %v", config.ConfigName, err)
+		}
+	}
+
+	if existing == nil {
+		if _, err := configCollection.InsertOne(ctx, doc); err != nil {
+			discard()
+			return fmt.Errorf("unable to insert config: %s", err)
+		}
+	} else {
+		// replacing the document also clears a tombstone
+		if _, err := configCollection.ReplaceOne(ctx, bson.M{"_id": existing["_id"]}, doc); err != nil {
+			discard()
+			return fmt.Errorf("unable to replace config: %s", err)
+		}
+
+		if err := d.invalidateConfig(existing); err != nil {
+			d.Logger.Errorf("unable to invalidate the cache: %v", err)
+		}
+
+		if filter := configVersionsFilter(existing); filter != nil {
+			oldVersions := bson.D{{"$and", []bson.M{filter, {"_id": bson.M{"$nin": versionIDs}}}}}
+			if _, err := configVersionCollection.DeleteMany(ctx, oldVersions); err != nil {
+				return fmt.Errorf("the config was replaced, but its old versions were kept: %s", err)
+			}
+		}
+	}
+
+	oldConfig, oldVersion := storedConfigPayload(existing)
+	d.EmitConfigChange(ConfigChange{
+		Old:        oldConfig,
+		New:        current.Config,
+		FuncName:   "ImportConfigs",
+		ConfigID:   configID,
+		ConfigName: config.ConfigName,
+		Actor:      hostID,
+		Checksum:   current.Checksum,
+		OldVersion: oldVersion,
+		NewVersion: current.Version,
+	})
+
+	return nil
+}
+
+// exportConfig converts a stored config into its bundle form
+func exportConfig(doc bson.M) (bundle.Config, error) {
+	var stored models.ConfigResponse
+	if err := stored.Ingest(doc); err != nil {
+		return bundle.Config{}, fmt.Errorf("error decoding the config: %s", err)
+	}
+
+	return bundle.Config{
+		ConfigName: stored.ConfigName,
+		ConfigID:   stored.ConfigID,
+		Owner:      stored.CreatedBy,
+		Host:       stored.Host,
+		Parents:    stored.Parents,
+		Tags:       stored.Tags,
+		Version:    stored.Version,
+		Checksum:   string(stored.Config.Checksum),
+		Created:    stored.Created,
+		Modified:   stored.Modified,
+		Config:     stored.Config.Config,
+	}, nil
+}
+
+// contentChecksums verifies the content checksums of an imported config
+// and its versions, and sets the checksums that are missing or were made
+// before content checksums
+func contentChecksums(config bundle.Config) (bundle.Config, error) {
+	sum := func(payload map[string]interface{}, stored string, version int32) (string, error) {
+		if checksum.IsContent(stored) {
+			if err := checksum.Verify(payload, stored); err != nil {
+				return "", fmt.Errorf("%w: version %d: %w", errInvalidImport, version, err)
+			}
+			return stored, nil
+		}
+
+		return checksum.Of(payload)
+	}
+
+	var err error
+	if config.Checksum, err = sum(config.Config, config.Checksum, config.Version); err != nil {
+		return config, err
+	}
+
+	versions := make([]bundle.Version, len(config.Versions))
+	for i, version := range config.Versions {
+		if version.Checksum, err = sum(version.Config, version.Checksum, version.Version); err != nil {
+			return config, err
+		}
+		versions[i] = version
+	}
+	if config.Versions != nil {
+		config.Versions = versions
+	}
+
+	return config, nil
+}
+
+// importAction returns what an import does with a config
+func importAction(exists bool, onConflict string) (string, error) {
+	switch onConflict {
+	case ImportSkip, ImportOverwrite, ImportNewVersion:
+	default:
+		return "", fmt.Errorf("%w: on_conflict must be %s, %s or %s", errInvalidImport, ImportSkip, ImportOverwrite, ImportNewVersion)
+	}
+
+	if !exists {
+		return importCreated, nil
+	}
+
+	switch onConflict {
+	case ImportOverwrite:
+		return importOverwritten, nil
+	case ImportNewVersion:
+		return importNewVersion, nil
+	}
+
+	return importSkipped, nil
+}
+
+// importVersions returns the current version of an imported config and the
+// versions to store, oldest first. A config without history is stored as a
+// single version. A history must include the current version
+func importVersions(config bundle.Config) (bundle.Version, []bundle.Version, error) {
+	version := config.Version
+	if version < 1 {
+		version = 1
+	}
+
+	current := bundle.Version{
+		Version:  version,
+		Owner:    config.Owner,
+		Host:     config.Host,
+		Checksum: config.Checksum,
+		Created:  config.Created,
+		Modified: config.Modified,
+		Config:   config.Config,
+	}
+
+	if len(config.Versions) == 0 {
+		return current, []bundle.Version{current}, nil
+	}
+
+	for _, v := range config.Versions {
+		if v.Version == current.Version {
+			return current, config.Versions, nil
+		}
+	}
+
+	return current, nil, fmt.Errorf("%w: version %d is missing from the versions of %s", errInvalidImport, current.Version, config.ConfigName)
+}
+
+// importedDocument builds a stored config document in the shape that
+// InsertConfig writes
+func importedDocument(config bundle.Config, configID string, version bundle.Version) bson.D {
+	now := time.Now()
+
+	owner := version.Owner
+	if owner == "" {
+		owner = config.Owner
+	}
+
+	host := version.Host
+	if host == "" {
+		host = config.Host
+	}
+
+	created := version.Created
+	if created.IsZero() {
+		created = now
+	}
+
+	modified := version.Modified
+	if modified.IsZero() {
+		modified = now
+	}
+
+	doc := bson.D{
+		{"config_name", config.ConfigName},
+		{"created_by", owner},
+		{"config", bson.D{
+			{"config", version.Config},
+			{"checksum", version.Checksum},
+		}},
+		{"config_id", configID},
+		{"host", host},
+		{"parents", config.Parents},
+		{"created", created},
+		{"modified", modified},
+		{"version", version.Version},
+	}
+
+	if config.Tags != nil {
+		doc = append(doc, bson.E{"tags", config.Tags})
+	}
+
+	return doc
+}
@@ -0,0 +1,354 @@
+package api
+
+import (
+	b64 "encoding/base64"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gin-contrib/cache/persistence"
+	cacheutils "github.com/gin-contrib/cache/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/aeekayy/stilla/service/pkg/breaker"
+	"github.com/aeekayy/stilla/service/pkg/cache"
+)
+
+// errCacheDisabled returned by the cache functions when the cache is turned off
+var errCacheDisabled = errors.New("the cache is not enabled")
+
+// errDocumentStoreUnavailable returned when the document store fails or its
+// circuit breaker is open. Reads fall back to the stale copy
+var errDocumentStoreUnavailable = newDALError(kindUnavailable, "document_store_unavailable", "the document store is unavailable")
+
+// readFromCache reads a configuration from the cache. The in-process cache
+// is checked before Redis. Redis hits are copied to the in-process cache.
+// response: cachehit, body, err
+func (d *DAL) readFromCache(configID, hostID string) (bool, bson.M, error) {
+	var cacheValue bson.M
+	cacheHit := false
+
+	// if the cache is not enabled. Skip all of this.
+	if !d.CacheEnabled {
+		return cacheHit, cacheValue, errCacheDisabled
+	}
+
+	cacheKey := getCacheKey(configID, hostID)
+
+	if d.LocalCache != nil {
+		if v, ok := d.LocalCache.Get(cacheKey); ok {
+			d.cacheStats.LocalHit()
+			return true, v.(bson.M), nil
+		}
+	}
+
+	cacheValue, err := d.getFromRedis(cacheKey)
+	if err != nil {
+		d.cacheStats.Miss()
+		return cacheHit, cacheValue, err
+	}
+
+	cacheHit = true
+	d.cacheStats.RedisHit()
+
+	if d.LocalCache != nil {
+		d.LocalCache.Set(cacheKey, cacheValue)
+	}
+
+	logLine := d.Redactor.Sprintf("cache hit for %s", cacheKey)
+	d.Logger.Info(logLine)
+	return cacheHit, cacheValue, nil
+}
+
+// readStale reads the last known good copy of a configuration. It's used
+// when the document store is unavailable
+func (d *DAL) readStale(configID, hostID string) (bson.M, bool) {
+	if !d.CacheEnabled || !d.StaleEnabled {
+		return nil, false
+	}
+
+	staleKey := getStaleCacheKey(configID, hostID)
+	cacheValue, err := d.getFromRedis(staleKey)
+	if err != nil {
+		return nil, false
+	}
+
+	d.cacheStats.StaleHit()
+	logLine := d.Redactor.Sprintf("serving stale copy %s", staleKey)
+	d.Logger.Warn(logLine)
+	return cacheValue, true
+}
+
+// getFromRedis reads and decodes a cache entry from Redis. Reads fail fast
+// while the Redis circuit breaker is open
+func (d *DAL) getFromRedis(cacheKey string) (bson.M, error) {
+	var cacheValue bson.M
+	var respEnc string
+
+	if err := d.CacheBreaker.Allow(); err != nil {
+		return cacheValue, fmt.Errorf("redis is unavailable: %w", err)
+	}
+
+	err := d.Cache.Get(cacheKey, &respEnc)
+
+	if err == persistence.ErrCacheMiss {
+		d.CacheBreaker.Success()
+		d.Logger.Debugf("cache miss: %v", err)
+		return cacheValue, fmt.Errorf("cache miss: %w", err)
+	} else if err != nil {
+		d.CacheBreaker.Failure()
+		d.Logger.Errorf("unable to retrieve config: %v", err)
+		return cacheValue, fmt.Errorf("unable to retrieve config: %v", err)
+	}
+	d.CacheBreaker.Success()
+
+	bsonBin, err := b64.StdEncoding.DecodeString(respEnc)
+	if err != nil {
+		d.Logger.Errorf("error decoding string: %v", err)
+		return cacheValue, fmt.Errorf("error decoding string: %v", err)
+	}
+	err = bson.Unmarshal(bsonBin, &cacheValue)
+	if err != nil {
+		d.Logger.Errorf("unable to unmarshal: %v", err)
+		return cacheValue, fmt.Errorf("unable to unmarshal: %v", err)
+	}
+
+	return cacheValue, nil
+}
+
+// writeToCache writes a configuration to Redis and the in-process cache
+func (d *DAL) writeToCache(configID, hostID string, result bson.M) error {
+	return d.writeToCacheAt(configID, hostID, result, "")
+}
+
+// writeToCacheAt writes a configuration that was read at a cache generation.
+// It's skipped when the config was invalidated since. An empty generation
+// writes it unconditionally
+func (d *DAL) writeToCacheAt(configID, hostID string, result bson.M, generation string) error {
+	if !d.CacheEnabled {
+		return errCacheDisabled
+	}
+
+	if configID == "" {
+		d.Logger.Errorf("can not set cache for empty config ID")
+		return fmt.Errorf("can not set cache for empty config ID")
+	}
+
+	// set the cache key
+	cacheKey := getCacheKey(configID, hostID)
+
+	logLine := d.Redactor.Sprintf("setting cache for %s", cacheKey)
+	d.Logger.Info(logLine)
+	bsonBin, err := bson.Marshal(result)
+	if err != nil {
+		d.cacheStats.WriteFailure()
+		d.Logger.Errorf("error writing to cache: %v", err)
+		return fmt.Errorf("error writing to the cache %s", err)
+	}
+	cacheEnc := b64.StdEncoding.EncodeToString(bsonBin)
+
+	if err := d.CacheBreaker.Allow(); err != nil {
+		d.cacheStats.WriteFailure()
+		return fmt.Errorf("redis is unavailable: %w", err)
+	}
+
+	// entries of a stored config are indexed so that writes can invalidate
+	// the name, ID and host scoped variants together. The stale copy
+	// outlives the entry and has its own index, so it's kept through
+	// invalidation as the last known good copy
+	indexID := configIndexID(result)
+	set := true
+	if indexID != "" && d.Redis != nil {
+		set, err = d.writeIndexedCache(cacheKey, getCacheIndexKey(indexID), cacheEnc, d.cacheTTL(), configID, generation)
+		if err == nil && set && d.StaleEnabled {
+			set, err = d.writeIndexedCache(getStaleCacheKey(configID, hostID), getStaleIndexKey(indexID), cacheEnc, d.StaleTTL, configID, generation)
+		}
+	} else {
+		err = d.Cache.Set(cacheKey, cacheEnc, d.cacheTTL())
+		if err == nil && d.StaleEnabled {
+			err = d.Cache.Set(getStaleCacheKey(configID, hostID), cacheEnc, d.StaleTTL)
+		}
+	}
+
+	if err != nil {
+		d.CacheBreaker.Failure()
+		d.cacheStats.WriteFailure()
+		d.Logger.Errorf("error writing to cache: %v", err)
+		return fmt.Errorf("error writing to the cache %s", err)
+	}
+	d.CacheBreaker.Success()
+
+	if !set {
+		d.Logger.Infof("skipped caching %s, it changed while it was read", cacheKey)
+		return nil
+	}
+
+	if d.LocalCache != nil {
+		d.LocalCache.Set(cacheKey, result)
+	}
+
+	return nil
+}
+
+// writeIndexedCache sets a cache entry and adds it to the index of its
+// config. With a generation, the entry is set only while the config is still
+// at it. It returns whether the entry was set
+func (d *DAL) writeIndexedCache(cacheKey, indexKey, value string, ttl time.Duration, configID, generation string) (bool, error) {
+	// serialize the same way as persistence.RedisStore so Get can read it
+	b, err := cacheutils.Serialize(value)
+	if err != nil {
+		return false, err
+	}
+
+	if generation == "" {
+		return true, d.Redis.SetIndexed(cacheKey, indexKey, b, ttl)
+	}
+
+	return d.Redis.SetIndexedAt(cacheKey, indexKey, b, ttl, getGenerationKey(configID), generation)
+}
+
+// cacheGeneration returns the cache generation of a config, by the ID or
+// name it's read with. It's empty when entries aren't indexed
+func (d *DAL) cacheGeneration(configID string) (string, error) {
+	if !d.CacheEnabled || d.Redis == nil {
+		return "", nil
+	}
+
+	if err := d.CacheBreaker.Allow(); err != nil {
+		return "", fmt.Errorf("redis is unavailable: %w", err)
+	}
+
+	generation, err := d.Redis.Generation(getGenerationKey(configID))
+	if err != nil {
+		d.CacheBreaker.Failure()
+		return "", err
+	}
+	d.CacheBreaker.Success()
+
+	return generation, nil
+}
+
+// invalidateConfig removes every cached variant of a stored config and
+// wakes the config watchers. It bumps the cache generations of the config's
+// ID and name, so reads that started earlier don't cache the old version.
+// The config document must contain its _id
+func (d *DAL) invalidateConfig(config bson.M) error {
+	// watchers reread the config once its cached copies are gone
+	defer d.watchers.notify()
+
+	generationKeys := []string{getGenerationKey(configIndexID(config))}
+	if name, ok := config["config_name"].(string); ok && name != "" {
+		generationKeys = append(generationKeys, getGenerationKey(name))
+	}
+
+	return d.deleteCacheIndex(config, getCacheIndexKey, generationKeys...)
+}
+
+// dropStaleConfig removes the stale copies of a stored config, so a deleted
+// config is not served while the document store is unavailable
+func (d *DAL) dropStaleConfig(config bson.M) error {
+	return d.deleteCacheIndex(config, getStaleIndexKey)
+}
+
+// deleteCacheIndex deletes the entries in one of the cache indexes of a config
+// and bumps the generations
+func (d *DAL) deleteCacheIndex(config bson.M, indexKey func(string) string, generationKeys ...string) error {
+	if !d.CacheEnabled || d.Redis == nil {
+		return nil
+	}
+
+	indexID := configIndexID(config)
+	if indexID == "" {
+		return fmt.Errorf("can not invalidate the cache for a config without an ID")
+	}
+
+	// invalidation skips the circuit breaker. Entries that are left behind
+	// would be served after Redis recovers
+	keys, err := d.Redis.DeleteIndexed(indexKey(indexID), generationKeys...)
+	if err != nil {
+		d.CacheBreaker.Failure()
+		d.cacheStats.WriteFailure()
+		return fmt.Errorf("error invalidating the cache for %s: %s", indexID, err)
+	}
+	d.CacheBreaker.Success()
+
+	if d.LocalCache != nil {
+		for _, key := range keys {
+			d.LocalCache.Delete(key)
+		}
+	}
+
+	d.Logger.Infof("invalidated %d cache entries for config %s", len(keys), indexID)
+	return nil
+}
+
+// cacheTTL returns how long configs are kept in Redis
+func (d *DAL) cacheTTL() time.Duration {
+	if d.CacheTTL <= 0 {
+		return time.Hour
+	}
+
+	return d.CacheTTL
+}
+
+// CacheStats returns the cache hit and miss statistics
+func (d *DAL) CacheStats() cache.StatsSnapshot {
+	snapshot := d.cacheStats.Snapshot(d.LocalCache)
+	snapshot.Enabled = d.CacheEnabled
+	return snapshot
+}
+
+// BreakerStates returns the state of the circuit breakers
+func (d *DAL) BreakerStates() map[string]breaker.State {
+	return map[string]breaker.State{
+		"docdb": d.DocBreaker.State(),
+		"redis": d.CacheBreaker.State(),
+	}
+}
+
+// getCacheKey standardize the cache key for configs
+func getCacheKey(configID, hostID string) string {
+	var hostPrefix string
+
+	if hostID != "" {
+		hostPrefix = fmt.Sprintf("_%s", hostID)
+	}
+
+	// return the cache key
+	return fmt.Sprintf("config_%s%s", configID, hostPrefix)
+}
+
+// getStaleCacheKey the key of the last known good copy of a config
+func getStaleCacheKey(configID, hostID string) string {
+	return fmt.Sprintf("stale_%s", getCacheKey(configID, hostID))
+}
+
+// getGenerationKey the key of the cache generation of a config, by the ID or
+// name it's read with
+func getGenerationKey(configID string) string {
+	return fmt.Sprintf("config_generation_%s", configID)
+}
+
+// getCacheIndexKey the key of the set that lists the cache keys of a config
+func getCacheIndexKey(indexID string) string {
+	return fmt.Sprintf("config_index_%s", indexID)
+}
+
+// getStaleIndexKey the key of the set that lists the stale copies of a config
+func getStaleIndexKey(indexID string) string {
+	return fmt.Sprintf("stale_index_%s", indexID)
+}
+
+// configIndexID returns the document ID that the cache index of a config
+// is keyed on. Empty if the document has no ID
+func configIndexID(config bson.M) string {
+	switch id := config["_id"].(type) {
+	case primitive.ObjectID:
+		return id.Hex()
+	case string:
+		return id
+	}
+
+	return ""
+}
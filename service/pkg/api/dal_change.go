@@ -0,0 +1,121 @@
+package api
+
+import (
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/aeekayy/stilla/service/api/protobuf/messages"
+	"github.com/aeekayy/stilla/service/pkg/diff"
+)
+
+const configChangeTopic = "config.change"
+
+var (
+	// configPayloadPath is where a config payload sits for redaction rules.
+	// It matches the payload's path in the InsertConfig audit event, so a
+	// rule such as config.config.**.password covers both events.
+	configPayloadPath = []string{"config", "config"}
+
+	diffOps = map[diff.Op]pb.ConfigDiff_Operation{
+		diff.OpAdd:     pb.ConfigDiff_ADD,
+		diff.OpRemove:  pb.ConfigDiff_REMOVE,
+		diff.OpReplace: pb.ConfigDiff_REPLACE,
+	}
+)
+
+// ConfigChange describes a config mutation for a change event
+type ConfigChange struct {
+	Old        interface{}
+	New        interface{}
+	FuncName   string
+	ConfigID   string
+	ConfigName string
+	Actor      string
+	Checksum   string
+	OldVersion int32
+	NewVersion int32
+}
+
+// EmitConfigChange emits a change event with the diff between the old and
+// new config payloads. Values of sensitive keys are masked.
+func (d *DAL) EmitConfigChange(change ConfigChange) {
+	if d.Producer == nil {
+		return
+	}
+
+	event, err := d.newConfigChangeEvent(change)
+	if err != nil {
+		d.Logger.Errorf("error building config change event: %s", err)
+		return
+	}
+
+	go d.produce(configChangeTopic, event)
+}
+
+// newConfigChangeEvent builds the protobuf message for a config change
+func (d *DAL) newConfigChangeEvent(change ConfigChange) (*pb.ConfigChange, error) {
+	changes, err := diff.Compute(change.Old, change.New)
+	if err != nil {
+		return nil, fmt.Errorf("unable to compute the config diff: %s", err)
+	}
+
+	event := &pb.ConfigChange{
+		ConfigId:   change.ConfigID,
+		ConfigName: change.ConfigName,
+		Actor:      change.Actor,
+		FuncName:   change.FuncName,
+		Service:    serviceName,
+		OldVersion: change.OldVersion,
+		NewVersion: change.NewVersion,
+		Checksum:   change.Checksum,
+		Sent:       timestamppb.Now(),
+	}
+
+	for _, c := range changes {
+		path := append(append([]string{}, configPayloadPath...), c.Path...)
+		configDiff := &pb.ConfigDiff{
+			Path: c.Pointer(),
+			Op:   diffOps[c.Op],
+		}
+
+		if c.Op != diff.OpAdd {
+			if configDiff.OldValue, err = structpb.NewValue(d.Redactor.Value(path, c.Old)); err != nil {
+				return nil, fmt.Errorf("unable to encode %s: %s", c.Pointer(), err)
+			}
+		}
+
+		if c.Op != diff.OpRemove {
+			if configDiff.NewValue, err = structpb.NewValue(d.Redactor.Value(path, c.New)); err != nil {
+				return nil, fmt.Errorf("unable to encode %s: %s", c.Pointer(), err)
+			}
+		}
+
+		event.Diff = append(event.Diff, configDiff)
+	}
+
+	return event, nil
+}
+
+// storedConfigPayload returns the config payload and version of a stored
+// config document
+func storedConfigPayload(doc bson.M) (interface{}, int32) {
+	var payload interface{}
+	var version int32
+
+	if doc == nil {
+		return payload, version
+	}
+
+	if v, ok := doc["version"].(int32); ok {
+		version = v
+	}
+
+	if cv, ok := doc["config"].(bson.M); ok {
+		payload = cv["config"]
+	}
+
+	return payload, version
+}
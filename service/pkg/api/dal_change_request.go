@@ -0,0 +1,459 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/aeekayy/stilla/service/pkg/api/models"
+	"github.com/aeekayy/stilla/service/pkg/diff"
+	"github.com/aeekayy/stilla/service/pkg/utils"
+)
+
+const (
+	configChangeRequestCollection = "config_change_request"
+	// maxListedChangeRequests the most change requests that are listed
+	maxListedChangeRequests = 500
+)
+
+// approvedChangeKey the context key set on a write that may change a
+// protected config
+type approvedChangeKey struct{}
+
+// withApproval returns a context for a write that may change a protected
+// config
+func withApproval(ctx context.Context) context.Context {
+	return context.WithValue(ctx, approvedChangeKey{}, true)
+}
+
+// isApproved returns whether a write may change a protected config
+func isApproved(ctx context.Context) bool {
+	approved, _ := ctx.Value(approvedChangeKey{}).(bool)
+	return approved
+}
+
+// errConfigProtected returned for writes to a protected config that can't
+// wait for approval
+var errConfigProtected = newDALError(kindConflict, "config_protected", "the config is protected, changes to it need an approved change request")
+
+// errChangeRequestNotFound returned for a change request that doesn't exist
+var errChangeRequestNotFound = newDALError(kindNotFound, "change_request_not_found", "the change request does not exist")
+
+// errChangeRequestNotPending returned when a change request that was
+// already reviewed is reviewed again
+var errChangeRequestNotPending = newDALError(kindConflict, "change_request_not_pending", "the change request is not pending")
+
+// errApproverRequired returned when a host without approver permission
+// reviews a change request
+var errApproverRequired = newDALError(kindForbidden, "approver_required", "reviewing change requests requires an approver host")
+
+// errSelfApproval returned when a host approves its own change request
+var errSelfApproval = newDALError(kindForbidden, "self_approval", "a change request must be approved by another host")
+
+// errInvalidChangeQuery returned for a change request list that can't be
+// served
+var errInvalidChangeQuery = newDALError(kindValidation, "invalid_query", "invalid change request query")
+
+// changeRequestStatuses the statuses change requests can be listed by
+var changeRequestStatuses = map[string]bool{
+	models.ChangePending:  true,
+	models.ChangeApproved: true,
+	models.ChangeApplied:  true,
+	models.ChangeRejected: true,
+	models.ChangeFailed:   true,
+}
+
+// changeRequestIndexes the indexes the change request list reads
+var changeRequestIndexes = []mongo.IndexModel{
+	{Keys: bson.D{{"status", 1}, {"requested", 1}}, Options: options.Index().SetName("status_requested")},
+	{Keys: bson.D{{"config_name", 1}, {"status", 1}, {"requested", 1}}, Options: options.Index().SetName("config_name_status_requested")},
+}
+
+// pendingChange returned for a write to a protected config. The write is
+// stored as a change request instead of a new version
+type pendingChange struct {
+	request models.ChangeRequest
+}
+
+// Error returns the message of the error
+func (e *pendingChange) Error() string {
+	return fmt.Sprintf("the config is protected, change request %s awaits approval", e.request.ID.Hex())
+}
+
+// isProtected returns whether a stored config is protected
+func isProtected(doc bson.M) bool {
+	protected, _ := doc["protected"].(bool)
+	return protected
+}
+
+// isApprover returns whether the authenticated host may review change
+// requests. Admin hosts are approvers
+func isApprover(d *DAL, ctx context.Context) bool {
+	if isAdmin(d, ctx) {
+		return true
+	}
+
+	hostID := requestHost(ctx)
+	if d.Config == nil || hostID == "" {
+		return false
+	}
+
+	for _, approver := range d.Config.ApproverHosts {
+		if approver == hostID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// requestChange stores a write to a protected config by hostID as a pending
+// change request and emits a ChangeRequested audit event
+func (d *DAL) requestChange(ctx context.Context, hostID string, stored bson.M, configIn models.ConfigIn, tags []string, sum, funcName string) (models.ChangeRequest, error) {
+	oldConfig, baseVersion := storedConfigPayload(stored)
+
+	changes, err := diff.Compute(oldConfig, configIn.Config)
+	if err != nil {
+		return models.ChangeRequest{}, fmt.Errorf("unable to diff the config: %s", err)
+	}
+
+	request := models.ChangeRequest{
+		ConfigName:  configIn.ConfigName,
+		Owner:       configIn.Owner,
+		Config:      configIn.Config,
+		Parents:     configIn.Parents,
+		Tags:        tags,
+		Checksum:    sum,
+		Operation:   funcName,
+		BaseVersion: baseVersion,
+		Diff:        make([]models.ConfigChangeDiff, 0, len(changes)),
+		Status:      models.ChangePending,
+		RequestedBy: hostID,
+		Requested:   time.Now().UTC(),
+		Comments:    make([]models.ChangeRequestComment, 0),
+	}
+	for _, c := range changes {
+		request.Diff = append(request.Diff, models.ConfigChangeDiff{Op: string(c.Op), Path: c.Pointer(), Old: c.Old, New: c.New})
+	}
+
+	result, err := d.changeRequests().InsertOne(ctx, request)
+	if err != nil {
+		return request, fmt.Errorf("error recording the change request: %s", err)
+	}
+	request.ID, _ = result.InsertedID.(primitive.ObjectID)
+
+	d.emitChangeRequest("ChangeRequested", request, nil)
+	d.Logger.Infof("change request %s of %s awaits approval", request.ID.Hex(), request.ConfigName)
+
+	return request, nil
+}
+
+// SetConfigProtection marks a config as protected or not. Writes to a
+// protected config wait for an approved change request
+func (d *DAL) SetConfigProtection(ctx *gin.Context, configID string, protected bool, req interface{}) error {
+	requestDetails := d.requestDetails(req)
+	requestDetails["config_id"] = utils.SanitizeMessageValue(configID)
+	requestDetails["protected"] = protected
+
+	d.EmitMessage("config.audit", "SetConfigProtection", requestDetails)
+
+	idFilter, err := configIDFilter(configID)
+	if err != nil {
+		return err
+	}
+
+	update := bson.M{"$unset": bson.M{"protected": ""}}
+	if protected {
+		update = bson.M{"$set": bson.M{"protected": true}}
+	}
+
+	config, err := d.updateConfigState(ctx, bson.D{{"$and", []bson.M{idFilter, notDeletedFilter}}}, update)
+	if err != nil {
+		return err
+	}
+
+	// cached reads include the protection
+	if err := d.invalidateConfig(config); err != nil {
+		d.Logger.Errorf("unable to invalidate the cache: %v", err)
+	}
+
+	return nil
+}
+
+// GetChangeRequests returns the change requests with a status, oldest
+// first. The list is limited to a config when the query names one
+func (d *DAL) GetChangeRequests(ctx *gin.Context, query models.ChangeRequestQuery, req interface{}) ([]models.ChangeRequest, error) {
+	requestDetails := d.requestDetails(req)
+	requestDetails["config_name"] = utils.SanitizeMessageValue(query.ConfigName)
+	requestDetails["status"] = utils.SanitizeMessageValue(query.Status)
+
+	d.EmitMessage("config.audit", "GetChangeRequests", requestDetails)
+
+	status := query.Status
+	if status == "" {
+		status = models.ChangePending
+	}
+	if !changeRequestStatuses[status] {
+		return nil, fmt.Errorf("%w: unknown status %q", errInvalidChangeQuery, status)
+	}
+
+	filter := bson.M{"status": status}
+	if query.ConfigName != "" {
+		filter["config_name"] = utils.SanitizeMongoInput(query.ConfigName)
+	}
+
+	opts := options.Find().SetSort(bson.D{{"requested", 1}, {"_id", 1}}).SetLimit(maxListedChangeRequests)
+	cursor, err := d.changeRequests().Find(ctx, filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("error accessing the change requests: %s", err)
+	}
+
+	requests := make([]models.ChangeRequest, 0)
+	if err := cursor.All(ctx, &requests); err != nil {
+		return nil, fmt.Errorf("error accessing the cursor: %s", err)
+	}
+
+	return requests, nil
+}
+
+// GetChangeRequest returns a change request of a config
+func (d *DAL) GetChangeRequest(ctx *gin.Context, configID, changeID string, req interface{}) (models.ChangeRequest, error) {
+	requestDetails := d.requestDetails(req)
+	requestDetails["config_id"] = utils.SanitizeMessageValue(configID)
+	requestDetails["change_id"] = utils.SanitizeMessageValue(changeID)
+
+	d.EmitMessage("config.audit", "GetChangeRequest", requestDetails)
+
+	filter, err := d.changeRequestFilter(ctx, configID, changeID)
+	if err != nil {
+		return models.ChangeRequest{}, err
+	}
+
+	return d.findChangeRequest(ctx, filter)
+}
+
+// ApproveChangeRequest approves a pending change request and applies it as
+// the next version of its config. The change is applied only while the
+// config is at the version it was made against; otherwise the request fails
+// and has to be made again
+func (d *DAL) ApproveChangeRequest(ctx *gin.Context, configID, changeID string, reviewIn models.ChangeRequestReviewIn, req interface{}) (models.ChangeRequest, error) {
+	requestDetails := d.requestDetails(req)
+	requestDetails["config_id"] = utils.SanitizeMessageValue(configID)
+	requestDetails["change_id"] = utils.SanitizeMessageValue(changeID)
+
+	d.EmitMessage("config.audit", "ApproveChangeRequest", requestDetails)
+
+	if !isApprover(d, ctx) {
+		return models.ChangeRequest{}, errApproverRequired
+	}
+
+	filter, err := d.changeRequestFilter(ctx, configID, changeID)
+	if err != nil {
+		return models.ChangeRequest{}, err
+	}
+
+	request, err := d.findChangeRequest(ctx, filter)
+	if err != nil {
+		return request, err
+	}
+
+	reviewer := requestHost(ctx)
+	if request.RequestedBy == reviewer {
+		return request, errSelfApproval
+	}
+
+	// the request is claimed first, so it's applied once when approvers
+	// race
+	now := time.Now().UTC()
+	set := bson.M{"status": models.ChangeApproved, "reviewed_by": reviewer, "reviewed": now}
+	if request, err = d.reviewChangeRequest(ctx, filter, set, reviewer, reviewIn.Comment); err != nil {
+		return request, err
+	}
+
+	configIn := models.ConfigIn{
+		ConfigName: request.ConfigName,
+		Owner:      request.Owner,
+		Config:     request.Config,
+		Parents:    request.Parents,
+		Tags:       request.Tags,
+	}
+	// the change is written on behalf of the host that requested it
+	write, applyErr := d.insertConfig(withApproval(ctx), request.RequestedBy, configIn, request.BaseVersion, request.Operation)
+
+	// a backend failure leaves the request pending, so it can be approved
+	// again
+	if _, _, ok := errorCode(applyErr); applyErr != nil && !ok {
+		reset := bson.M{"$set": bson.M{"status": models.ChangePending}, "$unset": bson.M{"reviewed_by": "", "reviewed": ""}}
+		if _, err := d.changeRequests().UpdateOne(ctx, bson.M{"_id": request.ID, "status": models.ChangeApproved}, reset); err != nil {
+			d.Logger.Errorf("unable to reset change request %s: %s", request.ID.Hex(), err)
+		}
+		return request, applyErr
+	}
+
+	set = bson.M{"status": models.ChangeApplied, "version": write.Version}
+	if applyErr != nil {
+		set = bson.M{"status": models.ChangeFailed, "error": applyErr.Error()}
+	}
+
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	if err := d.changeRequests().FindOneAndUpdate(ctx, bson.M{"_id": request.ID}, bson.M{"$set": set}, opts).Decode(&request); err != nil {
+		return request, fmt.Errorf("unable to record change request %s: %s", request.ID.Hex(), err)
+	}
+
+	d.emitChangeRequest("ChangeRequestApproved", request, applyErr)
+
+	return request, applyErr
+}
+
+// RejectChangeRequest rejects a pending change request. Approvers reject
+// requests and the host that made a request may withdraw it
+func (d *DAL) RejectChangeRequest(ctx *gin.Context, configID, changeID string, reviewIn models.ChangeRequestReviewIn, req interface{}) (models.ChangeRequest, error) {
+	requestDetails := d.requestDetails(req)
+	requestDetails["config_id"] = utils.SanitizeMessageValue(configID)
+	requestDetails["change_id"] = utils.SanitizeMessageValue(changeID)
+
+	d.EmitMessage("config.audit", "RejectChangeRequest", requestDetails)
+
+	filter, err := d.changeRequestFilter(ctx, configID, changeID)
+	if err != nil {
+		return models.ChangeRequest{}, err
+	}
+
+	request, err := d.findChangeRequest(ctx, filter)
+	if err != nil {
+		return request, err
+	}
+
+	reviewer := requestHost(ctx)
+	if request.RequestedBy != reviewer && !isApprover(d, ctx) {
+		return request, errApproverRequired
+	}
+
+	set := bson.M{"status": models.ChangeRejected, "reviewed_by": reviewer, "reviewed": time.Now().UTC()}
+	if request, err = d.reviewChangeRequest(ctx, filter, set, reviewer, reviewIn.Comment); err != nil {
+		return request, err
+	}
+
+	d.emitChangeRequest("ChangeRequestRejected", request, nil)
+
+	return request, nil
+}
+
+// CommentChangeRequest adds a comment to a change request
+func (d *DAL) CommentChangeRequest(ctx *gin.Context, configID, changeID string, commentIn models.ChangeRequestCommentIn, req interface{}) (models.ChangeRequest, error) {
+	requestDetails := d.requestDetails(req)
+	requestDetails["config_id"] = utils.SanitizeMessageValue(configID)
+	requestDetails["change_id"] = utils.SanitizeMessageValue(changeID)
+
+	d.EmitMessage("config.audit", "CommentChangeRequest", requestDetails)
+
+	filter, err := d.changeRequestFilter(ctx, configID, changeID)
+	if err != nil {
+		return models.ChangeRequest{}, err
+	}
+
+	comment := models.ChangeRequestComment{Author: requestHost(ctx), Body: commentIn.Body, Created: time.Now().UTC()}
+
+	var request models.ChangeRequest
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err = d.changeRequests().FindOneAndUpdate(ctx, filter, bson.M{"$push": bson.M{"comments": comment}}, opts).Decode(&request)
+	if err == mongo.ErrNoDocuments {
+		return request, errChangeRequestNotFound
+	} else if err != nil {
+		return request, fmt.Errorf("error recording the comment: %s", err)
+	}
+
+	return request, nil
+}
+
+// changeRequests returns the change request collection
+func (d *DAL) changeRequests() *mongo.Collection {
+	return d.DocumentStore.Database(configDB).Collection(configChangeRequestCollection)
+}
+
+// changeRequestFilter returns the filter of a change request of a config
+func (d *DAL) changeRequestFilter(ctx *gin.Context, configID, changeID string) (bson.M, error) {
+	objID, err := primitive.ObjectIDFromHex(changeID)
+	if err != nil {
+		return nil, errChangeRequestNotFound
+	}
+
+	configName, err := d.configName(ctx, configID)
+	if err != nil {
+		return nil, err
+	}
+
+	return bson.M{"_id": objID, "config_name": configName}, nil
+}
+
+// findChangeRequest returns the change request a filter matches
+func (d *DAL) findChangeRequest(ctx *gin.Context, filter bson.M) (models.ChangeRequest, error) {
+	var request models.ChangeRequest
+
+	err := d.changeRequests().FindOne(ctx, filter).Decode(&request)
+	if err == mongo.ErrNoDocuments {
+		return request, errChangeRequestNotFound
+	} else if err != nil {
+		return request, fmt.Errorf("error accessing the change request: %s", err)
+	}
+
+	return request, nil
+}
+
+// reviewChangeRequest records the review of a pending change request and
+// its comment, if any
+func (d *DAL) reviewChangeRequest(ctx *gin.Context, filter bson.M, set bson.M, reviewer, comment string) (models.ChangeRequest, error) {
+	var request models.ChangeRequest
+
+	pending := bson.M{"status": models.ChangePending}
+	for k, v := range filter {
+		pending[k] = v
+	}
+
+	update := bson.M{"$set": set}
+	if comment != "" {
+		update["$push"] = bson.M{"comments": models.ChangeRequestComment{Author: reviewer, Body: comment, Created: time.Now().UTC()}}
+	}
+
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err := d.changeRequests().FindOneAndUpdate(ctx, pending, update, opts).Decode(&request)
+	if err == mongo.ErrNoDocuments {
+		return request, errChangeRequestNotPending
+	} else if err != nil {
+		return request, fmt.Errorf("unable to record the review: %s", err)
+	}
+
+	return request, nil
+}
+
+// emitChangeRequest emits an audit event of a change request
+func (d *DAL) emitChangeRequest(event string, request models.ChangeRequest, err error) {
+	details := map[string]interface{}{
+		"change_id":    request.ID.Hex(),
+		"config_name":  utils.SanitizeMessageValue(request.ConfigName),
+		"operation":    request.Operation,
+		"base_version": request.BaseVersion,
+		"requested_by": utils.SanitizeMessageValue(request.RequestedBy),
+		"status":       request.Status,
+		"changes":      len(request.Diff),
+	}
+	if request.ReviewedBy != "" {
+		details["reviewed_by"] = utils.SanitizeMessageValue(request.ReviewedBy)
+	}
+
+	if err != nil {
+		details["error"] = err.Error()
+		d.Logger.Errorf("unable to apply change request %s: %v", request.ID.Hex(), d.Redactor.Error(err, request.ConfigName))
+	} else if request.Status == models.ChangeApplied {
+		details["version"] = request.Version
+		d.Logger.Infof("applied change request %s of %s at version %d", request.ID.Hex(), request.ConfigName, request.Version)
+	}
+
+	d.EmitMessage("config.audit", event, details)
+}
@@ -0,0 +1,193 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/aeekayy/stilla/service/pkg/utils"
+)
+
+// errConfigNotFound returned when a config does not exist or is in the
+// wrong state for the operation
+var errConfigNotFound = newDALError(kindNotFound, "config_not_found", "the config document does not exist")
+
+// notDeletedFilter matches configs that have not been deleted
+var notDeletedFilter = bson.M{"deleted": bson.M{"$exists": false}}
+
+// unprotectedFilter matches configs that aren't protected
+var unprotectedFilter = bson.M{"protected": bson.M{"$ne": true}}
+
+// deletedFields the fields of a config tombstone
+var deletedFields = bson.M{"deleted": "", "deleted_by": ""}
+
+// configIDFilter matches a config by ObjectID or by name
+func configIDFilter(configID string) (bson.M, error) {
+	if primitive.IsValidObjectID(configID) {
+		objID, err := primitive.ObjectIDFromHex(configID)
+		if err != nil {
+			return nil, fmt.Errorf("error setting objectid: %s, %s", configID, err)
+		}
+
+		return bson.M{"_id": bson.M{"$eq": objID}}, nil
+	}
+
+	return bson.M{"config_name": bson.M{"$eq": configID}}, nil
+}
+
+// DeleteConfig tombstones a config. The config is hidden from reads until
+// it's restored. Its version history is kept. Protected configs can't be
+// deleted
+func (d *DAL) DeleteConfig(ctx context.Context, configID string, req interface{}) error {
+	requestDetails := d.requestDetails(req)
+	requestDetails["config_id"] = utils.SanitizeMessageValue(configID)
+
+	d.EmitMessage("config.audit", "DeleteConfig", requestDetails)
+
+	idFilter, err := configIDFilter(configID)
+	if err != nil {
+		return err
+	}
+
+	update := bson.M{
+		"$set": bson.M{"deleted": time.Now(), "deleted_by": requestHost(ctx)},
+	}
+
+	config, err := d.updateConfigState(ctx, bson.D{{"$and", []bson.M{idFilter, notDeletedFilter, unprotectedFilter}}}, update)
+	if errors.Is(err, errConfigNotFound) {
+		// tell a protected config apart from a missing one
+		if existing, findErr := d.findConfig(ctx, configID, ""); findErr == nil && isProtected(existing) {
+			return errConfigProtected
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := d.invalidateConfig(config); err != nil {
+		d.Logger.Errorf("unable to invalidate the cache: %v", err)
+	}
+	if err := d.dropStaleConfig(config); err != nil {
+		d.Logger.Errorf("unable to drop the stale copies: %v", err)
+	}
+
+	d.Logger.Infof("deleted config %s", configIndexID(config))
+	return nil
+}
+
+// RestoreConfig brings back a deleted config
+func (d *DAL) RestoreConfig(ctx *gin.Context, configID string, req interface{}) error {
+	requestDetails := d.requestDetails(req)
+	requestDetails["config_id"] = utils.SanitizeMessageValue(configID)
+
+	d.EmitMessage("config.audit", "RestoreConfig", requestDetails)
+
+	idFilter, err := configIDFilter(configID)
+	if err != nil {
+		return err
+	}
+
+	deletedFilter := bson.M{"deleted": bson.M{"$exists": true}}
+	config, err := d.updateConfigState(ctx, bson.D{{"$and", []bson.M{idFilter, deletedFilter}}}, bson.M{"$unset": deletedFields})
+	if err != nil {
+		return err
+	}
+
+	if err := d.invalidateConfig(config); err != nil {
+		d.Logger.Errorf("unable to invalidate the cache: %v", err)
+	}
+
+	d.Logger.Infof("restored config %s", configIndexID(config))
+	return nil
+}
+
+// PurgeConfig permanently removes a config and all of its versions. It
+// returns the number of versions removed
+func (d *DAL) PurgeConfig(ctx *gin.Context, configID string, req interface{}) (int64, error) {
+	requestDetails := d.requestDetails(req)
+	requestDetails["config_id"] = utils.SanitizeMessageValue(configID)
+
+	d.EmitMessage("config.audit", "PurgeConfig", requestDetails)
+
+	configCollection := d.DocumentStore.Database(configDB).Collection(configCollection)
+	configVersionCollection := d.DocumentStore.Database(configDB).Collection(configVersionCollectionlection)
+
+	idFilter, err := configIDFilter(configID)
+	if err != nil {
+		return 0, err
+	}
+
+	var config bson.M
+	err = configCollection.FindOne(ctx, idFilter).Decode(&config)
+	if err == mongo.ErrNoDocuments {
+		return 0, errConfigNotFound
+	} else if err != nil {
+		return 0, fmt.Errorf("error accessing the config document: %s", err)
+	}
+
+	// remove the versions first so a failure can be retried
+	var versions int64
+	if versionFilter := configVersionsFilter(config); versionFilter != nil {
+		res, err := configVersionCollection.DeleteMany(ctx, versionFilter)
+		if err != nil {
+			return 0, fmt.Errorf("unable to purge the config versions: %s", err)
+		}
+		versions = res.DeletedCount
+	}
+
+	if _, err := configCollection.DeleteOne(ctx, bson.M{"_id": config["_id"]}); err != nil {
+		return versions, fmt.Errorf("unable to purge the config: %s", err)
+	}
+
+	if err := d.invalidateConfig(config); err != nil {
+		d.Logger.Errorf("unable to invalidate the cache: %v", err)
+	}
+	if err := d.dropStaleConfig(config); err != nil {
+		d.Logger.Errorf("unable to drop the stale copies: %v", err)
+	}
+
+	d.Logger.Infof("purged config %s and %d versions", configIndexID(config), versions)
+	return versions, nil
+}
+
+// configVersionsFilter matches the versions of a config. Versions from
+// InsertConfig carry the config_id. Versions from UpdateConfigByID only
+// carry the name. Nil if the config has neither
+func configVersionsFilter(config bson.M) bson.M {
+	var filter []bson.M
+	if id, ok := config["config_id"].(string); ok && id != "" {
+		filter = append(filter, bson.M{"config_id": id})
+	}
+	if name, ok := config["config_name"].(string); ok && name != "" {
+		filter = append(filter, bson.M{"config_name": name})
+	}
+
+	if len(filter) == 0 {
+		return nil
+	}
+
+	return bson.M{"$or": filter}
+}
+
+// updateConfigState applies an update to the config that matches the filter
+// and returns the config as it was before the update
+func (d *DAL) updateConfigState(ctx context.Context, filter bson.D, update bson.M) (bson.M, error) {
+	configCollection := d.DocumentStore.Database(configDB).Collection(configCollection)
+
+	var config bson.M
+	err := configCollection.FindOneAndUpdate(ctx, filter, update, options.FindOneAndUpdate()).Decode(&config)
+	if err == mongo.ErrNoDocuments {
+		return nil, errConfigNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("error updating the config document: %s", err)
+	}
+
+	return config, nil
+}
@@ -0,0 +1,260 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/aeekayy/stilla/service/pkg/api/models"
+	"github.com/aeekayy/stilla/service/pkg/flags"
+	"github.com/aeekayy/stilla/service/pkg/utils"
+)
+
+const (
+	// flagConfigPrefix the name prefix of the configs that store flags.
+	// Flags are versioned, audited, exported and imported like any other
+	// config
+	flagConfigPrefix = "flags/"
+	// maxEvaluatedFlags the most flags evaluated in one request
+	maxEvaluatedFlags = 500
+)
+
+// errFlagNotFound returned for a flag that doesn't exist
+var errFlagNotFound = newDALError(kindNotFound, "flag_not_found", "the flag does not exist")
+
+// errUnusableFlag returned for a stored flag that can't be evaluated, such
+// as one that was changed through the config API
+var errUnusableFlag = newDALError(kindUnprocessable, "invalid_flag", "the stored flag is invalid")
+
+// errInvalidFlagQuery returned for an evaluation of too many flags
+var errInvalidFlagQuery = newDALError(kindValidation, "invalid_query", "invalid flag evaluation query")
+
+// flagConfigName returns the name of the config that stores a flag
+func flagConfigName(key string) string {
+	return flagConfigPrefix + key
+}
+
+// PutFlag stores a flag as the next version of its config. A flag that's
+// unchanged isn't written again
+func (d *DAL) PutFlag(ctx *gin.Context, flag flags.Flag, req interface{}) (flags.Flag, ConfigWrite, error) {
+	requestDetails := d.requestDetails(req)
+	requestDetails["flag"] = d.Redactor.Field("flag", flag)
+
+	d.EmitMessage("config.audit", "PutFlag", requestDetails)
+
+	if err := flag.Normalize(); err != nil {
+		return flag, ConfigWrite{}, err
+	}
+
+	payload, err := flag.Payload()
+	if err != nil {
+		return flag, ConfigWrite{}, err
+	}
+
+	configIn := models.ConfigIn{
+		ConfigName: flagConfigName(flag.Key),
+		Owner:      requestHost(ctx),
+		Config:     payload,
+	}
+
+	write, err := d.insertConfig(ctx, requestHost(ctx), configIn, 0, "PutFlag")
+	return flag, write, err
+}
+
+// GetFlag returns the current version of a flag
+func (d *DAL) GetFlag(ctx *gin.Context, key string, req interface{}) (flags.Flag, int32, error) {
+	requestDetails := d.requestDetails(req)
+	requestDetails["flag_key"] = utils.SanitizeMessageValue(key)
+
+	d.EmitMessage("config.audit", "GetFlag", requestDetails)
+
+	return d.getFlag(ctx, key)
+}
+
+// getFlag reads a flag from the cache or the document store
+func (d *DAL) getFlag(ctx *gin.Context, key string) (flags.Flag, int32, error) {
+	if !flags.ValidKey(key) {
+		return flags.Flag{}, 0, fmt.Errorf("%w: %q isn't a valid flag key", flags.ErrInvalidFlag, key)
+	}
+
+	config, err := d.getConfig(ctx, flagConfigName(key), "")
+	if errors.Is(err, errConfigNotFound) {
+		return flags.Flag{}, 0, fmt.Errorf("%w: %s", errFlagNotFound, key)
+	} else if err != nil {
+		return flags.Flag{}, 0, err
+	}
+
+	flag, err := flags.FromPayload(config.Config.Config)
+	if err != nil {
+		return flag, 0, fmt.Errorf("%w: %s: %s", errUnusableFlag, key, err)
+	}
+
+	return flag, config.Version, nil
+}
+
+// SetFlagEnabled turns a flag on or off as the next version of its config.
+// Turning a flag off is its kill switch
+func (d *DAL) SetFlagEnabled(ctx *gin.Context, key string, enabled bool, req interface{}) (flags.Flag, int32, error) {
+	requestDetails := d.requestDetails(req)
+	requestDetails["flag_key"] = utils.SanitizeMessageValue(key)
+	requestDetails["enabled"] = enabled
+
+	d.EmitMessage("config.audit", "SetFlagEnabled", requestDetails)
+
+	if !flags.ValidKey(key) {
+		return flags.Flag{}, 0, fmt.Errorf("%w: %q isn't a valid flag key", flags.ErrInvalidFlag, key)
+	}
+
+	var flag flags.Flag
+	config, err := d.updateConfig(ctx, requestHost(ctx), flagConfigName(key), "SetFlagEnabled", func(config models.ConfigResponse) (models.ConfigIn, error) {
+		var err error
+		if flag, err = flags.FromPayload(config.Config.Config); err != nil {
+			return models.ConfigIn{}, fmt.Errorf("%w: %s: %s", errUnusableFlag, key, err)
+		}
+		flag.Enabled = enabled
+
+		payload, err := flag.Payload()
+		if err != nil {
+			return models.ConfigIn{}, err
+		}
+
+		return models.ConfigIn{ConfigName: config.ConfigName, Owner: config.CreatedBy, Config: payload, Parents: config.Parents}, nil
+	})
+	if errors.Is(err, errConfigNotFound) {
+		return flag, 0, fmt.Errorf("%w: %s", errFlagNotFound, key)
+	} else if err != nil {
+		return flag, 0, err
+	}
+
+	return flag, config.Version, nil
+}
+
+// EvaluateFlags evaluates flags for the authenticated host, with the tags
+// it registered with. Every flag is evaluated when keys is empty
+func (d *DAL) EvaluateFlags(ctx *gin.Context, keys []string, req interface{}) (map[string]flags.Evaluation, error) {
+	hostID := requestHost(ctx)
+
+	requestDetails := d.requestDetails(req)
+	requestDetails["flag_keys"] = d.Redactor.Field("flag_keys", keys)
+
+	evaluations, err := d.evaluateFlags(ctx, hostID, keys)
+	if err != nil {
+		requestDetails["error"] = err.Error()
+	} else {
+		variations := make(map[string]interface{}, len(evaluations))
+		errs := make(map[string]interface{})
+		for key, evaluation := range evaluations {
+			if evaluation.Reason == flags.ReasonError {
+				errs[key] = evaluation.Error
+				continue
+			}
+			variations[key] = evaluation.Variation
+		}
+		requestDetails["variations"] = variations
+		if len(errs) > 0 {
+			requestDetails["flag_errors"] = errs
+		}
+	}
+
+	d.EmitMessage("config.audit", "EvaluateFlags", requestDetails)
+
+	return evaluations, err
+}
+
+// evaluateFlags evaluates flags for a host. Stored flags that can't be
+// evaluated get an evaluation with ReasonError
+func (d *DAL) evaluateFlags(ctx *gin.Context, hostID string, keys []string) (map[string]flags.Evaluation, error) {
+	if len(keys) > maxEvaluatedFlags {
+		return nil, fmt.Errorf("%w: at most %d flags can be evaluated at once", errInvalidFlagQuery, maxEvaluatedFlags)
+	}
+
+	if len(keys) == 0 {
+		var err error
+		if keys, err = d.flagKeys(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	tags, err := d.hostTags(hostID)
+	if err != nil {
+		return nil, err
+	}
+
+	evaluations := make(map[string]flags.Evaluation, len(keys))
+	for _, key := range keys {
+		flag, version, err := d.getFlag(ctx, key)
+		// a stored flag that can't be evaluated doesn't fail the others
+		if errors.Is(err, errUnusableFlag) {
+			evaluations[key] = flags.Evaluation{Key: key, Reason: flags.ReasonError, Error: err.Error()}
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		evaluation := flag.Evaluate(hostID, tags)
+		evaluation.Version = version
+		evaluations[key] = evaluation
+	}
+
+	return evaluations, nil
+}
+
+// flagKeys returns the keys of every flag
+func (d *DAL) flagKeys(ctx *gin.Context) ([]string, error) {
+	configCollection := d.DocumentStore.Database(configDB).Collection(configCollection)
+
+	filter, err := configListFilter(models.ConfigListQuery{NamePrefix: flagConfigPrefix})
+	if err != nil {
+		return nil, err
+	}
+
+	opts := options.Find().
+		SetProjection(bson.M{"config_name": 1}).
+		SetSort(bson.D{{"config_name", 1}}).
+		SetLimit(maxEvaluatedFlags + 1)
+
+	cursor, err := configCollection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, fmt.Errorf("error accessing the collection: %s", err)
+	}
+
+	var docs []bson.M
+	if err := cursor.All(ctx, &docs); err != nil {
+		return nil, fmt.Errorf("error accessing the cursor: %s", err)
+	}
+
+	if len(docs) > maxEvaluatedFlags {
+		return nil, fmt.Errorf("%w: there are more than %d flags, evaluate them by key", errInvalidFlagQuery, maxEvaluatedFlags)
+	}
+
+	keys := make([]string, 0, len(docs))
+	for _, doc := range docs {
+		if name, ok := doc["config_name"].(string); ok {
+			keys = append(keys, strings.TrimPrefix(name, flagConfigPrefix))
+		}
+	}
+
+	return keys, nil
+}
+
+// hostTags returns the tags a host registered with. Hosts that aren't
+// registered have no tags
+func (d *DAL) hostTags(hostID string) ([]string, error) {
+	if hostID == "" || d.Database == nil {
+		return nil, nil
+	}
+
+	tags, err := d.Database.GetHostTags(hostID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to read the host tags: %s", err)
+	}
+
+	return tags, nil
+}
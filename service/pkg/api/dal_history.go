@@ -0,0 +1,81 @@
+package api
+
+import (
+	"context"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/aeekayy/stilla/service/pkg/api/models"
+	"github.com/aeekayy/stilla/service/pkg/utils"
+)
+
+// GetConfigHistory returns the stored versions of a config, oldest first,
+// and its scheduled changes
+func (d *DAL) GetConfigHistory(ctx context.Context, configID string, req interface{}) (models.ConfigHistory, error) {
+	var history models.ConfigHistory
+
+	requestDetails := d.requestDetails(req)
+	requestDetails["config_id"] = utils.SanitizeMessageValue(configID)
+
+	d.EmitMessage("config.audit", "GetConfigHistory", requestDetails)
+
+	idFilter, err := configIDFilter(configID)
+	if err != nil {
+		return history, err
+	}
+
+	configCollection := d.DocumentStore.Database(configDB).Collection(configCollection)
+
+	var config bson.M
+	err = configCollection.FindOne(ctx, bson.D{{"$and", []bson.M{idFilter, notDeletedFilter}}}).Decode(&config)
+	if err == mongo.ErrNoDocuments {
+		return history, errConfigNotFound
+	} else if err != nil {
+		return history, fmt.Errorf("error accessing the document: %s", err)
+	}
+
+	if history.Versions, err = d.configVersions(ctx, config); err != nil {
+		return history, err
+	}
+
+	configName, _ := config["config_name"].(string)
+	history.Schedules, err = d.configSchedules(ctx, configName)
+
+	return history, err
+}
+
+// configVersions returns the stored versions of a config document, oldest
+// first
+func (d *DAL) configVersions(ctx context.Context, config bson.M) ([]models.ConfigResponse, error) {
+	filter := configVersionsFilter(config)
+	if filter == nil {
+		return nil, nil
+	}
+
+	configVersionCollection := d.DocumentStore.Database(configDB).Collection(configVersionCollectionlection)
+
+	cursor, err := configVersionCollection.Find(ctx, filter, options.Find().SetSort(bson.D{{"version", 1}, {"_id", 1}}))
+	if err != nil {
+		return nil, fmt.Errorf("error accessing the versions: %s", err)
+	}
+
+	var docs []bson.M
+	if err := cursor.All(ctx, &docs); err != nil {
+		return nil, fmt.Errorf("error accessing the cursor: %s", err)
+	}
+
+	versions := make([]models.ConfigResponse, 0, len(docs))
+	for _, doc := range docs {
+		var stored models.ConfigResponse
+		if err := stored.Ingest(doc); err != nil {
+			return nil, fmt.Errorf("error decoding the version: %s", err)
+		}
+
+		versions = append(versions, stored)
+	}
+
+	return versions, nil
+}
@@ -0,0 +1,184 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/aeekayy/stilla/service/pkg/api/models"
+	"github.com/aeekayy/stilla/service/pkg/checksum"
+	"github.com/aeekayy/stilla/service/pkg/interpolate"
+	svcmodels "github.com/aeekayy/stilla/service/pkg/models"
+	"github.com/aeekayy/stilla/service/pkg/utils"
+)
+
+const (
+	// shareTagPrefix tags configs that other hosts can reference.
+	// share:<host ID> shares a config with one host and share:* with every
+	// host
+	shareTagPrefix = "share:"
+	// shareAll the share tag value that shares a config with every host
+	shareAll = "*"
+)
+
+// errUnresolvedReference returned for a reference to a config or an
+// environment variable that doesn't exist
+var errUnresolvedReference = newDALError(kindUnprocessable, "unresolved_reference", "the reference can't be resolved")
+
+// errReferenceForbidden returned for a reference the host can't read
+var errReferenceForbidden = newDALError(kindForbidden, "reference_forbidden", "the host can't read the reference")
+
+// errShareForbidden returned when a host that doesn't own a config adds a
+// share tag to it
+var errShareForbidden = newDALError(kindForbidden, "share_forbidden", "only the owner of a config or an admin can share it")
+
+// RenderConfig resolves the references in the payload of a config for the
+// host that reads it. The checksum of the response is the one of the
+// rendered payload
+func (d *DAL) RenderConfig(ctx *gin.Context, config models.ConfigResponse, req interface{}) (models.ConfigResponse, error) {
+	resolver := &configResolver{
+		d:     d,
+		ctx:   ctx,
+		host:  requestHost(ctx),
+		admin: isAdmin(d, ctx),
+	}
+
+	var settings svcmodels.Interpolation
+	if d.Config != nil {
+		settings = d.Config.Interpolation
+	}
+
+	resolved, err := interpolate.Resolve(config.ConfigName, config.Config.Config, resolver, settings.GetMaxDepth())
+
+	requestDetails := d.requestDetails(req)
+	requestDetails["config_id"] = utils.SanitizeMessageValue(config.ConfigID)
+	requestDetails["references"] = resolver.references()
+	if err != nil {
+		requestDetails["error"] = err.Error()
+	}
+	d.EmitMessage("config.audit", "RenderConfig", requestDetails)
+
+	if err != nil {
+		return config, err
+	}
+
+	payload, _ := resolved.(map[string]interface{})
+	sum, err := checksum.Of(payload)
+	if err != nil {
+		return config, err
+	}
+
+	config.Config = models.ConfigVersion{Config: payload, Checksum: models.Checksum(sum)}
+	return config, nil
+}
+
+// configResolver reads the configs and environment variables that a
+// config references, for the host that reads the config
+type configResolver struct {
+	d     *DAL
+	ctx   *gin.Context
+	host  string
+	admin bool
+	read  []string
+}
+
+// Config returns the payload of a referenced config. The host must own the
+// config, or the config must be shared with the host
+func (r *configResolver) Config(name string) (interface{}, error) {
+	config, err := r.d.getConfig(r.ctx, name, "")
+	if errors.Is(err, errConfigNotFound) {
+		return nil, fmt.Errorf("%w: the config %s doesn't exist", errUnresolvedReference, name)
+	} else if err != nil {
+		return nil, err
+	}
+
+	if !r.admin && !sharedWith(config, r.host) {
+		return nil, fmt.Errorf("%w: the config %s isn't shared with the host", errReferenceForbidden, name)
+	}
+
+	r.read = append(r.read, name)
+	return config.Config.Config, nil
+}
+
+// Env returns the value of an environment variable listed in
+// interpolation.env
+func (r *configResolver) Env(name string) (string, error) {
+	if r.d.Config == nil || !r.d.Config.Interpolation.AllowsEnv(name) {
+		return "", fmt.Errorf("%w: the environment variable %s isn't listed in interpolation.env", errReferenceForbidden, name)
+	}
+
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("%w: the environment variable %s isn't set", errUnresolvedReference, name)
+	}
+
+	return value, nil
+}
+
+// references returns the configs that were read, for the audit event
+func (r *configResolver) references() []interface{} {
+	out := make([]interface{}, len(r.read))
+	for i, name := range r.read {
+		out[i] = utils.SanitizeMessageValue(name)
+	}
+
+	return out
+}
+
+// sharedWith returns whether a host can reference a config. Hosts can
+// reference the configs they created and the configs tagged
+// share:<host ID> or share:*. The host that last wrote a config doesn't
+// own it
+func sharedWith(config models.ConfigResponse, host string) bool {
+	if host != "" && config.OwnerHost == host {
+		return true
+	}
+
+	for _, tag := range config.Tags {
+		switch tag {
+		case shareTagPrefix + shareAll:
+			return true
+		case shareTagPrefix + host:
+			if host != "" {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// checkShareTags returns errShareForbidden when tags add a share tag to a
+// stored config and hostID is neither its owner nor an admin. Nil tags keep
+// the stored ones, and the host that creates a config owns it
+func (d *DAL) checkShareTags(hostID string, existing bson.M, tags []string) error {
+	if tags == nil || existing == nil || isAdminHost(d, hostID) {
+		return nil
+	}
+
+	var config models.ConfigResponse
+	if err := config.Ingest(existing); err != nil {
+		return fmt.Errorf("unable to read the config: %s", err)
+	}
+
+	if hostID != "" && config.OwnerHost == hostID {
+		return nil
+	}
+
+	shared := make(map[string]bool, len(config.Tags))
+	for _, tag := range config.Tags {
+		shared[tag] = true
+	}
+
+	for _, tag := range tags {
+		if strings.HasPrefix(tag, shareTagPrefix) && !shared[tag] {
+			return fmt.Errorf("%w: %s", errShareForbidden, tag)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,301 @@
+package api
+
+import (
+	"context"
+	b64 "encoding/base64"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/aeekayy/stilla/service/pkg/api/models"
+)
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 100
+	defaultListSort  = "config_name"
+	tagMatchAll      = "all"
+	tagMatchAny      = "any"
+)
+
+// errInvalidListQuery returned when the filters, sort or cursor of a config
+// list can't be used
+var errInvalidListQuery = newDALError(kindValidation, "invalid_query", "invalid config list query")
+
+// listSortFields maps the sort fields of the list API to document fields
+var listSortFields = map[string]string{
+	"config_name": "config_name",
+	"created":     "created",
+	"modified":    "modified",
+}
+
+// configIndexes the indexes that back the config list filters and sorts.
+// Every sort index ends in _id, which breaks ties between pages. Config names
+// are unique, so concurrent writes can't create a config twice
+var configIndexes = []mongo.IndexModel{
+	{Keys: bson.D{{"config_name", 1}, {"_id", 1}}, Options: options.Index().SetName("config_name_id")},
+	{Keys: bson.D{{"config_name", 1}}, Options: options.Index().SetName("config_name_unique").SetUnique(true)},
+	{Keys: bson.D{{"created", 1}, {"_id", 1}}, Options: options.Index().SetName("created_id")},
+	{Keys: bson.D{{"modified", 1}, {"_id", 1}}, Options: options.Index().SetName("modified_id")},
+	{Keys: bson.D{{"created_by", 1}, {"config_name", 1}}, Options: options.Index().SetName("created_by_config_name")},
+	{Keys: bson.D{{"host", 1}, {"config_name", 1}}, Options: options.Index().SetName("host_config_name")},
+	{Keys: bson.D{{"tags", 1}}, Options: options.Index().SetName("tags")},
+}
+
+// listCursor the position after the last config of a page. It's bound to
+// the sort order it was created with
+type listCursor struct {
+	Sort  string      `bson:"s"`
+	Value interface{} `bson:"v"`
+	ID    interface{} `bson:"id"`
+}
+
+// GetConfigs returns a page of configs that match the query. Pages are
+// cursor based, so configs that are added between pages are not skipped
+func (d *DAL) GetConfigs(ctx context.Context, query models.ConfigListQuery, req interface{}) (models.ConfigList, error) {
+	var list models.ConfigList
+
+	requestDetails := d.requestDetails(req)
+	requestDetails["query"] = d.Redactor.Field("query", query)
+
+	d.EmitMessage("config.audit", "GetConfigs", requestDetails)
+
+	limit, err := listLimit(query.Limit)
+	if err != nil {
+		return list, err
+	}
+
+	field, direction, err := listSort(query.Sort)
+	if err != nil {
+		return list, err
+	}
+
+	filter, err := configListFilter(query)
+	if err != nil {
+		return list, err
+	}
+
+	pageFilter := filter
+	if query.Cursor != "" {
+		cursor, err := decodeListCursor(query.Cursor)
+		if err != nil {
+			return list, err
+		}
+
+		if cursor.Sort != listSortKey(field, direction) {
+			return list, fmt.Errorf("%w: the cursor was created with a different sort", errInvalidListQuery)
+		}
+
+		pageFilter = bson.D{{"$and", bson.A{filter, cursorFilter(field, direction, cursor)}}}
+	}
+
+	configCollection := d.DocumentStore.Database(configDB).Collection(configCollection)
+
+	// fetch one more than the limit to know if there's a next page
+	findOptions := options.Find()
+	findOptions.SetLimit(limit + 1)
+	findOptions.SetSort(bson.D{{field, direction}, {"_id", direction}})
+	findOptions.SetProjection(bson.D{{"config_version", 0}})
+
+	cursor, err := configCollection.Find(ctx, pageFilter, findOptions)
+	if err != nil {
+		return list, fmt.Errorf("error accessing the documents: %s", err)
+	}
+
+	var results []bson.M
+	if err = cursor.All(ctx, &results); err != nil {
+		return list, fmt.Errorf("error accessing the cursor: %s", err)
+	}
+
+	total, err := configCollection.CountDocuments(ctx, filter)
+	if err != nil {
+		return list, fmt.Errorf("error counting the documents: %s", err)
+	}
+	list.Total = total
+
+	if int64(len(results)) > limit {
+		results = results[:limit]
+		last := results[len(results)-1]
+
+		list.Next, err = encodeListCursor(listCursor{
+			Sort:  listSortKey(field, direction),
+			Value: last[field],
+			ID:    last["_id"],
+		})
+		if err != nil {
+			return list, err
+		}
+	}
+
+	list.Data = make([]models.ConfigResponse, 0, len(results))
+	for _, result := range results {
+		var config models.ConfigResponse
+		if err := config.Ingest(result); err != nil {
+			return list, fmt.Errorf("error decoding the config: %s", err)
+		}
+		list.Data = append(list.Data, config)
+	}
+
+	return list, nil
+}
+
+// collectionIndexes the indexes of each collection
+var collectionIndexes = []struct {
+	collection string
+	indexes    []mongo.IndexModel
+}{
+	{configCollection, configIndexes},
+	{configScheduleCollection, scheduleIndexes},
+	{configOverrideCollection, overrideIndexes},
+	{configChangeRequestCollection, changeRequestIndexes},
+}
+
+// EnsureIndexes creates the indexes of the config, schedule, override and
+// change request collections. Existing indexes are left as they are
+func (d *DAL) EnsureIndexes(ctx context.Context) error {
+	var errs []error
+	for _, c := range collectionIndexes {
+		collection := d.DocumentStore.Database(configDB).Collection(c.collection)
+
+		// a collection whose indexes can't be created doesn't hold up the
+		// others
+		names, err := collection.Indexes().CreateMany(ctx, c.indexes)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("unable to create the %s indexes: %s", c.collection, err))
+			continue
+		}
+
+		d.Logger.Infof("ensured %s indexes %s", c.collection, strings.Join(names, ", "))
+	}
+
+	return errors.Join(errs...)
+}
+
+// configListFilter builds the document filter of a list query. Deleted
+// configs are never listed
+func configListFilter(query models.ConfigListQuery) (bson.D, error) {
+	filter := bson.D{{"deleted", bson.M{"$exists": false}}}
+
+	if query.NamePrefix != "" {
+		// an anchored, case sensitive prefix can use the config_name index
+		filter = append(filter, bson.E{"config_name", bson.M{"$regex": "^" + regexp.QuoteMeta(query.NamePrefix)}})
+	}
+
+	if query.Owner != "" {
+		filter = append(filter, bson.E{"created_by", bson.M{"$eq": query.Owner}})
+	}
+
+	if query.Host != "" {
+		filter = append(filter, bson.E{"host", bson.M{"$eq": query.Host}})
+	}
+
+	switch query.TagMatch {
+	case "", tagMatchAll:
+		if len(query.Tags) > 0 {
+			filter = append(filter, bson.E{"tags", bson.M{"$all": query.Tags}})
+		}
+	case tagMatchAny:
+		if len(query.Tags) > 0 {
+			filter = append(filter, bson.E{"tags", bson.M{"$in": query.Tags}})
+		}
+	default:
+		return nil, fmt.Errorf("%w: tag_match must be %s or %s", errInvalidListQuery, tagMatchAll, tagMatchAny)
+	}
+
+	if !query.ModifiedSince.IsZero() {
+		filter = append(filter, bson.E{"modified", bson.M{"$gte": query.ModifiedSince}})
+	}
+
+	return filter, nil
+}
+
+// cursorFilter matches the configs that sort after the cursor. Configs with
+// the same sort value are ordered by _id
+func cursorFilter(field string, direction int, cursor listCursor) bson.M {
+	op := "$gt"
+	if direction < 0 {
+		op = "$lt"
+	}
+
+	return bson.M{"$or": bson.A{
+		bson.M{field: bson.M{op: cursor.Value}},
+		bson.M{field: cursor.Value, "_id": bson.M{op: cursor.ID}},
+	}}
+}
+
+// listLimit returns the page size. Zero uses the default
+func listLimit(limit int64) (int64, error) {
+	if limit < 0 {
+		return 0, fmt.Errorf("%w: the limit can't be negative", errInvalidListQuery)
+	}
+
+	if limit == 0 {
+		return defaultListLimit, nil
+	}
+
+	if limit > maxListLimit {
+		return maxListLimit, nil
+	}
+
+	return limit, nil
+}
+
+// listSort returns the document field and direction of a sort parameter
+func listSort(sort string) (string, int, error) {
+	if sort == "" {
+		sort = defaultListSort
+	}
+
+	direction := 1
+	if strings.HasPrefix(sort, "-") {
+		direction = -1
+		sort = strings.TrimPrefix(sort, "-")
+	}
+
+	field, ok := listSortFields[sort]
+	if !ok {
+		return "", 0, fmt.Errorf("%w: can't sort by %q", errInvalidListQuery, sort)
+	}
+
+	return field, direction, nil
+}
+
+// listSortKey identifies a sort order in a cursor
+func listSortKey(field string, direction int) string {
+	if direction < 0 {
+		return "-" + field
+	}
+
+	return field
+}
+
+// encodeListCursor encodes a cursor as an opaque token
+func encodeListCursor(cursor listCursor) (string, error) {
+	b, err := bson.Marshal(cursor)
+	if err != nil {
+		return "", fmt.Errorf("unable to encode the cursor: %s", err)
+	}
+
+	return b64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// decodeListCursor decodes a token from encodeListCursor
+func decodeListCursor(token string) (listCursor, error) {
+	var cursor listCursor
+
+	b, err := b64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return cursor, fmt.Errorf("%w: malformed cursor", errInvalidListQuery)
+	}
+
+	if err := bson.Unmarshal(b, &cursor); err != nil {
+		return cursor, fmt.Errorf("%w: malformed cursor", errInvalidListQuery)
+	}
+
+	return cursor, nil
+}
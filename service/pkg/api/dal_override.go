@@ -0,0 +1,374 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/aeekayy/stilla/service/pkg/api/models"
+	"github.com/aeekayy/stilla/service/pkg/patch"
+	"github.com/aeekayy/stilla/service/pkg/utils"
+)
+
+const (
+	configOverrideCollection = "config_override"
+	// maxOverrideTTL the longest an override can last
+	maxOverrideTTL = 7 * 24 * time.Hour
+	// maxListedOverrides the most active overrides that are listed
+	maxListedOverrides = 1000
+)
+
+// errOverrideNotFound returned for an override that doesn't exist
+var errOverrideNotFound = newDALError(kindNotFound, "override_not_found", "the override does not exist")
+
+// errOverrideActive returned when a config that has an active override is
+// overridden again
+var errOverrideActive = newDALError(kindConflict, "override_active", "the config already has an active override")
+
+// errOverrideNotActive returned when an override that was reverted or
+// failed is reverted
+var errOverrideNotActive = newDALError(kindConflict, "override_not_active", "the override is not active")
+
+// errInvalidOverride returned for an override that can't be applied
+var errInvalidOverride = newDALError(kindValidation, "invalid_override", "invalid override")
+
+// overrideIndexes the indexes the scheduler and the override list read. A
+// config has at most one active override
+var overrideIndexes = []mongo.IndexModel{
+	{Keys: bson.D{{"status", 1}, {"expires_at", 1}}, Options: options.Index().SetName("status_expires_at")},
+	{
+		Keys:    bson.D{{"config_name", 1}},
+		Options: options.Index().SetName("config_name_active").SetUnique(true).SetPartialFilterExpression(bson.M{"status": models.OverrideActive}),
+	},
+}
+
+// ApplyOverride applies a JSON Merge Patch to a config as its next version
+// until the TTL ends. The keys the patch changes are restored when it's
+// reverted
+func (d *DAL) ApplyOverride(ctx *gin.Context, configID string, overrideIn models.ConfigOverrideIn, req interface{}) (models.ConfigOverride, error) {
+	var override models.ConfigOverride
+
+	requestDetails := d.requestDetails(req)
+	requestDetails["config_id"] = utils.SanitizeMessageValue(configID)
+	requestDetails["override"] = d.Redactor.Field("override", overrideIn)
+
+	d.EmitMessage("config.audit", "ApplyOverride", requestDetails)
+
+	ttl, err := time.ParseDuration(overrideIn.TTL)
+	if err != nil || ttl <= 0 || ttl > maxOverrideTTL {
+		return override, fmt.Errorf("%w: the ttl must be a duration between 1s and %s", errInvalidOverride, maxOverrideTTL)
+	}
+
+	if len(overrideIn.Patch) == 0 {
+		return override, fmt.Errorf("%w: the patch is empty", errInvalidOverride)
+	}
+
+	body, err := json.Marshal(overrideIn.Patch)
+	if err != nil {
+		return override, fmt.Errorf("%w: %s", patch.ErrInvalidPatch, err)
+	}
+
+	config, err := d.findConfig(ctx, configID, "")
+	if err != nil {
+		return override, err
+	}
+	if isProtected(config) {
+		return override, errConfigProtected
+	}
+	configName, _ := config["config_name"].(string)
+
+	overrideCollection := d.DocumentStore.Database(configDB).Collection(configOverrideCollection)
+
+	err = overrideCollection.FindOne(ctx, bson.M{"config_name": configName, "status": models.OverrideActive}).Err()
+	if err == nil {
+		return override, errOverrideActive
+	} else if err != mongo.ErrNoDocuments {
+		return override, fmt.Errorf("error accessing the overrides: %s", err)
+	}
+
+	// the revert is computed from the version that's overridden and
+	// recorded with the override, so the override can always be reverted
+	payload, baseVersion := storedConfigPayload(config)
+	revert, err := patch.Inverse(payload, body)
+	if err != nil {
+		return override, err
+	}
+
+	now := time.Now().UTC()
+	override = models.ConfigOverride{
+		ConfigName:  configName,
+		Patch:       overrideIn.Patch,
+		Revert:      revert,
+		Reason:      overrideIn.Reason,
+		Status:      models.OverrideActive,
+		CreatedBy:   requestHost(ctx),
+		Created:     now,
+		ExpiresAt:   now.Add(ttl),
+		BaseVersion: baseVersion,
+	}
+
+	// the override is recorded first, so the unique index turns away a
+	// concurrent override of the same config
+	result, err := overrideCollection.InsertOne(ctx, override)
+	if mongo.IsDuplicateKeyError(err) {
+		return override, errOverrideActive
+	} else if err != nil {
+		return override, fmt.Errorf("error recording the override: %s", err)
+	}
+	override.ID, _ = result.InsertedID.(primitive.ObjectID)
+
+	updated, err := d.updateConfig(ctx, requestHost(ctx), configName, "ApplyOverride", func(config models.ConfigResponse) (models.ConfigIn, error) {
+		// the revert only undoes the override on top of the version it
+		// was computed from
+		if config.Version != override.BaseVersion {
+			return models.ConfigIn{}, fmt.Errorf("%w: the config changed while it was overridden", errVersionConflict)
+		}
+
+		patched, err := patch.Merge(config.Config.Config, body)
+		if err != nil {
+			return models.ConfigIn{}, err
+		}
+
+		payload, ok := patched.(map[string]interface{})
+		if !ok {
+			return models.ConfigIn{}, errPatchNotObject
+		}
+
+		return models.ConfigIn{ConfigName: config.ConfigName, Owner: config.CreatedBy, Config: payload, Parents: config.Parents}, nil
+	})
+	if err != nil {
+		if _, deleteErr := overrideCollection.DeleteOne(ctx, bson.M{"_id": override.ID}); deleteErr != nil {
+			d.Logger.Errorf("unable to remove override %s: %s", override.ID.Hex(), deleteErr)
+		}
+		return override, err
+	}
+	override.Version = updated.Version
+
+	// the override is reverted without its version, so it's in effect even
+	// if the version isn't recorded
+	if _, err := overrideCollection.UpdateOne(ctx, bson.M{"_id": override.ID}, bson.M{"$set": bson.M{"version": override.Version}}); err != nil {
+		d.Logger.Errorf("unable to record the version of override %s: %s", override.ID.Hex(), err)
+	}
+
+	return override, nil
+}
+
+// RevertOverride reverts an active override of a config before its TTL
+// ends
+func (d *DAL) RevertOverride(ctx *gin.Context, configID, overrideID string, req interface{}) (models.ConfigOverride, error) {
+	var override models.ConfigOverride
+
+	requestDetails := d.requestDetails(req)
+	requestDetails["config_id"] = utils.SanitizeMessageValue(configID)
+	requestDetails["override_id"] = utils.SanitizeMessageValue(overrideID)
+
+	d.EmitMessage("config.audit", "RevertOverride", requestDetails)
+
+	objID, err := primitive.ObjectIDFromHex(overrideID)
+	if err != nil {
+		return override, errOverrideNotFound
+	}
+
+	configName, err := d.configName(ctx, configID)
+	if err != nil {
+		return override, err
+	}
+
+	overrideCollection := d.DocumentStore.Database(configDB).Collection(configOverrideCollection)
+
+	err = overrideCollection.FindOne(ctx, bson.M{"_id": objID, "config_name": configName}).Decode(&override)
+	if err == mongo.ErrNoDocuments {
+		return override, errOverrideNotFound
+	} else if err != nil {
+		return override, fmt.Errorf("error accessing the override: %s", err)
+	}
+
+	if override.Status != models.OverrideActive {
+		return override, errOverrideNotActive
+	}
+
+	version, skipped, err := d.revertOverride(ctx, requestHost(ctx), override)
+	if err != nil {
+		return override, err
+	}
+
+	return d.finishOverride(ctx, override, requestHost(ctx), version, skipped, nil)
+}
+
+// GetActiveOverrides returns the active overrides of every config, the
+// soonest to expire first
+func (d *DAL) GetActiveOverrides(ctx *gin.Context, req interface{}) ([]models.ConfigOverride, error) {
+	requestDetails := d.requestDetails(req)
+
+	d.EmitMessage("config.audit", "GetActiveOverrides", requestDetails)
+
+	overrideCollection := d.DocumentStore.Database(configDB).Collection(configOverrideCollection)
+
+	opts := options.Find().SetSort(bson.D{{"expires_at", 1}, {"_id", 1}}).SetLimit(maxListedOverrides)
+	cursor, err := overrideCollection.Find(ctx, bson.M{"status": models.OverrideActive}, opts)
+	if err != nil {
+		return nil, fmt.Errorf("error accessing the overrides: %s", err)
+	}
+
+	overrides := make([]models.ConfigOverride, 0)
+	if err := cursor.All(ctx, &overrides); err != nil {
+		return nil, fmt.Errorf("error accessing the cursor: %s", err)
+	}
+
+	return overrides, nil
+}
+
+// revertExpiredOverrides reverts the active overrides whose TTL ended,
+// oldest first
+func (d *DAL) revertExpiredOverrides(ctx context.Context) error {
+	overrideCollection := d.DocumentStore.Database(configDB).Collection(configOverrideCollection)
+
+	filter := bson.M{"status": models.OverrideActive, "expires_at": bson.M{"$lte": time.Now().UTC()}}
+	opts := options.Find().SetSort(bson.D{{"expires_at", 1}, {"_id", 1}}).SetLimit(scheduleBatchSize)
+
+	cursor, err := overrideCollection.Find(ctx, filter, opts)
+	if err != nil {
+		return fmt.Errorf("error accessing the overrides: %s", err)
+	}
+
+	var overrides []models.ConfigOverride
+	if err := cursor.All(ctx, &overrides); err != nil {
+		return fmt.Errorf("error accessing the cursor: %s", err)
+	}
+
+	for _, override := range overrides {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		// an override that was applied before its config was protected is
+		// still reverted when its TTL ends
+		version, skipped, err := d.revertOverride(withApproval(ctx), override.CreatedBy, override)
+
+		// a backend failure or a concurrent write leaves the override
+		// active, so it's reverted on a later tick
+		kind, _, ok := errorCode(err)
+		if err != nil && (!ok || kind == kindUnavailable) {
+			return fmt.Errorf("unable to revert override %s: %w", override.ID.Hex(), err)
+		} else if err != nil && kind == kindConflict {
+			d.Logger.Warnf("override %s of %s changed while it was reverted, retrying", override.ID.Hex(), override.ConfigName)
+			continue
+		}
+
+		if _, err := d.finishOverride(ctx, override, "", version, skipped, err); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// revertOverride applies the inverse of an override to the current version
+// of its config as written by hostID and returns the version it's at. Keys
+// that changed after the override keep their values, and their JSON
+// Pointers are returned. The revert of a protected config is a change
+// request unless ctx is approved
+func (d *DAL) revertOverride(ctx context.Context, hostID string, override models.ConfigOverride) (int32, []string, error) {
+	if override.Revert == nil {
+		return 0, nil, fmt.Errorf("%w: the override has no recorded revert", errInvalidOverride)
+	}
+
+	applied, err := json.Marshal(override.Patch)
+	if err != nil {
+		return 0, nil, fmt.Errorf("unable to read the override patch: %s", err)
+	}
+
+	var skipped []string
+	config, err := d.updateConfig(ctx, hostID, override.ConfigName, "RevertOverride", func(config models.ConfigResponse) (models.ConfigIn, error) {
+		revert, changed, err := patch.Revertible(config.Config.Config, applied, override.Revert)
+		if err != nil {
+			return models.ConfigIn{}, err
+		}
+		skipped = changed
+
+		body, err := json.Marshal(revert)
+		if err != nil {
+			return models.ConfigIn{}, fmt.Errorf("unable to read the revert patch: %s", err)
+		}
+
+		patched, err := patch.Merge(config.Config.Config, body)
+		if err != nil {
+			return models.ConfigIn{}, err
+		}
+
+		payload, ok := patched.(map[string]interface{})
+		if !ok {
+			return models.ConfigIn{}, errPatchNotObject
+		}
+
+		return models.ConfigIn{ConfigName: config.ConfigName, Owner: config.CreatedBy, Config: payload, Parents: config.Parents}, nil
+	})
+
+	return config.Version, skipped, err
+}
+
+// finishOverride records the outcome of reverting an override and emits an
+// OverrideReverted audit event. revertedBy is empty when the TTL ended, and
+// skipped lists the keys that weren't reverted
+func (d *DAL) finishOverride(ctx context.Context, override models.ConfigOverride, revertedBy string, version int32, skipped []string, revertErr error) (models.ConfigOverride, error) {
+	now := time.Now().UTC()
+
+	set := bson.M{"status": models.OverrideReverted, "reverted": now, "reverted_version": version}
+	if revertedBy != "" {
+		set["reverted_by"] = revertedBy
+	}
+	if len(skipped) > 0 {
+		set["skipped"] = skipped
+	}
+	if revertErr != nil {
+		set = bson.M{"status": models.OverrideFailed, "error": revertErr.Error()}
+	}
+
+	overrideCollection := d.DocumentStore.Database(configDB).Collection(configOverrideCollection)
+
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err := overrideCollection.FindOneAndUpdate(ctx, bson.M{"_id": override.ID, "status": models.OverrideActive}, bson.M{"$set": set}, opts).Decode(&override)
+	if err == mongo.ErrNoDocuments {
+		// the override was reverted by another request in the meantime
+		return override, errOverrideNotActive
+	} else if err != nil {
+		return override, fmt.Errorf("unable to record override %s: %s", override.ID.Hex(), err)
+	}
+
+	details := map[string]interface{}{
+		"override_id": override.ID.Hex(),
+		"config_name": utils.SanitizeMessageValue(override.ConfigName),
+		"created_by":  utils.SanitizeMessageValue(override.CreatedBy),
+		"expires_at":  override.ExpiresAt.Format(time.RFC3339),
+		"expired":     revertedBy == "",
+		"status":      override.Status,
+	}
+	if revertedBy != "" {
+		details["reverted_by"] = utils.SanitizeMessageValue(revertedBy)
+	}
+
+	if revertErr != nil {
+		details["error"] = revertErr.Error()
+		d.Logger.Errorf("unable to revert override %s: %v", override.ID.Hex(), d.Redactor.Error(revertErr, override.ConfigName))
+	} else {
+		details["version"] = version
+		d.Logger.Infof("reverted override %s of %s at version %d", override.ID.Hex(), override.ConfigName, version)
+	}
+
+	// keys another write changed during the override are left as they are
+	if len(skipped) > 0 && revertErr == nil {
+		details["skipped"] = skipped
+		d.Logger.Warnf("override %s of %s left %d changed keys as they are", override.ID.Hex(), override.ConfigName, len(skipped))
+	}
+
+	d.EmitMessage("config.audit", "OverrideReverted", details)
+
+	return override, nil
+}
@@ -0,0 +1,138 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/aeekayy/stilla/service/pkg/api/models"
+	"github.com/aeekayy/stilla/service/pkg/patch"
+	"github.com/aeekayy/stilla/service/pkg/utils"
+)
+
+// errVersionConflict returned when a config gets a new version while it's
+// being updated
+var errVersionConflict = newDALError(kindConflict, "version_conflict", "the config changed while it was being updated")
+
+// errPatchNotObject returned when a patch turns the payload into anything
+// but an object
+var errPatchNotObject = newDALError(kindUnprocessable, "patch_not_object", "the patched config must be an object")
+
+// PatchConfig applies a JSON Merge Patch or a JSON Patch to the current
+// version of a config. The result is stored as the next version
+func (d *DAL) PatchConfig(ctx context.Context, configID string, mediaType string, body []byte, req interface{}) (models.ConfigResponse, error) {
+	requestDetails := d.requestDetails(req)
+	requestDetails["config_id"] = utils.SanitizeMessageValue(configID)
+	requestDetails["media_type"] = mediaType
+
+	var doc interface{}
+	if err := json.Unmarshal(body, &doc); err == nil {
+		requestDetails["patch"] = d.Redactor.Field("patch", doc)
+	}
+
+	d.EmitMessage("config.audit", "PatchConfig", requestDetails)
+
+	var apply func(interface{}, []byte) (interface{}, error)
+	switch mediaType {
+	case patch.MediaTypeMergePatch:
+		apply = patch.Merge
+	case patch.MediaTypeJSONPatch:
+		apply = patch.Apply
+	default:
+		return models.ConfigResponse{}, fmt.Errorf("%w: unsupported media type %q", patch.ErrInvalidPatch, mediaType)
+	}
+
+	return d.updateConfig(ctx, requestHost(ctx), configID, "PatchConfig", func(config models.ConfigResponse) (models.ConfigIn, error) {
+		patched, err := apply(config.Config.Config, body)
+		if err != nil {
+			return models.ConfigIn{}, err
+		}
+
+		payload, ok := patched.(map[string]interface{})
+		if !ok {
+			return models.ConfigIn{}, errPatchNotObject
+		}
+
+		return models.ConfigIn{ConfigName: config.ConfigName, Owner: config.CreatedBy, Config: payload, Parents: config.Parents}, nil
+	})
+}
+
+// UpdateConfigByID replaces the payload of a config, and its parents when
+// they're set. The result is stored as the next version
+func (d *DAL) UpdateConfigByID(ctx *gin.Context, configID string, updateConfigIn models.UpdateConfigIn, req interface{}) (models.ConfigResponse, error) {
+	requestDetails := d.requestDetails(req)
+	requestDetails["updateConfig"] = d.Redactor.Field("updateConfig", updateConfigIn)
+
+	// select database and collection ith Client.Database method
+	// and Database.Collection method
+	d.EmitMessage("config.audit", "UpdateConfigByID", requestDetails)
+
+	return d.updateConfig(ctx, requestHost(ctx), configID, "UpdateConfigByID", func(config models.ConfigResponse) (models.ConfigIn, error) {
+		parents := config.Parents
+		if updateConfigIn.Parents != nil {
+			parents = updateConfigIn.Parents
+		}
+
+		return models.ConfigIn{ConfigName: config.ConfigName, Owner: config.CreatedBy, Config: updateConfigIn.Config, Parents: parents}, nil
+	})
+}
+
+// updateConfig reads the current version of a config, builds the next one
+// with change and stores it through insertConfig as written by hostID. The
+// write fails with errVersionConflict if another version is stored in
+// between
+func (d *DAL) updateConfig(ctx context.Context, hostID string, configID string, funcName string, change func(models.ConfigResponse) (models.ConfigIn, error)) (models.ConfigResponse, error) {
+	var config models.ConfigResponse
+
+	idFilter, err := configIDFilter(configID)
+	if err != nil {
+		return config, err
+	}
+
+	configCollection := d.DocumentStore.Database(configDB).Collection(configCollection)
+
+	var existing bson.M
+	err = configCollection.FindOne(ctx, bson.D{{"$and", []bson.M{idFilter, notDeletedFilter}}}).Decode(&existing)
+	if err == mongo.ErrNoDocuments {
+		return config, errConfigNotFound
+	} else if err != nil {
+		return config, fmt.Errorf("error accessing the document: %s", err)
+	}
+
+	if err := config.Ingest(existing); err != nil {
+		return config, fmt.Errorf("unable to read the config: %s", err)
+	}
+
+	configIn, err := change(config)
+	if err != nil {
+		return config, err
+	}
+
+	// the version the change is based on must still be the latest. Configs
+	// stored without a version aren't checked
+	_, version := storedConfigPayload(existing)
+
+	write, err := d.insertConfig(ctx, hostID, configIn, version, funcName)
+	if err != nil {
+		return config, err
+	}
+
+	// a change that leaves the config as it is doesn't store a version
+	config.Config = models.ConfigVersion{Config: configIn.Config, Checksum: models.Checksum(write.Checksum)}
+	if write.Unchanged {
+		return config, nil
+	}
+
+	config.Parents = configIn.Parents
+	config.Host = hostID
+	config.Modified = time.Now()
+	config.Version = write.Version
+
+	d.Logger.Infof("updated config %s to version %d", config.ConfigID, config.Version)
+	return config, nil
+}
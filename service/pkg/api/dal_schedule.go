@@ -0,0 +1,308 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"github.com/aeekayy/stilla/service/pkg/api/models"
+	"github.com/aeekayy/stilla/service/pkg/utils"
+)
+
+const (
+	configScheduleCollection = "config_schedule"
+	// scheduleLockKey the Postgres advisory lock that's held while due
+	// changes are applied and expired overrides are reverted, so one
+	// replica does each
+	scheduleLockKey int64 = 0x5374696c6c61
+	// scheduleBatchSize the most changes applied on one tick
+	scheduleBatchSize = 100
+)
+
+// errScheduleNotFound returned for a scheduled change that doesn't exist
+var errScheduleNotFound = newDALError(kindNotFound, "schedule_not_found", "the scheduled change does not exist")
+
+// errScheduleNotPending returned when a scheduled change that was applied,
+// cancelled or failed is cancelled
+var errScheduleNotPending = newDALError(kindConflict, "schedule_not_pending", "the scheduled change is not pending")
+
+// errInvalidSchedule returned for a scheduled change that can't be applied
+var errInvalidSchedule = newDALError(kindValidation, "invalid_schedule", "invalid scheduled change")
+
+// scheduleIndexes the indexes the scheduler and the history read
+var scheduleIndexes = []mongo.IndexModel{
+	{Keys: bson.D{{"status", 1}, {"activate_at", 1}}, Options: options.Index().SetName("status_activate_at")},
+	{Keys: bson.D{{"config_name", 1}, {"activate_at", 1}}, Options: options.Index().SetName("config_name_activate_at")},
+}
+
+// ScheduleConfig schedules a payload to become the next version of a config
+// at a future time
+func (d *DAL) ScheduleConfig(ctx *gin.Context, configID string, scheduleIn models.ConfigScheduleIn, req interface{}) (models.ConfigSchedule, error) {
+	requestDetails := d.requestDetails(req)
+	requestDetails["config_id"] = utils.SanitizeMessageValue(configID)
+	requestDetails["schedule"] = d.Redactor.Field("schedule", scheduleIn)
+
+	d.EmitMessage("config.audit", "ScheduleConfig", requestDetails)
+
+	now := time.Now().UTC()
+	if !scheduleIn.ActivateAt.After(now) {
+		return models.ConfigSchedule{}, fmt.Errorf("%w: activate_at must be in the future", errInvalidSchedule)
+	}
+
+	config, err := d.findConfig(ctx, configID, "")
+	if err != nil {
+		return models.ConfigSchedule{}, err
+	}
+	if isProtected(config) {
+		return models.ConfigSchedule{}, errConfigProtected
+	}
+	configName, _ := config["config_name"].(string)
+
+	schedule := models.ConfigSchedule{
+		ConfigName: configName,
+		Config:     scheduleIn.Config,
+		Parents:    scheduleIn.Parents,
+		ActivateAt: scheduleIn.ActivateAt.UTC(),
+		Status:     models.SchedulePending,
+		CreatedBy:  requestHost(ctx),
+		Created:    now,
+	}
+
+	scheduleCollection := d.DocumentStore.Database(configDB).Collection(configScheduleCollection)
+
+	result, err := scheduleCollection.InsertOne(ctx, schedule)
+	if err != nil {
+		return schedule, fmt.Errorf("error scheduling the change: %s", err)
+	}
+	schedule.ID, _ = result.InsertedID.(primitive.ObjectID)
+
+	return schedule, nil
+}
+
+// CancelSchedule cancels a pending scheduled change of a config
+func (d *DAL) CancelSchedule(ctx *gin.Context, configID, scheduleID string, req interface{}) (models.ConfigSchedule, error) {
+	var schedule models.ConfigSchedule
+
+	requestDetails := d.requestDetails(req)
+	requestDetails["config_id"] = utils.SanitizeMessageValue(configID)
+	requestDetails["schedule_id"] = utils.SanitizeMessageValue(scheduleID)
+
+	d.EmitMessage("config.audit", "CancelSchedule", requestDetails)
+
+	objID, err := primitive.ObjectIDFromHex(scheduleID)
+	if err != nil {
+		return schedule, errScheduleNotFound
+	}
+
+	// a schedule of a deleted config can still be cancelled
+	configName, err := d.configName(ctx, configID)
+	if err != nil {
+		return schedule, err
+	}
+
+	scheduleCollection := d.DocumentStore.Database(configDB).Collection(configScheduleCollection)
+	filter := bson.M{"_id": objID, "config_name": configName}
+
+	now := time.Now().UTC()
+	update := bson.M{"$set": bson.M{
+		"status":       models.ScheduleCancelled,
+		"cancelled_by": requestHost(ctx),
+		"cancelled":    now,
+	}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	pending := bson.M{"_id": objID, "config_name": configName, "status": models.SchedulePending}
+	err = scheduleCollection.FindOneAndUpdate(ctx, pending, update, opts).Decode(&schedule)
+	if err != mongo.ErrNoDocuments {
+		if err != nil {
+			return schedule, fmt.Errorf("error cancelling the scheduled change: %s", err)
+		}
+		return schedule, nil
+	}
+
+	err = scheduleCollection.FindOne(ctx, filter).Err()
+	if err == mongo.ErrNoDocuments {
+		return schedule, errScheduleNotFound
+	} else if err != nil {
+		return schedule, fmt.Errorf("error accessing the scheduled change: %s", err)
+	}
+
+	return schedule, errScheduleNotPending
+}
+
+// configName returns the name of a config, including a deleted one
+func (d *DAL) configName(ctx context.Context, configID string) (string, error) {
+	idFilter, err := configIDFilter(configID)
+	if err != nil {
+		return "", err
+	}
+
+	configCollection := d.DocumentStore.Database(configDB).Collection(configCollection)
+
+	var doc bson.M
+	err = configCollection.FindOne(ctx, idFilter, options.FindOne().SetProjection(bson.M{"config_name": 1})).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		return "", errConfigNotFound
+	} else if err != nil {
+		return "", fmt.Errorf("error accessing the document: %s", err)
+	}
+
+	name, _ := doc["config_name"].(string)
+	return name, nil
+}
+
+// configSchedules returns the scheduled changes of a config, soonest first
+func (d *DAL) configSchedules(ctx context.Context, configName string) ([]models.ConfigSchedule, error) {
+	scheduleCollection := d.DocumentStore.Database(configDB).Collection(configScheduleCollection)
+
+	opts := options.Find().SetSort(bson.D{{"activate_at", 1}, {"_id", 1}})
+	cursor, err := scheduleCollection.Find(ctx, bson.M{"config_name": configName}, opts)
+	if err != nil {
+		return nil, fmt.Errorf("error accessing the scheduled changes: %s", err)
+	}
+
+	schedules := make([]models.ConfigSchedule, 0)
+	if err := cursor.All(ctx, &schedules); err != nil {
+		return nil, fmt.Errorf("error accessing the cursor: %s", err)
+	}
+
+	return schedules, nil
+}
+
+// RunScheduler applies the scheduled changes that are due and reverts the
+// overrides that expired on every interval until the context is done.
+// Replicas take turns through an advisory lock
+func (d *DAL) RunScheduler(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		locked, err := d.Database.WithAdvisoryLock(ctx, scheduleLockKey, d.runDueWork)
+		if err != nil {
+			d.Logger.Errorf("unable to run the scheduler: %s", err)
+		} else if !locked {
+			d.Logger.Debugf("another replica is running the scheduler")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// runDueWork applies the scheduled changes that are due, then reverts the
+// overrides that expired
+func (d *DAL) runDueWork(ctx context.Context) error {
+	if err := d.applyDueSchedules(ctx); err != nil {
+		return err
+	}
+
+	return d.revertExpiredOverrides(ctx)
+}
+
+// applyDueSchedules applies the pending changes that are due, oldest first
+func (d *DAL) applyDueSchedules(ctx context.Context) error {
+	scheduleCollection := d.DocumentStore.Database(configDB).Collection(configScheduleCollection)
+
+	filter := bson.M{"status": models.SchedulePending, "activate_at": bson.M{"$lte": time.Now().UTC()}}
+	opts := options.Find().SetSort(bson.D{{"activate_at", 1}, {"_id", 1}}).SetLimit(scheduleBatchSize)
+
+	cursor, err := scheduleCollection.Find(ctx, filter, opts)
+	if err != nil {
+		return fmt.Errorf("error accessing the scheduled changes: %s", err)
+	}
+
+	var schedules []models.ConfigSchedule
+	if err := cursor.All(ctx, &schedules); err != nil {
+		return fmt.Errorf("error accessing the cursor: %s", err)
+	}
+
+	for _, schedule := range schedules {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if err := d.applySchedule(ctx, schedule); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// applySchedule stores a scheduled change as the next version of its config
+// and records the outcome. A change the DAL rejects, such as one for a
+// deleted config, fails and isn't retried. A change to a protected config
+// awaits the approval of its change request
+func (d *DAL) applySchedule(ctx context.Context, schedule models.ConfigSchedule) error {
+	var write ConfigWrite
+	// a schedule doesn't bring back a config that was deleted
+	_, err := d.findConfig(ctx, schedule.ConfigName, "")
+	if err == nil {
+		// the change is written on behalf of the host that scheduled it
+		write, err = d.insertConfig(ctx, schedule.CreatedBy, models.ConfigIn{
+			ConfigName: schedule.ConfigName,
+			Owner:      schedule.CreatedBy,
+			Config:     schedule.Config,
+			Parents:    schedule.Parents,
+		}, 0, "ScheduleFired")
+	}
+
+	// a backend failure leaves the change pending, so it's tried again on
+	// the next tick
+	if kind, _, ok := errorCode(err); err != nil && (!ok || kind == kindUnavailable) {
+		return fmt.Errorf("unable to apply scheduled change %s: %w", schedule.ID.Hex(), err)
+	}
+
+	// a config that was protected after the change was scheduled waits for
+	// the approval of the change request the write made
+	var pending *pendingChange
+	now := time.Now().UTC()
+	set := bson.M{"status": models.ScheduleApplied, "applied": now, "version": write.Version}
+	if errors.As(err, &pending) {
+		set = bson.M{"status": models.ScheduleAwaitingApproval, "change_request_id": pending.request.ID}
+	} else if err != nil {
+		set = bson.M{"status": models.ScheduleFailed, "error": err.Error()}
+	}
+
+	scheduleCollection := d.DocumentStore.Database(configDB).Collection(configScheduleCollection)
+
+	// a change that was cancelled while it was applied stays cancelled
+	_, updateErr := scheduleCollection.UpdateOne(ctx, bson.M{"_id": schedule.ID, "status": models.SchedulePending}, bson.M{"$set": set})
+	if updateErr != nil {
+		return fmt.Errorf("unable to record scheduled change %s: %s", schedule.ID.Hex(), updateErr)
+	}
+
+	details := map[string]interface{}{
+		"schedule_id": schedule.ID.Hex(),
+		"config_name": utils.SanitizeMessageValue(schedule.ConfigName),
+		"activate_at": schedule.ActivateAt.Format(time.RFC3339),
+		"created_by":  utils.SanitizeMessageValue(schedule.CreatedBy),
+		"status":      set["status"],
+	}
+	switch {
+	case pending != nil:
+		details["change_request_id"] = pending.request.ID.Hex()
+		d.Logger.Infof("scheduled change %s of %s awaits approval as change request %s", schedule.ID.Hex(), schedule.ConfigName, pending.request.ID.Hex())
+	case err != nil:
+		details["error"] = err.Error()
+		d.Logger.Errorf("unable to apply scheduled change %s: %v", schedule.ID.Hex(), d.Redactor.Error(err, schedule.ConfigName))
+	default:
+		details["version"] = write.Version
+		details["unchanged"] = write.Unchanged
+		d.Logger.Infof("applied scheduled change %s as version %d of %s", schedule.ID.Hex(), write.Version, schedule.ConfigName)
+	}
+
+	d.EmitMessage("config.audit", "ScheduleFired", details)
+
+	return nil
+}
@@ -0,0 +1,137 @@
+package api
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+
+	"github.com/aeekayy/stilla/service/pkg/api/models"
+	"github.com/aeekayy/stilla/service/pkg/checksum"
+	"github.com/aeekayy/stilla/service/pkg/utils"
+)
+
+const (
+	maxTags      = 64  // tags per config
+	maxTagLength = 128 // characters per tag
+)
+
+// errInvalidTags returned when the tags of a config can't be stored
+var errInvalidTags = newDALError(kindValidation, "invalid_tags", "invalid tags")
+
+// UpdateConfigTags replaces the tags of a config. The config payload and
+// version are unchanged. It returns the stored tags. The tags of a protected
+// config are a change request
+func (d *DAL) UpdateConfigTags(ctx *gin.Context, configID string, tags []string, req interface{}) ([]string, error) {
+	requestDetails := d.requestDetails(req)
+	requestDetails["config_id"] = utils.SanitizeMessageValue(configID)
+	requestDetails["tags"] = d.Redactor.Field("tags", tags)
+
+	d.EmitMessage("config.audit", "UpdateConfigTags", requestDetails)
+
+	tags, err := normalizeTags(tags)
+	if err != nil {
+		return nil, err
+	}
+
+	idFilter, err := configIDFilter(configID)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := bson.D{{"$and", []bson.M{idFilter, notDeletedFilter}}}
+	configCollection := d.DocumentStore.Database(configDB).Collection(configCollection)
+
+	var existing bson.M
+	err = configCollection.FindOne(ctx, filter).Decode(&existing)
+	if err == mongo.ErrNoDocuments {
+		return nil, errConfigNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("error accessing the document: %s", err)
+	}
+
+	if err := d.checkShareTags(requestHost(ctx), existing, tags); err != nil {
+		return nil, err
+	}
+
+	// the tags of a protected config change once another host approves
+	// them. The approved change is stored as the next version
+	if isProtected(existing) && !isApproved(ctx) {
+		var current models.ConfigResponse
+		if err := current.Ingest(existing); err != nil {
+			return nil, fmt.Errorf("unable to read the config: %s", err)
+		}
+		if equalStrings(current.Tags, tags) {
+			return tags, nil
+		}
+
+		configIn := models.ConfigIn{
+			ConfigName: current.ConfigName,
+			Owner:      current.CreatedBy,
+			Config:     current.Config.Config,
+			Parents:    current.Parents,
+			Tags:       tags,
+		}
+		sum, err := checksum.Of(configIn.Config)
+		if err != nil {
+			return nil, err
+		}
+
+		request, err := d.requestChange(ctx, requestHost(ctx), existing, configIn, tags, sum, "UpdateConfigTags")
+		if err != nil {
+			return nil, err
+		}
+		return nil, &pendingChange{request: request}
+	}
+
+	update := bson.M{
+		"$set": bson.M{"tags": tags, "modified": time.Now()},
+	}
+
+	config, err := d.updateConfigState(ctx, filter, update)
+	if err != nil {
+		return nil, err
+	}
+
+	// cached copies carry the old tags
+	if err := d.invalidateConfig(config); err != nil {
+		d.Logger.Errorf("unable to invalidate the cache: %v", err)
+	}
+
+	d.Logger.Infof("updated the tags of config %s", configIndexID(config))
+	return tags, nil
+}
+
+// normalizeTags trims, deduplicates and sorts tags. Tags are case sensitive
+func normalizeTags(tags []string) ([]string, error) {
+	seen := make(map[string]bool, len(tags))
+	normalized := make([]string, 0, len(tags))
+
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			return nil, fmt.Errorf("%w: tags can't be empty", errInvalidTags)
+		}
+
+		if len(tag) > maxTagLength {
+			return nil, fmt.Errorf("%w: tags can't be longer than %d characters", errInvalidTags, maxTagLength)
+		}
+
+		if seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		normalized = append(normalized, tag)
+	}
+
+	if len(normalized) > maxTags {
+		return nil, fmt.Errorf("%w: a config can't have more than %d tags", errInvalidTags, maxTags)
+	}
+
+	sort.Strings(normalized)
+	return normalized, nil
+}
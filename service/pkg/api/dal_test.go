@@ -3,11 +3,18 @@ package api
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
 	"github.com/gin-contrib/cache/persistence"
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5"
@@ -15,10 +22,18 @@ import (
 	"github.com/pashagolub/pgxmock/v2"
 	"github.com/stretchr/testify/assert"
 	"go.mongodb.org/mongo-driver/bson"
-	// "go.mongodb.org/mongo-driver/mongo/integration/mtest"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
 	"go.uber.org/zap/zaptest"
 
+	apimodels "github.com/aeekayy/stilla/service/pkg/api/models"
+	"github.com/aeekayy/stilla/service/pkg/breaker"
+	"github.com/aeekayy/stilla/service/pkg/bundle"
+	"github.com/aeekayy/stilla/service/pkg/cache"
+	"github.com/aeekayy/stilla/service/pkg/checksum"
+	"github.com/aeekayy/stilla/service/pkg/flags"
 	"github.com/aeekayy/stilla/service/pkg/models"
+	"github.com/aeekayy/stilla/service/pkg/redact"
 	// "github.com/aeekayy/stilla/service/lib/db"
 )
 
@@ -26,6 +41,7 @@ import (
 type mockDB struct {
 	database		pgxmock.PgxPoolIface
 	Lookup			map[string]string
+	HostTags		map[string][]string
 }
 
 // NewMockDB returns a new mock database 
@@ -40,6 +56,7 @@ func NewMockDB() (mockDB, error) {
 	return mockDB{
 		database:	mock,
 		Lookup:		m,
+		HostTags:	make(map[string][]string),
 	}, nil
 }
 
@@ -65,9 +82,22 @@ func (m mockDB) GenerateAPIKey(name string, tags []string) (string, string, erro
 	m.Lookup["ApiKey"] = apiKey
 	m.Lookup["HostID"] = hostID
 	m.Lookup["Hostname"] = name
+	m.HostTags[hostID] = tags
 	return hostID, apiKey, nil
 }
 
+func (m mockDB) GetHostTags(id string) ([]string, error) {
+	tags, ok := m.HostTags[id]
+	if !ok {
+		return nil, pgx.ErrNoRows
+	}
+	return tags, nil
+}
+
+func (m mockDB) WithAdvisoryLock(ctx context.Context, key int64, fn func(context.Context) error) (bool, error) {
+	return true, fn(ctx)
+}
+
 func (m mockDB) ValidateAPIKey(id, token string) (string, error) {
 	return m.Lookup["HostID"], nil
 }
@@ -94,7 +124,11 @@ func setupDep(t *testing.T) *DAL {
 	config.Cache.Host = s.Addr()
 	config.Cache.Username = "default"
 	config.Cache.Password = redisPwd
-	testCache := persistence.NewRedisCache(config.Cache.Host, config.Cache.Password, time.Second)
+	testRedis, err := cache.NewRedis(config.Cache)
+	if err != nil {
+		t.Fatalf("could not create the redis client: %s", err)
+	}
+	testCache := persistence.NewRedisCacheWithPool(testRedis.Pool, time.Second)
 
 	// var response string
 	// cacheKey := "config_configID_hostID"
@@ -104,6 +138,7 @@ func setupDep(t *testing.T) *DAL {
 	}
 
 	dal.Cache = testCache
+	dal.Redis = testRedis
 	dal.Config = config
 	dal.Logger = sugar
 	dal.SessionKey = sessionKey
@@ -111,13 +146,139 @@ func setupDep(t *testing.T) *DAL {
 	dal.CacheEnabled = true
 	dal.Context = &ctx
 	dal.Database = pgDB
+	dal.Redactor = redact.Default()
 
-	// add mongo
-	// https://medium.com/@victor.neuret/mocking-the-official-mongo-golang-driver-5aad5b226a78
+	return dal
+}
+
+// setupMongo setup the dependencies for DAL testing with a mock document
+// store. Each command the DAL sends gets the next response added to mt
+// https://medium.com/@victor.neuret/mocking-the-official-mongo-golang-driver-5aad5b226a78
+func setupMongo(t *testing.T, mt *mtest.T) *DAL {
+	dal := setupDep(t)
+	dal.DocumentStore = mt.Client
 
 	return dal
 }
 
+// storedConfig returns a config document as the mock document store
+// returns it
+func storedConfig(name string, version int32, payload bson.D, extra ...bson.E) bson.D {
+	doc := bson.D{
+		{"_id", primitive.NewObjectID()},
+		{"config_name", name},
+		{"config_id", "id-" + name},
+		{"created_by", "owner"},
+		{"host", "host-1"},
+		{"config", bson.D{{"config", payload}, {"checksum", "sha256:stored"}}},
+		{"created", primitive.NewDateTimeFromTime(time.Now().Add(-time.Hour))},
+		{"version", version},
+	}
+
+	return append(doc, extra...)
+}
+
+// findResponse returns the response to a find command
+func findResponse(collection string, docs ...bson.D) bson.D {
+	return mtest.CreateCursorResponse(0, configDB+"."+collection, mtest.FirstBatch, docs...)
+}
+
+// updateResponse returns the response to an update command that matched n
+// documents
+func updateResponse(n int) bson.D {
+	return mtest.CreateSuccessResponse(bson.E{"n", n}, bson.E{"nModified", n})
+}
+
+// upsertResponse returns the response to an update command that inserted a
+// document
+func upsertResponse() bson.D {
+	upserted := bson.A{bson.D{{"index", 0}, {"_id", primitive.NewObjectID()}}}
+	return mtest.CreateSuccessResponse(bson.E{"n", 1}, bson.E{"nModified", 0}, bson.E{"upserted", upserted})
+}
+
+// findAndModifyResponse returns the response to a findAndModify command. A
+// nil doc matched nothing
+func findAndModifyResponse(doc bson.D) bson.D {
+	if doc == nil {
+		return mtest.CreateSuccessResponse(bson.E{"value", nil})
+	}
+
+	return mtest.CreateSuccessResponse(bson.E{"value", doc})
+}
+
+// startedCommands returns the commands the DAL sent, in order
+func startedCommands(mt *mtest.T) []bson.Raw {
+	var commands []bson.Raw
+	for _, event := range mt.GetAllStartedEvents() {
+		if event.CommandName == "endSessions" {
+			continue
+		}
+		commands = append(commands, event.Command)
+	}
+
+	return commands
+}
+
+// commandNames returns the names of the commands the DAL sent to mt
+func commandNames(mt *mtest.T) []string {
+	var names []string
+	for _, command := range startedCommands(mt) {
+		names = append(names, command.Index(0).Key())
+	}
+
+	return names
+}
+
+// auditEvent an audit event the DAL emitted
+type auditEvent struct {
+	FuncName string
+	Body     map[string]interface{}
+}
+
+// auditRecorder records the audit events the DAL emits
+type auditRecorder struct {
+	mu     sync.Mutex
+	events []auditEvent
+}
+
+// recordAudit records the audit events of dal
+func recordAudit(dal *DAL) *auditRecorder {
+	r := new(auditRecorder)
+	dal.onMessage = func(_, funcName string, body map[string]interface{}) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.events = append(r.events, auditEvent{FuncName: funcName, Body: body})
+	}
+
+	return r
+}
+
+// find returns the bodies of the events of a function
+func (r *auditRecorder) find(funcName string) []map[string]interface{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var bodies []map[string]interface{}
+	for _, event := range r.events {
+		if event.FuncName == funcName {
+			bodies = append(bodies, event.Body)
+		}
+	}
+
+	return bodies
+}
+
+// lockedDB a database where another session holds every advisory lock
+type lockedDB struct {
+	mockDB
+	keys []int64
+}
+
+func (l *lockedDB) WithAdvisoryLock(ctx context.Context, key int64, fn func(context.Context) error) (bool, error) {
+	l.keys = append(l.keys, key)
+	return false, nil
+}
+
 // TestReadFromCacheDisabled validates an error when the cache is disabled
 func TestReadFromCacheDisabled(t *testing.T) {
 	configID := "configID"
@@ -185,3 +346,1840 @@ func TestCache(t *testing.T) {
 		})
 	}
 }
+
+// TestLocalCache validates that Redis hits are served from the in-process cache
+func TestLocalCache(t *testing.T) {
+	basicBsonM := bson.M{"foo": "bar", "hello": "world"}
+
+	dal := setupDep(t)
+	dal.LocalCache = cache.NewLRU(10, time.Minute)
+
+	err := dal.writeToCache("configTest", "testhost", basicBsonM)
+	assert.Nil(t, err)
+
+	// drop the local copy so the first read goes to Redis
+	dal.LocalCache.Delete(getCacheKey("configTest", "testhost"))
+
+	for i := 0; i < 2; i++ {
+		cacheHit, result, err := dal.readFromCache("configTest", "testhost")
+		assert.Nil(t, err)
+		assert.True(t, cacheHit)
+		assert.Equal(t, basicBsonM, result)
+	}
+
+	_, _, err = dal.readFromCache("configMissing", "")
+	assert.ErrorIs(t, err, persistence.ErrCacheMiss)
+
+	stats := dal.CacheStats()
+	assert.True(t, stats.Enabled)
+	assert.Equal(t, uint64(1), stats.RedisHits)
+	assert.Equal(t, uint64(1), stats.LocalHits)
+	assert.Equal(t, uint64(1), stats.Misses)
+	assert.Equal(t, 1, stats.LocalEntries)
+}
+
+// TestInvalidateConfig validates that a write invalidates every cached variant of a config
+func TestInvalidateConfig(t *testing.T) {
+	objID := primitive.NewObjectID()
+	oldConfig := bson.M{"_id": objID, "config_name": "configTest", "version": int32(1)}
+	newConfig := bson.M{"_id": objID, "config_name": "configTest", "version": int32(2)}
+	otherConfig := bson.M{"_id": primitive.NewObjectID(), "config_name": "otherConfig", "version": int32(1)}
+
+	dal := setupDep(t)
+	dal.LocalCache = cache.NewLRU(10, time.Minute)
+
+	// the same config cached by name, by ID and per host
+	variants := [][2]string{
+		{"configTest", ""},
+		{"configTest", "testhost"},
+		{objID.Hex(), ""},
+	}
+	for _, v := range variants {
+		assert.Nil(t, dal.writeToCache(v[0], v[1], oldConfig))
+	}
+	assert.Nil(t, dal.writeToCache("otherConfig", "", otherConfig))
+
+	assert.Nil(t, dal.invalidateConfig(oldConfig))
+
+	for _, v := range variants {
+		cacheHit, _, err := dal.readFromCache(v[0], v[1])
+		assert.False(t, cacheHit, "expected %s to be invalidated", getCacheKey(v[0], v[1]))
+		assert.ErrorIs(t, err, persistence.ErrCacheMiss)
+	}
+
+	// other configs are untouched
+	cacheHit, _, err := dal.readFromCache("otherConfig", "")
+	assert.True(t, cacheHit)
+	assert.Nil(t, err)
+
+	// readers see the new version as soon as it's cached again
+	assert.Nil(t, dal.writeToCache("configTest", "", newConfig))
+	_, result, err := dal.readFromCache("configTest", "")
+	assert.Nil(t, err)
+	assert.Equal(t, int32(2), result["version"])
+
+	// the index only lists the entries written since the invalidation
+	assert.Nil(t, dal.invalidateConfig(newConfig))
+	cacheHit, _, _ = dal.readFromCache("configTest", "")
+	assert.False(t, cacheHit)
+
+	// a config without an ID can not be invalidated
+	assert.NotNil(t, dal.invalidateConfig(bson.M{"config_name": "configTest"}))
+}
+
+// TestInvalidateConfigDisabled validates that invalidation is a no-op when the cache is disabled
+func TestInvalidateConfigDisabled(t *testing.T) {
+	dal := setupDep(t)
+	dal.CacheEnabled = false
+
+	assert.Nil(t, dal.invalidateConfig(bson.M{"_id": primitive.NewObjectID()}))
+}
+
+// TestServeStale validates that the last known good copy is served while the document store is down
+func TestServeStale(t *testing.T) {
+	objID := primitive.NewObjectID()
+	config := bson.M{"_id": objID, "config_name": "configTest", "version": int32(3)}
+
+	dal := setupDep(t)
+	dal.StaleEnabled = true
+	dal.StaleTTL = 24 * time.Hour
+	dal.DocBreaker = breaker.New("docdb", 1, time.Minute)
+
+	assert.Nil(t, dal.writeToCache("configTest", "", config))
+
+	// the stale copy survives invalidation and the cache TTL
+	assert.Nil(t, dal.invalidateConfig(config))
+	cacheHit, _, _ := dal.readFromCache("configTest", "")
+	assert.False(t, cacheHit)
+
+	// open the breaker so the document store isn't called
+	assert.Nil(t, dal.DocBreaker.Allow())
+	dal.DocBreaker.Failure()
+
+	ctx := GetTestGinContext()
+	ctx.Params = gin.Params{{Key: "configId", Value: "configTest"}}
+	GetConfigByID(dal)(ctx)
+
+	assert.Equal(t, http.StatusOK, ctx.Writer.Status())
+	assert.Equal(t, "true", ctx.Writer.Header().Get("X-Stilla-Stale"))
+	assert.Contains(t, ctx.Writer.Header().Get("Warning"), "110")
+
+	// stale copies render in other formats too
+	ctx = GetTestGinContext()
+	ctx.Params = gin.Params{{Key: "configId", Value: "configTest"}}
+	ctx.Request.Header.Set("Accept", "text/x-dotenv")
+	GetConfigByID(dal)(ctx)
+	assert.Equal(t, http.StatusOK, ctx.Writer.Status())
+	assert.Equal(t, "text/x-dotenv; charset=utf-8", ctx.Writer.Header().Get("Content-Type"))
+	assert.Equal(t, "true", ctx.Writer.Header().Get("X-Stilla-Stale"))
+
+	stats := dal.CacheStats()
+	assert.Equal(t, uint64(2), stats.StaleHits)
+
+	// without a stale copy the service is unavailable
+	ctx = GetTestGinContext()
+	ctx.Params = gin.Params{{Key: "configId", Value: "missingConfig"}}
+	GetConfigByID(dal)(ctx)
+	assert.Equal(t, http.StatusServiceUnavailable, ctx.Writer.Status())
+	assert.Empty(t, ctx.Writer.Header().Get("X-Stilla-Stale"))
+}
+
+// TestGetConfigPath validates partial reads of cached configs by JSON pointer
+func TestGetConfigPath(t *testing.T) {
+	config := bson.M{
+		"_id":         primitive.NewObjectID(),
+		"config_name": "configTest",
+		"version":     int32(3),
+		"config": bson.M{"config": bson.M{
+			"database": bson.M{"host": "db.example.com", "port": int32(5432)},
+		}},
+	}
+
+	dal := setupDep(t)
+	assert.Nil(t, dal.writeToCache("configTest", "", config))
+
+	table := []struct {
+		name        string
+		query       string
+		valuePath   string
+		accept      string
+		code        int
+		contentType string
+		body        string
+	}{
+		{"TestPathQuery", "path=/database/host", "", "", http.StatusOK, "application/json; charset=utf-8", `{"data":"db.example.com"}`},
+		{"TestValueRouteText", "", "/database/port", "text/plain", http.StatusOK, "text/plain; charset=utf-8", "5432"},
+		{"TestValueRouteYAML", "format=yaml", "/database", "", http.StatusOK, "application/yaml; charset=utf-8", "host: db.example.com\nport: 5432\n"},
+		{"TestValueRouteRoot", "", "/", "", http.StatusOK, "application/json; charset=utf-8", `{"data":{"database":{"host":"db.example.com","port":5432}}}`},
+		{"TestPathMissing", "path=/database/user", "", "", http.StatusNotFound, "", ""},
+		{"TestPathInvalid", "path=database", "", "", http.StatusBadRequest, "", ""},
+		{"TestPathTextObject", "path=/database&format=text", "", "", http.StatusUnprocessableEntity, "", ""},
+	}
+
+	for _, tc := range table {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			ctx, _ := gin.CreateTestContext(w)
+			ctx.Request = &http.Request{Header: make(http.Header), URL: &url.URL{}}
+			ctx.Params = gin.Params{{Key: "configId", Value: "configTest"}}
+			if tc.valuePath != "" {
+				ctx.Params = append(ctx.Params, gin.Param{Key: "path", Value: tc.valuePath})
+			}
+			ctx.Request.URL.RawQuery = tc.query
+			if tc.accept != "" {
+				ctx.Request.Header.Set("Accept", tc.accept)
+			}
+
+			GetConfigByID(dal)(ctx)
+			assert.Equal(t, tc.code, ctx.Writer.Status())
+			if tc.contentType != "" {
+				assert.Equal(t, tc.contentType, ctx.Writer.Header().Get("Content-Type"))
+				assert.Equal(t, tc.body, w.Body.String())
+			}
+		})
+	}
+}
+
+// TestRenderConfig validates that references are resolved on reads with
+// render=true, for the host that reads the config
+func TestRenderConfig(t *testing.T) {
+	t.Setenv("STILLA_TEST_REGION", "us-east-1")
+
+	configs := map[string]bson.M{
+		"payments": {
+			"config_name": "payments",
+			"host":        "host-1",
+			"config": bson.M{"config": bson.M{
+				"db":     "${config:shared-db#/host}:${config:shared-db#/port}",
+				"port":   "${config:shared-db#/port}",
+				"region": "${env:STILLA_TEST_REGION}",
+			}},
+		},
+		"shared-db": {
+			"config_name": "shared-db",
+			"host":        "host-2",
+			"tags":        bson.A{"share:host-1"},
+			"config":      bson.M{"config": bson.M{"host": "db.example.com", "port": int32(5432)}},
+		},
+		"private": {
+			"config_name": "private",
+			"host":        "host-2",
+			"config":      bson.M{"config": bson.M{"token": "secret"}},
+		},
+		"loop": {
+			"config_name": "loop",
+			"host":        "host-1",
+			"config":      bson.M{"config": bson.M{"self": "${config:loop#/other}"}},
+		},
+		"reads-private": {
+			"config_name": "reads-private",
+			"host":        "host-1",
+			"config":      bson.M{"config": bson.M{"token": "${config:private#/token}"}},
+		},
+		"reads-env": {
+			"config_name": "reads-env",
+			"host":        "host-1",
+			"config":      bson.M{"config": bson.M{"home": "${env:HOME}"}},
+		},
+	}
+
+	dal := setupDep(t)
+	dal.Config.Interpolation.Env = []string{"STILLA_TEST_REGION"}
+	for name, config := range configs {
+		config["_id"] = primitive.NewObjectID()
+		assert.Nil(t, dal.writeToCache(name, "", config))
+	}
+
+	table := []struct {
+		name     string
+		configID string
+		query    string
+		code     int
+		body     string
+		problem  string
+	}{
+		{"TestRender", "payments", "render=true", http.StatusOK, `{"db":"db.example.com:5432","port":5432,"region":"us-east-1"}`, ""},
+		{"TestRenderPath", "payments", "render=true&path=/port", http.StatusOK, `5432`, ""},
+		{"TestNoRender", "payments", "render=false&path=/port", http.StatusOK, `"${config:shared-db#/port}"`, ""},
+		{"TestRenderInvalid", "payments", "render=maybe", http.StatusBadRequest, "", "invalid_request"},
+		{"TestRenderCycle", "loop", "render=true", http.StatusUnprocessableEntity, "", "reference_cycle"},
+		{"TestRenderForbidden", "reads-private", "render=true", http.StatusForbidden, "", "reference_forbidden"},
+		{"TestRenderEnvForbidden", "reads-env", "render=true", http.StatusForbidden, "", "reference_forbidden"},
+	}
+
+	for _, tc := range table {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, w := handlerContext(http.MethodGet, "/?"+tc.query, "", gin.Param{Key: "configId", Value: tc.configID})
+			ctx.Set("x-host-id", "host-1")
+
+			GetConfigByID(dal)(ctx)
+			assert.Equal(t, tc.code, ctx.Writer.Status(), w.Body.String())
+			if tc.problem != "" {
+				assertProblem(t, w, tc.problem)
+				return
+			}
+
+			var body struct {
+				Data json.RawMessage `json:"data"`
+			}
+			assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &body))
+			if tc.query == "render=true" {
+				var config apimodels.ConfigResponse
+				assert.Nil(t, json.Unmarshal(body.Data, &config))
+				payload, _ := json.Marshal(config.Config.Config)
+				assert.JSONEq(t, tc.body, string(payload))
+				assert.Nil(t, checksum.Verify(config.Config.Config, string(config.Config.Checksum)))
+				return
+			}
+			assert.JSONEq(t, tc.body, string(body.Data))
+		})
+	}
+
+	// admins can reference any config
+	dal.Config.AdminHosts = []string{"host-1"}
+	config, err := dal.getConfig(nil, "reads-private", "")
+	assert.Nil(t, err)
+	ctx := GetTestGinContext()
+	ctx.Set("x-host-id", "host-1")
+	rendered, err := dal.RenderConfig(ctx, config, ctx.Request)
+	assert.Nil(t, err)
+	assert.Equal(t, "secret", rendered.Config.Config["token"])
+}
+
+// TestSharedWith validates which hosts can reference a config
+func TestSharedWith(t *testing.T) {
+	config := apimodels.ConfigResponse{OwnerHost: "owner", Host: "host-3", Tags: []string{"team:core", "share:host-1"}}
+	assert.True(t, sharedWith(config, "owner"))
+	// the last writer doesn't own the config
+	assert.False(t, sharedWith(config, "host-3"))
+	assert.True(t, sharedWith(config, "host-1"))
+	assert.False(t, sharedWith(config, "host-2"))
+	assert.False(t, sharedWith(config, ""))
+
+	config.Tags = []string{"share:*"}
+	assert.True(t, sharedWith(config, "host-2"))
+}
+
+// TestCheckShareTags validates that only the owner of a config or an admin
+// can add share tags
+func TestCheckShareTags(t *testing.T) {
+	dal := setupDep(t)
+	dal.Config.AdminHosts = []string{"admin"}
+
+	existing := bson.M{"config_name": "payments", "owner_host": "owner", "host": "writer", "tags": bson.A{"share:host-1", "team:core"}}
+
+	table := []struct {
+		host string
+		tags []string
+		err  error
+	}{
+		{"owner", []string{"share:*"}, nil},
+		{"admin", []string{"share:*"}, nil},
+		{"writer", []string{"share:*"}, errShareForbidden},
+		{"writer", []string{"share:host-1", "team:core", "team:payments"}, nil},
+		{"writer", []string{"team:core"}, nil},
+		{"writer", nil, nil},
+	}
+
+	for _, tc := range table {
+		err := dal.checkShareTags(tc.host, existing, tc.tags)
+		if tc.err == nil {
+			assert.Nil(t, err, "%s %v", tc.host, tc.tags)
+		} else {
+			assert.ErrorIs(t, err, tc.err, "%s %v", tc.host, tc.tags)
+		}
+	}
+
+	// the host that creates a config owns it
+	assert.Nil(t, dal.checkShareTags("writer", nil, []string{"share:*"}))
+
+	// configs stored before their owner was recorded are shared by admins
+	delete(existing, "owner_host")
+	assert.ErrorIs(t, dal.checkShareTags("owner", existing, []string{"share:*"}), errShareForbidden)
+}
+
+// TestEvaluateFlag validates flag evaluation for the requesting host
+func TestEvaluateFlag(t *testing.T) {
+	configs := map[string]bson.M{
+		"flags/checkout": {
+			"config_name": "flags/checkout",
+			"version":     int32(3),
+			"config": bson.M{"config": bson.M{
+				"key":     "checkout",
+				"enabled": true,
+				"rules": bson.A{
+					bson.M{"tags": bson.A{"env:staging"}, "variation": "on"},
+				},
+				"fallthrough": bson.M{"variation": "off"},
+			}},
+		},
+		"flags/killed": {
+			"config_name": "flags/killed",
+			"config": bson.M{"config": bson.M{
+				"key":         "killed",
+				"enabled":     false,
+				"fallthrough": bson.M{"variation": "on"},
+			}},
+		},
+		"flags/broken": {
+			"config_name": "flags/broken",
+			"config": bson.M{"config": bson.M{
+				"key":         "broken",
+				"enabled":     true,
+				"fallthrough": bson.M{"variation": "missing"},
+			}},
+		},
+	}
+
+	dal := setupDep(t)
+	dal.Database.(mockDB).HostTags["host-1"] = []string{"env:staging"}
+	for name, config := range configs {
+		config["_id"] = primitive.NewObjectID()
+		assert.Nil(t, dal.writeToCache(name, "", config))
+	}
+
+	table := []struct {
+		name      string
+		flagKey   string
+		hostID    string
+		code      int
+		variation string
+		reason    string
+		problem   string
+	}{
+		{"TestRuleMatch", "checkout", "host-1", http.StatusOK, "on", flags.ReasonRule, ""},
+		{"TestFallthrough", "checkout", "host-2", http.StatusOK, "off", flags.ReasonFallthrough, ""},
+		{"TestKillSwitch", "killed", "host-1", http.StatusOK, "off", flags.ReasonOff, ""},
+		{"TestInvalidStoredFlag", "broken", "host-1", http.StatusUnprocessableEntity, "", "", "invalid_flag"},
+		{"TestInvalidKey", "no/slash", "host-1", http.StatusBadRequest, "", "", "invalid_flag"},
+	}
+
+	for _, tc := range table {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx, w := handlerContext(http.MethodGet, "/", "", gin.Param{Key: "flagKey", Value: tc.flagKey})
+			ctx.Set("x-host-id", tc.hostID)
+
+			EvaluateFlag(dal)(ctx)
+			assert.Equal(t, tc.code, ctx.Writer.Status(), w.Body.String())
+			if tc.problem != "" {
+				assertProblem(t, w, tc.problem)
+				return
+			}
+
+			var body struct {
+				Data flags.Evaluation `json:"data"`
+			}
+			assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &body))
+			assert.Equal(t, tc.flagKey, body.Data.Key)
+			assert.Equal(t, tc.variation, body.Data.Variation)
+			assert.Equal(t, tc.variation == "on", body.Data.Value)
+			assert.Equal(t, tc.reason, body.Data.Reason)
+		})
+	}
+
+	ctx := GetTestGinContext()
+	ctx.Set("x-host-id", "host-1")
+	evaluations, err := dal.EvaluateFlags(ctx, []string{"checkout", "killed", "broken"}, ctx.Request)
+	assert.Nil(t, err)
+	assert.Len(t, evaluations, 3)
+	assert.Equal(t, int32(3), evaluations["checkout"].Version)
+	assert.Equal(t, flags.ReasonOff, evaluations["killed"].Reason)
+
+	// a broken flag doesn't fail the others
+	assert.Equal(t, flags.ReasonError, evaluations["broken"].Reason)
+	assert.Contains(t, evaluations["broken"].Error, "invalid")
+	assert.Empty(t, evaluations["broken"].Variation)
+
+	_, err = dal.EvaluateFlags(ctx, make([]string, maxEvaluatedFlags+1), ctx.Request)
+	assert.ErrorIs(t, err, errInvalidFlagQuery)
+}
+
+// TestPutFlagKey validates that the flag key matches the path
+func TestPutFlagKey(t *testing.T) {
+	dal := setupDep(t)
+
+	ctx, w := handlerContext(http.MethodPut, "/api/v1/flag/checkout", `{"key":"other","enabled":true}`, gin.Param{Key: "flagKey", Value: "checkout"})
+
+	PutFlag(dal)(ctx)
+	assert.Equal(t, http.StatusBadRequest, ctx.Writer.Status())
+	assertProblem(t, w, "invalid_request")
+}
+
+// TestScheduleValidation validates the scheduled changes that are rejected
+// before the document store is read
+func TestScheduleValidation(t *testing.T) {
+	dal := setupDep(t)
+
+	ctx, w := handlerContext(http.MethodPost, "/api/v1/config/payments/schedules", `{"config":{"a":1}}`, gin.Param{Key: "configId", Value: "payments"})
+
+	ScheduleConfig(dal)(ctx)
+	assert.Equal(t, http.StatusBadRequest, ctx.Writer.Status())
+	assertProblem(t, w, "invalid_request")
+
+	past := apimodels.ConfigScheduleIn{Config: map[string]interface{}{"a": 1}, ActivateAt: time.Now().Add(-time.Minute)}
+	_, err := dal.ScheduleConfig(ctx, "payments", past, ctx.Request)
+	assert.ErrorIs(t, err, errInvalidSchedule)
+
+	_, err = dal.CancelSchedule(ctx, "payments", "not-an-id", ctx.Request)
+	assert.ErrorIs(t, err, errScheduleNotFound)
+}
+
+// TestOverrideValidation validates the overrides that are rejected before
+// the document store is read
+func TestOverrideValidation(t *testing.T) {
+	dal := setupDep(t)
+
+	ctx, w := handlerContext(http.MethodPost, "/api/v1/config/payments/overrides", `{"patch":{"log_level":"debug"}}`, gin.Param{Key: "configId", Value: "payments"})
+
+	ApplyOverride(dal)(ctx)
+	assert.Equal(t, http.StatusBadRequest, ctx.Writer.Status())
+	assertProblem(t, w, "invalid_request")
+
+	table := []struct {
+		name     string
+		override apimodels.ConfigOverrideIn
+	}{
+		{"TestInvalidTTL", apimodels.ConfigOverrideIn{Patch: map[string]interface{}{"log_level": "debug"}, TTL: "soon"}},
+		{"TestNegativeTTL", apimodels.ConfigOverrideIn{Patch: map[string]interface{}{"log_level": "debug"}, TTL: "-2h"}},
+		{"TestLongTTL", apimodels.ConfigOverrideIn{Patch: map[string]interface{}{"log_level": "debug"}, TTL: "169h"}},
+		{"TestEmptyPatch", apimodels.ConfigOverrideIn{Patch: map[string]interface{}{}, TTL: "2h"}},
+	}
+
+	for _, tc := range table {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := dal.ApplyOverride(ctx, "payments", tc.override, ctx.Request)
+			assert.ErrorIs(t, err, errInvalidOverride)
+		})
+	}
+
+	_, err := dal.RevertOverride(ctx, "payments", "not-an-id", ctx.Request)
+	assert.ErrorIs(t, err, errOverrideNotFound)
+}
+
+// TestRequestHost validates that DAL methods act as the host of a request
+// or of a context made for background work
+func TestRequestHost(t *testing.T) {
+	c := GetTestGinContext()
+	assert.Equal(t, "", requestHost(c))
+	c.Set("x-host", "session-host")
+	assert.Equal(t, "session-host", requestHost(c))
+	c.Set("x-host-id", "token-host")
+	assert.Equal(t, "token-host", requestHost(c))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ctx = withHost(ctx, "host-1")
+	assert.Equal(t, "host-1", requestHost(ctx))
+	assert.False(t, isApproved(ctx))
+	assert.True(t, isApproved(withApproval(ctx)))
+	assert.Equal(t, "host-1", requestHost(withApproval(ctx)))
+
+	cancel()
+	assert.ErrorIs(t, withApproval(ctx).Err(), context.Canceled)
+}
+
+// TestDropStaleConfig validates that a deleted config has no stale copy to serve
+func TestDropStaleConfig(t *testing.T) {
+	objID := primitive.NewObjectID()
+	config := bson.M{"_id": objID, "config_name": "configTest", "version": int32(3)}
+
+	dal := setupDep(t)
+	dal.StaleEnabled = true
+	dal.StaleTTL = 24 * time.Hour
+
+	assert.Nil(t, dal.writeToCache("configTest", "", config))
+	assert.Nil(t, dal.writeToCache(objID.Hex(), "", config))
+
+	assert.Nil(t, dal.invalidateConfig(config))
+	assert.Nil(t, dal.dropStaleConfig(config))
+
+	_, ok := dal.readStale("configTest", "")
+	assert.False(t, ok)
+	_, ok = dal.readStale(objID.Hex(), "")
+	assert.False(t, ok)
+}
+
+// TestConfigIDFilter validates the lookup by ObjectID or by name
+func TestConfigIDFilter(t *testing.T) {
+	objID := primitive.NewObjectID()
+
+	filter, err := configIDFilter(objID.Hex())
+	assert.Nil(t, err)
+	assert.Equal(t, bson.M{"_id": bson.M{"$eq": objID}}, filter)
+
+	filter, err = configIDFilter("configTest")
+	assert.Nil(t, err)
+	assert.Equal(t, bson.M{"config_name": bson.M{"$eq": "configTest"}}, filter)
+}
+
+// TestConfigListFilter validates the filters of the config list
+func TestConfigListFilter(t *testing.T) {
+	since := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+
+	filter, err := configListFilter(apimodels.ConfigListQuery{})
+	assert.Nil(t, err)
+	assert.Equal(t, bson.D{{"deleted", bson.M{"$exists": false}}}, filter)
+
+	filter, err = configListFilter(apimodels.ConfigListQuery{
+		NamePrefix:    "svc.",
+		Owner:         "aeekayy",
+		Host:          "host-1",
+		Tags:          []string{"team:core", "tier:1"},
+		ModifiedSince: since,
+	})
+	assert.Equal(t, bson.D{
+		{"deleted", bson.M{"$exists": false}},
+		{"config_name", bson.M{"$regex": `^svc\.`}},
+		{"created_by", bson.M{"$eq": "aeekayy"}},
+		{"host", bson.M{"$eq": "host-1"}},
+		{"tags", bson.M{"$all": []string{"team:core", "tier:1"}}},
+		{"modified", bson.M{"$gte": since}},
+	}, filter)
+
+	filter, err = configListFilter(apimodels.ConfigListQuery{Tags: []string{"a", "b"}, TagMatch: "any"})
+	assert.Nil(t, err)
+	assert.Contains(t, filter, bson.E{"tags", bson.M{"$in": []string{"a", "b"}}})
+
+	_, err = configListFilter(apimodels.ConfigListQuery{TagMatch: "some"})
+	assert.ErrorIs(t, err, errInvalidListQuery)
+}
+
+// TestNormalizeTags validates that tags are trimmed, deduplicated and sorted
+func TestNormalizeTags(t *testing.T) {
+	tags, err := normalizeTags([]string{" tier:1", "team:core", "tier:1 "})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"team:core", "tier:1"}, tags)
+
+	tags, err = normalizeTags([]string{})
+	assert.Nil(t, err)
+	assert.Empty(t, tags)
+
+	_, err = normalizeTags([]string{" "})
+	assert.ErrorIs(t, err, errInvalidTags)
+
+	tooMany := make([]string, maxTags+1)
+	for i := range tooMany {
+		tooMany[i] = fmt.Sprintf("tag-%d", i)
+	}
+	_, err = normalizeTags(tooMany)
+	assert.ErrorIs(t, err, errInvalidTags)
+}
+
+// TestListSort validates the sort parameter and page size of the config list
+func TestListSort(t *testing.T) {
+	field, direction, err := listSort("")
+	assert.Nil(t, err)
+	assert.Equal(t, "config_name", field)
+	assert.Equal(t, 1, direction)
+
+	field, direction, err = listSort("-modified")
+	assert.Nil(t, err)
+	assert.Equal(t, "modified", field)
+	assert.Equal(t, -1, direction)
+
+	_, _, err = listSort("config")
+	assert.ErrorIs(t, err, errInvalidListQuery)
+
+	limit, err := listLimit(0)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(defaultListLimit), limit)
+
+	limit, _ = listLimit(500)
+	assert.Equal(t, int64(maxListLimit), limit)
+
+	_, err = listLimit(-1)
+	assert.ErrorIs(t, err, errInvalidListQuery)
+}
+
+// TestListCursor validates that a cursor survives encoding
+func TestListCursor(t *testing.T) {
+	objID := primitive.NewObjectID()
+	modified := primitive.NewDateTimeFromTime(time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC))
+
+	token, err := encodeListCursor(listCursor{Sort: "-modified", Value: modified, ID: objID})
+	assert.Nil(t, err)
+
+	cursor, err := decodeListCursor(token)
+	assert.Nil(t, err)
+	assert.Equal(t, "-modified", cursor.Sort)
+	assert.Equal(t, modified, cursor.Value)
+	assert.Equal(t, objID, cursor.ID)
+
+	assert.Equal(t, bson.M{"$or": bson.A{
+		bson.M{"modified": bson.M{"$lt": modified}},
+		bson.M{"modified": modified, "_id": bson.M{"$lt": objID}},
+	}}, cursorFilter("modified", -1, cursor))
+
+	_, err = decodeListCursor("not a cursor")
+	assert.ErrorIs(t, err, errInvalidListQuery)
+}
+
+// TestGetConfigsInvalidQuery validates that a bad list query is rejected
+func TestGetConfigsInvalidQuery(t *testing.T) {
+	dal := setupDep(t)
+
+	for _, query := range []string{"sort=owner", "limit=ten", "cursor=abc", "modified_since=yesterday"} {
+		ctx := GetTestGinContext()
+		ctx.Request.URL = &url.URL{RawQuery: query}
+		GetConfigs(dal)(ctx)
+		assert.Equal(t, http.StatusBadRequest, ctx.Writer.Status(), query)
+	}
+}
+
+// TestImportAction validates the conflict strategies
+func TestImportAction(t *testing.T) {
+	table := []struct {
+		exists     bool
+		onConflict string
+		action     string
+	}{
+		{false, ImportSkip, importCreated},
+		{false, ImportOverwrite, importCreated},
+		{true, ImportSkip, importSkipped},
+		{true, ImportOverwrite, importOverwritten},
+		{true, ImportNewVersion, importNewVersion},
+	}
+
+	for _, tc := range table {
+		action, err := importAction(tc.exists, tc.onConflict)
+		assert.Nil(t, err)
+		assert.Equal(t, tc.action, action)
+	}
+
+	_, err := importAction(false, "replace")
+	assert.ErrorIs(t, err, errInvalidImport)
+}
+
+// TestImportedDocument validates that imported configs are stored like
+// InsertConfig stores them and exported back unchanged
+func TestImportedDocument(t *testing.T) {
+	created := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	config := bundle.Config{
+		ConfigName: "payments/api",
+		Owner:      "aeekayy",
+		Host:       "host-1",
+		Tags:       []string{"team:core"},
+		Version:    3,
+		Checksum:   "abc",
+		Created:    created,
+		Modified:   created,
+		Config:     map[string]interface{}{"db": map[string]interface{}{"port": int64(5432)}},
+	}
+
+	current, versions, err := importVersions(config)
+	assert.Nil(t, err)
+	assert.Equal(t, int32(3), current.Version)
+	assert.Equal(t, []bundle.Version{current}, versions)
+
+	doc := importedDocument(config, "config-id", current)
+	b, err := bson.Marshal(doc)
+	assert.Nil(t, err)
+
+	var stored bson.M
+	assert.Nil(t, bson.Unmarshal(b, &stored))
+
+	exported, err := exportConfig(stored)
+	assert.Nil(t, err)
+	assert.Equal(t, "config-id", exported.ConfigID)
+	assert.Equal(t, config.Tags, exported.Tags)
+	assert.Equal(t, config.Version, exported.Version)
+	assert.Equal(t, config.Owner, exported.Owner)
+	assert.True(t, created.Equal(exported.Created))
+	assert.Equal(t, int64(5432), exported.Config["db"].(map[string]interface{})["port"])
+
+	// a config without a version starts at 1
+	current, _, err = importVersions(bundle.Config{ConfigName: "redis"})
+	assert.Nil(t, err)
+	assert.Equal(t, int32(1), current.Version)
+
+	// a history must include the current version
+	config.Versions = []bundle.Version{{Version: 1}, {Version: 2}}
+	_, _, err = importVersions(config)
+	assert.ErrorIs(t, err, errInvalidImport)
+
+	config.Versions = append(config.Versions, bundle.Version{Version: 3})
+	_, versions, err = importVersions(config)
+	assert.Nil(t, err)
+	assert.Len(t, versions, 3)
+}
+
+// TestContentChecksums validates that imported checksums are verified and
+// missing ones are set
+func TestContentChecksums(t *testing.T) {
+	payload := map[string]interface{}{"port": float64(5432)}
+	sum, err := checksum.Of(payload)
+	assert.Nil(t, err)
+
+	config, err := contentChecksums(bundle.Config{
+		ConfigName: "db",
+		Version:    2,
+		Config:     payload,
+		Versions: []bundle.Version{
+			{Version: 1, Checksum: "abc", Config: map[string]interface{}{}},
+			{Version: 2, Checksum: sum, Config: payload},
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, sum, config.Checksum)
+	assert.True(t, checksum.IsContent(config.Versions[0].Checksum))
+	assert.Equal(t, sum, config.Versions[1].Checksum)
+
+	// a payload that doesn't match its checksum isn't imported
+	_, err = contentChecksums(bundle.Config{ConfigName: "db", Checksum: sum, Config: map[string]interface{}{"port": float64(5433)}})
+	assert.True(t, errors.Is(err, errInvalidImport))
+	assert.True(t, errors.Is(err, checksum.ErrMismatch))
+}
+
+// TestUnchangedConfig validates which writes are no-ops
+func TestUnchangedConfig(t *testing.T) {
+	payload := map[string]interface{}{"db": map[string]interface{}{"port": float64(5432)}}
+	sum, err := checksum.Of(payload)
+	assert.Nil(t, err)
+
+	stored := func(storedSum string, extra bson.M) bson.M {
+		doc := bson.M{
+			"config_name": "payments",
+			"config_id":   "config-id",
+			"version":     int32(4),
+			"parents":     bson.A{"base"},
+			"tags":        bson.A{"team:core"},
+			"config":      bson.M{"config": bson.M{"db": bson.M{"port": int32(5432)}}, "checksum": storedSum},
+		}
+		for k, v := range extra {
+			doc[k] = v
+		}
+		return doc
+	}
+	configIn := apimodels.ConfigIn{ConfigName: "payments", Config: payload, Parents: []string{"base"}}
+
+	table := []struct {
+		name      string
+		stored    bson.M
+		configIn  apimodels.ConfigIn
+		tags      []string
+		unchanged bool
+	}{
+		{"same content", stored(sum, nil), configIn, nil, true},
+		{"same tags", stored(sum, nil), configIn, []string{"team:core"}, true},
+		{"legacy checksum", stored("3f2a", nil), configIn, nil, true},
+		{"new config", nil, configIn, nil, false},
+		{"deleted", stored(sum, bson.M{"deleted": primitive.NewDateTimeFromTime(time.Now())}), configIn, nil, false},
+		{"new tags", stored(sum, nil), configIn, []string{"team:payments"}, false},
+		{"new parents", stored(sum, nil), apimodels.ConfigIn{ConfigName: "payments", Config: payload}, nil, false},
+		{"new payload", stored(sum, nil), apimodels.ConfigIn{ConfigName: "payments", Config: map[string]interface{}{}, Parents: []string{"base"}}, nil, false},
+	}
+
+	for _, tc := range table {
+		newSum, err := checksum.Of(tc.configIn.Config)
+		assert.Nil(t, err)
+		assert.Equal(t, tc.unchanged, unchangedConfig(tc.stored, tc.configIn, tc.tags, newSum), tc.name)
+	}
+}
+
+// TestCacheBreaker validates that Redis reads fail fast while the breaker is open
+func TestCacheBreaker(t *testing.T) {
+	dal := setupDep(t)
+	dal.CacheBreaker = breaker.New("redis", 1, time.Minute)
+
+	assert.Nil(t, dal.writeToCache("configTest", "", bson.M{"foo": "bar"}))
+
+	assert.Nil(t, dal.CacheBreaker.Allow())
+	dal.CacheBreaker.Failure()
+
+	cacheHit, _, err := dal.readFromCache("configTest", "")
+	assert.False(t, cacheHit)
+	assert.ErrorIs(t, err, breaker.ErrOpen)
+	assert.Equal(t, breaker.Open, dal.BreakerStates()["redis"])
+}
+
+// TestNewConfigChangeEvent validates the diff and secret masking of change events
+func TestNewConfigChangeEvent(t *testing.T) {
+	dal := setupDep(t)
+
+	stored := bson.M{
+		"version": int32(2),
+		"config": bson.M{
+			"checksum": "abc",
+			"config": bson.M{
+				"url":      "https://backstage.aeekay.co",
+				"password": "hunter2",
+				"debug":    true,
+			},
+		},
+	}
+	oldConfig, oldVersion := storedConfigPayload(stored)
+
+	event, err := dal.newConfigChangeEvent(ConfigChange{
+		Old:        oldConfig,
+		New:        map[string]interface{}{"url": "https://stilla.aeekay.co", "password": "hunter3", "timeout": 30},
+		FuncName:   "InsertConfig",
+		ConfigID:   "configID",
+		ConfigName: "backstage",
+		Actor:      "hostID",
+		OldVersion: oldVersion,
+		NewVersion: oldVersion + 1,
+	})
+	assert.Nil(t, err)
+
+	assert.Equal(t, int32(2), event.OldVersion)
+	assert.Equal(t, int32(3), event.NewVersion)
+	assert.Equal(t, "hostID", event.Actor)
+
+	var diffs []string
+	for _, d := range event.Diff {
+		diffs = append(diffs, fmt.Sprintf("%s %s %v %v", d.Op, d.Path, d.OldValue.AsInterface(), d.NewValue.AsInterface()))
+	}
+
+	assert.Equal(t, []string{
+		"REMOVE /debug true <nil>",
+		"REPLACE /password **** ****",
+		"ADD /timeout <nil> 30",
+		"REPLACE /url https://backstage.aeekay.co https://stilla.aeekay.co",
+	}, diffs)
+}
+
+// TestChangeRequestValidation validates the checks made before a change
+// request is read
+func TestChangeRequestValidation(t *testing.T) {
+	dal := setupDep(t)
+	dal.Config.ApproverHosts = []string{"approver-host"}
+
+	ctx := GetTestGinContext()
+	ctx.Set("x-host-id", "other-host")
+
+	_, err := dal.ApproveChangeRequest(ctx, "payments", primitive.NewObjectID().Hex(), apimodels.ChangeRequestReviewIn{}, ctx.Request)
+	assert.ErrorIs(t, err, errApproverRequired)
+
+	_, err = dal.RejectChangeRequest(ctx, "payments", "not-an-id", apimodels.ChangeRequestReviewIn{}, ctx.Request)
+	assert.ErrorIs(t, err, errChangeRequestNotFound)
+
+	_, err = dal.CommentChangeRequest(ctx, "payments", "not-an-id", apimodels.ChangeRequestCommentIn{Body: "lgtm"}, ctx.Request)
+	assert.ErrorIs(t, err, errChangeRequestNotFound)
+
+	_, err = dal.GetChangeRequests(ctx, apimodels.ChangeRequestQuery{Status: "merged"}, ctx.Request)
+	assert.ErrorIs(t, err, errInvalidChangeQuery)
+
+	assert.True(t, isProtected(bson.M{"protected": true}))
+	assert.False(t, isProtected(bson.M{"config_name": "payments"}))
+	assert.False(t, isProtected(nil))
+}
+
+// TestInsertConfigConditionalWrite validates that a config is written only
+// while it's at the version that was read
+func TestInsertConfigConditionalWrite(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	configIn := apimodels.ConfigIn{ConfigName: "payments", Owner: "owner", Config: map[string]interface{}{"retries": 3}}
+
+	mt.Run("TestPatchLosesRace", func(mt *mtest.T) {
+		dal := setupMongo(t, mt)
+		ctx := context.Background()
+
+		mt.AddMockResponses(
+			findResponse(configCollection, storedConfig("payments", 2, bson.D{{"retries", 1}})),
+			updateResponse(0),
+		)
+
+		_, err := dal.insertConfig(ctx, "host-1", configIn, 2, "PatchConfig")
+		assert.ErrorIs(t, err, errVersionConflict)
+
+		// the version isn't stored when the config wasn't moved to it
+		commands := startedCommands(mt)
+		assert.Len(t, commands, 2)
+		filter := commands[1].Lookup("updates").Array().Index(0).Value().Document().Lookup("q").String()
+		assert.Contains(t, filter, `"version": {"$numberInt":"2"}`)
+	})
+
+	mt.Run("TestWriteRetries", func(mt *mtest.T) {
+		dal := setupMongo(t, mt)
+		ctx := context.Background()
+
+		mt.AddMockResponses(
+			findResponse(configCollection, storedConfig("payments", 2, bson.D{{"retries", 1}})),
+			updateResponse(0),
+			findResponse(configCollection, storedConfig("payments", 3, bson.D{{"retries", 2}})),
+			updateResponse(1),
+			mtest.CreateSuccessResponse(),
+		)
+
+		write, err := dal.insertConfig(ctx, "host-1", configIn, 0, "InsertConfig")
+		assert.Nil(t, err)
+		assert.Equal(t, int32(4), write.Version)
+		assert.False(t, write.Created)
+	})
+
+	mt.Run("TestCreate", func(mt *mtest.T) {
+		dal := setupMongo(t, mt)
+		ctx := context.Background()
+
+		mt.AddMockResponses(
+			findResponse(configCollection),
+			upsertResponse(),
+			mtest.CreateSuccessResponse(),
+		)
+
+		write, err := dal.insertConfig(ctx, "host-1", configIn, 0, "InsertConfig")
+		assert.Nil(t, err)
+		assert.Equal(t, int32(1), write.Version)
+		assert.True(t, write.Created)
+
+		// a new config is created now
+		commands := startedCommands(mt)
+		assert.Len(t, commands, 3)
+		created := commands[2].Lookup("documents").Array().Index(0).Value().Document().Lookup("created").Time()
+		assert.WithinDuration(t, time.Now(), created, time.Minute)
+
+		// and owned by the host that created it
+		owner := commands[1].Lookup("updates").Array().Index(0).Value().Document().Lookup("u", "$setOnInsert", "owner_host").StringValue()
+		assert.Equal(t, "host-1", owner)
+	})
+
+	mt.Run("TestCreateRace", func(mt *mtest.T) {
+		dal := setupMongo(t, mt)
+		ctx := context.Background()
+
+		// the write is made again against the config another write created
+		duplicate := mtest.CreateWriteErrorsResponse(mtest.WriteError{Index: 0, Code: 11000, Message: "duplicate key"})
+		mt.AddMockResponses(
+			findResponse(configCollection),
+			duplicate,
+			findResponse(configCollection, storedConfig("payments", 1, bson.D{{"retries", 1}})),
+			updateResponse(1),
+			mtest.CreateSuccessResponse(),
+		)
+
+		write, err := dal.insertConfig(ctx, "host-1", configIn, 0, "InsertConfig")
+		assert.Nil(t, err)
+		assert.Equal(t, int32(2), write.Version)
+		assert.False(t, write.Created)
+	})
+}
+
+// TestReadAfterWrite validates that a config read after a write is never
+// served from a cache entry of the version before it
+func TestReadAfterWrite(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("TestWriteInvalidates", func(mt *mtest.T) {
+		dal := setupMongo(t, mt)
+		ctx := GetTestGinContext()
+		ctx.Set("x-host-id", "host-1")
+
+		id := primitive.NewObjectID()
+		stored := func(version int32, retries int) bson.D {
+			doc := storedConfig("payments", version, bson.D{{"retries", retries}})
+			doc[0] = bson.E{"_id", id}
+			return doc
+		}
+
+		mt.AddMockResponses(findResponse(configCollection, stored(1, 1)))
+		config, err := dal.GetConfig(ctx, "payments", "", ctx.Request)
+		assert.Nil(t, err)
+		assert.Equal(t, int32(1), config.Version)
+
+		// served from the cache
+		config, err = dal.GetConfig(ctx, "payments", "", ctx.Request)
+		assert.Nil(t, err)
+		assert.Equal(t, int32(1), config.Version)
+
+		mt.AddMockResponses(
+			findResponse(configCollection, stored(1, 1)),
+			updateResponse(1),
+			mtest.CreateSuccessResponse(),
+		)
+		configIn := apimodels.ConfigIn{ConfigName: "payments", Owner: "owner", Config: map[string]interface{}{"retries": 2}}
+		_, err = dal.InsertConfig(ctx, configIn, ctx.Request)
+		assert.Nil(t, err)
+
+		mt.AddMockResponses(findResponse(configCollection, stored(2, 2)))
+		config, err = dal.GetConfig(ctx, "payments", "", ctx.Request)
+		assert.Nil(t, err)
+		assert.Equal(t, int32(2), config.Version)
+	})
+
+	mt.Run("TestSlowReadDropped", func(mt *mtest.T) {
+		dal := setupMongo(t, mt)
+		ctx := GetTestGinContext()
+		ctx.Set("x-host-id", "host-1")
+
+		id := primitive.NewObjectID()
+		stored := func(version int32, retries int) bson.D {
+			doc := storedConfig("payments", version, bson.D{{"retries", retries}})
+			doc[0] = bson.E{"_id", id}
+			return doc
+		}
+
+		// a read fetches version 1 before the write
+		generation, err := dal.cacheGeneration("payments")
+		assert.Nil(t, err)
+		raw, err := bson.Marshal(stored(1, 1))
+		assert.Nil(t, err)
+		var before bson.M
+		assert.Nil(t, bson.Unmarshal(raw, &before))
+
+		mt.AddMockResponses(
+			findResponse(configCollection, stored(1, 1)),
+			findResponse(configCollection, stored(1, 1)),
+			updateResponse(1),
+			mtest.CreateSuccessResponse(),
+		)
+		_, err = dal.UpdateConfigByID(ctx, "payments", apimodels.UpdateConfigIn{Config: map[string]interface{}{"retries": 2}}, ctx.Request)
+		assert.Nil(t, err)
+
+		// and caches it once the write is done
+		assert.Nil(t, dal.writeToCacheAt("payments", "", before, generation))
+		hit, _, _ := dal.readFromCache("payments", "")
+		assert.False(t, hit)
+
+		mt.AddMockResponses(findResponse(configCollection, stored(2, 2)))
+		config, err := dal.GetConfig(ctx, "payments", "", ctx.Request)
+		assert.Nil(t, err)
+		assert.Equal(t, int32(2), config.Version)
+	})
+}
+
+// TestImportOverwriteOrder validates that an overwrite writes the new
+// versions before it replaces the config and deletes the old versions
+func TestImportOverwriteOrder(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	config := bundle.Config{ConfigName: "payments", Owner: "owner", Version: 2, Config: map[string]interface{}{"retries": 2}}
+
+	mt.Run("TestOverwrite", func(mt *mtest.T) {
+		dal := setupMongo(t, mt)
+		ctx := GetTestGinContext()
+		ctx.Set("x-host-id", "host-1")
+
+		mt.AddMockResponses(
+			findResponse(configCollection, storedConfig("payments", 5, bson.D{{"retries", 1}})),
+			mtest.CreateSuccessResponse(bson.E{"n", 1}),
+			updateResponse(1),
+			mtest.CreateSuccessResponse(bson.E{"n", 5}),
+		)
+
+		result := dal.importConfig(ctx, config, ImportOverwrite, false, ctx.Request)
+		assert.Equal(t, importOverwritten, result.Action, result.Error)
+		assert.Equal(t, int32(2), result.Version)
+
+		var names []string
+		for _, command := range startedCommands(mt) {
+			names = append(names, command.Index(0).Key())
+		}
+		assert.Equal(t, []string{"find", "insert", "update", "delete"}, names)
+
+		// the versions that were just written are kept
+		commands := startedCommands(mt)
+		inserted := commands[1].Lookup("documents").Array().Index(0).Value().Document().Lookup("_id").ObjectID()
+		filter := commands[3].Lookup("deletes").Array().Index(0).Value().Document().Lookup("q").String()
+		assert.Contains(t, filter, inserted.Hex())
+		assert.Contains(t, filter, "$nin")
+	})
+
+	mt.Run("TestFailedWriteKeepsHistory", func(mt *mtest.T) {
+		dal := setupMongo(t, mt)
+		ctx := GetTestGinContext()
+		ctx.Set("x-host-id", "host-1")
+
+		mt.AddMockResponses(
+			findResponse(configCollection, storedConfig("payments", 5, bson.D{{"retries", 1}})),
+			mtest.CreateCommandErrorResponse(mtest.CommandError{Code: 1, Message: "insert failed"}),
+		)
+
+		result := dal.importConfig(ctx, config, ImportOverwrite, false, ctx.Request)
+		assert.Equal(t, importFailed, result.Action)
+
+		// nothing was replaced or deleted
+		assert.Len(t, startedCommands(mt), 2)
+	})
+}
+
+// dueSchedule returns a pending scheduled change of payments that's due
+func dueSchedule(payload bson.D) bson.D {
+	return bson.D{
+		{"_id", primitive.NewObjectID()},
+		{"config_name", "payments"},
+		{"config", payload},
+		{"activate_at", primitive.NewDateTimeFromTime(time.Now().Add(-time.Minute))},
+		{"status", apimodels.SchedulePending},
+		{"created_by", "host-1"},
+		{"created", primitive.NewDateTimeFromTime(time.Now().Add(-time.Hour))},
+	}
+}
+
+// scheduleUpdate returns the $set of the update that recorded the outcome of
+// a scheduled change
+func scheduleUpdate(t *testing.T, command bson.Raw) bson.Raw {
+	assert.Equal(t, configScheduleCollection, command.Lookup("update").StringValue())
+	update := command.Lookup("updates").Array().Index(0).Value().Document()
+	assert.Contains(t, update.Lookup("q").String(), apimodels.SchedulePending)
+
+	return update.Lookup("u", "$set").Document()
+}
+
+// TestApplyDueSchedules validates the outcomes of scheduled changes
+func TestApplyDueSchedules(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("TestApplied", func(mt *mtest.T) {
+		dal := setupMongo(t, mt)
+		audit := recordAudit(dal)
+
+		schedule := dueSchedule(bson.D{{"retries", 2}})
+		mt.AddMockResponses(
+			findResponse(configScheduleCollection, schedule),
+			findResponse(configCollection, storedConfig("payments", 1, bson.D{{"retries", 1}})),
+			findResponse(configCollection, storedConfig("payments", 1, bson.D{{"retries", 1}})),
+			updateResponse(1),
+			mtest.CreateSuccessResponse(),
+			updateResponse(1),
+		)
+
+		assert.Nil(t, dal.applyDueSchedules(context.Background()))
+		assert.Equal(t, []string{"find", "find", "find", "update", "insert", "update"}, commandNames(mt))
+
+		set := scheduleUpdate(t, startedCommands(mt)[5])
+		assert.Equal(t, apimodels.ScheduleApplied, set.Lookup("status").StringValue())
+		assert.Equal(t, int32(2), set.Lookup("version").Int32())
+
+		fired := audit.find("ScheduleFired")
+		assert.Len(t, fired, 1)
+		assert.Equal(t, schedule[0].Value.(primitive.ObjectID).Hex(), fired[0]["schedule_id"])
+		assert.Equal(t, apimodels.ScheduleApplied, fired[0]["status"])
+		assert.Equal(t, int32(2), fired[0]["version"])
+	})
+
+	mt.Run("TestAwaitingApproval", func(mt *mtest.T) {
+		dal := setupMongo(t, mt)
+		audit := recordAudit(dal)
+
+		protected := storedConfig("payments", 1, bson.D{{"retries", 1}}, bson.E{"protected", true})
+		mt.AddMockResponses(
+			findResponse(configScheduleCollection, dueSchedule(bson.D{{"retries", 2}})),
+			findResponse(configCollection, protected),
+			findResponse(configCollection, protected),
+			mtest.CreateSuccessResponse(),
+			updateResponse(1),
+		)
+
+		assert.Nil(t, dal.applyDueSchedules(context.Background()))
+		commands := startedCommands(mt)
+		assert.Equal(t, configChangeRequestCollection, commands[3].Lookup("insert").StringValue())
+		requestID := commands[3].Lookup("documents").Array().Index(0).Value().Document().Lookup("_id").ObjectID()
+
+		set := scheduleUpdate(t, commands[4])
+		assert.Equal(t, apimodels.ScheduleAwaitingApproval, set.Lookup("status").StringValue())
+		assert.Equal(t, requestID, set.Lookup("change_request_id").ObjectID())
+
+		fired := audit.find("ScheduleFired")
+		assert.Len(t, fired, 1)
+		assert.Equal(t, apimodels.ScheduleAwaitingApproval, fired[0]["status"])
+		assert.Equal(t, requestID.Hex(), fired[0]["change_request_id"])
+	})
+
+	mt.Run("TestDeletedConfig", func(mt *mtest.T) {
+		dal := setupMongo(t, mt)
+		audit := recordAudit(dal)
+
+		// a schedule doesn't bring back a deleted config
+		mt.AddMockResponses(
+			findResponse(configScheduleCollection, dueSchedule(bson.D{{"retries", 2}})),
+			findResponse(configCollection),
+			updateResponse(1),
+		)
+
+		assert.Nil(t, dal.applyDueSchedules(context.Background()))
+		set := scheduleUpdate(t, startedCommands(mt)[2])
+		assert.Equal(t, apimodels.ScheduleFailed, set.Lookup("status").StringValue())
+		assert.Contains(t, set.Lookup("error").StringValue(), "does not exist")
+		assert.Equal(t, apimodels.ScheduleFailed, audit.find("ScheduleFired")[0]["status"])
+	})
+
+	mt.Run("TestBackendFailure", func(mt *mtest.T) {
+		dal := setupMongo(t, mt)
+		audit := recordAudit(dal)
+
+		// the change stays pending and is tried on the next tick
+		mt.AddMockResponses(
+			findResponse(configScheduleCollection, dueSchedule(bson.D{{"retries", 2}})),
+			mtest.CreateCommandErrorResponse(mtest.CommandError{Code: 1, Message: "internal error"}),
+		)
+
+		assert.NotNil(t, dal.applyDueSchedules(context.Background()))
+		assert.Equal(t, []string{"find", "find"}, commandNames(mt))
+		assert.Empty(t, audit.find("ScheduleFired"))
+	})
+}
+
+// TestRunSchedulerLocked validates that a replica skips the due work while
+// another one holds the scheduler lock
+func TestRunSchedulerLocked(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("TestLockHeld", func(mt *mtest.T) {
+		dal := setupMongo(t, mt)
+		locked := &lockedDB{mockDB: dal.Database.(mockDB)}
+		dal.Database = locked
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		dal.RunScheduler(ctx, time.Minute)
+
+		assert.Equal(t, []int64{scheduleLockKey}, locked.keys)
+		assert.Empty(t, startedCommands(mt))
+	})
+}
+
+// activeOverride returns an active override of payments that sets
+// log_level and adds debug_sql. Its revert restores log_level and removes
+// debug_sql
+func activeOverride(expiresAt time.Time) bson.D {
+	return bson.D{
+		{"_id", primitive.NewObjectID()},
+		{"config_name", "payments"},
+		{"patch", bson.D{{"log_level", "debug"}, {"debug_sql", true}}},
+		{"revert", bson.D{{"log_level", "info"}, {"debug_sql", nil}}},
+		{"status", apimodels.OverrideActive},
+		{"created_by", "host-1"},
+		{"created", primitive.NewDateTimeFromTime(time.Now().Add(-3 * time.Hour))},
+		{"expires_at", primitive.NewDateTimeFromTime(expiresAt)},
+		{"base_version", int32(1)},
+		{"version", int32(2)},
+	}
+}
+
+// TestRevertExpiredOverrides validates that an override whose TTL ended is
+// reverted to the values it replaced
+func TestRevertExpiredOverrides(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("TestReverted", func(mt *mtest.T) {
+		dal := setupMongo(t, mt)
+		audit := recordAudit(dal)
+
+		override := activeOverride(time.Now().Add(-time.Minute))
+		overridden := storedConfig("payments", 2, bson.D{{"log_level", "debug"}, {"debug_sql", true}, {"retries", 3}})
+		reverted := append(bson.D{}, override...)
+		reverted[4] = bson.E{"status", apimodels.OverrideReverted}
+
+		mt.AddMockResponses(
+			findResponse(configOverrideCollection, override),
+			findResponse(configCollection, overridden),
+			findResponse(configCollection, overridden),
+			updateResponse(1),
+			mtest.CreateSuccessResponse(),
+			findAndModifyResponse(reverted),
+		)
+
+		assert.Nil(t, dal.revertExpiredOverrides(context.Background()))
+		assert.Equal(t, []string{"find", "find", "find", "update", "insert", "findAndModify"}, commandNames(mt))
+
+		// the keys the override changed are back, and the rest is kept
+		commands := startedCommands(mt)
+		stored := commands[4].Lookup("documents").Array().Index(0).Value().Document()
+		assert.Equal(t, int32(3), stored.Lookup("version").Int32())
+		var payload map[string]interface{}
+		assert.Nil(t, bson.Unmarshal(stored.Lookup("config", "config").Document(), &payload))
+		assert.Equal(t, map[string]interface{}{"log_level": "info", "retries": int64(3)}, payload)
+
+		set := commands[5].Lookup("update", "$set").Document()
+		assert.Equal(t, apimodels.OverrideReverted, set.Lookup("status").StringValue())
+		assert.Equal(t, int32(3), set.Lookup("reverted_version").Int32())
+		_, err := set.LookupErr("reverted_by")
+		assert.NotNil(t, err)
+
+		events := audit.find("OverrideReverted")
+		assert.Len(t, events, 1)
+		assert.Equal(t, override[0].Value.(primitive.ObjectID).Hex(), events[0]["override_id"])
+		assert.Equal(t, true, events[0]["expired"])
+		assert.Equal(t, apimodels.OverrideReverted, events[0]["status"])
+		assert.Equal(t, int32(3), events[0]["version"])
+	})
+
+	mt.Run("TestChangedSinceOverride", func(mt *mtest.T) {
+		dal := setupMongo(t, mt)
+		audit := recordAudit(dal)
+
+		// another host lowered the log level during the incident
+		override := activeOverride(time.Now().Add(-time.Minute))
+		changed := storedConfig("payments", 3, bson.D{{"log_level", "warn"}, {"debug_sql", true}, {"retries", 3}})
+		reverted := append(bson.D{}, override...)
+		reverted[4] = bson.E{"status", apimodels.OverrideReverted}
+
+		mt.AddMockResponses(
+			findResponse(configOverrideCollection, override),
+			findResponse(configCollection, changed),
+			findResponse(configCollection, changed),
+			updateResponse(1),
+			mtest.CreateSuccessResponse(),
+			findAndModifyResponse(reverted),
+		)
+
+		assert.Nil(t, dal.revertExpiredOverrides(context.Background()))
+
+		// the later write is kept and the rest of the override is reverted
+		commands := startedCommands(mt)
+		stored := commands[4].Lookup("documents").Array().Index(0).Value().Document()
+		var payload map[string]interface{}
+		assert.Nil(t, bson.Unmarshal(stored.Lookup("config", "config").Document(), &payload))
+		assert.Equal(t, map[string]interface{}{"log_level": "warn", "retries": int64(3)}, payload)
+
+		set := commands[5].Lookup("update", "$set").Document()
+		assert.Equal(t, "/log_level", set.Lookup("skipped").Array().Index(0).Value().StringValue())
+
+		events := audit.find("OverrideReverted")
+		assert.Len(t, events, 1)
+		assert.Equal(t, []string{"/log_level"}, events[0]["skipped"])
+		assert.Equal(t, int32(4), events[0]["version"])
+	})
+
+	mt.Run("TestDeletedConfig", func(mt *mtest.T) {
+		dal := setupMongo(t, mt)
+		audit := recordAudit(dal)
+
+		// an override of a deleted config can't be reverted, so it fails
+		override := activeOverride(time.Now().Add(-time.Minute))
+		failed := append(bson.D{}, override...)
+		failed[4] = bson.E{"status", apimodels.OverrideFailed}
+
+		mt.AddMockResponses(
+			findResponse(configOverrideCollection, override),
+			findResponse(configCollection),
+			findAndModifyResponse(failed),
+		)
+
+		assert.Nil(t, dal.revertExpiredOverrides(context.Background()))
+		set := startedCommands(mt)[2].Lookup("update", "$set").Document()
+		assert.Equal(t, apimodels.OverrideFailed, set.Lookup("status").StringValue())
+
+		events := audit.find("OverrideReverted")
+		assert.Len(t, events, 1)
+		assert.Equal(t, apimodels.OverrideFailed, events[0]["status"])
+		assert.Contains(t, events[0]["error"], "does not exist")
+	})
+
+	mt.Run("TestProtectedConfig", func(mt *mtest.T) {
+		dal := setupMongo(t, mt)
+
+		// the TTL ending isn't held up by a change request
+		override := activeOverride(time.Now().Add(-time.Minute))
+		protected := storedConfig("payments", 2, bson.D{{"log_level", "debug"}, {"debug_sql", true}}, bson.E{"protected", true})
+		reverted := append(bson.D{}, override...)
+		reverted[4] = bson.E{"status", apimodels.OverrideReverted}
+
+		mt.AddMockResponses(
+			findResponse(configOverrideCollection, override),
+			findResponse(configCollection, protected),
+			findResponse(configCollection, protected),
+			updateResponse(1),
+			mtest.CreateSuccessResponse(),
+			findAndModifyResponse(reverted),
+		)
+
+		assert.Nil(t, dal.revertExpiredOverrides(context.Background()))
+		assert.Equal(t, []string{"find", "find", "find", "update", "insert", "findAndModify"}, commandNames(mt))
+		assert.Equal(t, configCollection, startedCommands(mt)[3].Lookup("update").StringValue())
+	})
+}
+
+// TestApplyOverrideRecorded validates that an override is recorded with its
+// revert before the config is overridden
+func TestApplyOverrideRecorded(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	overrideIn := apimodels.ConfigOverrideIn{Patch: map[string]interface{}{"log_level": "debug", "debug_sql": true}, TTL: "2h"}
+
+	mt.Run("TestVersionNotRecorded", func(mt *mtest.T) {
+		dal := setupMongo(t, mt)
+		ctx := GetTestGinContext()
+		ctx.Set("x-host-id", "host-1")
+
+		stored := storedConfig("payments", 1, bson.D{{"log_level", "info"}, {"retries", 3}})
+		mt.AddMockResponses(
+			findResponse(configCollection, stored),
+			findResponse(configOverrideCollection),
+			mtest.CreateSuccessResponse(),
+			findResponse(configCollection, stored),
+			findResponse(configCollection, stored),
+			updateResponse(1),
+			mtest.CreateSuccessResponse(),
+			mtest.CreateCommandErrorResponse(mtest.CommandError{Code: 1, Message: "update failed"}),
+		)
+
+		// the config is overridden, so the request succeeds
+		override, err := dal.ApplyOverride(ctx, "payments", overrideIn, ctx.Request)
+		assert.Nil(t, err)
+		assert.Equal(t, int32(2), override.Version)
+		assert.Equal(t, []string{"find", "find", "insert", "find", "find", "update", "insert", "update"}, commandNames(mt))
+
+		// the revert was recorded with the override
+		recorded := startedCommands(mt)[2].Lookup("documents").Array().Index(0).Value().Document()
+		assert.Equal(t, configOverrideCollection, startedCommands(mt)[2].Lookup("insert").StringValue())
+		assert.Equal(t, int32(1), recorded.Lookup("base_version").Int32())
+		assert.Equal(t, "info", recorded.Lookup("revert", "log_level").StringValue())
+		assert.Equal(t, bson.TypeNull, recorded.Lookup("revert", "debug_sql").Type)
+	})
+
+	mt.Run("TestConfigMoved", func(mt *mtest.T) {
+		dal := setupMongo(t, mt)
+		ctx := GetTestGinContext()
+		ctx.Set("x-host-id", "host-1")
+
+		// the config changed after the revert was computed
+		mt.AddMockResponses(
+			findResponse(configCollection, storedConfig("payments", 1, bson.D{{"log_level", "info"}})),
+			findResponse(configOverrideCollection),
+			mtest.CreateSuccessResponse(),
+			findResponse(configCollection, storedConfig("payments", 2, bson.D{{"log_level", "warn"}})),
+			mtest.CreateSuccessResponse(bson.E{"n", 1}),
+		)
+
+		_, err := dal.ApplyOverride(ctx, "payments", overrideIn, ctx.Request)
+		assert.ErrorIs(t, err, errVersionConflict)
+		assert.Equal(t, []string{"find", "find", "insert", "find", "delete"}, commandNames(mt))
+	})
+}
+
+// TestRevertOverrideProtected validates that reverting an override of a
+// protected config by hand is a change request
+func TestRevertOverrideProtected(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("TestChangeRequested", func(mt *mtest.T) {
+		dal := setupMongo(t, mt)
+		ctx := GetTestGinContext()
+		ctx.Set("x-host-id", "host-1")
+
+		override := activeOverride(time.Now().Add(time.Hour))
+		protected := storedConfig("payments", 2, bson.D{{"log_level", "debug"}, {"debug_sql", true}}, bson.E{"protected", true})
+
+		mt.AddMockResponses(
+			findResponse(configCollection, protected),
+			findResponse(configOverrideCollection, override),
+			findResponse(configCollection, protected),
+			findResponse(configCollection, protected),
+			mtest.CreateSuccessResponse(),
+		)
+
+		_, err := dal.RevertOverride(ctx, "payments", override[0].Value.(primitive.ObjectID).Hex(), ctx.Request)
+		var pending *pendingChange
+		assert.ErrorAs(t, err, &pending)
+
+		// the config isn't written and the override stays active
+		commands := startedCommands(mt)
+		assert.Len(t, commands, 5)
+		assert.Equal(t, configChangeRequestCollection, commands[4].Lookup("insert").StringValue())
+		requested := commands[4].Lookup("documents").Array().Index(0).Value().Document()
+		assert.Equal(t, "RevertOverride", requested.Lookup("operation").StringValue())
+		assert.Equal(t, int32(2), requested.Lookup("base_version").Int32())
+	})
+}
+
+// TestApplyOverrideActive validates that a config has at most one active
+// override
+func TestApplyOverrideActive(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	overrideIn := apimodels.ConfigOverrideIn{Patch: map[string]interface{}{"log_level": "debug"}, TTL: "2h"}
+
+	mt.Run("TestActive", func(mt *mtest.T) {
+		dal := setupMongo(t, mt)
+		ctx := GetTestGinContext()
+		ctx.Set("x-host-id", "host-1")
+
+		mt.AddMockResponses(
+			findResponse(configCollection, storedConfig("payments", 1, bson.D{{"log_level", "info"}})),
+			findResponse(configOverrideCollection, activeOverride(time.Now().Add(time.Hour))),
+		)
+
+		_, err := dal.ApplyOverride(ctx, "payments", overrideIn, ctx.Request)
+		assert.ErrorIs(t, err, errOverrideActive)
+		assert.Equal(t, []string{"find", "find"}, commandNames(mt))
+	})
+
+	mt.Run("TestConcurrentOverride", func(mt *mtest.T) {
+		dal := setupMongo(t, mt)
+		ctx := GetTestGinContext()
+		ctx.Set("x-host-id", "host-1")
+
+		// another override was recorded after the check, and the unique
+		// index turns this one away before the config is written
+		mt.AddMockResponses(
+			findResponse(configCollection, storedConfig("payments", 1, bson.D{{"log_level", "info"}})),
+			findResponse(configOverrideCollection),
+			mtest.CreateWriteErrorsResponse(mtest.WriteError{Index: 0, Code: 11000, Message: "duplicate key"}),
+		)
+
+		_, err := dal.ApplyOverride(ctx, "payments", overrideIn, ctx.Request)
+		assert.ErrorIs(t, err, errOverrideActive)
+		assert.Equal(t, []string{"find", "find", "insert"}, commandNames(mt))
+	})
+}
+
+// TestUpdateConfigTagsProtected validates that the tags of a protected
+// config are a change request
+func TestUpdateConfigTagsProtected(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("TestChangeRequested", func(mt *mtest.T) {
+		dal := setupMongo(t, mt)
+		ctx := GetTestGinContext()
+		ctx.Set("x-host-id", "host-1")
+
+		protected := storedConfig("payments", 2, bson.D{{"retries", 1}}, bson.E{"protected", true}, bson.E{"tags", bson.A{"team:payments"}})
+		mt.AddMockResponses(
+			findResponse(configCollection, protected),
+			mtest.CreateSuccessResponse(),
+		)
+
+		_, err := dal.UpdateConfigTags(ctx, "payments", []string{"team:payments", "tier:1"}, ctx.Request)
+		var pending *pendingChange
+		assert.ErrorAs(t, err, &pending)
+		assert.Equal(t, []string{"find", "insert"}, commandNames(mt))
+
+		requested := startedCommands(mt)[1].Lookup("documents").Array().Index(0).Value().Document()
+		assert.Equal(t, configChangeRequestCollection, startedCommands(mt)[1].Lookup("insert").StringValue())
+		assert.Equal(t, "UpdateConfigTags", requested.Lookup("operation").StringValue())
+		assert.Equal(t, int32(2), requested.Lookup("base_version").Int32())
+		tags, _ := requested.Lookup("tags").Array().Values()
+		assert.Len(t, tags, 2)
+	})
+
+	mt.Run("TestUnchanged", func(mt *mtest.T) {
+		dal := setupMongo(t, mt)
+		ctx := GetTestGinContext()
+		ctx.Set("x-host-id", "host-1")
+
+		protected := storedConfig("payments", 2, bson.D{{"retries", 1}}, bson.E{"protected", true}, bson.E{"tags", bson.A{"team:payments"}})
+		mt.AddMockResponses(findResponse(configCollection, protected))
+
+		tags, err := dal.UpdateConfigTags(ctx, "payments", []string{"team:payments"}, ctx.Request)
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"team:payments"}, tags)
+		assert.Equal(t, []string{"find"}, commandNames(mt))
+	})
+}
+
+// TestImportNewVersionProtected validates that a new version of a protected
+// config is reported as pending with its change request
+func TestImportNewVersionProtected(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("TestPending", func(mt *mtest.T) {
+		dal := setupMongo(t, mt)
+		ctx := GetTestGinContext()
+		ctx.Set("x-host-id", "host-1")
+
+		config := bundle.Config{ConfigName: "payments", Owner: "owner", Config: map[string]interface{}{"retries": 2}}
+		protected := storedConfig("payments", 5, bson.D{{"retries", 1}}, bson.E{"protected", true})
+		mt.AddMockResponses(
+			findResponse(configCollection, protected),
+			findResponse(configCollection, protected),
+			mtest.CreateSuccessResponse(),
+		)
+
+		result := dal.importConfig(ctx, config, ImportNewVersion, false, ctx.Request)
+		assert.Equal(t, importPending, result.Action, result.Error)
+		assert.Empty(t, result.Error)
+		assert.Zero(t, result.Version)
+
+		commands := startedCommands(mt)
+		assert.Len(t, commands, 3)
+		requestID := commands[2].Lookup("documents").Array().Index(0).Value().Document().Lookup("_id").ObjectID()
+		assert.Equal(t, requestID.Hex(), result.ChangeRequestID)
+	})
+}
+
+// changeRequest returns a change request of payments by host-1 that sets
+// retries to 2 against baseVersion
+func changeRequest(id primitive.ObjectID, baseVersion int32, status string, extra ...bson.E) bson.D {
+	doc := bson.D{
+		{"_id", id},
+		{"config_name", "payments"},
+		{"owner", "owner"},
+		{"config", bson.D{{"retries", 2}}},
+		{"checksum", "sha256:requested"},
+		{"operation", "InsertConfig"},
+		{"base_version", baseVersion},
+		{"diff", bson.A{}},
+		{"status", status},
+		{"requested_by", "host-1"},
+		{"requested", primitive.NewDateTimeFromTime(time.Now().Add(-time.Hour))},
+		{"comments", bson.A{}},
+	}
+
+	return append(doc, extra...)
+}
+
+// TestChangeRequests validates the two-person rule of protected configs
+func TestChangeRequests(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	protected := func(version int32) bson.D {
+		return storedConfig("payments", version, bson.D{{"retries", 1}}, bson.E{"protected", true})
+	}
+	approve := func(dal *DAL, host string, id primitive.ObjectID) (apimodels.ChangeRequest, error) {
+		ctx := GetTestGinContext()
+		ctx.Set("x-host-id", host)
+		return dal.ApproveChangeRequest(ctx, "payments", id.Hex(), apimodels.ChangeRequestReviewIn{}, ctx.Request)
+	}
+
+	mt.Run("TestWriteAccepted", func(mt *mtest.T) {
+		dal := setupMongo(t, mt)
+		ctx, w := handlerContext(http.MethodPost, "/api/v1/config/", `{"config_name":"payments","owner":"owner","config":{"retries":2}}`)
+		ctx.Set("x-host-id", "host-1")
+
+		mt.AddMockResponses(
+			findResponse(configCollection, protected(2)),
+			mtest.CreateSuccessResponse(),
+		)
+
+		AddConfig(dal)(ctx)
+		assert.Equal(t, http.StatusAccepted, w.Code)
+
+		// the write is stored as a pending request and the config is
+		// left as it is
+		commands := startedCommands(mt)
+		assert.Equal(t, []string{"find", "insert"}, commandNames(mt))
+		assert.Equal(t, configChangeRequestCollection, commands[1].Lookup("insert").StringValue())
+		stored := commands[1].Lookup("documents").Array().Index(0).Value().Document()
+		id := stored.Lookup("_id").ObjectID()
+
+		var body struct {
+			Data apimodels.ChangeRequest `json:"data"`
+		}
+		assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &body))
+		assert.Equal(t, id, body.Data.ID)
+		assert.Equal(t, apimodels.ChangePending, body.Data.Status)
+		assert.Equal(t, int32(2), body.Data.BaseVersion)
+		assert.Equal(t, "host-1", body.Data.RequestedBy)
+		assert.Equal(t, "/api/v1/config/payments/changes/"+id.Hex(), w.Header().Get("Location"))
+	})
+
+	mt.Run("TestNonApprover", func(mt *mtest.T) {
+		dal := setupMongo(t, mt)
+		dal.Config.ApproverHosts = []string{"approver-host"}
+		id := primitive.NewObjectID()
+
+		ctx, w := handlerContext(http.MethodPost, "/api/v1/config/payments/changes/"+id.Hex()+"/approve", "",
+			gin.Param{Key: "configId", Value: "payments"}, gin.Param{Key: "changeId", Value: id.Hex()})
+		ctx.Set("x-host-id", "other-host")
+
+		ApproveChangeRequest(dal)(ctx)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		assertProblem(t, w, "approver_required")
+		assert.Empty(t, startedCommands(mt))
+	})
+
+	mt.Run("TestSelfApproval", func(mt *mtest.T) {
+		dal := setupMongo(t, mt)
+		dal.Config.ApproverHosts = []string{"host-1"}
+		id := primitive.NewObjectID()
+
+		mt.AddMockResponses(
+			findResponse(configCollection, protected(2)),
+			findResponse(configChangeRequestCollection, changeRequest(id, 2, apimodels.ChangePending)),
+		)
+
+		_, err := approve(dal, "host-1", id)
+		assert.ErrorIs(t, err, errSelfApproval)
+		assert.Equal(t, []string{"find", "find"}, commandNames(mt))
+	})
+
+	mt.Run("TestApplied", func(mt *mtest.T) {
+		dal := setupMongo(t, mt)
+		dal.Config.ApproverHosts = []string{"approver-host"}
+		audit := recordAudit(dal)
+		id := primitive.NewObjectID()
+
+		mt.AddMockResponses(
+			findResponse(configCollection, protected(2)),
+			findResponse(configChangeRequestCollection, changeRequest(id, 2, apimodels.ChangePending)),
+			findAndModifyResponse(changeRequest(id, 2, apimodels.ChangeApproved, bson.E{"reviewed_by", "approver-host"})),
+			findResponse(configCollection, protected(2)),
+			updateResponse(1),
+			mtest.CreateSuccessResponse(),
+			findAndModifyResponse(changeRequest(id, 2, apimodels.ChangeApplied, bson.E{"reviewed_by", "approver-host"}, bson.E{"version", int32(3)})),
+		)
+
+		request, err := approve(dal, "approver-host", id)
+		assert.Nil(t, err)
+		assert.Equal(t, apimodels.ChangeApplied, request.Status)
+		assert.Equal(t, int32(3), request.Version)
+		assert.Equal(t, []string{"find", "find", "findAndModify", "find", "update", "insert", "findAndModify"}, commandNames(mt))
+
+		// the change is written only while the config is at the version
+		// it was made against
+		commands := startedCommands(mt)
+		update := commands[4].Lookup("updates").Array().Index(0).Value().Document()
+		assert.Contains(t, update.Lookup("q").String(), `{"version": {"$numberInt":"2"}}`)
+		set := update.Lookup("u", "$set").Document()
+		assert.Equal(t, int32(3), set.Lookup("version").Int32())
+		assert.Equal(t, "host-1", set.Lookup("host").StringValue())
+		assert.Equal(t, int32(2), set.Lookup("config", "config", "retries").Int32())
+
+		recorded := commands[6].Lookup("update", "$set").Document()
+		assert.Equal(t, apimodels.ChangeApplied, recorded.Lookup("status").StringValue())
+		assert.Equal(t, int32(3), recorded.Lookup("version").Int32())
+
+		events := audit.find("ChangeRequestApproved")
+		assert.Len(t, events, 1)
+	})
+
+	mt.Run("TestMovedBase", func(mt *mtest.T) {
+		dal := setupMongo(t, mt)
+		dal.Config.ApproverHosts = []string{"approver-host"}
+		id := primitive.NewObjectID()
+
+		// another change was approved after this one was requested
+		mt.AddMockResponses(
+			findResponse(configCollection, protected(3)),
+			findResponse(configChangeRequestCollection, changeRequest(id, 2, apimodels.ChangePending)),
+			findAndModifyResponse(changeRequest(id, 2, apimodels.ChangeApproved)),
+			findResponse(configCollection, protected(3)),
+			findAndModifyResponse(changeRequest(id, 2, apimodels.ChangeFailed, bson.E{"error", "version conflict"})),
+		)
+
+		request, err := approve(dal, "approver-host", id)
+		assert.ErrorIs(t, err, errVersionConflict)
+		assert.Equal(t, apimodels.ChangeFailed, request.Status)
+		assert.Equal(t, []string{"find", "find", "findAndModify", "find", "findAndModify"}, commandNames(mt))
+
+		recorded := startedCommands(mt)[4].Lookup("update", "$set").Document()
+		assert.Equal(t, apimodels.ChangeFailed, recorded.Lookup("status").StringValue())
+		assert.Contains(t, recorded.Lookup("error").StringValue(), "expected version 2, found 3")
+	})
+
+	mt.Run("TestRacingApprovers", func(mt *mtest.T) {
+		dal := setupMongo(t, mt)
+		dal.Config.ApproverHosts = []string{"approver-host", "approver-2"}
+		id := primitive.NewObjectID()
+
+		// both approvers read the pending request, and the other one
+		// claimed it first
+		mt.AddMockResponses(
+			findResponse(configCollection, protected(2)),
+			findResponse(configChangeRequestCollection, changeRequest(id, 2, apimodels.ChangePending)),
+			findAndModifyResponse(nil),
+		)
+
+		_, err := approve(dal, "approver-2", id)
+		assert.ErrorIs(t, err, errChangeRequestNotPending)
+
+		// the claim only matches a pending request, and the losing
+		// approver doesn't write the config
+		commands := startedCommands(mt)
+		assert.Equal(t, []string{"find", "find", "findAndModify"}, commandNames(mt))
+		assert.Equal(t, apimodels.ChangePending, commands[2].Lookup("query", "status").StringValue())
+	})
+}
@@ -0,0 +1,105 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/aeekayy/stilla/service/pkg/api/models"
+	"github.com/aeekayy/stilla/service/pkg/utils"
+)
+
+// configWatchers wakes the config watchers of this process when a config
+// changes. The zero value is ready to use
+type configWatchers struct {
+	mu       sync.Mutex
+	channels map[chan struct{}]struct{}
+}
+
+// subscribe returns a channel that receives a value after a config changes,
+// and a function that stops the subscription
+func (w *configWatchers) subscribe() (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+
+	w.mu.Lock()
+	if w.channels == nil {
+		w.channels = make(map[chan struct{}]struct{})
+	}
+	w.channels[ch] = struct{}{}
+	w.mu.Unlock()
+
+	return ch, func() {
+		w.mu.Lock()
+		delete(w.channels, ch)
+		w.mu.Unlock()
+	}
+}
+
+// notify wakes every subscriber. Subscribers that haven't caught up with
+// the last change aren't blocked on
+func (w *configWatchers) notify() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for ch := range w.channels {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// WatchConfig sends the current version of a config, then each new version
+// until ctx is done. Changes made by this process are sent right away and
+// changes made by other instances are picked up every interval. deleted is
+// set when the config is deleted. It returns errConfigNotFound if the config
+// doesn't exist when the watch starts
+func (d *DAL) WatchConfig(ctx context.Context, configID string, interval time.Duration, send func(config models.ConfigResponse, deleted bool) error, req interface{}) error {
+	requestDetails := d.requestDetails(req)
+	requestDetails["config_id"] = utils.SanitizeMessageValue(configID)
+
+	d.EmitMessage("config.audit", "WatchConfig", requestDetails)
+
+	changes, stop := d.watchers.subscribe()
+	defer stop()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var version int32
+	started, deleted := false, false
+	for {
+		config, err := d.getConfig(ctx, configID, "")
+		switch {
+		case errors.Is(err, errConfigNotFound):
+			if !started {
+				return err
+			}
+			if !deleted {
+				if err := send(models.ConfigResponse{}, true); err != nil {
+					return err
+				}
+				deleted = true
+			}
+		case errors.Is(err, errDocumentStoreUnavailable):
+			// keep watching until the document store is back
+			d.Logger.Warnf("unable to watch config %s: %s", utils.SanitizeMessageValue(configID), err)
+		case err != nil:
+			return err
+		case !started || deleted || config.Version != version:
+			if err := send(config, false); err != nil {
+				return err
+			}
+			version, deleted = config.Version, false
+		}
+		started = true
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-changes:
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/aeekayy/stilla/service/pkg/api/models"
+	"github.com/aeekayy/stilla/service/pkg/flags"
+	"github.com/aeekayy/stilla/service/pkg/interpolate"
+	"github.com/aeekayy/stilla/service/pkg/patch"
+	"github.com/aeekayy/stilla/service/pkg/pointer"
+	"github.com/aeekayy/stilla/service/pkg/render"
+)
+
+// problemContentType the media type of error responses
+const problemContentType = "application/problem+json"
+
+// problemTypePrefix the prefix of the type URI of a problem. The code is
+// appended
+const problemTypePrefix = defaultLongDomainName + "/problems/"
+
+// errorKind classifies DAL errors so handlers can pick a status
+type errorKind int
+
+const (
+	kindValidation errorKind = iota + 1
+	kindNotFound
+	kindConflict
+	kindUnprocessable
+	kindUnavailable
+	kindForbidden
+)
+
+// kindStatus the HTTP status of each kind
+var kindStatus = map[errorKind]int{
+	kindValidation:    http.StatusBadRequest,
+	kindNotFound:      http.StatusNotFound,
+	kindConflict:      http.StatusConflict,
+	kindUnprocessable: http.StatusUnprocessableEntity,
+	kindUnavailable:   http.StatusServiceUnavailable,
+	kindForbidden:     http.StatusForbidden,
+}
+
+// dalError a DAL error with a kind and a stable code. Errors that wrap one
+// are reported with its code
+type dalError struct {
+	kind    errorKind
+	code    string
+	message string
+}
+
+// newDALError returns a DAL error
+func newDALError(kind errorKind, code, message string) *dalError {
+	return &dalError{kind: kind, code: code, message: message}
+}
+
+// Error returns the message of the error
+func (e *dalError) Error() string {
+	return e.message
+}
+
+// packageErrors the kinds and codes of errors from other packages
+var packageErrors = []struct {
+	err  error
+	kind errorKind
+	code string
+}{
+	{flags.ErrInvalidFlag, kindValidation, "invalid_flag"},
+	{interpolate.ErrInvalidReference, kindUnprocessable, "invalid_reference"},
+	{interpolate.ErrCycle, kindUnprocessable, "reference_cycle"},
+	{interpolate.ErrMaxDepth, kindUnprocessable, "reference_depth_exceeded"},
+	{patch.ErrInvalidPatch, kindValidation, "invalid_patch"},
+	{patch.ErrTestFailed, kindConflict, "patch_test_failed"},
+	{pointer.ErrInvalidPointer, kindValidation, "invalid_pointer"},
+	{pointer.ErrNotFound, kindUnprocessable, "path_not_found"},
+	{render.ErrUnsupportedFormat, kindValidation, "unsupported_format"},
+}
+
+// errorCode returns the kind and code of an error. ok is false for errors
+// without a kind, such as driver errors
+func errorCode(err error) (kind errorKind, code string, ok bool) {
+	// callers that can't wait for approval treat the write as a conflict
+	var pc *pendingChange
+	if errors.As(err, &pc) {
+		return kindConflict, "change_request_pending", true
+	}
+
+	var de *dalError
+	if errors.As(err, &de) {
+		return de.kind, de.code, true
+	}
+
+	for _, pe := range packageErrors {
+		if errors.Is(err, pe.err) {
+			return pe.kind, pe.code, true
+		}
+	}
+
+	return 0, "", false
+}
+
+// errorProblem returns the status, code and detail of an error. Errors
+// without a kind are internal errors, described by message so nothing about
+// the backend is exposed
+func errorProblem(err error, message string) (int, string, string) {
+	kind, code, ok := errorCode(err)
+	if !ok {
+		return http.StatusInternalServerError, "internal_error", message
+	}
+
+	return kindStatus[kind], code, errorDetail(err, kind)
+}
+
+// errorDetail returns the message of an error with a kind. Not found and
+// unavailable errors may wrap driver messages, so only their own message
+// is returned
+func errorDetail(err error, kind errorKind) string {
+	var de *dalError
+	if (kind == kindNotFound || kind == kindUnavailable) && errors.As(err, &de) {
+		return de.message
+	}
+
+	return err.Error()
+}
+
+// writeError writes the problem of a DAL error and aborts the request.
+// message describes errors without a kind. A write to a protected config is
+// accepted with its change request
+func writeError(c *gin.Context, err error, message string) {
+	var pc *pendingChange
+	if errors.As(err, &pc) {
+		c.Header("Location", fmt.Sprintf("%s/config/%s/changes/%s", apiPrefix, url.PathEscape(pc.request.ConfigName), pc.request.ID.Hex()))
+		c.AbortWithStatusJSON(http.StatusAccepted, gin.H{"data": pc.request})
+		return
+	}
+
+	status, code, detail := errorProblem(err, message)
+	writeProblem(c, status, code, detail)
+}
+
+// writeBodyError writes the problem of a request body that can't be read.
+// Bodies over the size limit are reported as too large
+func writeBodyError(c *gin.Context, code, detail string, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeProblem(c, http.StatusRequestEntityTooLarge, "payload_too_large", fmt.Sprintf("the body is larger than %d bytes", tooLarge.Limit))
+		return
+	}
+
+	writeProblem(c, http.StatusBadRequest, code, detail)
+}
+
+// writeProblem writes an RFC 7807 problem and aborts the request
+func writeProblem(c *gin.Context, status int, code, detail string) {
+	problem := models.Error{
+		Type:      problemTypePrefix + code,
+		Title:     http.StatusText(status),
+		Status:    status,
+		Detail:    detail,
+		Code:      code,
+		RequestID: c.GetString(requestIDKey),
+	}
+	if c.Request != nil && c.Request.URL != nil {
+		problem.Instance = c.Request.URL.Path
+	}
+
+	c.Header("Content-Type", problemContentType)
+	c.AbortWithStatusJSON(status, problem)
+}
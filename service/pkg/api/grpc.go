@@ -0,0 +1,371 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/aeekayy/stilla/service/api/protobuf/configservice"
+	"github.com/aeekayy/stilla/service/pkg/api/models"
+	"github.com/aeekayy/stilla/service/pkg/patch"
+	"github.com/aeekayy/stilla/service/pkg/utils"
+)
+
+// ConfigServer implements the stilla.v1.ConfigService gRPC service with the
+// same DAL as the REST API
+type ConfigServer struct {
+	pb.UnimplementedConfigServiceServer
+
+	dal           *DAL
+	watchInterval time.Duration
+}
+
+// NewConfigServer returns a ConfigServer. Watch streams check for changes
+// made by other instances every watchInterval
+func NewConfigServer(dal *DAL, watchInterval time.Duration) *ConfigServer {
+	return &ConfigServer{dal: dal, watchInterval: watchInterval}
+}
+
+// NewGRPCServer returns a gRPC server with the ConfigService registered.
+// Calls are authenticated with the same tokens as the REST API
+func NewGRPCServer(dal *DAL, watchInterval time.Duration) *grpc.Server {
+	server := grpc.NewServer(
+		grpc.UnaryInterceptor(grpcUnaryAuth(dal)),
+		grpc.StreamInterceptor(grpcStreamAuth(dal)),
+	)
+	pb.RegisterConfigServiceServer(server, NewConfigServer(dal, watchInterval))
+
+	return server
+}
+
+// Get returns the latest version of a config
+func (s *ConfigServer) Get(ctx context.Context, in *pb.GetRequest) (*pb.Config, error) {
+	config, err := s.dal.GetConfig(ctx, in.GetConfigId(), "", grpcRequest(ctx))
+	if err != nil {
+		return nil, s.grpcError(err, in.GetConfigId())
+	}
+
+	return toProtoConfig(config)
+}
+
+// List returns a page of configs
+func (s *ConfigServer) List(ctx context.Context, in *pb.ListRequest) (*pb.ListResponse, error) {
+	query := models.ConfigListQuery{
+		Limit:      in.GetLimit(),
+		Cursor:     in.GetCursor(),
+		NamePrefix: in.GetNamePrefix(),
+		Owner:      in.GetOwner(),
+		Host:       in.GetHost(),
+		Tags:       in.GetTags(),
+		TagMatch:   in.GetTagMatch(),
+		Sort:       in.GetSort(),
+	}
+	if in.GetModifiedSince() != nil {
+		query.ModifiedSince = in.GetModifiedSince().AsTime()
+	}
+
+	list, err := s.dal.GetConfigs(ctx, query, grpcRequest(ctx))
+	if err != nil {
+		return nil, s.grpcError(err, "")
+	}
+
+	out := &pb.ListResponse{Next: list.Next, Total: list.Total}
+	for _, config := range list.Data {
+		config, err := toProtoConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		out.Configs = append(out.Configs, config)
+	}
+
+	return out, nil
+}
+
+// Put adds a config, or a new version of it when the name exists
+func (s *ConfigServer) Put(ctx context.Context, in *pb.PutRequest) (*pb.PutResponse, error) {
+	if in.GetConfigName() == "" {
+		return nil, status.Error(codes.InvalidArgument, "configName is required")
+	}
+
+	write, err := s.dal.InsertConfig(ctx, models.ConfigIn{
+		ConfigName: in.GetConfigName(),
+		Owner:      in.GetOwner(),
+		Config:     in.GetConfig().AsMap(),
+		Parents:    in.GetParents(),
+		Tags:       in.GetTags(),
+	}, grpcRequest(ctx))
+	if err != nil {
+		return nil, s.grpcError(err, in.GetConfigName())
+	}
+
+	return &pb.PutResponse{ConfigId: write.ConfigID, Created: write.Created}, nil
+}
+
+// Patch applies a JSON Merge Patch or a JSON Patch to a config
+func (s *ConfigServer) Patch(ctx context.Context, in *pb.PatchRequest) (*pb.Config, error) {
+	mediaType := patch.MediaTypeMergePatch
+	if in.GetType() == pb.PatchRequest_JSON_PATCH {
+		mediaType = patch.MediaTypeJSONPatch
+	}
+
+	config, err := s.dal.PatchConfig(ctx, in.GetConfigId(), mediaType, in.GetPatch(), grpcRequest(ctx))
+	if err != nil {
+		return nil, s.grpcError(err, in.GetConfigId())
+	}
+
+	return toProtoConfig(config)
+}
+
+// Delete soft deletes a config
+func (s *ConfigServer) Delete(ctx context.Context, in *pb.DeleteRequest) (*pb.DeleteResponse, error) {
+	if err := s.dal.DeleteConfig(ctx, in.GetConfigId(), grpcRequest(ctx)); err != nil {
+		return nil, s.grpcError(err, in.GetConfigId())
+	}
+
+	return &pb.DeleteResponse{}, nil
+}
+
+// History returns the versions of a config, oldest first
+func (s *ConfigServer) History(ctx context.Context, in *pb.HistoryRequest) (*pb.HistoryResponse, error) {
+	history, err := s.dal.GetConfigHistory(ctx, in.GetConfigId(), grpcRequest(ctx))
+	if err != nil {
+		return nil, s.grpcError(err, in.GetConfigId())
+	}
+
+	out := &pb.HistoryResponse{}
+	for _, version := range history.Versions {
+		version, err := toProtoConfig(version)
+		if err != nil {
+			return nil, err
+		}
+		out.Versions = append(out.Versions, version)
+	}
+
+	for _, schedule := range history.Schedules {
+		schedule, err := toProtoSchedule(schedule)
+		if err != nil {
+			return nil, err
+		}
+		out.Schedules = append(out.Schedules, schedule)
+	}
+
+	return out, nil
+}
+
+// Watch sends a config, then every new version of it until the call is
+// cancelled
+func (s *ConfigServer) Watch(in *pb.WatchRequest, stream pb.ConfigService_WatchServer) error {
+	ctx := stream.Context()
+
+	err := s.dal.WatchConfig(ctx, in.GetConfigId(), s.watchInterval, func(config models.ConfigResponse, deleted bool) error {
+		if deleted {
+			return stream.Send(&pb.WatchEvent{Type: pb.WatchEvent_DELETED})
+		}
+
+		out, err := toProtoConfig(config)
+		if err != nil {
+			return err
+		}
+
+		return stream.Send(&pb.WatchEvent{Type: pb.WatchEvent_UPDATED, Config: out})
+	}, grpcRequest(ctx))
+
+	return s.grpcError(err, in.GetConfigId())
+}
+
+// kindGRPCCode the status code of each kind of DAL error
+var kindGRPCCode = map[errorKind]codes.Code{
+	kindValidation:    codes.InvalidArgument,
+	kindNotFound:      codes.NotFound,
+	kindConflict:      codes.Aborted,
+	kindUnprocessable: codes.FailedPrecondition,
+	kindUnavailable:   codes.Unavailable,
+	kindForbidden:     codes.PermissionDenied,
+}
+
+// grpcError returns the status of a DAL error. Unexpected errors are logged
+// and not returned to the caller
+func (s *ConfigServer) grpcError(err error, configID string) error {
+	if err == nil || status.Code(err) != codes.Unknown {
+		return err
+	}
+
+	if kind, _, ok := errorCode(err); ok {
+		return status.Error(kindGRPCCode[kind], errorDetail(err, kind))
+	}
+
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return status.FromContextError(err).Err()
+	}
+
+	s.dal.Logger.Errorf("gRPC call failed: %v", s.dal.Redactor.Error(err, configID))
+	return status.Error(codes.Internal, "unable to complete the request")
+}
+
+// grpcUnaryAuth authenticates unary calls
+func grpcUnaryAuth(d *DAL) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, err := authenticateGRPC(d, ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		return handler(ctx, req)
+	}
+}
+
+// grpcStreamAuth authenticates streaming calls
+func grpcStreamAuth(d *DAL) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := authenticateGRPC(d, ss.Context())
+		if err != nil {
+			return err
+		}
+
+		return handler(srv, &authenticatedStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+// authenticatedStream a server stream with the context of its host
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+// Context returns the context of the stream
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
+
+// authenticateGRPC checks the token and host ID in the metadata of a call as
+// AuthRequired does for REST requests. Sessions aren't supported, so a
+// token is required
+func authenticateGRPC(d *DAL, ctx context.Context) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	var hostID string
+	if v := md.Get("hostid"); len(v) > 0 {
+		hostID = v[0]
+	}
+
+	if v := md.Get("authorization"); len(v) > 0 {
+		if parts := strings.Split(v[0], " "); len(parts) == 2 {
+			if _, ok, _ := ValidateToken(d, hostID, parts[1]); ok {
+				return withHost(ctx, hostID), nil
+			}
+		}
+	}
+
+	d.Logger.Infof("Auth failed for %s", d.Redactor.Obfuscate(hostID, 8))
+	d.EmitMessage("config.audit", "AuthFailure", d.requestDetails(grpcRequest(ctx)))
+
+	return nil, status.Error(codes.Unauthenticated, "unauthorized")
+}
+
+// grpcRequest describes a gRPC call as an HTTP/2 request so it can be
+// audited like a REST request
+func grpcRequest(ctx context.Context) *http.Request {
+	method, _ := grpc.Method(ctx)
+
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, "/", nil)
+	req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/2", 2, 0
+	req.RequestURI = method
+	req.URL.Path = method
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	for key, values := range md {
+		if key == ":authority" {
+			req.Host = values[0]
+			continue
+		}
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		req.RemoteAddr = p.Addr.String()
+	}
+
+	return req
+}
+
+// toProtoConfig converts a config to its protobuf message
+func toProtoConfig(config models.ConfigResponse) (*pb.Config, error) {
+	payload, err := utils.NormalizeJSON(config.Config.Config)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "unable to read the config: %s", err)
+	}
+
+	m, _ := payload.(map[string]interface{})
+	body, err := structpb.NewStruct(m)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "unable to convert the config: %s", err)
+	}
+
+	out := &pb.Config{
+		ConfigId:   config.ConfigID,
+		ConfigName: config.ConfigName,
+		CreatedBy:  config.CreatedBy,
+		Host:       config.Host,
+		Parents:    config.Parents,
+		Tags:       config.Tags,
+		Version:    config.Version,
+		Config:     body,
+		Checksum:   string(config.Config.Checksum),
+		Created:    timestamppb.New(config.Created),
+		Modified:   timestamppb.New(config.Modified),
+		Stale:      config.Stale,
+	}
+	if config.ID != nil {
+		out.Id = config.ID.Hex()
+	}
+
+	return out, nil
+}
+
+// toProtoSchedule converts a scheduled change to its protobuf message
+func toProtoSchedule(schedule models.ConfigSchedule) (*pb.ScheduledChange, error) {
+	payload, err := utils.NormalizeJSON(schedule.Config)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "unable to read the scheduled change: %s", err)
+	}
+
+	m, _ := payload.(map[string]interface{})
+	body, err := structpb.NewStruct(m)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "unable to convert the scheduled change: %s", err)
+	}
+
+	out := &pb.ScheduledChange{
+		Id:          schedule.ID.Hex(),
+		ConfigName:  schedule.ConfigName,
+		Config:      body,
+		Parents:     schedule.Parents,
+		ActivateAt:  timestamppb.New(schedule.ActivateAt),
+		Status:      schedule.Status,
+		CreatedBy:   schedule.CreatedBy,
+		Created:     timestamppb.New(schedule.Created),
+		Version:     schedule.Version,
+		CancelledBy: schedule.CancelledBy,
+		Error:       schedule.Error,
+	}
+	if schedule.Applied != nil {
+		out.Applied = timestamppb.New(*schedule.Applied)
+	}
+	if schedule.Cancelled != nil {
+		out.Cancelled = timestamppb.New(*schedule.Cancelled)
+	}
+
+	return out, nil
+}
@@ -0,0 +1,191 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/aeekayy/stilla/service/pkg/api/models"
+	"github.com/aeekayy/stilla/service/pkg/patch"
+	"github.com/aeekayy/stilla/service/pkg/pointer"
+)
+
+// TestGRPCAuth validates that calls need a valid token and carry their host
+func TestGRPCAuth(t *testing.T) {
+	dal := setupDep(t)
+	auth := grpcUnaryAuth(dal)
+	info := &grpc.UnaryServerInfo{FullMethod: "/stilla.v1.ConfigService/Get"}
+
+	var got context.Context
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		got = ctx
+		return "ok", nil
+	}
+
+	// no token
+	_, err := auth(context.Background(), nil, info, handler)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	assert.Nil(t, got)
+
+	// a token the database doesn't know
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer token", "hostid", "host"))
+	_, err = auth(ctx, nil, info, handler)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	hostID, apiKey, err := dal.Database.GenerateAPIKey("web", nil)
+	assert.Nil(t, err)
+
+	ctx = metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer "+apiKey, "hostid", hostID))
+	resp, err := auth(ctx, nil, info, handler)
+	assert.Nil(t, err)
+	assert.Equal(t, "ok", resp)
+
+	assert.Equal(t, hostID, requestHost(got))
+}
+
+// TestGRPCRequest validates that calls are described as HTTP/2 requests for
+// the audit log
+func TestGRPCRequest(t *testing.T) {
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(":authority", "stilla:9090", "hostid", "host", "user-agent", "grpc-go"))
+	ctx = peer.NewContext(ctx, &peer.Peer{Addr: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5000}})
+
+	req := grpcRequest(ctx)
+	assert.Equal(t, "HTTP/2", req.Proto)
+	assert.Equal(t, "stilla:9090", req.Host)
+	assert.Equal(t, "host", req.Header.Get("HostID"))
+	assert.Equal(t, "grpc-go", req.Header.Get("User-Agent"))
+	assert.Equal(t, "10.0.0.1:5000", req.RemoteAddr)
+}
+
+// TestGRPCError validates the status codes of DAL errors
+func TestGRPCError(t *testing.T) {
+	server := NewConfigServer(setupDep(t), time.Second)
+
+	table := []struct {
+		err  error
+		code codes.Code
+	}{
+		{nil, codes.OK},
+		{fmt.Errorf("%w: missing", errConfigNotFound), codes.NotFound},
+		{fmt.Errorf("%w: timeout", errDocumentStoreUnavailable), codes.Unavailable},
+		{fmt.Errorf("%w: expected version 2, found 3", errVersionConflict), codes.Aborted},
+		{patch.ErrTestFailed, codes.Aborted},
+		{fmt.Errorf("%w: /a", pointer.ErrNotFound), codes.FailedPrecondition},
+		{errPatchNotObject, codes.FailedPrecondition},
+		{&pendingChange{}, codes.Aborted},
+		{errConfigProtected, codes.Aborted},
+		{patch.ErrInvalidPatch, codes.InvalidArgument},
+		{fmt.Errorf("%w: bad limit", errInvalidListQuery), codes.InvalidArgument},
+		{context.Canceled, codes.Canceled},
+		{fmt.Errorf("find: %w", context.DeadlineExceeded), codes.DeadlineExceeded},
+		{status.Error(codes.PermissionDenied, "no"), codes.PermissionDenied},
+		{errors.New("connection reset"), codes.Internal},
+	}
+
+	for _, tc := range table {
+		assert.Equal(t, tc.code, status.Code(server.grpcError(tc.err, "payments")), fmt.Sprint(tc.err))
+	}
+
+	// driver messages aren't returned
+	err := server.grpcError(fmt.Errorf("%w: mongo: no documents in result", errConfigNotFound), "payments")
+	assert.Equal(t, errConfigNotFound.Error(), status.Convert(err).Message())
+}
+
+// TestToProtoConfig validates the conversion of configs to messages
+func TestToProtoConfig(t *testing.T) {
+	id := primitive.NewObjectID()
+	created := time.Date(2023, 5, 1, 0, 0, 0, 0, time.UTC)
+
+	config, err := toProtoConfig(models.ConfigResponse{
+		ID:         &id,
+		ConfigID:   "c1",
+		ConfigName: "payments",
+		Version:    3,
+		Tags:       []string{"prod"},
+		Created:    created,
+		Config: models.ConfigVersion{
+			Config:   map[string]interface{}{"port": int32(8080), "hosts": primitive.A{"a", "b"}},
+			Checksum: "abc",
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, id.Hex(), config.GetId())
+	assert.Equal(t, "payments", config.GetConfigName())
+	assert.Equal(t, int32(3), config.GetVersion())
+	assert.Equal(t, "abc", config.GetChecksum())
+	assert.Equal(t, created, config.GetCreated().AsTime())
+	assert.Equal(t, map[string]interface{}{"port": float64(8080), "hosts": []interface{}{"a", "b"}}, config.GetConfig().AsMap())
+
+	// a config without a payload has an empty one
+	config, err = toProtoConfig(models.ConfigResponse{ConfigName: "empty"})
+	assert.Nil(t, err)
+	assert.Empty(t, config.GetConfig().AsMap())
+	assert.Equal(t, "", config.GetId())
+}
+
+// TestToProtoSchedule validates the conversion of scheduled changes
+func TestToProtoSchedule(t *testing.T) {
+	id := primitive.NewObjectID()
+	activateAt := time.Date(2023, 5, 1, 2, 0, 0, 0, time.UTC)
+
+	schedule, err := toProtoSchedule(models.ConfigSchedule{
+		ID:         id,
+		ConfigName: "payments",
+		Config:     map[string]interface{}{"endpoint": "https://b.example.com"},
+		ActivateAt: activateAt,
+		Status:     models.SchedulePending,
+		CreatedBy:  "host-1",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, id.Hex(), schedule.GetId())
+	assert.Equal(t, activateAt, schedule.GetActivateAt().AsTime())
+	assert.Equal(t, models.SchedulePending, schedule.GetStatus())
+	assert.Equal(t, "https://b.example.com", schedule.GetConfig().AsMap()["endpoint"])
+	assert.Nil(t, schedule.GetApplied())
+
+	applied := activateAt.Add(time.Second)
+	schedule, err = toProtoSchedule(models.ConfigSchedule{ID: id, Status: models.ScheduleApplied, Version: 4, Applied: &applied})
+	assert.Nil(t, err)
+	assert.Equal(t, int32(4), schedule.GetVersion())
+	assert.Equal(t, applied, schedule.GetApplied().AsTime())
+}
+
+// TestConfigWatchers validates that subscribers are woken without blocking
+// on ones that fell behind
+func TestConfigWatchers(t *testing.T) {
+	var w configWatchers
+
+	ch, stop := w.subscribe()
+	w.notify()
+	w.notify()
+
+	select {
+	case <-ch:
+	default:
+		t.Fatal("expected a notification")
+	}
+	select {
+	case <-ch:
+		t.Fatal("notifications should be coalesced")
+	default:
+	}
+
+	stop()
+	w.notify()
+	select {
+	case <-ch:
+		t.Fatal("stopped subscriptions should not be notified")
+	default:
+	}
+}
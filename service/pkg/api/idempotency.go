@@ -0,0 +1,280 @@
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gomodule/redigo/redis"
+
+	"github.com/aeekayy/stilla/service/pkg/utils"
+)
+
+const (
+	// idempotencyKeyHeader the header that carries the idempotency key of a
+	// request
+	idempotencyKeyHeader = "Idempotency-Key"
+	// idempotentReplayedHeader set on responses that are replayed
+	idempotentReplayedHeader = "Idempotent-Replayed"
+	// idempotencyKeyPrefix the prefix of the Redis keys of idempotent
+	// requests
+	idempotencyKeyPrefix = "idempotency_"
+)
+
+// validIdempotencyKey matches idempotency keys. Keys are visible ASCII, such
+// as UUIDs
+var validIdempotencyKey = regexp.MustCompile(`^[\x21-\x7e]{1,255}$`)
+
+// idempotentMethods the methods that take an idempotency key
+var idempotentMethods = map[string]bool{
+	http.MethodPost:   true,
+	http.MethodPatch:  true,
+	http.MethodDelete: true,
+}
+
+// unreplayedHeaders the response headers that aren't stored for replays
+var unreplayedHeaders = map[string]bool{
+	http.CanonicalHeaderKey(requestIDHeader): true,
+	"Set-Cookie":                             true,
+}
+
+// idempotencyRecord a request with an idempotency key and its response.
+// Status is 0 while the request is in progress
+type idempotencyRecord struct {
+	Fingerprint string      `json:"fingerprint"`
+	Status      int         `json:"status,omitempty"`
+	Header      http.Header `json:"header,omitempty"`
+	Body        []byte      `json:"body,omitempty"`
+}
+
+// idempotencyStoreKey returns the Redis key of an idempotency key. Keys are
+// scoped to the host that sent them
+func idempotencyStoreKey(host, key string) string {
+	return fmt.Sprintf("%s%s_%s", idempotencyKeyPrefix, host, key)
+}
+
+// requestFingerprint returns a digest of the method, URI and body of a
+// request
+func requestFingerprint(req *http.Request, body []byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s\n", req.Method, req.URL.RequestURI())
+	h.Write(body)
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// reserveIdempotencyKey stores a pending record for a key that isn't in use.
+// It returns the stored record when the key is in use
+func (d *DAL) reserveIdempotencyKey(key, fingerprint string) (*idempotencyRecord, bool, error) {
+	pending, err := json.Marshal(idempotencyRecord{Fingerprint: fingerprint})
+	if err != nil {
+		return nil, false, err
+	}
+
+	var stored []byte
+	reserved := false
+	err = d.CacheBreaker.Do(func() error {
+		conn := d.Redis.Pool.Get()
+		defer conn.Close()
+
+		// the stored record may expire between the two commands, so the
+		// key is reserved again once
+		for attempt := 0; attempt < 2; attempt++ {
+			reply, err := conn.Do("SET", key, pending, "NX", "PX", d.IdempotencyTTL.Milliseconds())
+			if err != nil {
+				return err
+			}
+			if reply != nil {
+				reserved = true
+				return nil
+			}
+
+			stored, err = redis.Bytes(conn.Do("GET", key))
+			if !errors.Is(err, redis.ErrNil) {
+				return err
+			}
+		}
+
+		return fmt.Errorf("unable to reserve the idempotency key %s", key)
+	})
+	if err != nil || reserved {
+		return nil, reserved, err
+	}
+
+	var record idempotencyRecord
+	if err := json.Unmarshal(stored, &record); err != nil {
+		return nil, false, err
+	}
+
+	return &record, false, nil
+}
+
+// saveIdempotentResponse stores the response of a reserved key. Keys that
+// expired while the request ran aren't stored again
+func (d *DAL) saveIdempotentResponse(key string, record idempotencyRecord) error {
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	return d.CacheBreaker.Do(func() error {
+		conn := d.Redis.Pool.Get()
+		defer conn.Close()
+
+		_, err := conn.Do("SET", key, value, "XX", "PX", d.IdempotencyTTL.Milliseconds())
+		return err
+	})
+}
+
+// releaseIdempotencyKey removes a reserved key, so the request can be
+// retried
+func (d *DAL) releaseIdempotencyKey(key string) error {
+	return d.CacheBreaker.Do(func() error {
+		conn := d.Redis.Pool.Get()
+		defer conn.Close()
+
+		_, err := conn.Do("DEL", key)
+		return err
+	})
+}
+
+// Idempotency is a middleware that makes POST, PATCH and DELETE requests
+// with an Idempotency-Key header safe to retry. The first request with a
+// key runs and its response is kept for IdempotencyTTL. Retries get the
+// same response with an Idempotent-Replayed header. A key reused for a
+// different request gets a 422, and a retry while the first request runs
+// gets a 409. Server errors aren't kept, so they can be retried
+func Idempotency(d *DAL) gin.HandlerFunc {
+	fn := func(c *gin.Context) {
+		key := c.GetHeader(idempotencyKeyHeader)
+		if key == "" || !idempotentMethods[c.Request.Method] || d.Redis == nil || d.IdempotencyTTL <= 0 {
+			c.Next()
+			return
+		}
+
+		if !validIdempotencyKey.MatchString(key) {
+			writeProblem(c, http.StatusBadRequest, "invalid_idempotency_key", "the idempotency key must be 1 to 255 visible ASCII characters")
+			return
+		}
+
+		var body []byte
+		if c.Request.Body != nil {
+			// imports are the largest bodies the write routes take
+			var err error
+			body, err = io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxImportSize))
+			if err != nil {
+				writeBodyError(c, "invalid_request", "unable to read the request body", err)
+				return
+			}
+			c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		}
+
+		fingerprint := requestFingerprint(c.Request, body)
+		storeKey := idempotencyStoreKey(requestHost(c), key)
+
+		record, reserved, err := d.reserveIdempotencyKey(storeKey, fingerprint)
+		if err != nil {
+			d.Logger.Errorf("unable to check the idempotency key: %v", err)
+			writeProblem(c, http.StatusServiceUnavailable, "idempotency_unavailable", "idempotency keys can't be checked")
+			return
+		}
+
+		if !reserved {
+			switch {
+			case record.Fingerprint != fingerprint:
+				writeProblem(c, http.StatusUnprocessableEntity, "idempotency_key_reused", "the idempotency key was used for a different request")
+			case record.Status == 0:
+				writeProblem(c, http.StatusConflict, "idempotency_key_in_use", "a request with the idempotency key is in progress")
+			default:
+				d.replayResponse(c, key, record)
+			}
+			return
+		}
+
+		// release the key if the handler panics, so the request can be
+		// retried
+		completed := false
+		defer func() {
+			if !completed {
+				if err := d.releaseIdempotencyKey(storeKey); err != nil {
+					d.Logger.Errorf("unable to release the idempotency key: %v", err)
+				}
+			}
+		}()
+
+		writer := &teeWriter{ResponseWriter: c.Writer}
+		c.Writer = writer
+		c.Next()
+		c.Writer = writer.ResponseWriter
+		completed = true
+
+		status := writer.Status()
+		if status >= http.StatusInternalServerError {
+			if err := d.releaseIdempotencyKey(storeKey); err != nil {
+				d.Logger.Errorf("unable to release the idempotency key: %v", err)
+			}
+			return
+		}
+
+		header := make(http.Header)
+		for name, values := range writer.Header() {
+			if !unreplayedHeaders[name] {
+				header[name] = values
+			}
+		}
+
+		err = d.saveIdempotentResponse(storeKey, idempotencyRecord{
+			Fingerprint: fingerprint,
+			Status:      status,
+			Header:      header,
+			Body:        writer.body.Bytes(),
+		})
+		if err != nil {
+			d.Logger.Errorf("unable to save the idempotent response: %v", err)
+		}
+	}
+
+	return gin.HandlerFunc(fn)
+}
+
+// replayResponse writes the stored response of an idempotent request and
+// emits an audit event
+func (d *DAL) replayResponse(c *gin.Context, key string, record *idempotencyRecord) {
+	requestDetails := d.requestDetails(c.Request)
+	requestDetails["idempotency_key"] = utils.SanitizeMessageValue(key)
+	d.EmitMessage("config.audit", "IdempotentReplay", requestDetails)
+
+	for name, values := range record.Header {
+		c.Writer.Header()[name] = values
+	}
+	c.Header(idempotentReplayedHeader, "true")
+
+	c.Writer.WriteHeader(record.Status)
+	c.Writer.Write(record.Body)
+	c.Abort()
+}
+
+// teeWriter copies a response body as it's written
+type teeWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+// Write writes the body and copies it
+func (w *teeWriter) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+// WriteString writes the body and copies it
+func (w *teeWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
@@ -0,0 +1,136 @@
+package api
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// idempotencyRouter returns a router with the idempotency middleware in
+// front of handlers that count their calls
+func idempotencyRouter(dal *DAL, calls *int) *gin.Engine {
+	router := gin.New()
+	router.Use(RequestID(), func(c *gin.Context) {
+		c.Set("x-host-id", c.GetHeader("HostID"))
+	}, Idempotency(dal))
+
+	router.POST("/config", func(c *gin.Context) {
+		*calls++
+		body, _ := io.ReadAll(c.Request.Body)
+		c.Header("Location", "/config/c1")
+		c.JSON(http.StatusCreated, gin.H{"data": fmt.Sprintf("call %d: %s", *calls, body)})
+	})
+	router.DELETE("/config/:configId", func(c *gin.Context) {
+		*calls++
+		writeProblem(c, http.StatusServiceUnavailable, "document_store_unavailable", "the document store is unavailable")
+	})
+
+	return router
+}
+
+// sendIdempotent sends a request with an idempotency key
+func sendIdempotent(router *gin.Engine, method, path, host, key, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("HostID", host)
+	if key != "" {
+		req.Header.Set(idempotencyKeyHeader, key)
+	}
+	router.ServeHTTP(w, req)
+
+	return w
+}
+
+// TestIdempotency validates that retries are replayed and reused keys are
+// rejected
+func TestIdempotency(t *testing.T) {
+	dal := setupDep(t)
+	dal.IdempotencyTTL = time.Minute
+	calls := 0
+	router := idempotencyRouter(dal, &calls)
+
+	first := sendIdempotent(router, http.MethodPost, "/config", "host", "key-1", `{"a":1}`)
+	assert.Equal(t, http.StatusCreated, first.Code)
+	assert.Equal(t, 1, calls)
+
+	// a retry gets the first response without running the handler
+	retry := sendIdempotent(router, http.MethodPost, "/config", "host", "key-1", `{"a":1}`)
+	assert.Equal(t, http.StatusCreated, retry.Code)
+	assert.Equal(t, first.Body.String(), retry.Body.String())
+	assert.Equal(t, "/config/c1", retry.Header().Get("Location"))
+	assert.Equal(t, "true", retry.Header().Get(idempotentReplayedHeader))
+	assert.NotEqual(t, first.Header().Get(requestIDHeader), retry.Header().Get(requestIDHeader))
+	assert.Equal(t, 1, calls)
+
+	// the key can't be reused for a different body
+	reused := sendIdempotent(router, http.MethodPost, "/config", "host", "key-1", `{"a":2}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, reused.Code)
+	assertProblem(t, reused, "idempotency_key_reused")
+	assert.Equal(t, 1, calls)
+
+	// keys are scoped to the host
+	other := sendIdempotent(router, http.MethodPost, "/config", "other", "key-1", `{"a":2}`)
+	assert.Equal(t, http.StatusCreated, other.Code)
+	assert.Equal(t, 2, calls)
+
+	// requests without a key always run
+	sendIdempotent(router, http.MethodPost, "/config", "host", "", `{"a":1}`)
+	sendIdempotent(router, http.MethodPost, "/config", "host", "", `{"a":1}`)
+	assert.Equal(t, 4, calls)
+}
+
+// TestIdempotencyServerErrors validates that server errors aren't kept, so
+// the request can be retried
+func TestIdempotencyServerErrors(t *testing.T) {
+	dal := setupDep(t)
+	dal.IdempotencyTTL = time.Minute
+	calls := 0
+	router := idempotencyRouter(dal, &calls)
+
+	for i := 1; i <= 2; i++ {
+		w := sendIdempotent(router, http.MethodDelete, "/config/c1", "host", "key-1", "")
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		assert.Equal(t, i, calls)
+	}
+}
+
+// TestIdempotencyInProgress validates that a retry of a request that's
+// still running is rejected
+func TestIdempotencyInProgress(t *testing.T) {
+	dal := setupDep(t)
+	dal.IdempotencyTTL = time.Minute
+	calls := 0
+	router := idempotencyRouter(dal, &calls)
+
+	req, _ := http.NewRequest(http.MethodPost, "/config", strings.NewReader(`{"a":1}`))
+	_, reserved, err := dal.reserveIdempotencyKey(idempotencyStoreKey("host", "key-1"), requestFingerprint(req, []byte(`{"a":1}`)))
+	assert.Nil(t, err)
+	assert.True(t, reserved)
+
+	w := sendIdempotent(router, http.MethodPost, "/config", "host", "key-1", `{"a":1}`)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assertProblem(t, w, "idempotency_key_in_use")
+	assert.Equal(t, 0, calls)
+}
+
+// TestIdempotencyInvalidKey validates that malformed keys are rejected
+func TestIdempotencyInvalidKey(t *testing.T) {
+	dal := setupDep(t)
+	dal.IdempotencyTTL = time.Minute
+	calls := 0
+	router := idempotencyRouter(dal, &calls)
+
+	for _, key := range []string{"has space", strings.Repeat("k", 256)} {
+		w := sendIdempotent(router, http.MethodPost, "/config", "host", key, `{}`)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assertProblem(t, w, "invalid_idempotency_key")
+	}
+	assert.Equal(t, 0, calls)
+}
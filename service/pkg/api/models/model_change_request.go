@@ -0,0 +1,82 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The states of a change request
+const (
+	ChangePending = "pending"
+	// ChangeApproved a change that was approved and is being applied
+	ChangeApproved = "approved"
+	ChangeApplied  = "applied"
+	ChangeRejected = "rejected"
+	ChangeFailed   = "failed"
+)
+
+// ConfigProtectionIn marks a config as protected or not
+type ConfigProtectionIn struct {
+	Protected *bool `json:"protected" binding:"required"`
+}
+
+// ChangeRequestCommentIn a comment on a change request
+type ChangeRequestCommentIn struct {
+	Body string `json:"body" binding:"required,max=4096"`
+}
+
+// ChangeRequestReviewIn the optional comment of an approval or a rejection
+type ChangeRequestReviewIn struct {
+	Comment string `json:"comment,omitempty" binding:"max=4096"`
+}
+
+// ChangeRequestComment a comment on a change request
+type ChangeRequestComment struct {
+	Author  string    `json:"author" bson:"author"`
+	Body    string    `json:"body" bson:"body"`
+	Created time.Time `json:"created" bson:"created"`
+}
+
+// ConfigChangeDiff a change a change request makes to a payload
+type ConfigChangeDiff struct {
+	Op string `json:"op" bson:"op"`
+	// Path a JSON pointer
+	Path string      `json:"path" bson:"path"`
+	Old  interface{} `json:"old,omitempty" bson:"old,omitempty"`
+	New  interface{} `json:"new,omitempty" bson:"new,omitempty"`
+}
+
+// ChangeRequest a write to a protected config that waits for approval
+type ChangeRequest struct {
+	ID         primitive.ObjectID     `json:"id" bson:"_id,omitempty"`
+	ConfigName string                 `json:"config_name" bson:"config_name"`
+	Owner      string                 `json:"owner,omitempty" bson:"owner,omitempty"`
+	Config     map[string]interface{} `json:"config" bson:"config"`
+	Parents    []string               `json:"parents,omitempty" bson:"parents,omitempty"`
+	// Tags replace the tags of the config when they're set
+	Tags     []string `json:"tags,omitempty" bson:"tags"`
+	Checksum string   `json:"checksum" bson:"checksum"`
+	// Operation the write that was requested, such as PatchConfig
+	Operation string `json:"operation" bson:"operation"`
+	// BaseVersion the version the change was made against. It's applied
+	// only while the config is at that version
+	BaseVersion int32              `json:"base_version" bson:"base_version"`
+	Diff        []ConfigChangeDiff `json:"diff" bson:"diff"`
+	// Status pending, approved, applied, rejected or failed
+	Status      string                 `json:"status" bson:"status"`
+	RequestedBy string                 `json:"requested_by" bson:"requested_by"`
+	Requested   time.Time              `json:"requested" bson:"requested"`
+	ReviewedBy  string                 `json:"reviewed_by,omitempty" bson:"reviewed_by,omitempty"`
+	Reviewed    *time.Time             `json:"reviewed,omitempty" bson:"reviewed,omitempty"`
+	Version     int32                  `json:"version,omitempty" bson:"version,omitempty"`
+	Error       string                 `json:"error,omitempty" bson:"error,omitempty"`
+	Comments    []ChangeRequestComment `json:"comments" bson:"comments"`
+}
+
+// ChangeRequestQuery filters the listed change requests
+type ChangeRequestQuery struct {
+	ConfigName string `form:"config_name"`
+	// Status defaults to pending
+	Status string `form:"status"`
+}
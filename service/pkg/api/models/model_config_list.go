@@ -0,0 +1,30 @@
+package models
+
+import (
+	"time"
+)
+
+// ConfigListQuery the filters, sort order and page of a config list
+type ConfigListQuery struct {
+	// Maximum number of configs in the page. Capped at 100
+	Limit int64 `form:"limit" json:"limit,omitempty"`
+	// Cursor the next token of the previous page
+	Cursor     string   `form:"cursor" json:"cursor,omitempty"`
+	NamePrefix string   `form:"name_prefix" json:"name_prefix,omitempty"`
+	Owner      string   `form:"owner" json:"owner,omitempty"`
+	Host       string   `form:"host" json:"host,omitempty"`
+	Tags       []string `form:"tag" json:"tags,omitempty"`
+	// TagMatch all (default) lists configs with every tag, any with at least one
+	TagMatch      string    `form:"tag_match" json:"tag_match,omitempty"`
+	ModifiedSince time.Time `form:"modified_since" time_format:"2006-01-02T15:04:05Z07:00" json:"modified_since,omitempty"`
+	// Sort a field name. A leading - sorts in descending order
+	Sort string `form:"sort" json:"sort,omitempty"`
+}
+
+// ConfigList a page of configs
+type ConfigList struct {
+	Data []ConfigResponse `json:"data"`
+	// Next the cursor of the next page. Empty on the last page
+	Next  string `json:"next,omitempty"`
+	Total int64  `json:"total"`
+}
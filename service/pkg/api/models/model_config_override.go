@@ -0,0 +1,51 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The states of a temporary override
+const (
+	OverrideActive   = "active"
+	OverrideReverted = "reverted"
+	OverrideFailed   = "failed"
+)
+
+// ConfigOverrideIn a JSON Merge Patch that's applied to a config until its
+// TTL ends
+type ConfigOverrideIn struct {
+	Patch map[string]interface{} `json:"patch" binding:"required"`
+	// TTL how long the override lasts, such as 2h
+	TTL    string `json:"ttl" binding:"required"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// ConfigOverride a temporary override. Revert is the merge patch that
+// undoes it
+type ConfigOverride struct {
+	ID         primitive.ObjectID     `json:"id" bson:"_id,omitempty"`
+	ConfigName string                 `json:"config_name" bson:"config_name"`
+	Patch      map[string]interface{} `json:"patch" bson:"patch"`
+	Revert     map[string]interface{} `json:"revert,omitempty" bson:"revert,omitempty"`
+	Reason     string                 `json:"reason,omitempty" bson:"reason,omitempty"`
+	// Status active, reverted or failed
+	Status    string    `json:"status" bson:"status"`
+	CreatedBy string    `json:"created_by" bson:"created_by"`
+	Created   time.Time `json:"created" bson:"created"`
+	ExpiresAt time.Time `json:"expires_at" bson:"expires_at"`
+	// BaseVersion the version the override was applied to, and Version the
+	// version it was applied as
+	BaseVersion int32      `json:"base_version,omitempty" bson:"base_version,omitempty"`
+	Version     int32      `json:"version,omitempty" bson:"version,omitempty"`
+	Reverted    *time.Time `json:"reverted,omitempty" bson:"reverted,omitempty"`
+	// RevertedBy the host that reverted the override early. It's empty when
+	// the TTL ended
+	RevertedBy      string `json:"reverted_by,omitempty" bson:"reverted_by,omitempty"`
+	RevertedVersion int32  `json:"reverted_version,omitempty" bson:"reverted_version,omitempty"`
+	// Skipped the JSON Pointers of the keys that changed after the override
+	// was applied. They weren't reverted
+	Skipped []string `json:"skipped,omitempty" bson:"skipped,omitempty"`
+	Error   string   `json:"error,omitempty" bson:"error,omitempty"`
+}
@@ -28,9 +28,12 @@ type ConfigResponse struct {
 	CreatedBy  string              `json:"created_by" bson:"created_by"`
 	ConfigID   string              `json:"config_id" bson:"config_id"`
 	Host       string              `json:"host" bson:"host"`
+	OwnerHost  string              `json:"owner_host,omitempty" bson:"owner_host,omitempty"`
 	Parents    []string            `json:"parents,omitempty" bson:"parents,omitempty"`
 	Tags       []string            `form:"tags" json:"tags" yaml:"tags" bson:"tags"`
 	Version    int32               `json:"version" bson:"version"`
+	Protected  bool                `json:"protected,omitempty" bson:"protected,omitempty"`
+	Stale      bool                `json:"-" bson:"-"`
 }
 
 // Ingest ingest data from a BSON map
@@ -0,0 +1,55 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The states of a scheduled change
+const (
+	SchedulePending   = "pending"
+	ScheduleApplied   = "applied"
+	ScheduleCancelled = "cancelled"
+	ScheduleFailed    = "failed"
+	// ScheduleAwaitingApproval a change to a protected config that became a
+	// change request
+	ScheduleAwaitingApproval = "awaiting_approval"
+)
+
+// ConfigScheduleIn a change to apply to a config at a future time
+type ConfigScheduleIn struct {
+	Config     map[string]interface{} `json:"config" binding:"required"`
+	Parents    []string               `json:"parents,omitempty"`
+	ActivateAt time.Time              `json:"activate_at" binding:"required"`
+}
+
+// ConfigSchedule a scheduled change. The payload becomes the next version
+// of the config at ActivateAt
+type ConfigSchedule struct {
+	ID         primitive.ObjectID     `json:"id" bson:"_id,omitempty"`
+	ConfigName string                 `json:"config_name" bson:"config_name"`
+	Config     map[string]interface{} `json:"config" bson:"config"`
+	Parents    []string               `json:"parents,omitempty" bson:"parents,omitempty"`
+	ActivateAt time.Time              `json:"activate_at" bson:"activate_at"`
+	// Status pending, applied, cancelled, failed or awaiting_approval
+	Status    string    `json:"status" bson:"status"`
+	CreatedBy string    `json:"created_by" bson:"created_by"`
+	Created   time.Time `json:"created" bson:"created"`
+	// Version the version the change was applied as
+	Version     int32      `json:"version,omitempty" bson:"version,omitempty"`
+	Applied     *time.Time `json:"applied,omitempty" bson:"applied,omitempty"`
+	CancelledBy string     `json:"cancelled_by,omitempty" bson:"cancelled_by,omitempty"`
+	Cancelled   *time.Time `json:"cancelled,omitempty" bson:"cancelled,omitempty"`
+	Error       string     `json:"error,omitempty" bson:"error,omitempty"`
+	// ChangeRequestID the change request a change to a protected config
+	// waits on
+	ChangeRequestID *primitive.ObjectID `json:"change_request_id,omitempty" bson:"change_request_id,omitempty"`
+}
+
+// ConfigHistory the stored versions of a config, oldest first, and its
+// scheduled changes, soonest first
+type ConfigHistory struct {
+	Versions  []ConfigResponse `json:"versions"`
+	Schedules []ConfigSchedule `json:"schedules"`
+}
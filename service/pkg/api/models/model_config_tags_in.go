@@ -0,0 +1,6 @@
+package models
+
+// ConfigTagsIn the tags of a config. An empty list removes every tag
+type ConfigTagsIn struct {
+	Tags []string `form:"tags" json:"tags" yaml:"tags" binding:"required"`
+}
@@ -10,9 +10,14 @@
 
 package models
 
-// Error ...
+// Error an RFC 7807 problem details body. Code is stable, so clients can
+// branch on it
 type Error struct {
-	Code *interface{} `json:"code"`
-
-	Message *interface{} `json:"message"`
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	Code      string `json:"code"`
+	RequestID string `json:"request_id,omitempty"`
 }
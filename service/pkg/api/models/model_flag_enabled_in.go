@@ -0,0 +1,7 @@
+package models
+
+// FlagEnabledIn turns a flag on or off. Turning a flag off is its kill
+// switch
+type FlagEnabledIn struct {
+	Enabled *bool `form:"enabled" json:"enabled" yaml:"enabled" binding:"required"`
+}
@@ -0,0 +1,21 @@
+package models
+
+// ImportResult the outcome of importing one config
+type ImportResult struct {
+	ConfigName string `json:"config_name"`
+	// Action created, skipped, overwritten, new_version, pending or failed
+	Action  string `json:"action"`
+	Version int32  `json:"version,omitempty"`
+	// ChangeRequestID the change request a pending config awaits approval as
+	ChangeRequestID string `json:"change_request_id,omitempty"`
+	Error           string `json:"error,omitempty"`
+}
+
+// ImportReport the outcome of a bulk import. Nothing is written on a dry run
+type ImportReport struct {
+	DryRun     bool           `json:"dry_run"`
+	OnConflict string         `json:"on_conflict"`
+	Results    []ImportResult `json:"results"`
+	// Summary the number of configs for each action
+	Summary map[string]int `json:"summary"`
+}
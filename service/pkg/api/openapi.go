@@ -0,0 +1,258 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/gin-gonic/gin"
+
+	apispec "github.com/aeekayy/stilla/service/api"
+)
+
+// apiPrefix the prefix of the REST API routes. It's the server URL of the
+// spec, so spec paths don't have it
+const apiPrefix = "/api/v1"
+
+var (
+	openAPIOnce sync.Once
+	openAPIDoc  *openapi3.T
+	openAPIJSON []byte
+	openAPIErr  error
+)
+
+// routeParam matches the :name and *name parameters of gin routes
+var routeParam = regexp.MustCompile(`[:*]([A-Za-z0-9_]+)`)
+
+// loadOpenAPI returns the embedded OpenAPI spec and its JSON form. The spec
+// is parsed and validated once
+func loadOpenAPI() (*openapi3.T, []byte, error) {
+	openAPIOnce.Do(func() {
+		// merge patches are JSON documents, the other patch and bundle
+		// types already have decoders or aren't validated
+		openapi3filter.RegisterBodyDecoder("application/merge-patch+json", openapi3filter.RegisteredBodyDecoder("application/json"))
+
+		loader := openapi3.NewLoader()
+		doc, err := loader.LoadFromData(apispec.OpenAPI)
+		if err != nil {
+			openAPIErr = fmt.Errorf("unable to parse the OpenAPI spec: %w", err)
+			return
+		}
+
+		if err := doc.Validate(loader.Context); err != nil {
+			openAPIErr = fmt.Errorf("invalid OpenAPI spec: %w", err)
+			return
+		}
+
+		openAPIJSON, openAPIErr = json.Marshal(doc)
+		openAPIDoc = doc
+	})
+
+	return openAPIDoc, openAPIJSON, openAPIErr
+}
+
+// specPath returns the spec path of a gin route, such as
+// /config/{configId} for /api/v1/config/:configId. Trailing slashes are
+// dropped
+func specPath(fullPath string) string {
+	path := strings.TrimPrefix(fullPath, apiPrefix)
+	path = routeParam.ReplaceAllString(path, "{$1}")
+	if len(path) > 1 {
+		path = strings.TrimSuffix(path, "/")
+	}
+
+	return path
+}
+
+// specRoute returns the operation of the route a request matched. ok is
+// false for requests that didn't match a route, or routes the spec doesn't
+// describe
+func specRoute(doc *openapi3.T, c *gin.Context) (*routers.Route, map[string]string, bool) {
+	fullPath := c.FullPath()
+	if fullPath == "" {
+		return nil, nil, false
+	}
+
+	path := specPath(fullPath)
+	item := doc.Paths.Find(path)
+	if item == nil {
+		return nil, nil, false
+	}
+
+	op := item.GetOperation(c.Request.Method)
+	if op == nil {
+		return nil, nil, false
+	}
+
+	params := make(map[string]string, len(c.Params))
+	for _, p := range c.Params {
+		// wildcard parameters keep their leading slash
+		params[p.Key] = strings.TrimPrefix(p.Value, "/")
+	}
+
+	route := &routers.Route{
+		Spec:      doc,
+		Path:      path,
+		PathItem:  item,
+		Method:    c.Request.Method,
+		Operation: op,
+	}
+
+	return route, params, true
+}
+
+// isJSONBody returns whether a request has a JSON body. Other bodies, such
+// as bundles, are checked by their handlers
+func isJSONBody(req *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// validationOptions the options of request and response validation
+func validationOptions(excludeBody bool) *openapi3filter.Options {
+	options := &openapi3filter.Options{
+		ExcludeRequestBody: excludeBody,
+		// authentication is checked by AuthRequired
+		AuthenticationFunc: openapi3filter.NoopAuthenticationFunc,
+		// requests are validated, not changed
+		SkipSettingDefaults: true,
+	}
+	options.WithCustomSchemaErrorFunc(func(err *openapi3.SchemaError) string {
+		if pointer := err.JSONPointer(); len(pointer) > 0 {
+			return fmt.Sprintf("/%s: %s", strings.Join(pointer, "/"), err.Reason)
+		}
+
+		return err.Reason
+	})
+
+	return options
+}
+
+// OpenAPISpec - The OpenAPI spec as JSON
+func OpenAPISpec(dal *DAL) gin.HandlerFunc {
+	fn := func(c *gin.Context) {
+		_, body, err := loadOpenAPI()
+		if err != nil {
+			dal.Logger.Errorf("unable to load the OpenAPI spec: %v", err)
+			writeProblem(c, http.StatusInternalServerError, "internal_error", "unable to load the OpenAPI spec")
+			return
+		}
+
+		c.Data(http.StatusOK, "application/json; charset=utf-8", body)
+	}
+
+	return gin.HandlerFunc(fn)
+}
+
+// ValidateOpenAPI is a middleware that validates requests against the
+// OpenAPI spec. Invalid requests get a 400 problem. JSON bodies are
+// validated, other bodies are left to the handlers. When validateResponses
+// is set, which is meant for tests, responses are buffered and validated
+// too, and an invalid response is replaced with a 500 problem
+func ValidateOpenAPI(d *DAL, doc *openapi3.T, validateResponses bool) gin.HandlerFunc {
+	fn := func(c *gin.Context) {
+		route, params, ok := specRoute(doc, c)
+		if !ok {
+			c.Next()
+			return
+		}
+
+		input := &openapi3filter.RequestValidationInput{
+			Request:    c.Request,
+			PathParams: params,
+			Route:      route,
+			Options:    validationOptions(!isJSONBody(c.Request)),
+		}
+		if err := openapi3filter.ValidateRequest(c.Request.Context(), input); err != nil {
+			writeProblem(c, http.StatusBadRequest, "invalid_request", err.Error())
+			return
+		}
+
+		if !validateResponses {
+			c.Next()
+			return
+		}
+
+		writer := c.Writer
+		recorder := &responseRecorder{ResponseWriter: writer, status: http.StatusOK}
+		c.Writer = recorder
+		c.Next()
+		c.Writer = writer
+
+		err := openapi3filter.ValidateResponse(c.Request.Context(), &openapi3filter.ResponseValidationInput{
+			RequestValidationInput: input,
+			Status:                 recorder.status,
+			Header:                 writer.Header(),
+			Body:                   io.NopCloser(bytes.NewReader(recorder.body.Bytes())),
+			Options:                validationOptions(false),
+		})
+		if err != nil {
+			d.Logger.Errorf("invalid response to %s %s: %v", c.Request.Method, route.Path, err)
+			writer.Header().Del("Content-Length")
+			writeProblem(c, http.StatusInternalServerError, "invalid_response", err.Error())
+			return
+		}
+
+		writer.WriteHeader(recorder.status)
+		writer.Write(recorder.body.Bytes())
+	}
+
+	return gin.HandlerFunc(fn)
+}
+
+// responseRecorder buffers a response so it can be validated before it's
+// sent
+type responseRecorder struct {
+	gin.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+// WriteHeader records the status
+func (w *responseRecorder) WriteHeader(code int) {
+	w.status = code
+}
+
+// WriteHeaderNow does nothing. The header is written with the body
+func (w *responseRecorder) WriteHeaderNow() {}
+
+// Write buffers the body
+func (w *responseRecorder) Write(data []byte) (int, error) {
+	return w.body.Write(data)
+}
+
+// WriteString buffers the body
+func (w *responseRecorder) WriteString(s string) (int, error) {
+	return w.body.WriteString(s)
+}
+
+// Status returns the recorded status
+func (w *responseRecorder) Status() int {
+	return w.status
+}
+
+// Size returns the size of the buffered body
+func (w *responseRecorder) Size() int {
+	return w.body.Len()
+}
+
+// Written returns whether a body was buffered
+func (w *responseRecorder) Written() bool {
+	return w.body.Len() > 0
+}
+
+// Flush does nothing. The body is sent once it's validated
+func (w *responseRecorder) Flush() {}
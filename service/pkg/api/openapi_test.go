@@ -0,0 +1,136 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestOpenAPISpec validates that the embedded spec loads and is served as
+// JSON
+func TestOpenAPISpec(t *testing.T) {
+	doc, body, err := loadOpenAPI()
+	assert.Nil(t, err)
+	assert.NotNil(t, doc)
+
+	router := NewRouter(setupDep(t))
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, apiPrefix+"/openapi.json", nil)
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, body, w.Body.Bytes())
+
+	var spec map[string]interface{}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &spec))
+	assert.Equal(t, "3.0.3", spec["openapi"])
+}
+
+// TestRoutesMatchSpec fails when a route isn't in the spec, or the spec
+// describes an operation that isn't routed
+func TestRoutesMatchSpec(t *testing.T) {
+	doc, _, err := loadOpenAPI()
+	assert.Nil(t, err)
+
+	var routed []string
+	for _, route := range NewRouter(setupDep(t)).Routes() {
+		routed = append(routed, route.Method+" "+specPath(route.Path))
+	}
+
+	var documented []string
+	for path, item := range doc.Paths {
+		for method := range item.Operations() {
+			documented = append(documented, method+" "+path)
+		}
+	}
+
+	sort.Strings(routed)
+	sort.Strings(documented)
+	assert.Equal(t, documented, routed)
+}
+
+// TestSpecPath validates the conversion of gin routes to spec paths
+func TestSpecPath(t *testing.T) {
+	table := []struct {
+		route string
+		path  string
+	}{
+		{"/api/v1/configs/", "/configs"},
+		{"/api/v1/health/", "/health"},
+		{"/api/v1/config/:configId", "/config/{configId}"},
+		{"/api/v1/config/:configId/value/*path", "/config/{configId}/value/{path}"},
+		{"/api/v1/host/:hostId/config/:configId", "/host/{hostId}/config/{configId}"},
+		{"/api/v1/openapi.json", "/openapi.json"},
+	}
+
+	for _, tc := range table {
+		assert.Equal(t, tc.path, specPath(tc.route), tc.route)
+	}
+}
+
+// TestValidateOpenAPI validates that requests and responses that don't
+// match the spec are rejected
+func TestValidateOpenAPI(t *testing.T) {
+	dal := setupDep(t)
+	doc, _, err := loadOpenAPI()
+	assert.Nil(t, err)
+
+	router := gin.New()
+	router.Use(RequestID(), ValidateOpenAPI(dal, doc, true))
+	router.GET(apiPrefix+"/configs/", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"data": []interface{}{}, "total": 0})
+	})
+	router.POST(apiPrefix+"/config/", func(c *gin.Context) {
+		c.JSON(http.StatusCreated, gin.H{"data": "c1"})
+	})
+	router.POST(apiPrefix+"/configs/import", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"data": gin.H{}})
+	})
+	// the health check answers with a body the spec doesn't allow
+	router.GET(apiPrefix+"/health/", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"message": 5})
+	})
+
+	table := []struct {
+		name        string
+		method      string
+		path        string
+		contentType string
+		body        string
+		status      int
+	}{
+		{"valid query", http.MethodGet, "/configs/?limit=10&tag_match=any", "", "", http.StatusOK},
+		{"negative limit", http.MethodGet, "/configs/?limit=-1", "", "", http.StatusBadRequest},
+		{"unknown tag match", http.MethodGet, "/configs/?tag_match=some", "", "", http.StatusBadRequest},
+		{"valid body", http.MethodPost, "/config/", "application/json", `{"config_name": "payments", "config": {}}`, http.StatusCreated},
+		{"missing name", http.MethodPost, "/config/", "application/json", `{"config": {}}`, http.StatusBadRequest},
+		{"wrong type", http.MethodPost, "/config/", "application/json", `{"config_name": "payments", "tags": "prod"}`, http.StatusBadRequest},
+		{"bundles aren't validated", http.MethodPost, "/configs/import", "application/x-ndjson", "{}\n", http.StatusOK},
+		{"invalid response", http.MethodGet, "/health/", "", "", http.StatusInternalServerError},
+	}
+
+	for _, tc := range table {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(tc.method, apiPrefix+tc.path, strings.NewReader(tc.body))
+			if tc.contentType != "" {
+				req.Header.Set("Content-Type", tc.contentType)
+			}
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, tc.status, w.Code, w.Body.String())
+			switch tc.status {
+			case http.StatusBadRequest:
+				assertProblem(t, w, "invalid_request")
+			case http.StatusInternalServerError:
+				assertProblem(t, w, "invalid_response")
+			}
+		})
+	}
+}
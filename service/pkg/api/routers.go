@@ -11,18 +11,28 @@
 package api
 
 import (
+	"context"
 	"net/http"
+	"regexp"
 	"strings"
 
 	sentrygin "github.com/getsentry/sentry-go/gin"
 	"github.com/gin-gonic/contrib/sessions"
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 	"github.com/newrelic/go-agent/v3/integrations/nrgin"
+)
 
-	"github.com/aeekayy/stilla/service/pkg/utils"
+const (
+	hostKey = "host"
+	// requestIDHeader the header that carries the ID of a request
+	requestIDHeader = "X-Request-ID"
+	// requestIDKey the context key of the request ID
+	requestIDKey = "x-request-id"
 )
 
-const hostKey = "host"
+// validRequestID matches request IDs that are passed through from clients
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
 
 // Route is the information for every URI.
 type Route struct {
@@ -39,10 +49,19 @@ type Routes []Route
 func NewRouter(dal *DAL) *gin.Engine {
 	router := gin.Default()
 	router.SetTrustedProxies([]string{})
+	router.HandleMethodNotAllowed = true
+	router.Use(RequestID())
+
+	router.NoRoute(func(c *gin.Context) {
+		writeProblem(c, http.StatusNotFound, "route_not_found", "no route matches the request")
+	})
+	router.NoMethod(func(c *gin.Context) {
+		writeProblem(c, http.StatusMethodNotAllowed, "method_not_allowed", "the route doesn't support the method")
+	})
 
 	// Setup the cookie store for session management
 	// TODO: Make this optional
-	store, err := sessions.NewRedisStore(10, "tcp", dal.Config.Cache.Host, dal.Config.Cache.Password, []byte(dal.SessionKey))
+	store, err := newSessionStore(dal.Redis, []byte(dal.SessionKey))
 
 	if err != nil {
 		dal.Logger.Errorf("error setting up cache for DAL: %s", err)
@@ -62,9 +81,23 @@ func NewRouter(dal *DAL) *gin.Engine {
 
 	authRequired := AuthRequired(dal)
 
+	// requests are validated against the OpenAPI spec once they're
+	// authenticated
+	validate := gin.HandlerFunc(func(c *gin.Context) { c.Next() })
+	doc, _, specErr := loadOpenAPI()
+	if specErr != nil {
+		dal.Logger.Errorf("unable to load the OpenAPI spec: %s", specErr)
+	} else if dal.Config == nil || !dal.Config.OpenAPI.DisableValidation {
+		validate = ValidateOpenAPI(dal, doc, gin.Mode() == gin.TestMode)
+	}
+
+	router.GET(apiPrefix+"/openapi.json", OpenAPISpec(dal))
+
+	idempotent := Idempotency(dal)
+
 	// Simple group: v1
 	hostGroup := router.Group("/api/v1/host")
-	hostGroup.Use(authRequired)
+	hostGroup.Use(authRequired, validate)
 	for _, route := range hostRoutes {
 		handler := route.HandlerFunc(dal)
 		switch route.Method {
@@ -82,6 +115,7 @@ func NewRouter(dal *DAL) *gin.Engine {
 	}
 
 	healthGroup := router.Group("/api/v1/health")
+	healthGroup.Use(validate)
 	for _, route := range healthRoutes {
 		handler := route.HandlerFunc(dal)
 		switch route.Method {
@@ -99,7 +133,7 @@ func NewRouter(dal *DAL) *gin.Engine {
 	}
 
 	recordGroup := router.Group("/api/v1/records")
-	recordGroup.Use(authRequired)
+	recordGroup.Use(authRequired, validate)
 	for _, route := range recordRoutes {
 		handler := route.HandlerFunc(dal)
 		switch route.Method {
@@ -117,7 +151,7 @@ func NewRouter(dal *DAL) *gin.Engine {
 	}
 
 	configGroup := router.Group("/api/v1/config")
-	configGroup.Use(authRequired)
+	configGroup.Use(authRequired, validate, idempotent)
 	for _, route := range configRoutes {
 		handler := route.HandlerFunc(dal)
 		switch route.Method {
@@ -135,7 +169,7 @@ func NewRouter(dal *DAL) *gin.Engine {
 	}
 
 	configsGroup := router.Group("/api/v1/configs")
-	configsGroup.Use(authRequired)
+	configsGroup.Use(authRequired, validate, idempotent)
 	for _, route := range configsRoutes {
 		handler := route.HandlerFunc(dal)
 		switch route.Method {
@@ -152,6 +186,42 @@ func NewRouter(dal *DAL) *gin.Engine {
 		}
 	}
 
+	flagGroup := router.Group("/api/v1/flag")
+	flagGroup.Use(authRequired, validate, idempotent)
+	for _, route := range flagRoutes {
+		handler := route.HandlerFunc(dal)
+		switch route.Method {
+		case http.MethodGet:
+			flagGroup.GET(route.Pattern, handler)
+		case http.MethodPost:
+			flagGroup.POST(route.Pattern, handler)
+		case http.MethodPut:
+			flagGroup.PUT(route.Pattern, handler)
+		case http.MethodPatch:
+			flagGroup.PATCH(route.Pattern, handler)
+		case http.MethodDelete:
+			flagGroup.DELETE(route.Pattern, handler)
+		}
+	}
+
+	flagsGroup := router.Group("/api/v1/flags")
+	flagsGroup.Use(authRequired, validate, idempotent)
+	for _, route := range flagsRoutes {
+		handler := route.HandlerFunc(dal)
+		switch route.Method {
+		case http.MethodGet:
+			flagsGroup.GET(route.Pattern, handler)
+		case http.MethodPost:
+			flagsGroup.POST(route.Pattern, handler)
+		case http.MethodPut:
+			flagsGroup.PUT(route.Pattern, handler)
+		case http.MethodPatch:
+			flagsGroup.PATCH(route.Pattern, handler)
+		case http.MethodDelete:
+			flagsGroup.DELETE(route.Pattern, handler)
+		}
+	}
+
 	return router
 }
 
@@ -176,6 +246,13 @@ var hostRoutes = Routes{
 		"/:hostId/config/:configId",
 		GetConfigByID,
 	},
+
+	{
+		"GetConfigValueByHostID",
+		http.MethodGet,
+		"/:hostId/config/:configId/value/*path",
+		GetConfigByID,
+	},
 }
 
 var healthRoutes = Routes{
@@ -185,6 +262,18 @@ var healthRoutes = Routes{
 		"/",
 		PingGet,
 	},
+	{
+		"CacheStats",
+		http.MethodGet,
+		"/cache",
+		CacheStats,
+	},
+	{
+		"BreakerStates",
+		http.MethodGet,
+		"/breakers",
+		BreakerStates,
+	},
 }
 
 var recordRoutes = Routes{
@@ -211,12 +300,117 @@ var configRoutes = Routes{
 		GetConfigByID,
 	},
 
+	{
+		"GetConfigValue",
+		http.MethodGet,
+		"/:configId/value/*path",
+		GetConfigByID,
+	},
+
 	{
 		"UpdateConfigByID",
 		http.MethodPatch,
 		"/:configId",
 		UpdateConfigByID,
 	},
+
+	{
+		"DeleteConfigByID",
+		http.MethodDelete,
+		"/:configId",
+		DeleteConfigByID,
+	},
+
+	{
+		"RestoreConfigByID",
+		http.MethodPost,
+		"/:configId/restore",
+		RestoreConfigByID,
+	},
+
+	{
+		"PurgeConfigByID",
+		http.MethodDelete,
+		"/:configId/purge",
+		PurgeConfigByID,
+	},
+
+	{
+		"UpdateConfigTags",
+		http.MethodPut,
+		"/:configId/tags",
+		UpdateConfigTags,
+	},
+
+	{
+		"GetConfigHistory",
+		http.MethodGet,
+		"/:configId/history",
+		GetConfigHistory,
+	},
+
+	{
+		"ScheduleConfig",
+		http.MethodPost,
+		"/:configId/schedules",
+		ScheduleConfig,
+	},
+
+	{
+		"CancelSchedule",
+		http.MethodDelete,
+		"/:configId/schedules/:scheduleId",
+		CancelSchedule,
+	},
+
+	{
+		"ApplyOverride",
+		http.MethodPost,
+		"/:configId/overrides",
+		ApplyOverride,
+	},
+
+	{
+		"RevertOverride",
+		http.MethodDelete,
+		"/:configId/overrides/:overrideId",
+		RevertOverride,
+	},
+
+	{
+		"SetConfigProtection",
+		http.MethodPut,
+		"/:configId/protection",
+		SetConfigProtection,
+	},
+
+	{
+		"GetChangeRequest",
+		http.MethodGet,
+		"/:configId/changes/:changeId",
+		GetChangeRequest,
+	},
+
+	{
+		"ApproveChangeRequest",
+		http.MethodPost,
+		"/:configId/changes/:changeId/approve",
+		ApproveChangeRequest,
+	},
+
+	{
+		"RejectChangeRequest",
+		http.MethodPost,
+		"/:configId/changes/:changeId/reject",
+		RejectChangeRequest,
+	},
+
+	{
+		"CommentChangeRequest",
+		http.MethodPost,
+		"/:configId/changes/:changeId/comments",
+		CommentChangeRequest,
+	},
 }
 var configsRoutes = Routes{
 	{
@@ -225,6 +419,72 @@ var configsRoutes = Routes{
 		"/",
 		GetConfigs,
 	},
+
+	{
+		"ExportConfigs",
+		http.MethodGet,
+		"/export",
+		ExportConfigs,
+	},
+
+	{
+		"ImportConfigs",
+		http.MethodPost,
+		"/import",
+		ImportConfigs,
+	},
+
+	{
+		"GetActiveOverrides",
+		http.MethodGet,
+		"/overrides",
+		GetActiveOverrides,
+	},
+
+	{
+		"GetChangeRequests",
+		http.MethodGet,
+		"/changes",
+		GetChangeRequests,
+	},
+}
+
+var flagRoutes = Routes{
+	{
+		"GetFlag",
+		http.MethodGet,
+		"/:flagKey",
+		GetFlag,
+	},
+
+	{
+		"PutFlag",
+		http.MethodPut,
+		"/:flagKey",
+		PutFlag,
+	},
+
+	{
+		"SetFlagEnabled",
+		http.MethodPut,
+		"/:flagKey/enabled",
+		SetFlagEnabled,
+	},
+
+	{
+		"EvaluateFlag",
+		http.MethodGet,
+		"/:flagKey/evaluate",
+		EvaluateFlag,
+	},
+}
+var flagsRoutes = Routes{
+	{
+		"EvaluateFlags",
+		http.MethodGet,
+		"/evaluate",
+		EvaluateFlags,
+	},
 }
 
 func extractToken(c *gin.Context) (string, string, bool) {
@@ -237,6 +497,27 @@ func extractToken(c *gin.Context) (string, string, bool) {
 	return "", host, false
 }
 
+// RequestID is a middleware that sets the ID of each request. The
+// X-Request-ID header is used when it's a valid ID, otherwise a new one is
+// made. The ID is added to the request headers, so it's in the audit log,
+// and returned in the X-Request-ID response header
+func RequestID() gin.HandlerFunc {
+	fn := func(c *gin.Context) {
+		requestID := c.GetHeader(requestIDHeader)
+		if !validRequestID.MatchString(requestID) {
+			requestID = uuid.NewString()
+			c.Request.Header.Set(requestIDHeader, requestID)
+		}
+
+		c.Set(requestIDKey, requestID)
+		c.Header(requestIDHeader, requestID)
+
+		c.Next()
+	}
+
+	return gin.HandlerFunc(fn)
+}
+
 // AuthRequired is a simple middleware to check the session
 func AuthRequired(d *DAL) gin.HandlerFunc {
 	fn := func(c *gin.Context) {
@@ -248,8 +529,9 @@ func AuthRequired(d *DAL) gin.HandlerFunc {
 			host, ok, _ = ValidateToken(d, hostID, token)
 			c.Set("x-host-id", hostID)
 			if !ok {
-				d.Logger.Infof("Auth failed for %s", utils.ObfuscateValue(hostID, 8))
-				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+				d.Logger.Infof("Auth failed for %s", d.Redactor.Obfuscate(hostID, 8))
+				d.EmitMessage("config.audit", "AuthFailure", d.requestDetails(c.Request))
+				writeProblem(c, http.StatusUnauthorized, "unauthorized", "a valid token or session is required")
 				return
 			}
 		} else {
@@ -258,8 +540,9 @@ func AuthRequired(d *DAL) gin.HandlerFunc {
 		}
 
 		if host == "" {
+			d.EmitMessage("config.audit", "AuthFailure", d.requestDetails(c.Request))
 			// Abort the request with the appropriate error code
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			writeProblem(c, http.StatusUnauthorized, "unauthorized", "a valid token or session is required")
 			return
 		}
 		// set the context
@@ -270,3 +553,48 @@ func AuthRequired(d *DAL) gin.HandlerFunc {
 
 	return gin.HandlerFunc(fn)
 }
+
+// hostIDKey the context key of the host that DAL methods run as outside of
+// a REST request
+type hostIDKey struct{}
+
+// withHost returns a context that DAL methods run with as hostID, such as
+// for a gRPC call or background work
+func withHost(ctx context.Context, hostID string) context.Context {
+	return context.WithValue(ctx, hostIDKey{}, hostID)
+}
+
+// requestHost returns the ID of the authenticated host of a request, or of
+// the host a context was made for with withHost
+func requestHost(ctx context.Context) string {
+	if hostID, ok := ctx.Value(hostIDKey{}).(string); ok {
+		return hostID
+	}
+
+	hostID, _ := ctx.Value("x-host-id").(string)
+	if hostID == "" {
+		hostID, _ = ctx.Value("x-host").(string)
+	}
+
+	return hostID
+}
+
+// isAdmin returns whether the authenticated host is listed in admin_hosts
+func isAdmin(d *DAL, ctx context.Context) bool {
+	return isAdminHost(d, requestHost(ctx))
+}
+
+// isAdminHost returns whether a host is listed in admin_hosts
+func isAdminHost(d *DAL, hostID string) bool {
+	if d.Config == nil || hostID == "" {
+		return false
+	}
+
+	for _, admin := range d.Config.AdminHosts {
+		if admin == hostID {
+			return true
+		}
+	}
+
+	return false
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"math/rand"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -11,7 +12,6 @@ import (
 	"time"
 
 	"github.com/confluentinc/confluent-kafka-go/kafka"
-	"github.com/gin-contrib/cache/persistence"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/autotls"
 	"github.com/gin-gonic/gin"
@@ -20,9 +20,12 @@ import (
 	"github.com/pkg/errors"
 	"go.uber.org/ratelimit"
 	"go.uber.org/zap"
+	"google.golang.org/grpc"
 
 	"github.com/aeekayy/stilla/service/lib/db"
+	"github.com/aeekayy/stilla/service/pkg/cache"
 	"github.com/aeekayy/stilla/service/pkg/models"
+	"github.com/aeekayy/stilla/service/pkg/retention"
 )
 
 const (
@@ -56,6 +59,8 @@ type HTTPServer struct {
 	config     models.Server      `json:"config",yaml:"config"`
 	DomainName string             `json:"domain_name",yaml:"domain_name"`
 	Secure     bool               `json:"secure",yaml:"secure"`
+	grpcServer *grpc.Server
+	grpcAddr   string
 }
 
 // Get returns a new web server leveraging the service logger
@@ -71,18 +76,17 @@ func Get(ctx context.Context, sugar *zap.SugaredLogger, domainName string, confi
 	dbParams := config.Database.Parameters
 	dbConn, err := db.Connect(&ctx, dbUser, dbPass, dbHost, dbName, dbParams)
 
-	cachePass := config.Cache.Password
-	cacheHost := config.Cache.Host
-
-	// TODO: Switch to NewRedisCacheWithPool
-	// https://github.com/gin-contrib/cache/blob/v1.2.0/persistence/redis.go#L55-L57
-	store := persistence.NewRedisCache(cacheHost, cachePass, time.Second)
-
 	if err != nil {
 		sugar.Fatalf("couldn't connect to the database at %s: %w", dbHost, err)
 		return nil, err
 	}
 
+	redisClient, err := cache.NewRedis(config.Cache)
+	if err != nil {
+		sugar.Fatalf("couldn't set up redis at %s: %s", config.Cache.Host, err)
+		return nil, err
+	}
+
 	mongoConn, _, _, err := db.MongoConnect(&ctx, config.DocDB.Username, config.DocDB.Password, config.DocDB.Host, config.DocDB.Timeout, config.DocDB.DNSSeed)
 
 	if err != nil {
@@ -119,12 +123,38 @@ func Get(ctx context.Context, sugar *zap.SugaredLogger, domainName string, confi
 
 	collectionName := "config"
 
-	dal := NewDAL(&ctx, sugar, nrapp, config, *dbConn, mongoConn, store, kafkaProducer, collectionName, config.SessionKey)
+	dal := NewDAL(&ctx, sugar, nrapp, config, *dbConn, mongoConn, redisClient, kafkaProducer, collectionName, config.SessionKey)
+
+	// the service can run without the indexes, so a failure isn't fatal
+	if err := dal.EnsureIndexes(ctx); err != nil {
+		sugar.Errorf("%s", err)
+	}
+
+	// archive expired audit records in the background
+	if config.Retention.Enabled {
+		archiver, err := retention.New(*dbConn, sugar, config.Retention)
+		if err != nil {
+			sugar.Fatalf("invalid audit retention configuration: %s", err)
+			return nil, err
+		}
+
+		go archiver.Run(ctx)
+	}
+
+	// apply scheduled config changes in the background
+	if config.Scheduler.IsEnabled() {
+		interval, err := config.Scheduler.GetInterval()
+		if err != nil {
+			sugar.Errorf("invalid scheduler interval, using %s: %s", interval, err)
+		}
+
+		go dal.RunScheduler(ctx, interval)
+	}
 	router := NewRouter(dal)
 
 	router.Use(cors.New(cors.Config{
 		AllowOrigins:  []string{"https://stilla.aeekay.co"},
-		AllowMethods:  []string{"PUT", "POST", "GET", "PATCH", "HEAD", "OPTIONS"},
+		AllowMethods:  []string{"PUT", "POST", "GET", "PATCH", "DELETE", "HEAD", "OPTIONS"},
 		AllowHeaders:  []string{"Origin", "Referer", "Content-Type", "Accept", "Session", "Access-Control-Allow-Origin", "scheme", "path", "method", "authority", "user-agent", "sec-fetch-site", "sec-fetch-dest", "sec-fetch-mode", "sec-ch-ua-platform", "sec-ch-ua-mobile", "sec-ch-ua", "dnt", "content-length", "accept-encoding", "accept-language", "cache-control", "pragma"},
 		ExposeHeaders: []string{"Origin", "Referer", "Content-Type", "Accept", "Session", "Access-Control-Allow-Origin", "scheme", "path", "method", "authority", "user-agent", "sec-fetch-site", "sec-fetch-dest", "sec-fetch-mode", "sec-ch-ua-platform", "sec-ch-ua-mobile", "sec-ch-ua", "dnt", "content-length", "accept-encoding", "accept-language", "cache-control", "pragma"},
 		AllowOriginFunc: func(origin string) bool {
@@ -151,7 +181,17 @@ func Get(ctx context.Context, sugar *zap.SugaredLogger, domainName string, confi
 		Handler: router,
 	}
 
-	return &HTTPServer{Context: ctx, Engine: router, DomainName: domainName, server: srv, config: config.Server}, nil
+	// the gRPC ConfigService shares the DAL with the REST API
+	var grpcServer *grpc.Server
+	if config.GRPC.Enabled {
+		watchInterval, err := config.GRPC.GetWatchInterval()
+		if err != nil {
+			sugar.Errorf("invalid grpc watch interval, using %s: %s", watchInterval, err)
+		}
+		grpcServer = NewGRPCServer(dal, watchInterval)
+	}
+
+	return &HTTPServer{Context: ctx, Engine: router, DomainName: domainName, server: srv, config: config.Server, grpcServer: grpcServer, grpcAddr: fmt.Sprintf(":%d", config.GRPC.GetPort())}, nil
 }
 
 // run runs the web server
@@ -163,6 +203,32 @@ func (h *HTTPServer) run() error {
 	return h.Engine.Run()
 }
 
+// runGRPC runs the gRPC server
+func (h *HTTPServer) runGRPC() error {
+	lis, err := net.Listen("tcp", h.grpcAddr)
+	if err != nil {
+		return fmt.Errorf("unable to listen on %s: %s", h.grpcAddr, err)
+	}
+
+	return h.grpcServer.Serve(lis)
+}
+
+// stopGRPC stops the gRPC server. Calls that are still running when ctx is
+// done, such as Watch streams, are cancelled
+func (h *HTTPServer) stopGRPC(ctx context.Context) {
+	stopped := make(chan struct{})
+	go func() {
+		h.grpcServer.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		h.grpcServer.Stop()
+	}
+}
+
 // Run runs the web server
 func (h *HTTPServer) Run() error {
 	timeoutDuration, err := time.ParseDuration(h.config.Timeout)
@@ -170,7 +236,7 @@ func (h *HTTPServer) Run() error {
 		return fmt.Errorf("error parsing the duration: %s", err)
 	}
 
-	quit := make(chan error)
+	quit := make(chan error, 2)
 
 	go func() {
 		if err := h.run(); err != nil {
@@ -178,6 +244,14 @@ func (h *HTTPServer) Run() error {
 		}
 	}()
 
+	if h.grpcServer != nil {
+		go func() {
+			if err := h.runGRPC(); err != nil {
+				quit <- err
+			}
+		}()
+	}
+
 	// SIGKILL and SIGSTOP cannot be caught, so don't bother adding them here
 	interrupt := make(chan os.Signal, 2)
 	signal.Notify(interrupt, syscall.SIGINT, syscall.SIGTERM)
@@ -193,5 +267,10 @@ func (h *HTTPServer) Run() error {
 
 	ctx, cancel := context.WithTimeout(context.Background(), timeoutDuration)
 	defer cancel()
+
+	if h.grpcServer != nil {
+		h.stopGRPC(ctx)
+	}
+
 	return errors.Wrap(h.server.Shutdown(ctx), "Failed shutting down gracefully")
 }
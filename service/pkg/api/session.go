@@ -0,0 +1,41 @@
+package api
+
+import (
+	"fmt"
+
+	"github.com/boj/redistore"
+	"github.com/gin-gonic/contrib/sessions"
+	gsessions "github.com/gorilla/sessions"
+
+	"github.com/aeekayy/stilla/service/pkg/cache"
+)
+
+// sessionStore a session store backed by the shared Redis client
+type sessionStore struct {
+	*redistore.RediStore
+}
+
+// newSessionStore returns a session store that uses the Redis pool of the cache
+func newSessionStore(redisClient *cache.Redis, keyPairs ...[]byte) (sessions.Store, error) {
+	if redisClient == nil {
+		return nil, fmt.Errorf("redis is not configured")
+	}
+
+	store, err := redistore.NewRediStoreWithPool(redisClient.Pool, keyPairs...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sessionStore{store}, nil
+}
+
+// Options sets the cookie options of new sessions
+func (s *sessionStore) Options(options sessions.Options) {
+	s.RediStore.Options = &gsessions.Options{
+		Path:     options.Path,
+		Domain:   options.Domain,
+		MaxAge:   options.MaxAge,
+		Secure:   options.Secure,
+		HttpOnly: options.HttpOnly,
+	}
+}
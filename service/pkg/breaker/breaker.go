@@ -0,0 +1,201 @@
+// Package breaker circuit breakers for the data stores used by Stilla. A
+// breaker opens after a number of consecutive failures, fails fast while
+// it's open and lets a single probe through once the timeout has passed.
+package breaker
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrOpen returned by Allow when the breaker is open
+var ErrOpen = errors.New("the circuit breaker is open")
+
+// State the state of a breaker
+type State int
+
+const (
+	// Closed requests are allowed
+	Closed State = iota
+	// Open requests fail fast
+	Open
+	// HalfOpen a single probe is allowed to test for recovery
+	HalfOpen
+)
+
+// String returns the name of the state
+func (s State) String() string {
+	switch s {
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	}
+
+	return "closed"
+}
+
+// MarshalText encodes the state by name
+func (s State) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Breaker a circuit breaker. A nil Breaker allows every request. It is
+// safe for concurrent use
+type Breaker struct {
+	// OnStateChange is called with the old and new state when the state
+	// changes. It's called with the lock held and must not use the breaker
+	OnStateChange func(name string, from, to State)
+
+	name      string
+	mu        sync.Mutex
+	now       func() time.Time
+	openedAt  time.Time
+	timeout   time.Duration
+	threshold int
+	failures  int
+	state     State
+	probing   bool
+}
+
+// New returns a closed breaker that opens after threshold consecutive
+// failures and probes again after timeout
+func New(name string, threshold int, timeout time.Duration) *Breaker {
+	if threshold < 1 {
+		threshold = 1
+	}
+
+	return &Breaker{
+		name:      name,
+		now:       time.Now,
+		timeout:   timeout,
+		threshold: threshold,
+	}
+}
+
+// Allow returns ErrOpen if the request should fail fast. Every allowed
+// request must be followed by Success, Failure or Release
+func (b *Breaker) Allow() error {
+	if b == nil {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == Open && !b.now().Before(b.openedAt.Add(b.timeout)) {
+		b.setState(HalfOpen)
+	}
+
+	switch b.state {
+	case Open:
+		return ErrOpen
+	case HalfOpen:
+		if b.probing {
+			return ErrOpen
+		}
+		b.probing = true
+	}
+
+	return nil
+}
+
+// Success records a successful request. A successful probe closes the breaker
+func (b *Breaker) Success() {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+	b.probing = false
+	b.setState(Closed)
+}
+
+// Failure records a failed request. A failed probe opens the breaker again
+func (b *Breaker) Failure() {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	b.probing = false
+
+	if b.state == HalfOpen || b.failures >= b.threshold {
+		b.openedAt = b.now()
+		b.setState(Open)
+	}
+}
+
+// Release ends a request without recording a result, such as a request
+// cancelled by the client
+func (b *Breaker) Release() {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+}
+
+// Do runs fn if the breaker allows it and records any error as a failure
+func (b *Breaker) Do(fn func() error) error {
+	if err := b.Allow(); err != nil {
+		return err
+	}
+
+	if err := fn(); err != nil {
+		b.Failure()
+		return err
+	}
+
+	b.Success()
+	return nil
+}
+
+// State returns the current state of the breaker
+func (b *Breaker) State() State {
+	if b == nil {
+		return Closed
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == Open && !b.now().Before(b.openedAt.Add(b.timeout)) {
+		return HalfOpen
+	}
+
+	return b.state
+}
+
+// Name returns the name of the breaker
+func (b *Breaker) Name() string {
+	if b == nil {
+		return ""
+	}
+
+	return b.name
+}
+
+// setState changes the state. The lock must be held
+func (b *Breaker) setState(state State) {
+	if b.state == state {
+		return
+	}
+
+	from := b.state
+	b.state = state
+
+	if b.OnStateChange != nil {
+		b.OnStateChange(b.name, from, state)
+	}
+}
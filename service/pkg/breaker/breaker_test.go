@@ -0,0 +1,86 @@
+package breaker
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestBreaker validates opening, probing and recovery
+func TestBreaker(t *testing.T) {
+	now := time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC)
+	b := New("mongo", 2, 30*time.Second)
+	b.now = func() time.Time { return now }
+
+	var changes []State
+	b.OnStateChange = func(name string, from, to State) {
+		assert.Equal(t, "mongo", name)
+		changes = append(changes, to)
+	}
+
+	// one failure is under the threshold
+	assert.Nil(t, b.Allow())
+	b.Failure()
+	assert.Equal(t, Closed, b.State())
+
+	assert.Nil(t, b.Allow())
+	b.Failure()
+	assert.Equal(t, Open, b.State())
+	assert.ErrorIs(t, b.Allow(), ErrOpen)
+
+	// a single probe is allowed after the timeout
+	now = now.Add(30 * time.Second)
+	assert.Equal(t, HalfOpen, b.State())
+	assert.Nil(t, b.Allow())
+	assert.ErrorIs(t, b.Allow(), ErrOpen)
+
+	// a failed probe opens the breaker again
+	b.Failure()
+	assert.ErrorIs(t, b.Allow(), ErrOpen)
+
+	// a successful probe closes it
+	now = now.Add(30 * time.Second)
+	assert.Nil(t, b.Allow())
+	b.Success()
+	assert.Equal(t, Closed, b.State())
+	assert.Nil(t, b.Allow())
+
+	assert.Equal(t, []State{Open, HalfOpen, Open, HalfOpen, Closed}, changes)
+}
+
+// TestBreakerRelease validates that a released probe lets another probe through
+func TestBreakerRelease(t *testing.T) {
+	now := time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC)
+	b := New("redis", 1, time.Second)
+	b.now = func() time.Time { return now }
+
+	assert.Nil(t, b.Allow())
+	b.Failure()
+
+	now = now.Add(time.Second)
+	assert.Nil(t, b.Allow())
+	b.Release()
+	assert.Nil(t, b.Allow())
+	assert.Equal(t, HalfOpen, b.State())
+}
+
+// TestBreakerDo validates that errors are recorded as failures
+func TestBreakerDo(t *testing.T) {
+	b := New("redis", 1, time.Minute)
+
+	errDown := errors.New("down")
+	assert.ErrorIs(t, b.Do(func() error { return errDown }), errDown)
+	assert.ErrorIs(t, b.Do(func() error { return nil }), ErrOpen)
+}
+
+// TestNilBreaker validates that a nil breaker allows every request
+func TestNilBreaker(t *testing.T) {
+	var b *Breaker
+
+	assert.Nil(t, b.Allow())
+	b.Failure()
+	assert.Nil(t, b.Do(func() error { return nil }))
+	assert.Equal(t, Closed, b.State())
+}
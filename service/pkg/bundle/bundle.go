@@ -0,0 +1,346 @@
+// Package bundle reads and writes archives of configs for bulk import and
+// export. A bundle is either NDJSON, with a header line followed by one
+// config per line, or a tar archive with a manifest.json and one JSON file
+// per config under configs/.
+package bundle
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aeekayy/stilla/service/pkg/utils"
+)
+
+// Format the archive format of a bundle
+type Format string
+
+const (
+	// FormatNDJSON newline delimited JSON
+	FormatNDJSON Format = "ndjson"
+	// FormatTar a tar archive
+	FormatTar Format = "tar"
+
+	// Kind identifies a Stilla bundle in its header
+	Kind = "stilla.bundle/v1"
+
+	manifestName = "manifest.json"
+	configsDir   = "configs/"
+	maxLineSize  = 16 << 20 // longest NDJSON line
+)
+
+// ErrUnsupportedFormat returned for an unknown bundle format
+var ErrUnsupportedFormat = errors.New("unsupported bundle format")
+
+// ErrInvalidBundle returned when a bundle can't be read
+var ErrInvalidBundle = errors.New("invalid bundle")
+
+// Header describes a bundle
+type Header struct {
+	Kind     string    `json:"kind"`
+	Exported time.Time `json:"exported"`
+	// History whether the configs carry their version history
+	History bool `json:"history"`
+}
+
+// Config a config with its metadata and, optionally, its version history
+type Config struct {
+	ConfigName string                 `json:"config_name"`
+	ConfigID   string                 `json:"config_id,omitempty"`
+	Owner      string                 `json:"owner,omitempty"`
+	Host       string                 `json:"host,omitempty"`
+	Parents    []string               `json:"parents,omitempty"`
+	Tags       []string               `json:"tags,omitempty"`
+	Version    int32                  `json:"version,omitempty"`
+	Checksum   string                 `json:"checksum,omitempty"`
+	Created    time.Time              `json:"created,omitempty"`
+	Modified   time.Time              `json:"modified,omitempty"`
+	Config     map[string]interface{} `json:"config"`
+	Versions   []Version              `json:"versions,omitempty"`
+}
+
+// Version a past version of a config
+type Version struct {
+	Version  int32                  `json:"version"`
+	Owner    string                 `json:"owner,omitempty"`
+	Host     string                 `json:"host,omitempty"`
+	Checksum string                 `json:"checksum,omitempty"`
+	Created  time.Time              `json:"created,omitempty"`
+	Modified time.Time              `json:"modified,omitempty"`
+	Config   map[string]interface{} `json:"config"`
+}
+
+// ParseFormat returns the format for a name. ndjson is the default
+func ParseFormat(name string) (Format, error) {
+	switch strings.ToLower(name) {
+	case "", "ndjson", "jsonl":
+		return FormatNDJSON, nil
+	case "tar":
+		return FormatTar, nil
+	}
+
+	return "", fmt.Errorf("%w: %q", ErrUnsupportedFormat, name)
+}
+
+// ForContentType returns the format of a Content-Type header
+func ForContentType(contentType string) (Format, error) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", fmt.Errorf("%w: %q", ErrUnsupportedFormat, contentType)
+	}
+
+	switch mediaType {
+	case "application/x-ndjson", "application/jsonl", "application/json":
+		return FormatNDJSON, nil
+	case "application/x-tar":
+		return FormatTar, nil
+	}
+
+	return "", fmt.Errorf("%w: %q", ErrUnsupportedFormat, contentType)
+}
+
+// ContentType returns the Content-Type header of the format
+func (f Format) ContentType() string {
+	if f == FormatTar {
+		return "application/x-tar"
+	}
+
+	return "application/x-ndjson"
+}
+
+// Extension returns the file extension of the format
+func (f Format) Extension() string {
+	if f == FormatTar {
+		return ".tar"
+	}
+
+	return ".ndjson"
+}
+
+// Writer writes configs to a bundle
+type Writer interface {
+	Write(Config) error
+	// Close finishes the bundle. It doesn't close the underlying writer
+	Close() error
+}
+
+// NewWriter returns a Writer for the format. The header is written first
+func NewWriter(format Format, w io.Writer, header Header) (Writer, error) {
+	header.Kind = Kind
+
+	switch format {
+	case FormatNDJSON:
+		nw := &ndjsonWriter{enc: json.NewEncoder(w)}
+		if err := nw.enc.Encode(header); err != nil {
+			return nil, err
+		}
+		return nw, nil
+	case FormatTar:
+		tw := &tarWriter{tw: tar.NewWriter(w), modTime: header.Exported, names: make(map[string]bool)}
+		if err := tw.writeFile(manifestName, header); err != nil {
+			return nil, err
+		}
+		return tw, nil
+	}
+
+	return nil, fmt.Errorf("%w: %q", ErrUnsupportedFormat, format)
+}
+
+// ndjsonWriter writes one config per line
+type ndjsonWriter struct {
+	enc *json.Encoder
+}
+
+func (w *ndjsonWriter) Write(config Config) error {
+	return w.enc.Encode(config)
+}
+
+func (w *ndjsonWriter) Close() error {
+	return nil
+}
+
+// tarWriter writes one file per config
+type tarWriter struct {
+	tw      *tar.Writer
+	modTime time.Time
+	names   map[string]bool
+}
+
+func (w *tarWriter) Write(config Config) error {
+	// names may contain slashes, so they're escaped into a single file name
+	name := configsDir + url.PathEscape(config.ConfigName) + ".json"
+	if w.names[name] {
+		return fmt.Errorf("duplicate config %q", config.ConfigName)
+	}
+	w.names[name] = true
+
+	return w.writeFile(name, config)
+}
+
+func (w *tarWriter) Close() error {
+	return w.tw.Close()
+}
+
+// writeFile writes a value as an indented JSON file
+func (w *tarWriter) writeFile(name string, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = w.tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(b)),
+		ModTime: w.modTime,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = w.tw.Write(b)
+	return err
+}
+
+// ReadAll reads every config in a bundle. A bundle without a header is
+// read as a plain list of configs
+func ReadAll(format Format, r io.Reader) (Header, []Config, error) {
+	var header Header
+	var configs []Config
+	var err error
+
+	switch format {
+	case FormatNDJSON:
+		header, configs, err = readNDJSON(r)
+	case FormatTar:
+		header, configs, err = readTar(r)
+	default:
+		return header, nil, fmt.Errorf("%w: %q", ErrUnsupportedFormat, format)
+	}
+
+	if err == nil && header.Kind != "" && header.Kind != Kind {
+		return header, nil, fmt.Errorf("%w: unknown kind %q", ErrInvalidBundle, header.Kind)
+	}
+
+	return header, configs, err
+}
+
+// readNDJSON reads a header line, if there is one, and one config per line
+func readNDJSON(r io.Reader) (Header, []Config, error) {
+	var header Header
+	var configs []Config
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineSize)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+		b := bytes.TrimSpace(scanner.Bytes())
+		if len(b) == 0 {
+			continue
+		}
+
+		if len(configs) == 0 && header.Kind == "" && isHeader(b) {
+			if err := json.Unmarshal(b, &header); err != nil {
+				return header, nil, fmt.Errorf("%w: line %d: %s", ErrInvalidBundle, line, err)
+			}
+			continue
+		}
+
+		config, err := decodeConfig(b)
+		if err != nil {
+			return header, nil, fmt.Errorf("%w: line %d: %s", ErrInvalidBundle, line, err)
+		}
+		configs = append(configs, config)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return header, nil, fmt.Errorf("%w: %s", ErrInvalidBundle, err)
+	}
+
+	return header, configs, nil
+}
+
+// readTar reads the manifest and the config files. Other files are ignored
+func readTar(r io.Reader) (Header, []Config, error) {
+	var header Header
+	var configs []Config
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return header, nil, fmt.Errorf("%w: %s", ErrInvalidBundle, err)
+		}
+
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		name := path.Clean(hdr.Name)
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			return header, nil, fmt.Errorf("%w: %s: %s", ErrInvalidBundle, name, err)
+		}
+
+		switch {
+		case name == manifestName:
+			if err := json.Unmarshal(b, &header); err != nil {
+				return header, nil, fmt.Errorf("%w: %s: %s", ErrInvalidBundle, name, err)
+			}
+		case strings.HasPrefix(name, configsDir) && strings.HasSuffix(name, ".json"):
+			config, err := decodeConfig(b)
+			if err != nil {
+				return header, nil, fmt.Errorf("%w: %s: %s", ErrInvalidBundle, name, err)
+			}
+			configs = append(configs, config)
+		}
+	}
+
+	return header, configs, nil
+}
+
+// isHeader returns whether a JSON object is a bundle header
+func isHeader(b []byte) bool {
+	var probe struct {
+		Kind string `json:"kind"`
+	}
+
+	return json.Unmarshal(b, &probe) == nil && probe.Kind != ""
+}
+
+// decodeConfig decodes and validates a config
+func decodeConfig(b []byte) (Config, error) {
+	var config Config
+
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.DisallowUnknownFields()
+	decoder.UseNumber()
+	if err := decoder.Decode(&config); err != nil {
+		return config, err
+	}
+
+	// keep integers as integers in the document store
+	utils.JSONNumbers(config.Config)
+	for _, version := range config.Versions {
+		utils.JSONNumbers(version.Config)
+	}
+
+	if strings.TrimSpace(config.ConfigName) == "" {
+		return config, fmt.Errorf("config_name is required")
+	}
+
+	return config, nil
+}
@@ -0,0 +1,112 @@
+package bundle
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// configs the configs written by the round trip tests
+var configs = []Config{
+	{
+		ConfigName: "payments/api",
+		Owner:      "aeekayy",
+		Tags:       []string{"team:core"},
+		Version:    2,
+		Config:     map[string]interface{}{"port": int64(8080), "debug": false},
+		Versions: []Version{
+			{Version: 1, Config: map[string]interface{}{"port": int64(80)}},
+			{Version: 2, Config: map[string]interface{}{"port": int64(8080), "debug": false}},
+		},
+	},
+	{
+		ConfigName: "kubernetes",
+		Parents:    []string{"payments/api"},
+		Config:     map[string]interface{}{"enabled": true, "ratio": 0.5},
+	},
+}
+
+// TestRoundTrip validates that both formats read back what they wrote
+func TestRoundTrip(t *testing.T) {
+	exported := time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC)
+
+	for _, format := range []Format{FormatNDJSON, FormatTar} {
+		t.Run(string(format), func(t *testing.T) {
+			var buf bytes.Buffer
+
+			w, err := NewWriter(format, &buf, Header{Exported: exported, History: true})
+			assert.Nil(t, err)
+			for _, config := range configs {
+				assert.Nil(t, w.Write(config))
+			}
+			assert.Nil(t, w.Close())
+
+			header, read, err := ReadAll(format, &buf)
+			assert.Nil(t, err)
+			assert.Equal(t, Kind, header.Kind)
+			assert.True(t, header.History)
+			assert.True(t, exported.Equal(header.Exported))
+			assert.ElementsMatch(t, configs, read)
+		})
+	}
+}
+
+// TestReadNDJSONWithoutHeader validates that hand written bundles can be read
+func TestReadNDJSONWithoutHeader(t *testing.T) {
+	header, read, err := ReadAll(FormatNDJSON, strings.NewReader(`
+{"config_name": "kubernetes", "config": {"replicas": 3}}
+
+{"config_name": "redis", "config": {"host": "localhost"}}
+`))
+	assert.Nil(t, err)
+	assert.Empty(t, header.Kind)
+	assert.Len(t, read, 2)
+	assert.Equal(t, int64(3), read[0].Config["replicas"])
+}
+
+// TestReadInvalid validates the bundle errors
+func TestReadInvalid(t *testing.T) {
+	table := []struct {
+		name   string
+		bundle string
+	}{
+		{"TestReadInvalidJSON", `{"config_name": "kubernetes"`},
+		{"TestReadMissingName", `{"config": {"enabled": true}}`},
+		{"TestReadUnknownField", `{"config_name": "kubernetes", "configs": {}}`},
+		{"TestReadUnknownKind", `{"kind": "stilla.bundle/v9"}`},
+	}
+
+	for _, tc := range table {
+		t.Run(tc.name, func(t *testing.T) {
+			_, _, err := ReadAll(FormatNDJSON, strings.NewReader(tc.bundle))
+			assert.ErrorIs(t, err, ErrInvalidBundle)
+		})
+	}
+
+	_, _, err := ReadAll(FormatTar, strings.NewReader("not a tar file"))
+	assert.ErrorIs(t, err, ErrInvalidBundle)
+}
+
+// TestFormats validates the format names and content types
+func TestFormats(t *testing.T) {
+	format, err := ParseFormat("")
+	assert.Nil(t, err)
+	assert.Equal(t, FormatNDJSON, format)
+
+	_, err = ParseFormat("zip")
+	assert.ErrorIs(t, err, ErrUnsupportedFormat)
+
+	format, err = ForContentType("application/x-tar")
+	assert.Nil(t, err)
+	assert.Equal(t, FormatTar, format)
+
+	format, err = ForContentType("application/x-ndjson; charset=utf-8")
+	assert.Nil(t, err)
+	assert.Equal(t, FormatNDJSON, format)
+
+	_, err = ForContentType("text/plain")
+	assert.ErrorIs(t, err, ErrUnsupportedFormat)
+}
@@ -0,0 +1,115 @@
+// Package cache in-process caching for Stilla. The LRU sits in front of
+// Redis and keeps recently read configs in memory for a short time.
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// entry an item in the LRU
+type entry struct {
+	expires time.Time
+	value   interface{}
+	key     string
+}
+
+// LRU a size bounded, least recently used cache with a TTL per entry.
+// It is safe for concurrent use
+type LRU struct {
+	mu        sync.Mutex
+	now       func() time.Time
+	ll        *list.List
+	items     map[string]*list.Element
+	ttl       time.Duration
+	size      int
+	evictions uint64
+}
+
+// NewLRU returns an LRU that holds at most size entries for ttl each
+func NewLRU(size int, ttl time.Duration) *LRU {
+	return &LRU{
+		now:   time.Now,
+		ll:    list.New(),
+		items: make(map[string]*list.Element, size),
+		ttl:   ttl,
+		size:  size,
+	}
+}
+
+// Get returns the value of a key if it's present and not expired
+func (l *LRU) Get(key string) (interface{}, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	el, ok := l.items[key]
+	if !ok {
+		return nil, false
+	}
+
+	e := el.Value.(*entry)
+	if !l.now().Before(e.expires) {
+		l.removeElement(el)
+		return nil, false
+	}
+
+	l.ll.MoveToFront(el)
+	return e.value, true
+}
+
+// Set adds or replaces a key. The least recently used entry is evicted
+// when the LRU is full
+func (l *LRU) Set(key string, value interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	expires := l.now().Add(l.ttl)
+	if el, ok := l.items[key]; ok {
+		e := el.Value.(*entry)
+		e.value = value
+		e.expires = expires
+		l.ll.MoveToFront(el)
+		return
+	}
+
+	l.items[key] = l.ll.PushFront(&entry{key: key, value: value, expires: expires})
+
+	for l.ll.Len() > l.size {
+		l.removeElement(l.ll.Back())
+		l.evictions++
+	}
+}
+
+// Delete removes a key
+func (l *LRU) Delete(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if el, ok := l.items[key]; ok {
+		l.removeElement(el)
+	}
+}
+
+// Len returns the number of entries, including expired entries that
+// have not been removed yet
+func (l *LRU) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.ll.Len()
+}
+
+// Evictions returns the number of entries evicted because the LRU was full
+func (l *LRU) Evictions() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.evictions
+}
+
+// removeElement removes an element. The lock must be held
+func (l *LRU) removeElement(el *list.Element) {
+	l.ll.Remove(el)
+	delete(l.items, el.Value.(*entry).key)
+}
@@ -0,0 +1,85 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestLRUEviction validates that the least recently used entry is evicted
+func TestLRUEviction(t *testing.T) {
+	l := NewLRU(2, time.Minute)
+
+	l.Set("a", 1)
+	l.Set("b", 2)
+
+	// touch a so that b is the least recently used
+	_, ok := l.Get("a")
+	assert.True(t, ok)
+
+	l.Set("c", 3)
+
+	_, ok = l.Get("b")
+	assert.False(t, ok)
+
+	v, ok := l.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, 1, v)
+
+	assert.Equal(t, 2, l.Len())
+	assert.Equal(t, uint64(1), l.Evictions())
+}
+
+// TestLRUExpiry validates that entries expire after the TTL
+func TestLRUExpiry(t *testing.T) {
+	now := time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC)
+	l := NewLRU(2, 5*time.Second)
+	l.now = func() time.Time { return now }
+
+	l.Set("a", 1)
+
+	now = now.Add(4 * time.Second)
+	_, ok := l.Get("a")
+	assert.True(t, ok)
+
+	now = now.Add(time.Second)
+	_, ok = l.Get("a")
+	assert.False(t, ok)
+	assert.Equal(t, 0, l.Len())
+}
+
+// TestLRUDelete validates that a deleted key is gone
+func TestLRUDelete(t *testing.T) {
+	l := NewLRU(2, time.Minute)
+
+	l.Set("a", 1)
+	l.Set("a", 2)
+	assert.Equal(t, 1, l.Len())
+
+	v, _ := l.Get("a")
+	assert.Equal(t, 2, v)
+
+	l.Delete("a")
+	_, ok := l.Get("a")
+	assert.False(t, ok)
+
+	// deleting a missing key is a no-op
+	l.Delete("missing")
+}
+
+// TestStatsSnapshot validates the hit ratio
+func TestStatsSnapshot(t *testing.T) {
+	var s Stats
+
+	assert.Equal(t, float64(0), s.Snapshot(nil).HitRatio)
+
+	s.LocalHit()
+	s.RedisHit()
+	s.Miss()
+	s.Miss()
+
+	snapshot := s.Snapshot(NewLRU(1, time.Minute))
+	assert.Equal(t, 0.5, snapshot.HitRatio)
+	assert.Equal(t, uint64(2), snapshot.Misses)
+}
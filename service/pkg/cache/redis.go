@@ -0,0 +1,429 @@
+package cache
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/FZambia/sentinel"
+	"github.com/gomodule/redigo/redis"
+	"github.com/mna/redisc"
+
+	"github.com/aeekayy/stilla/service/pkg/models"
+)
+
+const (
+	clusterRetries    = 3                      // attempts for a command that's redirected by the cluster
+	clusterRetryDelay = 100 * time.Millisecond // wait before retrying a TRYAGAIN error
+	generationTTL     = 24 * time.Hour         // how long a generation outlives its last bump
+)
+
+// setIndexedScript sets a cache entry and records its key in an index
+// set. The index lives at least as long as the entries it lists. With a
+// generation key, the entry is only set while the generation is still the
+// one the value was read at
+// KEYS[1] cache key, KEYS[2] index key, KEYS[3] generation key (optional),
+// ARGV[1] value, ARGV[2] ttl in seconds, ARGV[3] generation
+var setIndexedScript = redis.NewScript(-1, `
+if KEYS[3] and (redis.call('GET', KEYS[3]) or '0') ~= ARGV[3] then
+	return 0
+end
+redis.call('SETEX', KEYS[1], ARGV[2], ARGV[1])
+redis.call('SADD', KEYS[2], KEYS[1])
+if redis.call('TTL', KEYS[2]) < tonumber(ARGV[2]) then
+	redis.call('EXPIRE', KEYS[2], ARGV[2])
+end
+return 1
+`)
+
+// deleteIndexedScript deletes every entry listed in an index and the index
+// in one step, so readers never see a mix of old and new entries. It bumps
+// the generations, so values read before the delete aren't set afterwards
+// KEYS[1] index key, KEYS[2...] generation keys, ARGV[1] generation ttl in
+// seconds. Returns the deleted cache keys
+var deleteIndexedScript = redis.NewScript(-1, `
+for i = 2, #KEYS do
+	redis.call('INCR', KEYS[i])
+	redis.call('EXPIRE', KEYS[i], ARGV[1])
+end
+local keys = redis.call('SMEMBERS', KEYS[1])
+for i = 1, #keys do
+	redis.call('DEL', keys[i])
+end
+redis.call('DEL', KEYS[1])
+return keys
+`)
+
+// Redis a Redis client shared by the config cache and the session store.
+// It supports a single server, Sentinel failover and Redis Cluster
+type Redis struct {
+	Pool    *redis.Pool
+	Mode    string
+	closers []func() error
+}
+
+// NewRedis returns a Redis client for the cache configuration
+func NewRedis(config models.Cache) (*Redis, error) {
+	mode, err := config.GetMode()
+	if err != nil {
+		return nil, err
+	}
+
+	options, err := dialOptions(config)
+	if err != nil {
+		return nil, err
+	}
+
+	idleTimeout, err := config.Pool.GetIdleTimeout()
+	if err != nil {
+		return nil, err
+	}
+
+	maxConnLifetime, err := config.Pool.GetMaxConnLifetime()
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Redis{
+		Mode: mode,
+		Pool: &redis.Pool{
+			MaxIdle:         config.Pool.GetMaxIdle(),
+			MaxActive:       config.Pool.MaxActive,
+			IdleTimeout:     idleTimeout,
+			MaxConnLifetime: maxConnLifetime,
+			Wait:            config.Pool.Wait,
+			TestOnBorrow: func(c redis.Conn, t time.Time) error {
+				_, err := c.Do("PING")
+				return err
+			},
+		},
+	}
+
+	switch mode {
+	case models.RedisModeSentinel:
+		err = r.withSentinel(config, options)
+	case models.RedisModeCluster:
+		err = r.withCluster(config, options)
+	default:
+		r.Pool.Dial = func() (redis.Conn, error) {
+			return dial(config.Host, config, options)
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	r.closers = append(r.closers, r.Pool.Close)
+
+	return r, nil
+}
+
+// withSentinel dials the master that the sentinels report. Connections
+// that are no longer to the master are dropped from the pool
+func (r *Redis) withSentinel(config models.Cache, options []redis.DialOption) error {
+	if config.Sentinel.MasterName == "" || len(config.Sentinel.Addresses) == 0 {
+		return fmt.Errorf("sentinel mode needs a master name and sentinel addresses")
+	}
+
+	sentinelOptions := append([]redis.DialOption{}, options...)
+	if config.Sentinel.Password != "" {
+		sentinelOptions = append(sentinelOptions, redis.DialPassword(config.Sentinel.Password))
+	}
+
+	sntnl := &sentinel.Sentinel{
+		Addrs:      config.Sentinel.Addresses,
+		MasterName: config.Sentinel.MasterName,
+		Dial: func(addr string) (redis.Conn, error) {
+			return redis.Dial("tcp", addr, sentinelOptions...)
+		},
+	}
+
+	r.Pool.Dial = func() (redis.Conn, error) {
+		masterAddr, err := sntnl.MasterAddr()
+		if err != nil {
+			return nil, err
+		}
+
+		return dial(masterAddr, config, options)
+	}
+	r.Pool.TestOnBorrow = func(c redis.Conn, t time.Time) error {
+		if !sentinel.TestRole(c, "master") {
+			return fmt.Errorf("the connection is not to the redis master")
+		}
+
+		return nil
+	}
+	r.closers = append(r.closers, sntnl.Close)
+
+	return nil
+}
+
+// withCluster routes each command to the node that owns its key
+func (r *Redis) withCluster(config models.Cache, options []redis.DialOption) error {
+	if len(config.Cluster.Addresses) == 0 {
+		return fmt.Errorf("cluster mode needs the addresses of the startup nodes")
+	}
+
+	if config.DB != 0 {
+		return fmt.Errorf("redis cluster only supports database 0")
+	}
+
+	cluster := &redisc.Cluster{
+		StartupNodes: config.Cluster.Addresses,
+		DialOptions:  append(authOptions(config), options...),
+	}
+
+	if err := cluster.Refresh(); err != nil {
+		return fmt.Errorf("unable to discover the redis cluster: %s", err)
+	}
+
+	r.Pool.Dial = func() (redis.Conn, error) {
+		c, err := cluster.Dial()
+		if err != nil {
+			return nil, err
+		}
+
+		// follow MOVED and ASK redirects when a pooled connection is
+		// reused for a key on another node
+		return redisc.RetryConn(c, clusterRetries, clusterRetryDelay)
+	}
+	r.closers = append(r.closers, cluster.Close)
+
+	return nil
+}
+
+// Cluster returns whether Redis runs in cluster mode
+func (r *Redis) Cluster() bool {
+	return r.Mode == models.RedisModeCluster
+}
+
+// Close closes the pool and the connections to the sentinels or cluster
+func (r *Redis) Close() error {
+	var err error
+	for i := len(r.closers) - 1; i >= 0; i-- {
+		if closeErr := r.closers[i](); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+
+	return err
+}
+
+// SetIndexed sets a key for ttl and adds it to the index set
+func (r *Redis) SetIndexed(key, index string, value []byte, ttl time.Duration) error {
+	_, err := r.setIndexed([]string{key, index}, value, ttl, "")
+	return err
+}
+
+// SetIndexedAt sets a key like SetIndexed while the generation stored at
+// generationKey is still generation, the one the value was read at. A
+// missing generation is "0". It returns false when DeleteIndexed bumped the
+// generation in the meantime
+func (r *Redis) SetIndexedAt(key, index string, value []byte, ttl time.Duration, generationKey, generation string) (bool, error) {
+	return r.setIndexed([]string{key, index, generationKey}, value, ttl, generation)
+}
+
+// setIndexed sets the key in keys[0] and adds it to the index in keys[1].
+// keys[2] is the optional generation key
+func (r *Redis) setIndexed(keys []string, value []byte, ttl time.Duration, generation string) (bool, error) {
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	seconds := int64(ttl / time.Second)
+
+	// the key and the index may be owned by different cluster nodes,
+	// so they can't be set by one script. The generation is checked
+	// first, which leaves a short window
+	if r.Cluster() {
+		if len(keys) == 3 {
+			current, err := r.generation(conn, keys[2])
+			if err != nil || current != generation {
+				return false, err
+			}
+		}
+		if _, err := conn.Do("SETEX", keys[0], seconds, value); err != nil {
+			return false, err
+		}
+		if _, err := conn.Do("SADD", keys[1], keys[0]); err != nil {
+			return false, err
+		}
+		_, err := conn.Do("EXPIRE", keys[1], seconds)
+		return err == nil, err
+	}
+
+	args := []interface{}{len(keys)}
+	for _, key := range keys {
+		args = append(args, key)
+	}
+	args = append(args, value, seconds, generation)
+
+	set, err := redis.Int(setIndexedScript.Do(conn, args...))
+	return set == 1, err
+}
+
+// Generation returns the generation stored at a key. A missing generation
+// is "0"
+func (r *Redis) Generation(key string) (string, error) {
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	return r.generation(conn, key)
+}
+
+// generation reads a generation on conn
+func (r *Redis) generation(conn redis.Conn, key string) (string, error) {
+	generation, err := redis.String(conn.Do("GET", key))
+	if err == redis.ErrNil {
+		return "0", nil
+	}
+
+	return generation, err
+}
+
+// DeleteIndexed deletes every key in the index set and the index, and bumps
+// the generations. It returns the deleted keys. The delete is atomic except
+// in cluster mode
+func (r *Redis) DeleteIndexed(index string, generationKeys ...string) ([]string, error) {
+	conn := r.Pool.Get()
+	defer conn.Close()
+
+	if !r.Cluster() {
+		args := []interface{}{1 + len(generationKeys), index}
+		for _, key := range generationKeys {
+			args = append(args, key)
+		}
+		args = append(args, int64(generationTTL/time.Second))
+
+		return redis.Strings(deleteIndexedScript.Do(conn, args...))
+	}
+
+	// the generations are bumped first, so a value read before the delete
+	// isn't set after it
+	for _, key := range generationKeys {
+		if _, err := conn.Do("INCR", key); err != nil {
+			return nil, err
+		}
+		if _, err := conn.Do("EXPIRE", key, int64(generationTTL/time.Second)); err != nil {
+			return nil, err
+		}
+	}
+
+	keys, err := redis.Strings(conn.Do("SMEMBERS", index))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range keys {
+		if _, err := conn.Do("DEL", key); err != nil {
+			return nil, err
+		}
+	}
+
+	_, err = conn.Do("DEL", index)
+	return keys, err
+}
+
+// dial connects to a Redis server, authenticates and selects the database
+func dial(addr string, config models.Cache, options []redis.DialOption) (redis.Conn, error) {
+	c, err := redis.Dial("tcp", addr, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := auth(c, config); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	// select the database after authenticating
+	if config.DB != 0 {
+		if _, err := c.Do("SELECT", config.DB); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// auth authenticates a connection. A username uses the Redis 6 ACL form
+func auth(c redis.Conn, config models.Cache) error {
+	if config.Password == "" {
+		return nil
+	}
+
+	var err error
+	if config.Username != "" {
+		_, err = c.Do("AUTH", config.Username, config.Password)
+	} else {
+		_, err = c.Do("AUTH", config.Password)
+	}
+
+	return err
+}
+
+// authOptions the password option for cluster nodes. Nodes are dialed by
+// the cluster client, so only password authentication is supported
+func authOptions(config models.Cache) []redis.DialOption {
+	if config.Password == "" {
+		return nil
+	}
+
+	return []redis.DialOption{redis.DialPassword(config.Password)}
+}
+
+// dialOptions the timeout and TLS options shared by every connection
+func dialOptions(config models.Cache) ([]redis.DialOption, error) {
+	dialTimeout, err := config.Pool.GetDialTimeout()
+	if err != nil {
+		return nil, err
+	}
+
+	options := []redis.DialOption{redis.DialConnectTimeout(dialTimeout)}
+
+	if !config.TLS.Enabled {
+		return options, nil
+	}
+
+	tlsConfig, err := newTLSConfig(config.TLS)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(options, redis.DialUseTLS(true), redis.DialTLSConfig(tlsConfig)), nil
+}
+
+// newTLSConfig builds the TLS configuration for Redis connections
+func newTLSConfig(config models.RedisTLS) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         config.ServerName,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}
+
+	if config.CAFile != "" {
+		ca, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read the redis ca file: %s", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in %s", config.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if config.CertFile != "" || config.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load the redis client certificate: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
@@ -0,0 +1,128 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/aeekayy/stilla/service/pkg/models"
+)
+
+// TestNewRedis validates the connection, authentication and database selection
+func TestNewRedis(t *testing.T) {
+	s := miniredis.RunT(t)
+	s.RequireUserAuth("stilla", "redis")
+
+	r, err := NewRedis(models.Cache{
+		Host:     s.Addr(),
+		Username: "stilla",
+		Password: "redis",
+		DB:       2,
+		Pool:     models.RedisPool{MaxActive: 2, Wait: true},
+	})
+	assert.Nil(t, err)
+	defer r.Close()
+
+	assert.Equal(t, models.RedisModeStandalone, r.Mode)
+	assert.Equal(t, 2, r.Pool.MaxActive)
+
+	conn := r.Pool.Get()
+	defer conn.Close()
+	_, err = conn.Do("SET", "foo", "bar")
+	assert.Nil(t, err)
+
+	s.Select(2)
+	assert.True(t, s.Exists("foo"))
+}
+
+// TestNewRedisInvalid validates the configuration errors
+func TestNewRedisInvalid(t *testing.T) {
+	table := []struct {
+		name  string
+		cache models.Cache
+	}{
+		{"TestNewRedisInvalidMode", models.Cache{Mode: "memcached"}},
+		{"TestNewRedisSentinelNoAddresses", models.Cache{Sentinel: models.RedisSentinel{MasterName: "mymaster"}}},
+		{"TestNewRedisClusterNoAddresses", models.Cache{Mode: models.RedisModeCluster}},
+		{"TestNewRedisClusterDB", models.Cache{DB: 1, Cluster: models.RedisCluster{Addresses: []string{"localhost:7000"}}}},
+		{"TestNewRedisMissingCA", models.Cache{TLS: models.RedisTLS{Enabled: true, CAFile: "missing.pem"}}},
+		{"TestNewRedisInvalidIdleTimeout", models.Cache{Pool: models.RedisPool{IdleTimeout: "soon"}}},
+	}
+
+	for _, tc := range table {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewRedis(tc.cache)
+			assert.NotNil(t, err)
+		})
+	}
+}
+
+// TestIndexed validates that the entries of an index are deleted together
+func TestIndexed(t *testing.T) {
+	s := miniredis.RunT(t)
+
+	r, err := NewRedis(models.Cache{Host: s.Addr()})
+	assert.Nil(t, err)
+	defer r.Close()
+
+	assert.Nil(t, r.SetIndexed("config_a", "config_index_1", []byte("a"), time.Minute))
+	assert.Nil(t, r.SetIndexed("config_a_host", "config_index_1", []byte("a"), time.Hour))
+	assert.Nil(t, r.SetIndexed("config_b", "config_index_2", []byte("b"), time.Minute))
+
+	// the index outlives its entries
+	assert.Equal(t, time.Hour, s.TTL("config_index_1"))
+
+	keys, err := r.DeleteIndexed("config_index_1")
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{"config_a", "config_a_host"}, keys)
+
+	assert.False(t, s.Exists("config_a"))
+	assert.False(t, s.Exists("config_a_host"))
+	assert.False(t, s.Exists("config_index_1"))
+	assert.True(t, s.Exists("config_b"))
+
+	keys, err = r.DeleteIndexed("config_index_missing")
+	assert.Nil(t, err)
+	assert.Empty(t, keys)
+}
+
+// TestIndexedGeneration validates that an entry read before an invalidation
+// isn't cached after it
+func TestIndexedGeneration(t *testing.T) {
+	s := miniredis.RunT(t)
+
+	r, err := NewRedis(models.Cache{Host: s.Addr()})
+	assert.Nil(t, err)
+	defer r.Close()
+
+	generation, err := r.Generation("config_generation_a")
+	assert.Nil(t, err)
+	assert.Equal(t, "0", generation)
+
+	set, err := r.SetIndexedAt("config_a", "config_index_1", []byte("a"), time.Minute, "config_generation_a", generation)
+	assert.Nil(t, err)
+	assert.True(t, set)
+
+	_, err = r.DeleteIndexed("config_index_1", "config_generation_a")
+	assert.Nil(t, err)
+	assert.False(t, s.Exists("config_a"))
+
+	next, err := r.Generation("config_generation_a")
+	assert.Nil(t, err)
+	assert.Equal(t, "1", next)
+	assert.Equal(t, generationTTL, s.TTL("config_generation_a"))
+
+	// the read from before the invalidation is dropped
+	set, err = r.SetIndexedAt("config_a", "config_index_1", []byte("a"), time.Minute, "config_generation_a", generation)
+	assert.Nil(t, err)
+	assert.False(t, set)
+	assert.False(t, s.Exists("config_a"))
+
+	set, err = r.SetIndexedAt("config_a", "config_index_1", []byte("b"), time.Minute, "config_generation_a", next)
+	assert.Nil(t, err)
+	assert.True(t, set)
+	value, _ := s.Get("config_a")
+	assert.Equal(t, "b", value)
+}
@@ -0,0 +1,83 @@
+package cache
+
+import (
+	"sync/atomic"
+)
+
+// Stats counts cache lookups per tier. The zero value is ready to use
+type Stats struct {
+	localHits  atomic.Uint64
+	redisHits  atomic.Uint64
+	misses     atomic.Uint64
+	staleHits  atomic.Uint64
+	coalesced  atomic.Uint64
+	writeFails atomic.Uint64
+}
+
+// StatsSnapshot a point in time copy of the cache statistics
+type StatsSnapshot struct {
+	LocalHits     uint64  `json:"local_hits"`
+	RedisHits     uint64  `json:"redis_hits"`
+	Misses        uint64  `json:"misses"`
+	StaleHits     uint64  `json:"stale_hits"`
+	Coalesced     uint64  `json:"coalesced"`
+	WriteFailures uint64  `json:"write_failures"`
+	LocalEntries  int     `json:"local_entries"`
+	LocalEvicted  uint64  `json:"local_evictions"`
+	HitRatio      float64 `json:"hit_ratio"`
+	Enabled       bool    `json:"enabled"`
+}
+
+// LocalHit records a hit in the in-process cache
+func (s *Stats) LocalHit() {
+	s.localHits.Add(1)
+}
+
+// RedisHit records a hit in Redis
+func (s *Stats) RedisHit() {
+	s.redisHits.Add(1)
+}
+
+// Miss records a lookup that missed every tier
+func (s *Stats) Miss() {
+	s.misses.Add(1)
+}
+
+// StaleHit records a stale copy served because the document store was unavailable
+func (s *Stats) StaleHit() {
+	s.staleHits.Add(1)
+}
+
+// Coalesced records a miss that shared the result of a concurrent lookup
+func (s *Stats) Coalesced() {
+	s.coalesced.Add(1)
+}
+
+// WriteFailure records a failed cache write
+func (s *Stats) WriteFailure() {
+	s.writeFails.Add(1)
+}
+
+// Snapshot returns the current statistics. The local cache may be nil
+func (s *Stats) Snapshot(local *LRU) StatsSnapshot {
+	snapshot := StatsSnapshot{
+		LocalHits:     s.localHits.Load(),
+		RedisHits:     s.redisHits.Load(),
+		Misses:        s.misses.Load(),
+		StaleHits:     s.staleHits.Load(),
+		Coalesced:     s.coalesced.Load(),
+		WriteFailures: s.writeFails.Load(),
+	}
+
+	if local != nil {
+		snapshot.LocalEntries = local.Len()
+		snapshot.LocalEvicted = local.Evictions()
+	}
+
+	total := snapshot.LocalHits + snapshot.RedisHits + snapshot.Misses
+	if total > 0 {
+		snapshot.HitRatio = float64(snapshot.LocalHits+snapshot.RedisHits) / float64(total)
+	}
+
+	return snapshot
+}
@@ -0,0 +1,188 @@
+// Package checksum computes content checksums of configuration payloads.
+// A payload is hashed in its canonical JSON form: object keys are sorted,
+// there's no insignificant whitespace, strings escape only quotes,
+// backslashes, control characters and U+2028 and U+2029, and numbers are
+// written as Go writes int64 and float64 values. The form is written here
+// rather than by encoding/json, so it doesn't change with the Go version. A
+// checksum is the hex SHA-256 of the canonical form with a "sha256:" prefix,
+// so clients can verify a payload they received by hashing it the same way.
+package checksum
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aeekayy/stilla/service/pkg/utils"
+)
+
+// Prefix the prefix of content checksums. Checksums stored before content
+// checksums don't have it
+const Prefix = "sha256:"
+
+// ErrMismatch returned when a payload doesn't match its checksum
+var ErrMismatch = errors.New("checksum mismatch")
+
+// Canonical returns the canonical JSON form of a payload. Values decoded
+// from the document store are normalized first
+func Canonical(payload interface{}) ([]byte, error) {
+	normalized, err := utils.NormalizeJSON(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := writeValue(&buf, normalized); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// writeValue writes the canonical form of a normalized JSON value
+func writeValue(buf *bytes.Buffer, v interface{}) error {
+	switch t := v.(type) {
+	case nil:
+		buf.WriteString("null")
+	case bool:
+		buf.WriteString(strconv.FormatBool(t))
+	case int64:
+		buf.WriteString(strconv.FormatInt(t, 10))
+	case float64:
+		return writeFloat(buf, t)
+	case string:
+		writeString(buf, t)
+	case []interface{}:
+		buf.WriteByte('[')
+		for i, item := range t {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeValue(buf, item); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	case map[string]interface{}:
+		keys := make([]string, 0, len(t))
+		for k := range t {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		buf.WriteByte('{')
+		for i, k := range keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeString(buf, k)
+			buf.WriteByte(':')
+			if err := writeValue(buf, t[k]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	default:
+		return fmt.Errorf("unsupported value of type %T", v)
+	}
+
+	return nil
+}
+
+// writeFloat writes a float64 as encoding/json does: exponents are only
+// used for very small and very large values and have no leading zeros
+func writeFloat(buf *bytes.Buffer, f float64) error {
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		return fmt.Errorf("unsupported number %v", f)
+	}
+
+	format := byte('f')
+	if abs := math.Abs(f); abs != 0 && (abs < 1e-6 || abs >= 1e21) {
+		format = 'e'
+	}
+
+	b := strconv.AppendFloat(nil, f, format, -1, 64)
+	if n := len(b); format == 'e' && n >= 4 && b[n-4] == 'e' && b[n-3] == '-' && b[n-2] == '0' {
+		// e-07 is written as e-7
+		b[n-2] = b[n-1]
+		b = b[:n-1]
+	}
+	buf.Write(b)
+
+	return nil
+}
+
+// writeString writes a quoted string. Quotes, backslashes, control
+// characters and the JavaScript line terminators are escaped, with the
+// short escapes where JSON has them
+func writeString(buf *bytes.Buffer, s string) {
+	const digits = "0123456789abcdef"
+
+	buf.WriteByte('"')
+	for _, r := range s {
+		switch {
+		case r == '"' || r == '\\':
+			buf.WriteByte('\\')
+			buf.WriteRune(r)
+		case r == '\b':
+			buf.WriteString(`\b`)
+		case r == '\f':
+			buf.WriteString(`\f`)
+		case r == '\n':
+			buf.WriteString(`\n`)
+		case r == '\r':
+			buf.WriteString(`\r`)
+		case r == '\t':
+			buf.WriteString(`\t`)
+		case r < 0x20:
+			buf.WriteString(`\u00`)
+			buf.WriteByte(digits[r>>4])
+			buf.WriteByte(digits[r&0xf])
+		case r == '\u2028':
+			buf.WriteString(`\u2028`)
+		case r == '\u2029':
+			buf.WriteString(`\u2029`)
+		default:
+			buf.WriteRune(r)
+		}
+	}
+	buf.WriteByte('"')
+}
+
+// Of returns the content checksum of a payload
+func Of(payload interface{}) (string, error) {
+	canonical, err := Canonical(payload)
+	if err != nil {
+		return "", fmt.Errorf("unable to compute the checksum: %w", err)
+	}
+
+	sum := sha256.Sum256(canonical)
+	return Prefix + hex.EncodeToString(sum[:]), nil
+}
+
+// IsContent returns whether a checksum is a content checksum. Older
+// checksums can't be verified
+func IsContent(sum string) bool {
+	return strings.HasPrefix(sum, Prefix)
+}
+
+// Verify returns ErrMismatch when a payload doesn't match a content
+// checksum
+func Verify(payload interface{}, sum string) error {
+	actual, err := Of(payload)
+	if err != nil {
+		return err
+	}
+
+	if actual != sum {
+		return fmt.Errorf("%w: expected %s, found %s", ErrMismatch, sum, actual)
+	}
+
+	return nil
+}
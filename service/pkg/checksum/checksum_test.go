@@ -0,0 +1,75 @@
+package checksum
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// TestCanonical validates the canonical form of payloads
+func TestCanonical(t *testing.T) {
+	table := []struct {
+		name      string
+		payload   interface{}
+		canonical string
+	}{
+		{"sorted keys", map[string]interface{}{"b": 1, "a": map[string]interface{}{"d": true, "c": nil}}, `{"a":{"c":null,"d":true},"b":1}`},
+		{"html isn't escaped", map[string]interface{}{"url": "a?b=1&c=<d>"}, `{"url":"a?b=1&c=<d>"}`},
+		{"numbers", map[string]interface{}{"int": float64(8080), "float": 1.5, "small": 0.00001}, `{"float":1.5,"int":8080,"small":0.00001}`},
+		{"stored payload", bson.M{"port": int32(5432), "hosts": bson.A{"a", bson.M{"z": int64(1)}}}, `{"hosts":["a",{"z":1}],"port":5432}`},
+		{"nil", nil, `null`},
+	}
+
+	for _, tc := range table {
+		canonical, err := Canonical(tc.payload)
+		assert.Nil(t, err, tc.name)
+		assert.Equal(t, tc.canonical, string(canonical), tc.name)
+	}
+}
+
+// TestOf validates that equal content has the same checksum, whatever its
+// source
+func TestOf(t *testing.T) {
+	request, err := Of(map[string]interface{}{"port": float64(5432), "name": "db"})
+	assert.Nil(t, err)
+	stored, err := Of(bson.M{"name": "db", "port": int32(5432)})
+	assert.Nil(t, err)
+
+	assert.Equal(t, request, stored)
+	assert.True(t, IsContent(request))
+	// sha256 of {"name":"db","port":5432}
+	assert.Equal(t, "sha256:b9dfd9658f78451a4a126181e1798e01b637999def47957ae896bc1e8fbf248c", request)
+
+	changed, err := Of(map[string]interface{}{"port": float64(5433), "name": "db"})
+	assert.Nil(t, err)
+	assert.NotEqual(t, request, changed)
+}
+
+// TestVerify validates payloads against checksums
+func TestVerify(t *testing.T) {
+	payload := map[string]interface{}{"enabled": true}
+	sum, err := Of(payload)
+	assert.Nil(t, err)
+
+	assert.Nil(t, Verify(payload, sum))
+
+	err = Verify(map[string]interface{}{"enabled": false}, sum)
+	assert.True(t, errors.Is(err, ErrMismatch))
+	assert.False(t, IsContent("4ff1a05fef2bc0d1"))
+}
+
+// TestCanonicalStrings validates the escaping of strings. The Python SDK
+// test hashes the same fixture, so both must produce the same bytes
+func TestCanonicalStrings(t *testing.T) {
+	payload := map[string]interface{}{"ctl\u0001": "\b\f\n\r\t\u0000\u001f\u007f\"\\/\u2028\u2029é"}
+
+	canonical, err := Canonical(payload)
+	assert.Nil(t, err)
+	assert.Equal(t, `{"ctl\u0001":"\b\f\n\r\t\u0000\u001f`+"\u007f"+`\"\\/\u2028\u2029`+"é"+`"}`, string(canonical))
+
+	sum, err := Of(payload)
+	assert.Nil(t, err)
+	assert.Equal(t, "sha256:ffb3139128ad4ff87d675036b56354da4fd028611cf3d3943ef27f84300006ad", sum)
+}
@@ -0,0 +1,134 @@
+// Package diff computes the changes between two configuration payloads.
+// Payloads are compared in their JSON form: maps are compared key by key
+// and any other value, including arrays, is compared as a whole.
+package diff
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Op the kind of change made at a path
+type Op string
+
+const (
+	// OpAdd a value was added
+	OpAdd Op = "add"
+	// OpRemove a value was removed
+	OpRemove Op = "remove"
+	// OpReplace a value was replaced
+	OpReplace Op = "replace"
+)
+
+// Change a single change between two payloads
+type Change struct {
+	Op   Op          `json:"op"`
+	Path []string    `json:"-"`
+	Old  interface{} `json:"old,omitempty"`
+	New  interface{} `json:"new,omitempty"`
+}
+
+// Pointer returns the path of the change as a JSON pointer (RFC 6901)
+func (c Change) Pointer() string {
+	return Pointer(c.Path)
+}
+
+// MarshalJSON includes the JSON pointer of the change
+func (c Change) MarshalJSON() ([]byte, error) {
+	type change Change
+	return json.Marshal(struct {
+		Path string `json:"path"`
+		change
+	}{c.Pointer(), change(c)})
+}
+
+// Compute returns the changes needed to turn old into new, ordered by path.
+// Both values are normalized to their JSON representation first.
+func Compute(old, new interface{}) ([]Change, error) {
+	o, err := Normalize(old)
+	if err != nil {
+		return nil, fmt.Errorf("unable to normalize the old value: %s", err)
+	}
+
+	n, err := Normalize(new)
+	if err != nil {
+		return nil, fmt.Errorf("unable to normalize the new value: %s", err)
+	}
+
+	var changes []Change
+	compute(nil, o, n, &changes)
+	return changes, nil
+}
+
+// compute appends the changes between two normalized values
+func compute(path []string, old, new interface{}, changes *[]Change) {
+	oldMap, oldIsMap := old.(map[string]interface{})
+	newMap, newIsMap := new.(map[string]interface{})
+
+	if !oldIsMap || !newIsMap {
+		if !reflect.DeepEqual(old, new) {
+			*changes = append(*changes, Change{Op: OpReplace, Path: path, Old: old, New: new})
+		}
+		return
+	}
+
+	keys := make([]string, 0, len(oldMap)+len(newMap))
+	for k := range oldMap {
+		keys = append(keys, k)
+	}
+	for k := range newMap {
+		if _, ok := oldMap[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		childPath := append(append([]string{}, path...), k)
+		ov, inOld := oldMap[k]
+		nv, inNew := newMap[k]
+
+		switch {
+		case !inNew:
+			*changes = append(*changes, Change{Op: OpRemove, Path: childPath, Old: ov})
+		case !inOld:
+			*changes = append(*changes, Change{Op: OpAdd, Path: childPath, New: nv})
+		default:
+			compute(childPath, ov, nv, changes)
+		}
+	}
+}
+
+// Normalize converts a value into its generic JSON representation made of
+// maps, slices, strings, float64, bool and nil
+func Normalize(v interface{}) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var out interface{}
+	err = json.Unmarshal(b, &out)
+	return out, err
+}
+
+// Pointer converts path segments into a JSON pointer (RFC 6901)
+func Pointer(path []string) string {
+	if len(path) == 0 {
+		return ""
+	}
+
+	escaped := make([]string, len(path))
+	for i, p := range path {
+		escaped[i] = strings.ReplaceAll(strings.ReplaceAll(p, "~", "~0"), "/", "~1")
+	}
+
+	return "/" + strings.Join(escaped, "/")
+}
@@ -0,0 +1,52 @@
+package diff
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// TestSuiteCompute validates the changes between two payloads
+func TestSuiteCompute(t *testing.T) {
+	table := []struct {
+		name     string
+		old      interface{}
+		new      interface{}
+		expected []Change
+	}{
+		{"TestComputeEqual", map[string]interface{}{"a": 1}, map[string]interface{}{"a": 1}, nil},
+		{"TestComputeFromNil", nil, map[string]interface{}{"a": 1}, []Change{{Op: OpReplace, Path: nil, Old: nil, New: map[string]interface{}{"a": float64(1)}}}},
+		{"TestComputeAdd", map[string]interface{}{}, map[string]interface{}{"a": "b"}, []Change{{Op: OpAdd, Path: []string{"a"}, New: "b"}}},
+		{"TestComputeRemove", map[string]interface{}{"a": "b"}, map[string]interface{}{}, []Change{{Op: OpRemove, Path: []string{"a"}, Old: "b"}}},
+		{"TestComputeNested", bson.M{"db": bson.M{"host": "a", "port": int32(5432)}}, map[string]interface{}{"db": map[string]interface{}{"host": "b", "port": 5432}}, []Change{{Op: OpReplace, Path: []string{"db", "host"}, Old: "a", New: "b"}}},
+		{"TestComputeArray", map[string]interface{}{"l": []interface{}{1, 2}}, map[string]interface{}{"l": []interface{}{1, 3}}, []Change{{Op: OpReplace, Path: []string{"l"}, Old: []interface{}{float64(1), float64(2)}, New: []interface{}{float64(1), float64(3)}}}},
+		{"TestComputeOrdered", map[string]interface{}{"b": 1, "c": 1}, map[string]interface{}{"a": 1, "b": 2}, []Change{
+			{Op: OpAdd, Path: []string{"a"}, New: float64(1)},
+			{Op: OpReplace, Path: []string{"b"}, Old: float64(1), New: float64(2)},
+			{Op: OpRemove, Path: []string{"c"}, Old: float64(1)},
+		}},
+	}
+
+	for _, tc := range table {
+		t.Run(tc.name, func(t *testing.T) {
+			changes, err := Compute(tc.old, tc.new)
+			assert.Nil(t, err)
+			assert.Equal(t, tc.expected, changes, "the changes should match.")
+		})
+	}
+}
+
+// TestPointer validates JSON pointer escaping
+func TestPointer(t *testing.T) {
+	assert.Equal(t, "", Pointer(nil))
+	assert.Equal(t, "/a~1b/c~0d", Pointer([]string{"a/b", "c~d"}))
+}
+
+// TestChangeMarshalJSON validates that changes are encoded with their pointer
+func TestChangeMarshalJSON(t *testing.T) {
+	b, err := json.Marshal(Change{Op: OpReplace, Path: []string{"db", "host"}, Old: "a", New: "b"})
+	assert.Nil(t, err)
+	assert.Equal(t, `{"path":"/db/host","op":"replace","old":"a","new":"b"}`, string(b))
+}
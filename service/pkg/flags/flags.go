@@ -0,0 +1,303 @@
+// Package flags evaluates feature flags. A flag has named variations, a
+// kill switch, targeting rules that match host tags and a fallthrough that's
+// served to every other host. Rules and the fallthrough serve a variation,
+// or split hosts between variations with a percentage rollout. Rollouts hash
+// the flag key and the host ID, so a host keeps its variation while the
+// percentages stay the same, and growing a percentage only moves hosts into
+// that variation.
+package flags
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+const (
+	// KindBoolean a flag that's on or off
+	KindBoolean = "boolean"
+	// KindMultivariate a flag with any number of variations of any type
+	KindMultivariate = "multivariate"
+
+	// TagMatchAll a rule matches hosts with every tag
+	TagMatchAll = "all"
+	// TagMatchAny a rule matches hosts with at least one tag
+	TagMatchAny = "any"
+
+	// ReasonOff the flag is killed
+	ReasonOff = "off"
+	// ReasonRule a targeting rule matched the host
+	ReasonRule = "rule_match"
+	// ReasonFallthrough no rule matched the host
+	ReasonFallthrough = "fallthrough"
+	// ReasonError the stored flag can't be evaluated. No variation is served
+	ReasonError = "error"
+
+	// VariationOn the variation boolean flags serve when they're on
+	VariationOn = "on"
+	// VariationOff the variation boolean flags serve when they're off
+	VariationOff = "off"
+
+	// buckets the number of rollout buckets. Weights are percentages
+	buckets = 100
+)
+
+// ErrInvalidFlag returned for a flag that can't be evaluated
+var ErrInvalidFlag = errors.New("invalid flag")
+
+// validKey matches flag keys
+var validKey = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+// Flag a feature flag
+type Flag struct {
+	Key         string `json:"key"`
+	Description string `json:"description,omitempty"`
+	// Kind boolean (default) or multivariate
+	Kind string `json:"kind"`
+	// Enabled is the kill switch. A disabled flag serves OffVariation to
+	// every host
+	Enabled    bool                   `json:"enabled"`
+	Variations map[string]interface{} `json:"variations"`
+	// OffVariation the variation of a disabled flag
+	OffVariation string `json:"off_variation"`
+	// Rules are checked in order. The first that matches the host serves
+	Rules []Rule `json:"rules,omitempty"`
+	// Fallthrough serves hosts that no rule matches
+	Fallthrough Serve `json:"fallthrough"`
+}
+
+// Rule targets hosts by their tags
+type Rule struct {
+	Tags []string `json:"tags"`
+	// TagMatch all (default) or any
+	TagMatch string `json:"tag_match,omitempty"`
+	Serve
+}
+
+// Serve a variation, or a percentage rollout between variations
+type Serve struct {
+	Variation string     `json:"variation,omitempty"`
+	Rollout   []Weighted `json:"rollout,omitempty"`
+}
+
+// Weighted the percentage of hosts that get a variation in a rollout
+type Weighted struct {
+	Variation string `json:"variation"`
+	Weight    int    `json:"weight"`
+}
+
+// Evaluation the variation a host gets
+type Evaluation struct {
+	Key       string      `json:"key"`
+	Value     interface{} `json:"value"`
+	Variation string      `json:"variation"`
+	Reason    string      `json:"reason"`
+	// Rule the index of the rule that matched
+	Rule *int `json:"rule,omitempty"`
+	// Version the version of the flag that was evaluated
+	Version int32 `json:"version,omitempty"`
+	// Error why the flag couldn't be evaluated, with ReasonError
+	Error string `json:"error,omitempty"`
+}
+
+// ValidKey returns whether a string can be a flag key
+func ValidKey(key string) bool {
+	return validKey.MatchString(key)
+}
+
+// FromPayload reads a flag from its stored form
+func FromPayload(payload interface{}) (Flag, error) {
+	var flag Flag
+
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return flag, err
+	}
+
+	if err := json.Unmarshal(b, &flag); err != nil {
+		return flag, fmt.Errorf("%w: %s", ErrInvalidFlag, err)
+	}
+
+	return flag, flag.Normalize()
+}
+
+// Payload returns the stored form of a flag
+func (f Flag) Payload() (map[string]interface{}, error) {
+	b, err := json.Marshal(f)
+	if err != nil {
+		return nil, err
+	}
+
+	var payload map[string]interface{}
+	err = json.Unmarshal(b, &payload)
+	return payload, err
+}
+
+// Normalize sets the defaults of a flag and validates it. Boolean flags
+// default to on and off variations, serve off when they're disabled and
+// on to hosts that no rule matches
+func (f *Flag) Normalize() error {
+	if !ValidKey(f.Key) {
+		return fmt.Errorf("%w: the key must be 1 to 128 letters, digits, dots, dashes or underscores", ErrInvalidFlag)
+	}
+
+	switch f.Kind {
+	case "", KindBoolean:
+		f.Kind = KindBoolean
+		if len(f.Variations) == 0 {
+			f.Variations = map[string]interface{}{VariationOn: true, VariationOff: false}
+		}
+		if f.OffVariation == "" {
+			f.OffVariation = VariationOff
+		}
+		if f.Fallthrough.Variation == "" && len(f.Fallthrough.Rollout) == 0 {
+			f.Fallthrough.Variation = VariationOn
+		}
+		for name, value := range f.Variations {
+			if _, ok := value.(bool); !ok {
+				return fmt.Errorf("%w: the variation %s of a boolean flag must be true or false", ErrInvalidFlag, name)
+			}
+		}
+	case KindMultivariate:
+		if len(f.Variations) == 0 {
+			return fmt.Errorf("%w: a multivariate flag needs variations", ErrInvalidFlag)
+		}
+	default:
+		return fmt.Errorf("%w: the kind must be %s or %s", ErrInvalidFlag, KindBoolean, KindMultivariate)
+	}
+
+	if _, ok := f.Variations[f.OffVariation]; !ok {
+		return fmt.Errorf("%w: the off variation %q doesn't exist", ErrInvalidFlag, f.OffVariation)
+	}
+
+	for i := range f.Rules {
+		rule := &f.Rules[i]
+		if len(rule.Tags) == 0 {
+			return fmt.Errorf("%w: rule %d has no tags", ErrInvalidFlag, i)
+		}
+
+		switch rule.TagMatch {
+		case "":
+			rule.TagMatch = TagMatchAll
+		case TagMatchAll, TagMatchAny:
+		default:
+			return fmt.Errorf("%w: the tag_match of rule %d must be %s or %s", ErrInvalidFlag, i, TagMatchAll, TagMatchAny)
+		}
+
+		if err := f.checkServe(rule.Serve); err != nil {
+			return fmt.Errorf("%w: rule %d: %s", ErrInvalidFlag, i, err)
+		}
+	}
+
+	if err := f.checkServe(f.Fallthrough); err != nil {
+		return fmt.Errorf("%w: fallthrough: %s", ErrInvalidFlag, err)
+	}
+
+	return nil
+}
+
+// checkServe validates that a serve has a variation or a rollout of
+// existing variations that adds up to 100
+func (f *Flag) checkServe(serve Serve) error {
+	if (serve.Variation == "") == (len(serve.Rollout) == 0) {
+		return errors.New("serve either a variation or a rollout")
+	}
+
+	if serve.Variation != "" {
+		if _, ok := f.Variations[serve.Variation]; !ok {
+			return fmt.Errorf("the variation %q doesn't exist", serve.Variation)
+		}
+		return nil
+	}
+
+	total := 0
+	for _, weighted := range serve.Rollout {
+		if _, ok := f.Variations[weighted.Variation]; !ok {
+			return fmt.Errorf("the variation %q doesn't exist", weighted.Variation)
+		}
+		if weighted.Weight < 0 {
+			return fmt.Errorf("the weight of %q is negative", weighted.Variation)
+		}
+		total += weighted.Weight
+	}
+
+	if total != buckets {
+		return fmt.Errorf("the rollout weights add up to %d, not %d", total, buckets)
+	}
+
+	return nil
+}
+
+// Evaluate returns the variation a host gets. The flag must be normalized
+func (f Flag) Evaluate(hostID string, hostTags []string) Evaluation {
+	if !f.Enabled {
+		return f.evaluation(f.OffVariation, ReasonOff, nil)
+	}
+
+	tags := make(map[string]bool, len(hostTags))
+	for _, tag := range hostTags {
+		tags[tag] = true
+	}
+
+	for i, rule := range f.Rules {
+		if rule.matches(tags) {
+			index := i
+			return f.evaluation(f.serve(rule.Serve, hostID), ReasonRule, &index)
+		}
+	}
+
+	return f.evaluation(f.serve(f.Fallthrough, hostID), ReasonFallthrough, nil)
+}
+
+// evaluation returns the evaluation of a variation
+func (f Flag) evaluation(variation, reason string, rule *int) Evaluation {
+	return Evaluation{
+		Key:       f.Key,
+		Value:     f.Variations[variation],
+		Variation: variation,
+		Reason:    reason,
+		Rule:      rule,
+	}
+}
+
+// serve returns the variation a serve gives a host
+func (f Flag) serve(serve Serve, hostID string) string {
+	if len(serve.Rollout) == 0 {
+		return serve.Variation
+	}
+
+	bucket := Bucket(f.Key, hostID)
+	for _, weighted := range serve.Rollout {
+		if bucket < weighted.Weight {
+			return weighted.Variation
+		}
+		bucket -= weighted.Weight
+	}
+
+	// weights add up to 100, so this is only reached by flags that
+	// weren't normalized
+	return serve.Rollout[len(serve.Rollout)-1].Variation
+}
+
+// matches returns whether a rule matches a host's tags
+func (r Rule) matches(tags map[string]bool) bool {
+	for _, tag := range r.Tags {
+		if tags[tag] && r.TagMatch == TagMatchAny {
+			return true
+		}
+		if !tags[tag] && r.TagMatch != TagMatchAny {
+			return false
+		}
+	}
+
+	return r.TagMatch != TagMatchAny
+}
+
+// Bucket returns the rollout bucket of a host for a flag, from 0 to 99
+func Bucket(key, hostID string) int {
+	sum := sha256.Sum256([]byte(key + "/" + hostID))
+	return int(binary.BigEndian.Uint64(sum[:8]) % buckets)
+}
@@ -0,0 +1,155 @@
+package flags
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// TestNormalize validates the defaults and validation of flags
+func TestNormalize(t *testing.T) {
+	flag := Flag{Key: "new-checkout", Enabled: true}
+	assert.Nil(t, flag.Normalize())
+	assert.Equal(t, KindBoolean, flag.Kind)
+	assert.Equal(t, map[string]interface{}{"on": true, "off": false}, flag.Variations)
+	assert.Equal(t, VariationOff, flag.OffVariation)
+	assert.Equal(t, Serve{Variation: VariationOn}, flag.Fallthrough)
+
+	variations := map[string]interface{}{"red": "#f00", "blue": "#00f"}
+	table := []struct {
+		name string
+		flag Flag
+	}{
+		{"invalid key", Flag{Key: "a b"}},
+		{"unknown kind", Flag{Key: "a", Kind: "percent"}},
+		{"boolean with a string", Flag{Key: "a", Variations: map[string]interface{}{"on": "yes", "off": false}}},
+		{"multivariate without variations", Flag{Key: "a", Kind: KindMultivariate}},
+		{"unknown off variation", Flag{Key: "a", Kind: KindMultivariate, Variations: variations, OffVariation: "green", Fallthrough: Serve{Variation: "red"}}},
+		{"no fallthrough", Flag{Key: "a", Kind: KindMultivariate, Variations: variations, OffVariation: "red"}},
+		{"variation and rollout", Flag{Key: "a", Fallthrough: Serve{Variation: "on", Rollout: []Weighted{{"on", 100}}}}},
+		{"rollout under 100", Flag{Key: "a", Fallthrough: Serve{Rollout: []Weighted{{"on", 50}, {"off", 40}}}}},
+		{"negative weight", Flag{Key: "a", Fallthrough: Serve{Rollout: []Weighted{{"on", 110}, {"off", -10}}}}},
+		{"rule without tags", Flag{Key: "a", Rules: []Rule{{Serve: Serve{Variation: "on"}}}}},
+		{"unknown tag match", Flag{Key: "a", Rules: []Rule{{Tags: []string{"tier:1"}, TagMatch: "some", Serve: Serve{Variation: "on"}}}}},
+		{"rule with an unknown variation", Flag{Key: "a", Rules: []Rule{{Tags: []string{"tier:1"}, Serve: Serve{Variation: "maybe"}}}}},
+	}
+
+	for _, tc := range table {
+		err := tc.flag.Normalize()
+		assert.True(t, errors.Is(err, ErrInvalidFlag), "%s: %v", tc.name, err)
+	}
+}
+
+// TestEvaluate validates the kill switch, targeting rules and the
+// fallthrough
+func TestEvaluate(t *testing.T) {
+	flag := Flag{
+		Key:     "checkout",
+		Kind:    KindMultivariate,
+		Enabled: true,
+		Variations: map[string]interface{}{
+			"v1": "classic",
+			"v2": "express",
+			"v3": "beta",
+		},
+		OffVariation: "v1",
+		Rules: []Rule{
+			{Tags: []string{"env:prod", "tier:1"}, Serve: Serve{Variation: "v1"}},
+			{Tags: []string{"team:qa", "team:dev"}, TagMatch: TagMatchAny, Serve: Serve{Variation: "v3"}},
+		},
+		Fallthrough: Serve{Variation: "v2"},
+	}
+	assert.Nil(t, flag.Normalize())
+
+	table := []struct {
+		name      string
+		tags      []string
+		variation string
+		reason    string
+		rule      int
+	}{
+		{"every tag", []string{"env:prod", "tier:1", "team:dev"}, "v1", ReasonRule, 0},
+		{"any tag", []string{"env:prod", "team:dev"}, "v3", ReasonRule, 1},
+		{"no rule", []string{"env:prod"}, "v2", ReasonFallthrough, -1},
+		{"no tags", nil, "v2", ReasonFallthrough, -1},
+	}
+
+	for _, tc := range table {
+		evaluation := flag.Evaluate("host-1", tc.tags)
+		assert.Equal(t, tc.variation, evaluation.Variation, tc.name)
+		assert.Equal(t, flag.Variations[tc.variation], evaluation.Value, tc.name)
+		assert.Equal(t, tc.reason, evaluation.Reason, tc.name)
+		if tc.rule >= 0 {
+			assert.Equal(t, tc.rule, *evaluation.Rule, tc.name)
+		} else {
+			assert.Nil(t, evaluation.Rule, tc.name)
+		}
+	}
+
+	// the kill switch wins over every rule
+	flag.Enabled = false
+	evaluation := flag.Evaluate("host-1", []string{"team:qa"})
+	assert.Equal(t, "v1", evaluation.Variation)
+	assert.Equal(t, ReasonOff, evaluation.Reason)
+}
+
+// TestRollout validates that rollouts are stable and close to their
+// weights, and that growing a percentage only moves hosts into it
+func TestRollout(t *testing.T) {
+	flag := Flag{Key: "new-cache", Enabled: true, Fallthrough: Serve{Rollout: []Weighted{{"on", 20}, {"off", 80}}}}
+	assert.Nil(t, flag.Normalize())
+
+	grown := flag
+	grown.Fallthrough = Serve{Rollout: []Weighted{{"on", 50}, {"off", 50}}}
+
+	on := 0
+	for i := 0; i < 1000; i++ {
+		host := fmt.Sprintf("host-%d", i)
+		variation := flag.Evaluate(host, nil).Variation
+		assert.Equal(t, variation, flag.Evaluate(host, nil).Variation)
+
+		if variation == "on" {
+			on++
+			assert.Equal(t, "on", grown.Evaluate(host, nil).Variation)
+		}
+	}
+	assert.InDelta(t, 200, on, 50)
+
+	// hosts get independent buckets for each flag
+	same := 0
+	for i := 0; i < 1000; i++ {
+		host := fmt.Sprintf("host-%d", i)
+		if Bucket("a", host) == Bucket("b", host) {
+			same++
+		}
+	}
+	assert.Less(t, same, 50)
+}
+
+// TestPayload validates that flags are stored and read back as config
+// payloads
+func TestPayload(t *testing.T) {
+	flag := Flag{Key: "dark-mode", Enabled: true, Rules: []Rule{{Tags: []string{"beta"}, Serve: Serve{Rollout: []Weighted{{"on", 10}, {"off", 90}}}}}}
+	assert.Nil(t, flag.Normalize())
+
+	payload, err := flag.Payload()
+	assert.Nil(t, err)
+	assert.Equal(t, "dark-mode", payload["key"])
+
+	// the document store returns bson types
+	stored := bson.M{}
+	for k, v := range payload {
+		stored[k] = v
+	}
+	stored["rules"] = bson.A{bson.M{"tags": bson.A{"beta"}, "tag_match": "all", "rollout": bson.A{bson.M{"variation": "on", "weight": int32(10)}, bson.M{"variation": "off", "weight": int32(90)}}}}
+
+	read, err := FromPayload(stored)
+	assert.Nil(t, err)
+	assert.Equal(t, flag, read)
+
+	_, err = FromPayload(bson.M{"key": "x", "enabled": "yes"})
+	assert.True(t, errors.Is(err, ErrInvalidFlag))
+}
@@ -0,0 +1,89 @@
+package importer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// manifest the parts of a Kubernetes manifest that are read. Lists hold
+// their manifests in items
+type manifest struct {
+	Kind     string `yaml:"kind"`
+	Metadata struct {
+		Name      string `yaml:"name"`
+		Namespace string `yaml:"namespace"`
+	} `yaml:"metadata"`
+	Data  map[string]string `yaml:"data"`
+	Items []manifest        `yaml:"items"`
+}
+
+// readConfigMapFile reads every ConfigMap in a YAML or JSON file, including
+// those in lists and in files with several documents. A ConfigMap is named
+// {namespace}/{name}, or {name} without a namespace, and its data becomes
+// the payload. binaryData and other kinds of manifests are skipped
+func readConfigMapFile(file, rel string) ([]Config, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var configs []Config
+
+	decoder := yaml.NewDecoder(bytes.NewReader(b))
+	for {
+		var m manifest
+		err := decoder.Decode(&m)
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, fileError(file, err)
+		}
+
+		read, err := configMaps(m, file)
+		if err != nil {
+			return nil, fileError(file, err)
+		}
+		configs = append(configs, read...)
+	}
+
+	return configs, nil
+}
+
+// configMaps returns the ConfigMaps in a manifest
+func configMaps(m manifest, file string) ([]Config, error) {
+	var configs []Config
+
+	switch m.Kind {
+	case "ConfigMap":
+		if m.Metadata.Name == "" {
+			return nil, fmt.Errorf("a ConfigMap has no name")
+		}
+
+		name := m.Metadata.Name
+		if m.Metadata.Namespace != "" {
+			name = m.Metadata.Namespace + "/" + name
+		}
+
+		payload := make(map[string]interface{}, len(m.Data))
+		for k, v := range m.Data {
+			payload[k] = v
+		}
+
+		configs = append(configs, Config{Name: name, Path: file, Config: payload})
+	case "List", "ConfigMapList":
+		for _, item := range m.Items {
+			read, err := configMaps(item, file)
+			if err != nil {
+				return nil, err
+			}
+			configs = append(configs, read...)
+		}
+	}
+
+	return configs, nil
+}
@@ -0,0 +1,71 @@
+package importer
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// consulEntry a key in the output of consul kv export. Values are base64
+// encoded
+type consulEntry struct {
+	Key   string  `json:"key"`
+	Flags uint64  `json:"flags"`
+	Value *string `json:"value"`
+}
+
+// readConsulFile reads a Consul KV export. Keys are grouped into one config
+// per folder: config/payments/db_host -> db_host in config/payments. Keys at
+// the top level go in a config named after the export file. Folder keys,
+// which end with a slash, are skipped
+func readConsulFile(file, rel string) ([]Config, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []consulEntry
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return nil, fileError(file, err)
+	}
+
+	payloads := make(map[string]map[string]interface{})
+	var names []string
+
+	for _, entry := range entries {
+		if entry.Key == "" || strings.HasSuffix(entry.Key, "/") {
+			continue
+		}
+
+		var value []byte
+		if entry.Value != nil {
+			value, err = base64.StdEncoding.DecodeString(*entry.Value)
+			if err != nil {
+				return nil, fileError(file, fmt.Errorf("key %q: %s", entry.Key, err))
+			}
+		}
+
+		name := path.Dir(entry.Key)
+		if name == "." {
+			name = fileName(rel)
+		}
+
+		payload, ok := payloads[name]
+		if !ok {
+			payload = make(map[string]interface{})
+			payloads[name] = payload
+			names = append(names, name)
+		}
+		payload[path.Base(entry.Key)] = string(value)
+	}
+
+	configs := make([]Config, 0, len(names))
+	for _, name := range names {
+		configs = append(configs, Config{Name: name, Path: file, Config: payloads[name]})
+	}
+
+	return configs, nil
+}
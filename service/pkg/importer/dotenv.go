@@ -0,0 +1,147 @@
+package importer
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// dotenvBase the name of a .env file at the root
+const dotenvBase = "env"
+
+// isDotenvFile returns whether a file is a .env, .env.{profile} or
+// {name}.env file
+func isDotenvFile(base string) bool {
+	return base == ".env" || strings.HasPrefix(base, ".env.") || strings.HasSuffix(base, ".env")
+}
+
+// readDotenvFile reads a .env file as one config. payments/.env ->
+// payments, payments/.env.prod -> payments/prod and payments.env -> payments
+func readDotenvFile(file, rel string) ([]Config, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := parseDotenv(b)
+	if err != nil {
+		return nil, fileError(file, err)
+	}
+
+	base := rel[strings.LastIndex(rel, "/")+1:]
+
+	var name string
+	switch {
+	case base == ".env":
+		name = profileName(rel, dotenvBase, "")
+	case strings.HasPrefix(base, ".env."):
+		name = profileName(rel, dotenvBase, strings.TrimPrefix(base, ".env."))
+	default:
+		name = fileName(rel)
+	}
+
+	return []Config{{Name: name, Path: file, Config: payload}}, nil
+}
+
+// parseDotenv parses KEY=value lines. Blank lines, comments and a leading
+// export are skipped. Single quoted values are read literally, double quoted
+// values expand \n, \r, \t, \", \\ and \$, and bare values end at a #
+// that follows a space. Values are kept as strings
+func parseDotenv(b []byte) (map[string]interface{}, error) {
+	payload := make(map[string]interface{})
+
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		text = strings.TrimPrefix(text, "export ")
+		i := strings.Index(text, "=")
+		if i < 1 {
+			return nil, fmt.Errorf("line %d: expected KEY=value", line)
+		}
+
+		key := strings.TrimSpace(text[:i])
+		if !isDotenvKey(key) {
+			return nil, fmt.Errorf("line %d: invalid key %q", line, key)
+		}
+
+		value, err := dotenvValue(strings.TrimSpace(text[i+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err)
+		}
+
+		payload[key] = value
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return payload, nil
+}
+
+// isDotenvKey returns whether a key is made of letters, digits, underscores
+// and dots and doesn't start with a digit
+func isDotenvKey(key string) bool {
+	for i, r := range key {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_', r == '.':
+		case r >= '0' && r <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+
+	return key != ""
+}
+
+// dotenvValue unquotes a value
+func dotenvValue(s string) (string, error) {
+	switch {
+	case strings.HasPrefix(s, "'"):
+		end := strings.Index(s[1:], "'")
+		if end < 0 {
+			return "", fmt.Errorf("unterminated single quote")
+		}
+		return s[1 : end+1], nil
+	case strings.HasPrefix(s, `"`):
+		var b strings.Builder
+		for i := 1; i < len(s); i++ {
+			switch c := s[i]; {
+			case c == '"':
+				return b.String(), nil
+			case c == '\\' && i+1 < len(s):
+				i++
+				switch s[i] {
+				case 'n':
+					b.WriteByte('\n')
+				case 'r':
+					b.WriteByte('\r')
+				case 't':
+					b.WriteByte('\t')
+				case '"', '\\', '$':
+					b.WriteByte(s[i])
+				default:
+					b.WriteByte('\\')
+					b.WriteByte(s[i])
+				}
+			default:
+				b.WriteByte(c)
+			}
+		}
+		return "", fmt.Errorf("unterminated double quote")
+	}
+
+	if i := strings.Index(s, " #"); i >= 0 {
+		s = s[:i]
+	}
+
+	return strings.TrimSpace(s), nil
+}
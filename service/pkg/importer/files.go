@@ -0,0 +1,140 @@
+package importer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+
+	"github.com/aeekayy/stilla/service/pkg/utils"
+)
+
+// isDataFile returns whether a file is YAML, JSON or TOML
+func isDataFile(base string) bool {
+	switch strings.ToLower(filepath.Ext(base)) {
+	case ".yaml", ".yml", ".json", ".toml":
+		return true
+	}
+
+	return false
+}
+
+// isManifestFile returns whether a file is a YAML or JSON manifest
+func isManifestFile(base string) bool {
+	switch strings.ToLower(filepath.Ext(base)) {
+	case ".yaml", ".yml", ".json":
+		return true
+	}
+
+	return false
+}
+
+// isJSONFile returns whether a file is JSON
+func isJSONFile(base string) bool {
+	return strings.ToLower(filepath.Ext(base)) == ".json"
+}
+
+// readDataFile reads a YAML, JSON or TOML file as one config named after
+// its path. The file must hold an object
+func readDataFile(file, rel string) ([]Config, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var payload map[string]interface{}
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".json":
+		payload, err = decodeJSON(b)
+	case ".toml":
+		err = toml.Unmarshal(b, &payload)
+	default:
+		payload, err = decodeYAML(b)
+	}
+	if err != nil {
+		return nil, fileError(file, err)
+	}
+
+	if payload == nil {
+		payload = map[string]interface{}{}
+	}
+
+	return []Config{{Name: fileName(rel), Path: file, Config: payload}}, nil
+}
+
+// decodeJSON decodes a JSON object. Integers stay integers
+func decodeJSON(b []byte) (map[string]interface{}, error) {
+	var payload map[string]interface{}
+
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	if err := decoder.Decode(&payload); err != nil {
+		return nil, err
+	}
+
+	utils.JSONNumbers(payload)
+	return payload, nil
+}
+
+// decodeYAML decodes the first document of a YAML file as an object
+func decodeYAML(b []byte) (map[string]interface{}, error) {
+	var payload map[string]interface{}
+
+	if err := yaml.Unmarshal(b, &payload); err != nil {
+		return nil, err
+	}
+
+	v, err := stringKeys(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, _ = v.(map[string]interface{})
+	return payload, nil
+}
+
+// stringKeys converts the maps YAML decodes with non-string keys, such as
+// 1: one, into maps with string keys, which the document store can hold
+func stringKeys(v interface{}) (interface{}, error) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, child := range t {
+			converted, err := stringKeys(child)
+			if err != nil {
+				return nil, err
+			}
+			t[k] = converted
+		}
+		return t, nil
+	case map[interface{}]interface{}:
+		out := make(map[string]interface{}, len(t))
+		for k, child := range t {
+			key := fmt.Sprint(k)
+			if _, ok := out[key]; ok {
+				return nil, fmt.Errorf("key %q is repeated", key)
+			}
+			converted, err := stringKeys(child)
+			if err != nil {
+				return nil, err
+			}
+			out[key] = converted
+		}
+		return out, nil
+	case []interface{}:
+		for i, child := range t {
+			converted, err := stringKeys(child)
+			if err != nil {
+				return nil, err
+			}
+			t[i] = converted
+		}
+		return t, nil
+	}
+
+	return v, nil
+}
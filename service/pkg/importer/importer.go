@@ -0,0 +1,190 @@
+// Package importer reads configs from formats and systems other than Stilla
+// bundles, so that existing estates can be migrated without one-off scripts.
+// Each source turns files under a root into named payloads. Names are mapped
+// from file paths relative to the root, except for Kubernetes ConfigMaps and
+// Consul keys, which carry their own names.
+package importer
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Source a format or system that configs are imported from
+type Source string
+
+const (
+	// SourceFiles YAML, JSON and TOML files, one config per file
+	SourceFiles Source = "files"
+	// SourceDotenv .env files
+	SourceDotenv Source = "dotenv"
+	// SourceSpring Spring application.properties and application-{profile}.properties files
+	SourceSpring Source = "spring"
+	// SourceConfigMap Kubernetes ConfigMap manifests
+	SourceConfigMap Source = "configmap"
+	// SourceConsul Consul KV exports from consul kv export
+	SourceConsul Source = "consul"
+)
+
+// ErrUnsupportedSource returned for an unknown source
+var ErrUnsupportedSource = errors.New("unsupported import source")
+
+// ErrInvalidFile returned when a file can't be parsed
+var ErrInvalidFile = errors.New("invalid file")
+
+// ErrDuplicateName returned when two files map to the same config name
+var ErrDuplicateName = errors.New("duplicate config name")
+
+// Config a config read from a source
+type Config struct {
+	// Name the config name, mapped from the file path
+	Name string `json:"config_name"`
+	// Path the file the config was read from
+	Path   string                 `json:"path"`
+	Config map[string]interface{} `json:"config"`
+}
+
+// sources the accepted names of each source
+var sources = map[string]Source{
+	"files":      SourceFiles,
+	"yaml":       SourceFiles,
+	"json":       SourceFiles,
+	"toml":       SourceFiles,
+	"dotenv":     SourceDotenv,
+	"env":        SourceDotenv,
+	"spring":     SourceSpring,
+	"properties": SourceSpring,
+	"configmap":  SourceConfigMap,
+	"kubernetes": SourceConfigMap,
+	"consul":     SourceConsul,
+}
+
+// reader reads the configs of one file. rel is the slash separated path of
+// the file relative to the root, or the base name when the root is a file
+type reader struct {
+	match func(base string) bool
+	read  func(file, rel string) ([]Config, error)
+}
+
+// readers the files each source reads and how it reads them
+var readers = map[Source]reader{
+	SourceFiles:     {isDataFile, readDataFile},
+	SourceDotenv:    {isDotenvFile, readDotenvFile},
+	SourceSpring:    {isPropertiesFile, readSpringFile},
+	SourceConfigMap: {isManifestFile, readConfigMapFile},
+	SourceConsul:    {isJSONFile, readConsulFile},
+}
+
+// ParseSource returns the source for a name such as yaml or consul
+func ParseSource(name string) (Source, error) {
+	source, ok := sources[strings.ToLower(strings.TrimSpace(name))]
+	if !ok {
+		return "", fmt.Errorf("%w: %q", ErrUnsupportedSource, name)
+	}
+
+	return source, nil
+}
+
+// Read reads every config of the source under root, sorted by name. root is
+// a file or a directory that's walked for the files the source reads
+func Read(source Source, root string) ([]Config, error) {
+	r, ok := readers[source]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnsupportedSource, source)
+	}
+
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+
+	var configs []Config
+	if !info.IsDir() {
+		configs, err = r.read(root, filepath.Base(root))
+		if err != nil {
+			return nil, err
+		}
+		return sortConfigs(configs)
+	}
+
+	err = filepath.WalkDir(root, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			// skip hidden directories such as .git
+			if file != root && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !d.Type().IsRegular() || !r.match(d.Name()) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, file)
+		if err != nil {
+			return err
+		}
+
+		read, err := r.read(file, filepath.ToSlash(rel))
+		if err != nil {
+			return err
+		}
+		configs = append(configs, read...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return sortConfigs(configs)
+}
+
+// sortConfigs sorts configs by name and rejects names that are read twice
+func sortConfigs(configs []Config) ([]Config, error) {
+	sort.SliceStable(configs, func(i, j int) bool {
+		return configs[i].Name < configs[j].Name
+	})
+
+	for i := 1; i < len(configs); i++ {
+		if configs[i].Name == configs[i-1].Name {
+			return nil, fmt.Errorf("%w: %s is read from %s and %s", ErrDuplicateName, configs[i].Name, configs[i-1].Path, configs[i].Path)
+		}
+	}
+
+	return configs, nil
+}
+
+// fileName maps a relative file path to a config name by dropping the
+// extension. services/payments.yaml -> services/payments
+func fileName(rel string) string {
+	return strings.TrimSuffix(rel, path.Ext(rel))
+}
+
+// profileName maps a file with a default base name, such as
+// application.properties or application-prod.properties, to its directory and
+// profile. payments/application.properties -> payments and
+// payments/application-prod.properties -> payments/prod. A file at the root
+// is named by the default name: application-prod.properties -> application/prod
+func profileName(rel, base, profile string) string {
+	dir := path.Dir(rel)
+	if dir == "." {
+		dir = base
+	}
+
+	return path.Join(dir, profile)
+}
+
+// fileError wraps a parse error with the file it came from
+func fileError(file string, err error) error {
+	return fmt.Errorf("%w: %s: %s", ErrInvalidFile, file, err)
+}
@@ -0,0 +1,206 @@
+package importer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeFiles writes files relative to a temporary root and returns the root
+func writeFiles(t *testing.T, files map[string]string) string {
+	root := t.TempDir()
+
+	for name, content := range files {
+		file := filepath.Join(root, filepath.FromSlash(name))
+		assert.Nil(t, os.MkdirAll(filepath.Dir(file), 0755))
+		assert.Nil(t, os.WriteFile(file, []byte(content), 0644))
+	}
+
+	return root
+}
+
+// names returns the names of configs and their payloads by name
+func names(configs []Config) ([]string, map[string]map[string]interface{}) {
+	var out []string
+	payloads := make(map[string]map[string]interface{})
+	for _, c := range configs {
+		out = append(out, c.Name)
+		payloads[c.Name] = c.Config
+	}
+
+	return out, payloads
+}
+
+// TestReadFiles validates that YAML, JSON and TOML files are named after
+// their paths
+func TestReadFiles(t *testing.T) {
+	root := writeFiles(t, map[string]string{
+		"services/payments.yaml": "db:\n  port: 5432\n  hosts: [a, b]\nlevels:\n  1: debug\n",
+		"services/redis.json":    `{"port": 6379, "ratio": 0.5}`,
+		"kafka.toml":             "brokers = 3\n[tls]\nenabled = true\n",
+		"README.md":              "ignored",
+		".git/config.yaml":       "ignored: true",
+	})
+
+	configs, err := Read(SourceFiles, root)
+	assert.Nil(t, err)
+
+	got, payloads := names(configs)
+	assert.Equal(t, []string{"kafka", "services/payments", "services/redis"}, got)
+	assert.Equal(t, 5432, payloads["services/payments"]["db"].(map[string]interface{})["port"])
+	assert.Equal(t, map[string]interface{}{"1": "debug"}, payloads["services/payments"]["levels"])
+	assert.Equal(t, int64(6379), payloads["services/redis"]["port"])
+	assert.Equal(t, 0.5, payloads["services/redis"]["ratio"])
+	assert.Equal(t, int64(3), payloads["kafka"]["brokers"])
+
+	// a single file is named after its base name
+	configs, err = Read(SourceFiles, filepath.Join(root, "kafka.toml"))
+	assert.Nil(t, err)
+	got, _ = names(configs)
+	assert.Equal(t, []string{"kafka"}, got)
+}
+
+// TestReadInvalidFiles validates the errors of files that can't be imported
+func TestReadInvalidFiles(t *testing.T) {
+	root := writeFiles(t, map[string]string{"list.yaml": "- a\n- b\n"})
+	_, err := Read(SourceFiles, root)
+	assert.ErrorIs(t, err, ErrInvalidFile)
+
+	root = writeFiles(t, map[string]string{"payments.yaml": "a: 1", "payments.json": `{"a": 1}`})
+	_, err = Read(SourceFiles, root)
+	assert.ErrorIs(t, err, ErrDuplicateName)
+
+	_, err = Read(Source("vault"), root)
+	assert.ErrorIs(t, err, ErrUnsupportedSource)
+}
+
+// TestReadDotenv validates the names and values read from .env files
+func TestReadDotenv(t *testing.T) {
+	root := writeFiles(t, map[string]string{
+		".env": "# comment\nLOG_LEVEL=info\n",
+		"payments/.env": "export DB_HOST=db.local # the primary\n" +
+			"DB_PASSWORD='p@ss word #1'\n" +
+			"GREETING=\"it's\\n\\\"here\\\" \\$HOME\"\n" +
+			"EMPTY=\n",
+		"payments/.env.prod": "DB_HOST=db.prod\n",
+		"redis.env":          "PORT=6379\n",
+	})
+
+	configs, err := Read(SourceDotenv, root)
+	assert.Nil(t, err)
+
+	got, payloads := names(configs)
+	assert.Equal(t, []string{"env", "payments", "payments/prod", "redis"}, got)
+	assert.Equal(t, map[string]interface{}{
+		"DB_HOST":     "db.local",
+		"DB_PASSWORD": "p@ss word #1",
+		"GREETING":    "it's\n\"here\" $HOME",
+		"EMPTY":       "",
+	}, payloads["payments"])
+	assert.Equal(t, "6379", payloads["redis"]["PORT"])
+
+	_, err = parseDotenv([]byte("1KEY=value\n"))
+	assert.NotNil(t, err)
+	_, err = parseDotenv([]byte("KEY='value\n"))
+	assert.NotNil(t, err)
+}
+
+// TestReadSpring validates that properties are nested and profiles are
+// named after their directory
+func TestReadSpring(t *testing.T) {
+	root := writeFiles(t, map[string]string{
+		"application.properties": "spring.application.name=shared\n",
+		"payments/application.properties": "server.port=8080\n" +
+			"db.hosts[0]=a\n" +
+			"db.hosts[1]=b\n" +
+			"routes[0].path=/pay\n" +
+			"labels[team.name]=core\n" +
+			"url=${DB_URL}\n" +
+			"greeting=caf\\u00e9\n",
+		"payments/application-prod.properties": "server.port=443\n",
+	})
+
+	configs, err := Read(SourceSpring, root)
+	assert.Nil(t, err)
+
+	got, payloads := names(configs)
+	assert.Equal(t, []string{"application", "payments", "payments/prod"}, got)
+	assert.Equal(t, map[string]interface{}{
+		"server":   map[string]interface{}{"port": "8080"},
+		"db":       map[string]interface{}{"hosts": []interface{}{"a", "b"}},
+		"routes":   []interface{}{map[string]interface{}{"path": "/pay"}},
+		"labels":   map[string]interface{}{"team.name": "core"},
+		"url":      "${DB_URL}",
+		"greeting": "café",
+	}, payloads["payments"])
+
+	root = writeFiles(t, map[string]string{"application.properties": "db=x\ndb.host=y\n"})
+	_, err = Read(SourceSpring, root)
+	assert.ErrorIs(t, err, ErrInvalidFile)
+
+	for _, key := range []string{"a..b", "a.", "a[", "a[]", ".a", "a[99999]"} {
+		_, err := parseSpringKey(key)
+		assert.NotNil(t, err, key)
+	}
+}
+
+// TestReadConfigMaps validates that ConfigMaps are read from documents and
+// lists, and other manifests are skipped
+func TestReadConfigMaps(t *testing.T) {
+	root := writeFiles(t, map[string]string{
+		"k8s/payments.yaml": "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: payments\n  namespace: prod\n" +
+			"data:\n  LOG_LEVEL: info\n  app.yaml: |\n    port: 8080\n" +
+			"---\napiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: payments\n",
+		"k8s/list.json": `{"kind": "List", "items": [{"kind": "ConfigMap", "metadata": {"name": "redis"}, "data": {"PORT": "6379"}}]}`,
+	})
+
+	configs, err := Read(SourceConfigMap, root)
+	assert.Nil(t, err)
+
+	got, payloads := names(configs)
+	assert.Equal(t, []string{"prod/payments", "redis"}, got)
+	assert.Equal(t, map[string]interface{}{"LOG_LEVEL": "info", "app.yaml": "port: 8080\n"}, payloads["prod/payments"])
+	assert.Equal(t, "6379", payloads["redis"]["PORT"])
+
+	root = writeFiles(t, map[string]string{"cm.yaml": "kind: ConfigMap\ndata:\n  a: b\n"})
+	_, err = Read(SourceConfigMap, root)
+	assert.ErrorIs(t, err, ErrInvalidFile)
+}
+
+// TestReadConsul validates that Consul keys are grouped by folder
+func TestReadConsul(t *testing.T) {
+	root := writeFiles(t, map[string]string{
+		"kv.json": `[
+			{"key": "config/", "flags": 0, "value": null},
+			{"key": "config/payments/db_host", "flags": 0, "value": "ZGIubG9jYWw="},
+			{"key": "config/payments/port", "flags": 0, "value": "ODA4MA=="},
+			{"key": "maintenance", "flags": 0, "value": "dHJ1ZQ=="}
+		]`,
+	})
+
+	configs, err := Read(SourceConsul, root)
+	assert.Nil(t, err)
+
+	got, payloads := names(configs)
+	assert.Equal(t, []string{"config/payments", "kv"}, got)
+	assert.Equal(t, map[string]interface{}{"db_host": "db.local", "port": "8080"}, payloads["config/payments"])
+	assert.Equal(t, "true", payloads["kv"]["maintenance"])
+
+	root = writeFiles(t, map[string]string{"kv.json": `[{"key": "a/b", "value": "!!"}]`})
+	_, err = Read(SourceConsul, root)
+	assert.ErrorIs(t, err, ErrInvalidFile)
+}
+
+// TestParseSource validates the source names
+func TestParseSource(t *testing.T) {
+	for name, source := range map[string]Source{"YAML": SourceFiles, "env": SourceDotenv, "properties": SourceSpring, "kubernetes": SourceConfigMap, "consul": SourceConsul} {
+		got, err := ParseSource(name)
+		assert.Nil(t, err)
+		assert.Equal(t, source, got)
+	}
+
+	_, err := ParseSource("vault")
+	assert.ErrorIs(t, err, ErrUnsupportedSource)
+}
@@ -0,0 +1,179 @@
+package importer
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/magiconair/properties"
+)
+
+const (
+	// springBase the default base name of Spring properties files
+	springBase = "application"
+	// maxSpringIndex the largest array index read from a key
+	maxSpringIndex = 10000
+)
+
+// springLoader reads properties as Spring does, as ISO 8859-1 with \uXXXX
+// escapes. ${...} placeholders are kept for Spring to resolve
+var springLoader = &properties.Loader{Encoding: properties.ISO_8859_1, DisableExpansion: true}
+
+// isPropertiesFile returns whether a file is a Java properties file
+func isPropertiesFile(base string) bool {
+	return strings.ToLower(filepath.Ext(base)) == ".properties"
+}
+
+// readSpringFile reads a properties file as one config.
+// payments/application.properties -> payments and
+// payments/application-prod.properties -> payments/prod. Other files are
+// named after their path
+func readSpringFile(file, rel string) ([]Config, error) {
+	props, err := springLoader.LoadFile(file)
+	if err != nil {
+		return nil, fileError(file, err)
+	}
+
+	payload, err := unflattenProperties(props)
+	if err != nil {
+		return nil, fileError(file, err)
+	}
+
+	base := strings.TrimSuffix(rel[strings.LastIndex(rel, "/")+1:], filepath.Ext(rel))
+
+	var name string
+	switch {
+	case base == springBase:
+		name = profileName(rel, springBase, "")
+	case strings.HasPrefix(base, springBase+"-"):
+		name = profileName(rel, springBase, strings.TrimPrefix(base, springBase+"-"))
+	default:
+		name = fileName(rel)
+	}
+
+	return []Config{{Name: name, Path: file, Config: payload}}, nil
+}
+
+// unflattenProperties nests properties by their keys, the inverse of how
+// Spring binds them. db.host -> {"db": {"host": ...}}, servers[0] ->
+// {"servers": [...]} and map[a.b] -> {"map": {"a.b": ...}}. Values are kept
+// as strings
+func unflattenProperties(props *properties.Properties) (map[string]interface{}, error) {
+	var root interface{} = map[string]interface{}{}
+
+	for _, key := range props.Keys() {
+		value, _ := props.Get(key)
+
+		path, err := parseSpringKey(key)
+		if err != nil {
+			return nil, err
+		}
+
+		root, err = setPath(root, path, value, key)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return root.(map[string]interface{}), nil
+}
+
+// pathSegment a step in a nested key. index is set for array elements
+type pathSegment struct {
+	key   string
+	index int
+	array bool
+}
+
+// parseSpringKey splits a key on dots and brackets. Numbers in brackets are
+// array indexes and anything else in brackets is a map key
+func parseSpringKey(key string) ([]pathSegment, error) {
+	var path []pathSegment
+
+	rest := key
+	for rest != "" {
+		end := strings.IndexAny(rest, ".[")
+		if end < 0 {
+			end = len(rest)
+		}
+		if end == 0 {
+			return nil, fmt.Errorf("invalid key %q", key)
+		}
+		path = append(path, pathSegment{key: rest[:end]})
+		rest = rest[end:]
+
+		for strings.HasPrefix(rest, "[") {
+			end := strings.Index(rest, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("invalid key %q: unterminated [", key)
+			}
+
+			inner := rest[1:end]
+			if i, err := strconv.Atoi(inner); err == nil {
+				if i < 0 || i > maxSpringIndex {
+					return nil, fmt.Errorf("invalid key %q: index %d is out of range", key, i)
+				}
+				path = append(path, pathSegment{index: i, array: true})
+			} else if inner != "" {
+				path = append(path, pathSegment{key: inner})
+			} else {
+				return nil, fmt.Errorf("invalid key %q: empty []", key)
+			}
+			rest = rest[end+1:]
+		}
+
+		if rest == "" {
+			break
+		}
+		if !strings.HasPrefix(rest, ".") || len(rest) == 1 {
+			return nil, fmt.Errorf("invalid key %q", key)
+		}
+		rest = rest[1:]
+	}
+
+	return path, nil
+}
+
+// setPath sets a value at the path below node and returns the node, which
+// is new when node is nil or a grown array
+func setPath(node interface{}, path []pathSegment, value interface{}, key string) (interface{}, error) {
+	if len(path) == 0 {
+		if node != nil {
+			return nil, fmt.Errorf("key %q conflicts with another key", key)
+		}
+		return value, nil
+	}
+
+	s := path[0]
+	if s.array {
+		list, ok := node.([]interface{})
+		if node != nil && !ok {
+			return nil, fmt.Errorf("key %q conflicts with another key", key)
+		}
+		for len(list) <= s.index {
+			list = append(list, nil)
+		}
+
+		child, err := setPath(list[s.index], path[1:], value, key)
+		if err != nil {
+			return nil, err
+		}
+		list[s.index] = child
+		return list, nil
+	}
+
+	m, ok := node.(map[string]interface{})
+	if node == nil {
+		m = map[string]interface{}{}
+	} else if !ok {
+		return nil, fmt.Errorf("key %q conflicts with another key", key)
+	}
+
+	child, err := setPath(m[s.key], path[1:], value, key)
+	if err != nil {
+		return nil, err
+	}
+	m[s.key] = child
+	return m, nil
+}
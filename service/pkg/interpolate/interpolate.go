@@ -0,0 +1,273 @@
+// Package interpolate resolves references in configuration payloads. A
+// string value can reference a value of another config with
+// ${config:name#/pointer}, a whole config with ${config:name}, or an
+// environment variable with ${env:NAME}. A string that's a single reference
+// takes the referenced value as is, so numbers and objects keep their type.
+// References inside a longer string must be scalars. $${ is a literal ${.
+package interpolate
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/aeekayy/stilla/service/pkg/pointer"
+	"github.com/aeekayy/stilla/service/pkg/utils"
+)
+
+const (
+	// KindConfig a reference to another config
+	KindConfig = "config"
+	// KindEnv a reference to an environment variable
+	KindEnv = "env"
+)
+
+// ErrInvalidReference returned for a reference that can't be parsed, or a
+// value that can't be part of a string
+var ErrInvalidReference = errors.New("invalid reference")
+
+// ErrCycle returned when a config references itself, directly or through
+// other configs
+var ErrCycle = errors.New("reference cycle")
+
+// ErrMaxDepth returned when references are nested deeper than allowed
+var ErrMaxDepth = errors.New("references are nested too deeply")
+
+// validEnvName matches environment variable names
+var validEnvName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Resolver reads the targets of references
+type Resolver interface {
+	// Config returns the payload of a config by name
+	Config(name string) (interface{}, error)
+	// Env returns the value of an environment variable
+	Env(name string) (string, error)
+}
+
+// Reference a reference in a payload
+type Reference struct {
+	Kind    string
+	Name    string
+	Pointer string
+}
+
+// String returns the reference as it's written in a payload
+func (r Reference) String() string {
+	if r.Pointer != "" {
+		return fmt.Sprintf("${%s:%s#%s}", r.Kind, r.Name, r.Pointer)
+	}
+
+	return fmt.Sprintf("${%s:%s}", r.Kind, r.Name)
+}
+
+// ParseReference parses the inside of ${...}, such as config:name#/pointer
+func ParseReference(s string) (Reference, error) {
+	kind, target, ok := strings.Cut(s, ":")
+	if !ok {
+		return Reference{}, fmt.Errorf("%w: ${%s} has no kind", ErrInvalidReference, s)
+	}
+
+	switch kind {
+	case KindConfig:
+		name, ptr, _ := strings.Cut(target, "#")
+		if name == "" {
+			return Reference{}, fmt.Errorf("%w: ${%s} has no config name", ErrInvalidReference, s)
+		}
+		if _, err := pointer.Parse(ptr); err != nil {
+			return Reference{}, fmt.Errorf("%w: ${%s}: %s", ErrInvalidReference, s, err)
+		}
+		return Reference{Kind: kind, Name: name, Pointer: ptr}, nil
+	case KindEnv:
+		if !validEnvName.MatchString(target) {
+			return Reference{}, fmt.Errorf("%w: ${%s} isn't a valid variable name", ErrInvalidReference, s)
+		}
+		return Reference{Kind: kind, Name: target}, nil
+	}
+
+	return Reference{}, fmt.Errorf("%w: ${%s} must be a config or env reference", ErrInvalidReference, s)
+}
+
+// Resolve returns a payload with its references resolved. name is the
+// config the payload belongs to. Referenced values are resolved too, up to
+// maxDepth configs deep. The payload is returned in its JSON form
+func Resolve(name string, payload interface{}, r Resolver, maxDepth int) (interface{}, error) {
+	value, err := utils.NormalizeJSON(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &resolution{resolver: r, maxDepth: maxDepth}
+	return res.value(value, []string{name})
+}
+
+// resolution resolves the references of a payload
+type resolution struct {
+	resolver Resolver
+	maxDepth int
+}
+
+// value resolves the references in a value. chain is the configs being
+// resolved, starting with the one the payload belongs to
+func (res *resolution) value(v interface{}, chain []string) (interface{}, error) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(t))
+		for k, child := range t {
+			resolved, err := res.value(child, chain)
+			if err != nil {
+				return nil, err
+			}
+			out[k] = resolved
+		}
+		return out, nil
+	case []interface{}:
+		out := make([]interface{}, len(t))
+		for i, child := range t {
+			resolved, err := res.value(child, chain)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = resolved
+		}
+		return out, nil
+	case string:
+		return res.str(t, chain)
+	}
+
+	return v, nil
+}
+
+// str resolves the references in a string
+func (res *resolution) str(s string, chain []string) (interface{}, error) {
+	if !strings.Contains(s, "${") {
+		return s, nil
+	}
+
+	parts, err := split(s)
+	if err != nil {
+		return nil, err
+	}
+
+	// a single reference keeps the type of its value
+	if len(parts) == 1 && parts[0].ref != nil {
+		return res.reference(*parts[0].ref, chain)
+	}
+
+	var b strings.Builder
+	for _, part := range parts {
+		if part.ref == nil {
+			b.WriteString(part.text)
+			continue
+		}
+
+		value, err := res.reference(*part.ref, chain)
+		if err != nil {
+			return nil, err
+		}
+
+		text, err := scalarText(value)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s %s", ErrInvalidReference, part.ref, err)
+		}
+		b.WriteString(text)
+	}
+
+	return b.String(), nil
+}
+
+// reference returns the resolved value of a reference
+func (res *resolution) reference(ref Reference, chain []string) (interface{}, error) {
+	if ref.Kind == KindEnv {
+		value, err := res.resolver.Env(ref.Name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", ref, err)
+		}
+		return value, nil
+	}
+
+	for _, name := range chain {
+		if name == ref.Name {
+			return nil, fmt.Errorf("%w: %s -> %s", ErrCycle, strings.Join(chain, " -> "), ref.Name)
+		}
+	}
+
+	if len(chain) > res.maxDepth {
+		return nil, fmt.Errorf("%w: %s is more than %d configs deep", ErrMaxDepth, ref, res.maxDepth)
+	}
+
+	payload, err := res.resolver.Config(ref.Name)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", ref, err)
+	}
+
+	value, err := pointer.Get(payload, ref.Pointer)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", ref, err)
+	}
+
+	// the chain is copied so sibling references don't share it
+	next := make([]string, len(chain), len(chain)+1)
+	copy(next, chain)
+	return res.value(value, append(next, ref.Name))
+}
+
+// part a literal or a reference in a string
+type part struct {
+	text string
+	ref  *Reference
+}
+
+// split splits a string into literals and references
+func split(s string) ([]part, error) {
+	var parts []part
+	var text strings.Builder
+
+	for i := 0; i < len(s); {
+		switch {
+		case strings.HasPrefix(s[i:], "$${"):
+			text.WriteString("${")
+			i += 3
+		case strings.HasPrefix(s[i:], "${"):
+			end := strings.IndexByte(s[i+2:], '}')
+			if end < 0 {
+				return nil, fmt.Errorf("%w: %q has an unterminated reference", ErrInvalidReference, s)
+			}
+
+			ref, err := ParseReference(s[i+2 : i+2+end])
+			if err != nil {
+				return nil, err
+			}
+
+			if text.Len() > 0 {
+				parts = append(parts, part{text: text.String()})
+				text.Reset()
+			}
+			parts = append(parts, part{ref: &ref})
+			i += end + 3
+		default:
+			text.WriteByte(s[i])
+			i++
+		}
+	}
+
+	if text.Len() > 0 {
+		parts = append(parts, part{text: text.String()})
+	}
+
+	return parts, nil
+}
+
+// scalarText returns the text of a value that's part of a string
+func scalarText(value interface{}) (string, error) {
+	switch t := value.(type) {
+	case string:
+		return t, nil
+	case bool, int64, float64:
+		b, err := json.Marshal(t)
+		return string(b), err
+	}
+
+	return "", errors.New("isn't a string, number or boolean")
+}
@@ -0,0 +1,152 @@
+package interpolate
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/aeekayy/stilla/service/pkg/pointer"
+)
+
+// errMissing returned by mapResolver for targets it doesn't have
+var errMissing = errors.New("missing")
+
+// mapResolver resolves references from maps and records the configs it
+// reads
+type mapResolver struct {
+	configs map[string]interface{}
+	env     map[string]string
+	read    []string
+}
+
+func (r *mapResolver) Config(name string) (interface{}, error) {
+	r.read = append(r.read, name)
+	payload, ok := r.configs[name]
+	if !ok {
+		return nil, errMissing
+	}
+	return payload, nil
+}
+
+func (r *mapResolver) Env(name string) (string, error) {
+	value, ok := r.env[name]
+	if !ok {
+		return "", errMissing
+	}
+	return value, nil
+}
+
+// TestParseReference validates the parsing of references
+func TestParseReference(t *testing.T) {
+	table := []struct {
+		in  string
+		ref Reference
+		err bool
+	}{
+		{"config:shared-db#/host", Reference{Kind: KindConfig, Name: "shared-db", Pointer: "/host"}, false},
+		{"config:shared-db", Reference{Kind: KindConfig, Name: "shared-db"}, false},
+		{"env:REGION", Reference{Kind: KindEnv, Name: "REGION"}, false},
+		{"config:#/host", Reference{}, true},
+		{"config:db#host", Reference{}, true},
+		{"env:NOT-VALID", Reference{}, true},
+		{"secret:x", Reference{}, true},
+		{"REGION", Reference{}, true},
+	}
+
+	for _, tc := range table {
+		ref, err := ParseReference(tc.in)
+		if tc.err {
+			assert.True(t, errors.Is(err, ErrInvalidReference), tc.in)
+			continue
+		}
+		assert.Nil(t, err, tc.in)
+		assert.Equal(t, tc.ref, ref, tc.in)
+		assert.Equal(t, "${"+tc.in+"}", ref.String())
+	}
+}
+
+// TestResolve validates the resolution of references
+func TestResolve(t *testing.T) {
+	resolver := &mapResolver{
+		configs: map[string]interface{}{
+			"shared-db": bson.M{"host": "db.example.com", "port": int32(5432), "replica": "${config:replica#/host}"},
+			"replica":   bson.M{"host": "replica.example.com"},
+		},
+		env: map[string]string{"REGION": "us-east-1"},
+	}
+
+	payload := bson.M{
+		"db": bson.M{
+			"host":    "${config:shared-db#/host}",
+			"port":    "${config:shared-db#/port}",
+			"url":     "postgres://${config:shared-db#/host}:${config:shared-db#/port}/app",
+			"replica": "${config:shared-db#/replica}",
+		},
+		"region":  "${env:REGION}",
+		"all":     "${config:replica}",
+		"list":    bson.A{"${env:REGION}", int32(1)},
+		"literal": "$${env:REGION} costs $5",
+	}
+
+	resolved, err := Resolve("payments", payload, resolver, 8)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"db": map[string]interface{}{
+			"host":    "db.example.com",
+			"port":    int64(5432),
+			"url":     "postgres://db.example.com:5432/app",
+			"replica": "replica.example.com",
+		},
+		"region":  "us-east-1",
+		"all":     map[string]interface{}{"host": "replica.example.com"},
+		"list":    []interface{}{"us-east-1", int64(1)},
+		"literal": "${env:REGION} costs $5",
+	}, resolved)
+
+	// the payload isn't changed
+	assert.Equal(t, "${env:REGION}", payload["region"])
+}
+
+// TestResolveErrors validates the errors of references that can't be
+// resolved
+func TestResolveErrors(t *testing.T) {
+	resolver := &mapResolver{
+		configs: map[string]interface{}{
+			"a":    bson.M{"b": "${config:b#/a}", "value": "${config:a#/x}"},
+			"b":    bson.M{"a": "${config:a#/b}"},
+			"obj":  bson.M{"nested": bson.M{"x": 1}},
+			"deep": bson.M{"next": "${config:deep2#/next}"},
+		},
+	}
+	for i := 2; i <= 10; i++ {
+		resolver.configs[fmt.Sprintf("deep%d", i)] = bson.M{"next": fmt.Sprintf("${config:deep%d#/next}", i+1)}
+	}
+	resolver.configs["deep11"] = bson.M{"next": "end"}
+
+	table := []struct {
+		name    string
+		payload interface{}
+		err     error
+	}{
+		{"cycle", bson.M{"v": "${config:a#/b}"}, ErrCycle},
+		{"self", bson.M{"v": "${config:root#/x}"}, ErrCycle},
+		{"too deep", bson.M{"v": "${config:deep#/next}"}, ErrMaxDepth},
+		{"missing config", bson.M{"v": "${config:none#/x}"}, errMissing},
+		{"missing env", bson.M{"v": "${env:NONE}"}, errMissing},
+		{"missing path", bson.M{"v": "${config:obj#/none}"}, pointer.ErrNotFound},
+		{"object in a string", bson.M{"v": "x=${config:obj#/nested}"}, ErrInvalidReference},
+		{"unterminated", bson.M{"v": "${env:REGION"}, ErrInvalidReference},
+	}
+
+	for _, tc := range table {
+		_, err := Resolve("root", tc.payload, resolver, 8)
+		assert.True(t, errors.Is(err, tc.err), "%s: %v", tc.name, err)
+	}
+
+	// references nested as deep as allowed resolve
+	_, err := Resolve("root", bson.M{"v": "${config:deep#/next}"}, resolver, 11)
+	assert.Nil(t, err)
+}
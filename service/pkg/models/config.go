@@ -4,23 +4,64 @@ package models
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/confluentinc/confluent-kafka-go/kafka"
 	"github.com/spf13/viper"
 )
 
+const (
+	defaultCacheTTL       = time.Hour
+	defaultLocalCacheTTL  = 5 * time.Second
+	defaultLocalCacheSize = 1024
+
+	defaultRedisMaxIdle     = 5
+	defaultRedisIdleTimeout = 240 * time.Second
+	defaultRedisDialTimeout = 5 * time.Second
+
+	defaultStaleTTL         = 24 * time.Hour
+	defaultBreakerThreshold = 5
+	defaultBreakerTimeout   = 30 * time.Second
+
+	defaultGRPCPort          = 9090
+	defaultGRPCWatchInterval = 5 * time.Second
+
+	defaultIdempotencyTTL = 24 * time.Hour
+
+	defaultInterpolationMaxDepth = 8
+
+	defaultSchedulerInterval = 30 * time.Second
+)
+
+// Redis deployment modes
+const (
+	RedisModeStandalone = "standalone"
+	RedisModeSentinel   = "sentinel"
+	RedisModeCluster    = "cluster"
+)
+
 // Config main configuration struct for the service
 type Config struct {
-	Kafka       map[string]interface{} `yaml:"kafka" json:"kafka" mapstructure:"kafka"`
-	Database    Database               `yaml:"database" json:"database" mapstructure:"database"`
-	Cache       Cache                  `yaml:"cache" json:"cache" mapstructure:"cache"`
-	Server      Server                 `yaml:"server" json:"server" mapstructure:"server"`
-	Sentry      SentryConfig           `yaml:"sentry" json:"sentry" mapstructure:"sentry"`
-	Environment string                 `yaml:"enviornment" json:"environment" mapstructure:"environment"`
-	SessionKey  string                 `yaml:"session_key" json:"session_key" mapstructure:"session_key"`
-	DocDB       DocumentDatabase       `yaml:"docdb" json:"docdb" mapstructure:"docdb"`
-	NewRelic    NewRelicConfig         `yaml:"new_relic" json:"new_relic" mapstructure:"new_relic"`
-	Audit       bool                   `yaml:"audit" json:"audit" mapstructure:"audit"`
+	Kafka         map[string]interface{} `yaml:"kafka" json:"kafka" mapstructure:"kafka"`
+	Database      Database               `yaml:"database" json:"database" mapstructure:"database"`
+	Cache         Cache                  `yaml:"cache" json:"cache" mapstructure:"cache"`
+	Server        Server                 `yaml:"server" json:"server" mapstructure:"server"`
+	GRPC          GRPC                   `yaml:"grpc" json:"grpc" mapstructure:"grpc"`
+	OpenAPI       OpenAPI                `yaml:"openapi" json:"openapi" mapstructure:"openapi"`
+	Idempotency   Idempotency            `yaml:"idempotency" json:"idempotency" mapstructure:"idempotency"`
+	Interpolation Interpolation          `yaml:"interpolation" json:"interpolation" mapstructure:"interpolation"`
+	Scheduler     Scheduler              `yaml:"scheduler" json:"scheduler" mapstructure:"scheduler"`
+	Sentry        SentryConfig           `yaml:"sentry" json:"sentry" mapstructure:"sentry"`
+	Environment   string                 `yaml:"enviornment" json:"environment" mapstructure:"environment"`
+	SessionKey    string                 `yaml:"session_key" json:"session_key" mapstructure:"session_key"`
+	DocDB         DocumentDatabase       `yaml:"docdb" json:"docdb" mapstructure:"docdb"`
+	NewRelic      NewRelicConfig         `yaml:"new_relic" json:"new_relic" mapstructure:"new_relic"`
+	Audit         bool                   `yaml:"audit" json:"audit" mapstructure:"audit"`
+	Redaction     Redaction              `yaml:"redaction" json:"redaction" mapstructure:"redaction"`
+	Retention     AuditRetention         `yaml:"audit_retention" json:"audit_retention" mapstructure:"audit_retention"`
+	Breaker       CircuitBreaker         `yaml:"circuit_breaker" json:"circuit_breaker" mapstructure:"circuit_breaker"`
+	AdminHosts    []string               `yaml:"admin_hosts" json:"admin_hosts" mapstructure:"admin_hosts"`
+	ApproverHosts []string               `yaml:"approver_hosts" json:"approver_hosts" mapstructure:"approver_hosts"`
 }
 
 // NewConfig returns an empty configuration
@@ -82,10 +123,242 @@ func flattenKafkaConfigMap(prefix string, src map[string]interface{}, cm *kafka.
 
 // Cache struct to hold Redis configuration
 type Cache struct {
-	Host     string `yaml:"host" json:"host" mapstructure:"host"`
-	Username string `yaml:"username" json:"username" mapstructure:"username"`
-	Password string `yaml:"password" json:"password" mapstructure:"password"`
-	Type     string `yaml:"type" json:"type" mapstructure:"type"`
+	Enabled  *bool      `yaml:"enabled" json:"enabled" mapstructure:"enabled"`
+	Host     string     `yaml:"host" json:"host" mapstructure:"host"`
+	Username string     `yaml:"username" json:"username" mapstructure:"username"`
+	Password string     `yaml:"password" json:"password" mapstructure:"password"`
+	Type     string     `yaml:"type" json:"type" mapstructure:"type"`
+	TTL      string     `yaml:"ttl" json:"ttl" mapstructure:"ttl"`
+	Local    LocalCache `yaml:"local" json:"local" mapstructure:"local"`
+	Stale    StaleCache `yaml:"stale" json:"stale" mapstructure:"stale"`
+
+	// Redis client settings shared by the config cache and the session store
+	Mode     string        `yaml:"mode" json:"mode" mapstructure:"mode"`
+	DB       int           `yaml:"db" json:"db" mapstructure:"db"`
+	Pool     RedisPool     `yaml:"pool" json:"pool" mapstructure:"pool"`
+	TLS      RedisTLS      `yaml:"tls" json:"tls" mapstructure:"tls"`
+	Sentinel RedisSentinel `yaml:"sentinel" json:"sentinel" mapstructure:"sentinel"`
+	Cluster  RedisCluster  `yaml:"cluster" json:"cluster" mapstructure:"cluster"`
+}
+
+// StaleCache struct to hold the stale copy configuration. The last known
+// good copy of a config is served when the document store is unavailable
+type StaleCache struct {
+	Enabled *bool  `yaml:"enabled" json:"enabled" mapstructure:"enabled"`
+	TTL     string `yaml:"ttl" json:"ttl" mapstructure:"ttl"`
+}
+
+// IsEnabled returns whether stale copies are kept. They are kept unless
+// turned off in the configuration
+func (s StaleCache) IsEnabled() bool {
+	return s.Enabled == nil || *s.Enabled
+}
+
+// GetTTL returns how long stale copies are kept
+func (s StaleCache) GetTTL() (time.Duration, error) {
+	return parseDurationOrDefault(s.TTL, defaultStaleTTL)
+}
+
+// CircuitBreaker struct to hold the circuit breaker configuration for the
+// document store and Redis
+type CircuitBreaker struct {
+	Threshold int    `yaml:"threshold" json:"threshold" mapstructure:"threshold"`
+	Timeout   string `yaml:"timeout" json:"timeout" mapstructure:"timeout"`
+}
+
+// GetThreshold returns the number of consecutive failures that open a breaker
+func (c CircuitBreaker) GetThreshold() int {
+	if c.Threshold <= 0 {
+		return defaultBreakerThreshold
+	}
+
+	return c.Threshold
+}
+
+// GetTimeout returns how long a breaker stays open before a probe
+func (c CircuitBreaker) GetTimeout() (time.Duration, error) {
+	return parseDurationOrDefault(c.Timeout, defaultBreakerTimeout)
+}
+
+// RedisPool struct to hold the Redis connection pool sizing
+type RedisPool struct {
+	MaxIdle         int    `yaml:"max_idle" json:"max_idle" mapstructure:"max_idle"`
+	MaxActive       int    `yaml:"max_active" json:"max_active" mapstructure:"max_active"`
+	IdleTimeout     string `yaml:"idle_timeout" json:"idle_timeout" mapstructure:"idle_timeout"`
+	MaxConnLifetime string `yaml:"max_conn_lifetime" json:"max_conn_lifetime" mapstructure:"max_conn_lifetime"`
+	DialTimeout     string `yaml:"dial_timeout" json:"dial_timeout" mapstructure:"dial_timeout"`
+	Wait            bool   `yaml:"wait" json:"wait" mapstructure:"wait"`
+}
+
+// RedisTLS struct to hold the TLS settings for Redis connections
+type RedisTLS struct {
+	Enabled            bool   `yaml:"enabled" json:"enabled" mapstructure:"enabled"`
+	CAFile             string `yaml:"ca_file" json:"ca_file" mapstructure:"ca_file"`
+	CertFile           string `yaml:"cert_file" json:"cert_file" mapstructure:"cert_file"`
+	KeyFile            string `yaml:"key_file" json:"key_file" mapstructure:"key_file"`
+	ServerName         string `yaml:"server_name" json:"server_name" mapstructure:"server_name"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify" json:"insecure_skip_verify" mapstructure:"insecure_skip_verify"`
+}
+
+// RedisSentinel struct to hold the Sentinel settings. The master is looked
+// up by name through the sentinels
+type RedisSentinel struct {
+	MasterName string   `yaml:"master_name" json:"master_name" mapstructure:"master_name"`
+	Addresses  []string `yaml:"addresses" json:"addresses" mapstructure:"addresses"`
+	Password   string   `yaml:"password" json:"password" mapstructure:"password"`
+}
+
+// RedisCluster struct to hold the Redis Cluster settings. The addresses
+// are the startup nodes used to discover the cluster
+type RedisCluster struct {
+	Addresses []string `yaml:"addresses" json:"addresses" mapstructure:"addresses"`
+}
+
+// LocalCache struct to hold the in-process cache configuration. The
+// local cache sits in front of Redis. A negative size disables it
+type LocalCache struct {
+	TTL  string `yaml:"ttl" json:"ttl" mapstructure:"ttl"`
+	Size int    `yaml:"size" json:"size" mapstructure:"size"`
+}
+
+// IsEnabled returns whether the cache is enabled. The cache is enabled
+// unless it is turned off in the configuration
+func (c Cache) IsEnabled() bool {
+	return c.Enabled == nil || *c.Enabled
+}
+
+// GetTTL returns how long configs are kept in Redis
+func (c Cache) GetTTL() (time.Duration, error) {
+	return parseDurationOrDefault(c.TTL, defaultCacheTTL)
+}
+
+// GetMode returns the Redis deployment mode. Without an explicit mode,
+// a sentinel master name selects Sentinel and cluster addresses select Cluster
+func (c Cache) GetMode() (string, error) {
+	switch c.Mode {
+	case RedisModeStandalone, RedisModeSentinel, RedisModeCluster:
+		return c.Mode, nil
+	case "":
+		if c.Sentinel.MasterName != "" {
+			return RedisModeSentinel, nil
+		}
+		if len(c.Cluster.Addresses) > 0 {
+			return RedisModeCluster, nil
+		}
+		return RedisModeStandalone, nil
+	}
+
+	return "", fmt.Errorf("invalid cache mode %s", c.Mode)
+}
+
+// GetIdleTimeout returns how long idle connections stay in the pool
+func (p RedisPool) GetIdleTimeout() (time.Duration, error) {
+	return parseDurationOrDefault(p.IdleTimeout, defaultRedisIdleTimeout)
+}
+
+// GetMaxConnLifetime returns how long a connection is used before it's
+// closed. Zero keeps connections open
+func (p RedisPool) GetMaxConnLifetime() (time.Duration, error) {
+	return parseDurationOrDefault(p.MaxConnLifetime, 0)
+}
+
+// GetDialTimeout returns the timeout for new connections
+func (p RedisPool) GetDialTimeout() (time.Duration, error) {
+	return parseDurationOrDefault(p.DialTimeout, defaultRedisDialTimeout)
+}
+
+// GetMaxIdle returns the maximum number of idle connections in the pool
+func (p RedisPool) GetMaxIdle() int {
+	if p.MaxIdle <= 0 {
+		return defaultRedisMaxIdle
+	}
+
+	return p.MaxIdle
+}
+
+// GetTTL returns how long configs are kept in the local cache
+func (l LocalCache) GetTTL() (time.Duration, error) {
+	return parseDurationOrDefault(l.TTL, defaultLocalCacheTTL)
+}
+
+// GetSize returns the number of configs kept in the local cache.
+// Zero means the local cache is disabled
+func (l LocalCache) GetSize() int {
+	switch {
+	case l.Size < 0:
+		return 0
+	case l.Size == 0:
+		return defaultLocalCacheSize
+	}
+
+	return l.Size
+}
+
+// parseDurationOrDefault parses a duration. Empty strings return the default
+func parseDurationOrDefault(s string, d time.Duration) (time.Duration, error) {
+	if s == "" {
+		return d, nil
+	}
+
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return d, fmt.Errorf("invalid duration %s: %s", s, err)
+	}
+
+	return parsed, nil
+}
+
+// parseIntervalOrDefault parses the period of a ticker. Tickers need a
+// positive period, so the default is returned for zero and negative ones
+func parseIntervalOrDefault(s string, d time.Duration) (time.Duration, error) {
+	parsed, err := parseDurationOrDefault(s, d)
+	if err != nil {
+		return d, err
+	}
+
+	if parsed <= 0 {
+		return d, fmt.Errorf("the interval %s must be positive", s)
+	}
+
+	return parsed, nil
+}
+
+// Redaction struct to hold the redaction policy applied to audit
+// events and log output
+type Redaction struct {
+	Mask            string          `yaml:"mask" json:"mask" mapstructure:"mask"`
+	Headers         []RedactionRule `yaml:"headers" json:"headers" mapstructure:"headers"`
+	Paths           []RedactionRule `yaml:"paths" json:"paths" mapstructure:"paths"`
+	Keys            []RedactionRule `yaml:"keys" json:"keys" mapstructure:"keys"`
+	Values          []RedactionRule `yaml:"values" json:"values" mapstructure:"values"`
+	DisableDefaults bool            `yaml:"disable_defaults" json:"disable_defaults" mapstructure:"disable_defaults"`
+}
+
+// RedactionRule a pattern and the action to take when it matches.
+// Action is either "mask" or "drop"
+type RedactionRule struct {
+	Pattern string `yaml:"pattern" json:"pattern" mapstructure:"pattern"`
+	Action  string `yaml:"action" json:"action" mapstructure:"action"`
+}
+
+// AuditRetention struct to hold the audit retention and archival
+// configuration
+type AuditRetention struct {
+	Interval    string            `yaml:"interval" json:"interval" mapstructure:"interval"`
+	ArchiveDir  string            `yaml:"archive_dir" json:"archive_dir" mapstructure:"archive_dir"`
+	Policies    []RetentionPolicy `yaml:"policies" json:"policies" mapstructure:"policies"`
+	BatchSize   int               `yaml:"batch_size" json:"batch_size" mapstructure:"batch_size"`
+	Enabled     bool              `yaml:"enabled" json:"enabled" mapstructure:"enabled"`
+	Partitioned bool              `yaml:"partitioned" json:"partitioned" mapstructure:"partitioned"`
+}
+
+// RetentionPolicy how long to keep audit records. Keep accepts Go
+// durations as well as days (400d) and years (2y). A policy without
+// function names applies to every record not covered by another policy
+type RetentionPolicy struct {
+	Name      string   `yaml:"name" json:"name" mapstructure:"name"`
+	Keep      string   `yaml:"keep" json:"keep" mapstructure:"keep"`
+	FuncNames []string `yaml:"funcnames" json:"funcnames" mapstructure:"funcnames"`
 }
 
 // Database Cache struct to hold Postgres configuration
@@ -113,6 +386,99 @@ type Server struct {
 	Port    int    `yaml:"port" json:"port" mapstructure:"port"`
 }
 
+// GRPC struct to hold the gRPC server configuration. The server runs in the
+// same process as the web server when it's enabled
+type GRPC struct {
+	Enabled bool `yaml:"enabled" json:"enabled" mapstructure:"enabled"`
+	Port    int  `yaml:"port" json:"port" mapstructure:"port"`
+	// WatchInterval how often Watch streams check for changes made by other
+	// instances. Changes made by this instance are sent right away
+	WatchInterval string `yaml:"watch_interval" json:"watch_interval" mapstructure:"watch_interval"`
+}
+
+// GetPort returns the port of the gRPC server
+func (g GRPC) GetPort() int {
+	if g.Port <= 0 {
+		return defaultGRPCPort
+	}
+
+	return g.Port
+}
+
+// GetWatchInterval returns how often Watch streams check for changes. The
+// default is returned for intervals that aren't positive
+func (g GRPC) GetWatchInterval() (time.Duration, error) {
+	return parseIntervalOrDefault(g.WatchInterval, defaultGRPCWatchInterval)
+}
+
+// OpenAPI struct to hold the validation of requests against the OpenAPI spec.
+// Requests are validated unless it's disabled
+type OpenAPI struct {
+	DisableValidation bool `yaml:"disable_validation" json:"disable_validation" mapstructure:"disable_validation"`
+}
+
+// Idempotency struct to hold the settings of idempotency keys
+type Idempotency struct {
+	// TTL how long the response to a request with an idempotency key is
+	// kept for retries
+	TTL string `yaml:"ttl" json:"ttl" mapstructure:"ttl"`
+}
+
+// GetTTL returns how long the responses of idempotent requests are kept
+func (i Idempotency) GetTTL() (time.Duration, error) {
+	return parseDurationOrDefault(i.TTL, defaultIdempotencyTTL)
+}
+
+// Interpolation struct to hold the settings of references in config
+// payloads
+type Interpolation struct {
+	// MaxDepth how many configs deep references are resolved
+	MaxDepth int `yaml:"max_depth" json:"max_depth" mapstructure:"max_depth"`
+	// Env the environment variables that ${env:NAME} references can read.
+	// Other variables aren't exposed
+	Env []string `yaml:"env" json:"env" mapstructure:"env"`
+}
+
+// GetMaxDepth returns how many configs deep references are resolved
+func (i Interpolation) GetMaxDepth() int {
+	if i.MaxDepth <= 0 {
+		return defaultInterpolationMaxDepth
+	}
+
+	return i.MaxDepth
+}
+
+// AllowsEnv returns whether references can read an environment variable
+func (i Interpolation) AllowsEnv(name string) bool {
+	for _, allowed := range i.Env {
+		if allowed == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Scheduler struct to hold the settings of the scheduler that applies
+// scheduled config changes and reverts expired overrides
+type Scheduler struct {
+	Enabled *bool `yaml:"enabled" json:"enabled" mapstructure:"enabled"`
+	// Interval how often the scheduler looks for work that's due
+	Interval string `yaml:"interval" json:"interval" mapstructure:"interval"`
+}
+
+// IsEnabled returns whether the scheduler runs. It runs unless it's turned
+// off
+func (s Scheduler) IsEnabled() bool {
+	return s.Enabled == nil || *s.Enabled
+}
+
+// GetInterval returns how often the scheduler looks for changes that are
+// due. The default is returned for intervals that aren't positive
+func (s Scheduler) GetInterval() (time.Duration, error) {
+	return parseIntervalOrDefault(s.Interval, defaultSchedulerInterval)
+}
+
 // GetConfig retrieves the Viper configuration for the service
 func GetConfig(in string) (*Config, error) {
 	// retrieve the configuration using viper
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/confluentinc/confluent-kafka-go/kafka"
 	"github.com/stretchr/testify/assert"
@@ -178,3 +179,92 @@ func TestPassGetConfig(t *testing.T) {
 
 	assert.Equal(t, checkConfig, config, "the configurations should match.")
 }
+
+// TestSuiteCacheMode validates the Redis deployment mode
+func TestSuiteCacheMode(t *testing.T) {
+	table := []struct {
+		name      string
+		cache     Cache
+		expected  string
+		expectErr bool
+	}{
+		{"TestCacheModeDefault", Cache{Host: "localhost"}, RedisModeStandalone, false},
+		{"TestCacheModeSentinel", Cache{Sentinel: RedisSentinel{MasterName: "mymaster"}}, RedisModeSentinel, false},
+		{"TestCacheModeCluster", Cache{Cluster: RedisCluster{Addresses: []string{"localhost:7000"}}}, RedisModeCluster, false},
+		{"TestCacheModeExplicit", Cache{Mode: RedisModeStandalone, Sentinel: RedisSentinel{MasterName: "mymaster"}}, RedisModeStandalone, false},
+		{"TestCacheModeInvalid", Cache{Mode: "memcached"}, "", true},
+	}
+
+	for _, tc := range table {
+		t.Run(tc.name, func(t *testing.T) {
+			mode, err := tc.cache.GetMode()
+			if tc.expectErr {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tc.expected, mode)
+		})
+	}
+}
+
+// TestGRPCDefaults validates the defaults of the gRPC server configuration
+func TestGRPCDefaults(t *testing.T) {
+	var grpc GRPC
+	assert.Equal(t, defaultGRPCPort, grpc.GetPort())
+
+	interval, err := grpc.GetWatchInterval()
+	assert.Nil(t, err)
+	assert.Equal(t, defaultGRPCWatchInterval, interval)
+
+	grpc = GRPC{Port: 9443, WatchInterval: "1s"}
+	assert.Equal(t, 9443, grpc.GetPort())
+	interval, err = grpc.GetWatchInterval()
+	assert.Nil(t, err)
+	assert.Equal(t, time.Second, interval)
+
+	_, err = GRPC{WatchInterval: "soon"}.GetWatchInterval()
+	assert.NotNil(t, err)
+
+	// a ticker can't run without a positive interval
+	for _, watchInterval := range []string{"0s", "-1s"} {
+		interval, err = GRPC{WatchInterval: watchInterval}.GetWatchInterval()
+		assert.NotNil(t, err)
+		assert.Equal(t, defaultGRPCWatchInterval, interval)
+	}
+}
+
+// TestInterpolationDefaults validates the defaults of reference resolution
+func TestInterpolationDefaults(t *testing.T) {
+	var interpolation Interpolation
+	assert.Equal(t, defaultInterpolationMaxDepth, interpolation.GetMaxDepth())
+	assert.False(t, interpolation.AllowsEnv("HOME"))
+
+	interpolation = Interpolation{MaxDepth: 3, Env: []string{"REGION"}}
+	assert.Equal(t, 3, interpolation.GetMaxDepth())
+	assert.True(t, interpolation.AllowsEnv("REGION"))
+	assert.False(t, interpolation.AllowsEnv("region"))
+}
+
+// TestSchedulerDefaults validates the scheduler settings
+func TestSchedulerDefaults(t *testing.T) {
+	var scheduler Scheduler
+	assert.True(t, scheduler.IsEnabled())
+	interval, err := scheduler.GetInterval()
+	assert.Nil(t, err)
+	assert.Equal(t, defaultSchedulerInterval, interval)
+
+	disabled := false
+	scheduler = Scheduler{Enabled: &disabled, Interval: "5s"}
+	assert.False(t, scheduler.IsEnabled())
+	interval, err = scheduler.GetInterval()
+	assert.Nil(t, err)
+	assert.Equal(t, 5*time.Second, interval)
+
+	// a ticker can't run without a positive interval
+	for _, schedulerInterval := range []string{"0s", "-1m"} {
+		interval, err = Scheduler{Interval: schedulerInterval}.GetInterval()
+		assert.NotNil(t, err)
+		assert.Equal(t, defaultSchedulerInterval, interval)
+	}
+}
@@ -0,0 +1,498 @@
+// Package patch applies JSON Merge Patch (RFC 7396) and JSON Patch
+// (RFC 6902) documents to configuration payloads. Payloads are patched in
+// their JSON form and are never modified in place.
+package patch
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/aeekayy/stilla/service/pkg/pointer"
+	"github.com/aeekayy/stilla/service/pkg/utils"
+)
+
+const (
+	// MediaTypeMergePatch the media type of a JSON Merge Patch
+	MediaTypeMergePatch = "application/merge-patch+json"
+	// MediaTypeJSONPatch the media type of a JSON Patch
+	MediaTypeJSONPatch = "application/json-patch+json"
+)
+
+// ErrInvalidPatch returned for a patch document that can't be read
+var ErrInvalidPatch = errors.New("invalid patch")
+
+// ErrTestFailed returned when a test operation doesn't match
+var ErrTestFailed = errors.New("patch test failed")
+
+// Operation a JSON Patch operation
+type Operation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// Merge applies a JSON Merge Patch. Objects in the patch are merged into
+// the payload, null removes a key and any other value replaces it
+func Merge(payload interface{}, patch []byte) (interface{}, error) {
+	doc, err := utils.NormalizeJSON(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := decode(patch)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidPatch, err)
+	}
+
+	return merge(doc, p), nil
+}
+
+// merge merges a patch into a target as RFC 7396 describes
+func merge(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = map[string]interface{}{}
+	}
+
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+			continue
+		}
+		t[k] = merge(t[k], v)
+	}
+
+	return t
+}
+
+// Inverse returns the JSON Merge Patch that undoes a merge patch of an
+// object. Keys the patch changes or removes get their values in payload
+// back, and keys it adds are removed. Other keys are left alone, so the
+// inverse can be applied after unrelated changes
+func Inverse(payload interface{}, patch []byte) (map[string]interface{}, error) {
+	doc, err := utils.NormalizeJSON(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := decode(patch)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidPatch, err)
+	}
+
+	if _, ok := p.(map[string]interface{}); !ok {
+		return nil, fmt.Errorf("%w: the patch must be an object", ErrInvalidPatch)
+	}
+
+	out, _ := inverse(doc, p).(map[string]interface{})
+	return out, nil
+}
+
+// inverse returns the merge patch that turns the merge of patch into target
+// back into target
+func inverse(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return target
+	}
+
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		// the patch replaced target with an object
+		return target
+	}
+
+	out := make(map[string]interface{}, len(p))
+	for k, v := range p {
+		old, exists := t[k]
+		switch {
+		case !exists:
+			out[k] = nil
+		case v == nil:
+			out[k] = old
+		default:
+			out[k] = inverse(old, v)
+		}
+	}
+
+	return out
+}
+
+// Revertible returns the part of the inverse of a merge patch that can be
+// applied to payload without undoing later changes, and the JSON Pointers
+// of the keys it leaves out. A key is left out when its value in payload
+// isn't the one the patch wrote, sorted by pointer
+func Revertible(payload interface{}, patch []byte, inverse interface{}) (map[string]interface{}, []string, error) {
+	doc, err := utils.NormalizeJSON(payload)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	p, err := decode(patch)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %s", ErrInvalidPatch, err)
+	}
+	if _, ok := p.(map[string]interface{}); !ok {
+		return nil, nil, fmt.Errorf("%w: the patch must be an object", ErrInvalidPatch)
+	}
+
+	inv, err := utils.NormalizeJSON(inverse)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var changed []string
+	out := revertible(doc, p, inv, nil, &changed)
+	sort.Strings(changed)
+
+	return out, changed, nil
+}
+
+// revertible returns the keys of inverse whose values in target are the
+// ones patch wrote, and adds the pointers of the others to changed
+func revertible(target, patch, inverse interface{}, path []string, changed *[]string) map[string]interface{} {
+	p, _ := patch.(map[string]interface{})
+	inv, _ := inverse.(map[string]interface{})
+	t, _ := target.(map[string]interface{})
+
+	out := make(map[string]interface{}, len(inv))
+	for k, v := range inv {
+		keyPath := append(append([]string{}, path...), k)
+		current, exists := t[k]
+		written, patched := p[k]
+
+		// an object that was merged into is checked key by key
+		if nested, ok := v.(map[string]interface{}); ok {
+			if _, ok := written.(map[string]interface{}); ok {
+				if _, ok := current.(map[string]interface{}); !ok {
+					*changed = append(*changed, pointer.Format(keyPath))
+					continue
+				}
+				if revert := revertible(current, written, nested, keyPath, changed); len(revert) > 0 {
+					out[k] = revert
+				}
+				continue
+			}
+		}
+
+		switch {
+		case !patched:
+			out[k] = v
+		case written == nil && exists:
+			// the key was removed and added again since
+			*changed = append(*changed, pointer.Format(keyPath))
+		case written != nil && (!exists || !equal(current, merge(nil, written))):
+			*changed = append(*changed, pointer.Format(keyPath))
+		default:
+			out[k] = v
+		}
+	}
+
+	return out
+}
+
+// Apply applies a JSON Patch. Operations are applied in order and the
+// payload is unchanged unless every one succeeds. A path that doesn't exist
+// returns pointer.ErrNotFound and a failed test, including a test of a path
+// that doesn't exist, returns ErrTestFailed
+func Apply(payload interface{}, patch []byte) (interface{}, error) {
+	var ops []Operation
+	if err := json.Unmarshal(patch, &ops); err != nil {
+		return nil, fmt.Errorf("%w: a JSON Patch is an array of operations: %s", ErrInvalidPatch, err)
+	}
+
+	doc, err := utils.NormalizeJSON(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, op := range ops {
+		doc, err = applyOperation(doc, op)
+		if err != nil {
+			return nil, fmt.Errorf("operation %d (%s %s): %w", i, op.Op, op.Path, err)
+		}
+	}
+
+	return doc, nil
+}
+
+// applyOperation applies one operation
+func applyOperation(doc interface{}, op Operation) (interface{}, error) {
+	path, err := pointer.Parse(op.Path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidPatch, err)
+	}
+
+	switch op.Op {
+	case "add", "replace", "test":
+		if len(op.Value) == 0 {
+			return nil, fmt.Errorf("%w: %s needs a value", ErrInvalidPatch, op.Op)
+		}
+
+		value, err := decode(op.Value)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidPatch, err)
+		}
+
+		switch op.Op {
+		case "add":
+			return add(doc, path, value)
+		case "replace":
+			return replace(doc, path, value)
+		}
+
+		// a value that isn't there doesn't match either
+		current, err := get(doc, path)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrTestFailed, err)
+		}
+		if !equal(current, value) {
+			return nil, ErrTestFailed
+		}
+		return doc, nil
+	case "remove":
+		return remove(doc, path)
+	case "move", "copy":
+		from, err := pointer.Parse(op.From)
+		if err != nil {
+			return nil, fmt.Errorf("%w: from: %s", ErrInvalidPatch, err)
+		}
+
+		value, err := get(doc, from)
+		if err != nil {
+			return nil, err
+		}
+
+		// get returns a copy, so a copied value shares nothing with the original
+		if op.Op == "copy" {
+			return add(doc, path, value)
+		}
+
+		if isPrefix(from, path) && len(from) < len(path) {
+			return nil, fmt.Errorf("%w: can't move a value into itself", ErrInvalidPatch)
+		}
+
+		doc, err = remove(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		return add(doc, path, value)
+	}
+
+	return nil, fmt.Errorf("%w: unknown op %q", ErrInvalidPatch, op.Op)
+}
+
+// add adds a value to an object or inserts it into an array. The parent
+// must exist
+func add(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	return update(doc, path, func(parent interface{}, token string) (interface{}, error) {
+		switch t := parent.(type) {
+		case map[string]interface{}:
+			t[token] = value
+			return t, nil
+		case []interface{}:
+			i, err := pointer.Index(token, len(t))
+			if err != nil || i > len(t) {
+				return nil, notFound(path)
+			}
+			t = append(t, nil)
+			copy(t[i+1:], t[i:])
+			t[i] = value
+			return t, nil
+		}
+
+		return nil, notFound(path)
+	})
+}
+
+// remove removes an existing value
+func remove(doc interface{}, path []string) (interface{}, error) {
+	if len(path) == 0 {
+		return nil, fmt.Errorf("%w: can't remove the whole document", ErrInvalidPatch)
+	}
+
+	return update(doc, path, func(parent interface{}, token string) (interface{}, error) {
+		switch t := parent.(type) {
+		case map[string]interface{}:
+			if _, ok := t[token]; !ok {
+				return nil, notFound(path)
+			}
+			delete(t, token)
+			return t, nil
+		case []interface{}:
+			i, err := pointer.Index(token, len(t))
+			if err != nil || i >= len(t) {
+				return nil, notFound(path)
+			}
+			return append(t[:i], t[i+1:]...), nil
+		}
+
+		return nil, notFound(path)
+	})
+}
+
+// replace replaces an existing value
+func replace(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	return update(doc, path, func(parent interface{}, token string) (interface{}, error) {
+		switch t := parent.(type) {
+		case map[string]interface{}:
+			if _, ok := t[token]; !ok {
+				return nil, notFound(path)
+			}
+			t[token] = value
+			return t, nil
+		case []interface{}:
+			i, err := pointer.Index(token, len(t))
+			if err != nil || i >= len(t) {
+				return nil, notFound(path)
+			}
+			t[i] = value
+			return t, nil
+		}
+
+		return nil, notFound(path)
+	})
+}
+
+// update walks to the parent of the last token, changes it with leaf and
+// returns the updated node. Arrays are written back to their parents since
+// leaf may return a new slice
+func update(node interface{}, path []string, leaf func(parent interface{}, token string) (interface{}, error)) (interface{}, error) {
+	return walk(node, path, path, leaf)
+}
+
+// walk is update for the rest of a path. Errors report the full path
+func walk(node interface{}, full, path []string, leaf func(parent interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 1 {
+		return leaf(node, path[0])
+	}
+
+	switch t := node.(type) {
+	case map[string]interface{}:
+		child, ok := t[path[0]]
+		if !ok {
+			return nil, notFound(full)
+		}
+		child, err := walk(child, full, path[1:], leaf)
+		if err != nil {
+			return nil, err
+		}
+		t[path[0]] = child
+		return t, nil
+	case []interface{}:
+		i, err := pointer.Index(path[0], len(t))
+		if err != nil || i >= len(t) {
+			return nil, notFound(full)
+		}
+		child, err := walk(t[i], full, path[1:], leaf)
+		if err != nil {
+			return nil, err
+		}
+		t[i] = child
+		return t, nil
+	}
+
+	return nil, notFound(full)
+}
+
+// get returns the value at a path
+func get(doc interface{}, path []string) (interface{}, error) {
+	return pointer.Get(doc, pointer.Format(path))
+}
+
+// notFound the error for a path that doesn't exist
+func notFound(path []string) error {
+	return fmt.Errorf("%w: %s", pointer.ErrNotFound, pointer.Format(path))
+}
+
+// isPrefix returns whether prefix is a prefix of path
+func isPrefix(prefix, path []string) bool {
+	if len(prefix) > len(path) {
+		return false
+	}
+
+	return strings.Join(prefix, "\x00") == strings.Join(path[:len(prefix)], "\x00")
+}
+
+// equal compares JSON values. Numbers are equal when their values are,
+// so 1 and 1.0 match
+func equal(a, b interface{}) bool {
+	switch x := a.(type) {
+	case int64:
+		switch y := b.(type) {
+		case int64:
+			return x == y
+		case float64:
+			return float64(x) == y
+		}
+		return false
+	case float64:
+		switch y := b.(type) {
+		case int64:
+			return x == float64(y)
+		case float64:
+			return x == y
+		}
+		return false
+	case map[string]interface{}:
+		y, ok := b.(map[string]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for k, v := range x {
+			w, ok := y[k]
+			if !ok || !equal(v, w) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		y, ok := b.([]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if !equal(x[i], y[i]) {
+				return false
+			}
+		}
+		return true
+	}
+
+	return reflect.DeepEqual(a, b)
+}
+
+// decode decodes a JSON value. Integers stay integers
+func decode(b []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+
+	var v interface{}
+	if err := decoder.Decode(&v); err != nil {
+		return nil, err
+	}
+	if decoder.More() {
+		return nil, errors.New("unexpected data after the JSON value")
+	}
+
+	return utils.JSONNumbers(v), nil
+}
@@ -0,0 +1,192 @@
+package patch
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+
+	"github.com/aeekayy/stilla/service/pkg/pointer"
+	"github.com/aeekayy/stilla/service/pkg/utils"
+)
+
+// TestMerge validates the example of RFC 7396 on a payload from the document store
+func TestMerge(t *testing.T) {
+	payload := bson.M{
+		"title":   "Goodbye!",
+		"author":  bson.M{"givenName": "John", "familyName": "Doe"},
+		"tags":    bson.A{"example", "sample"},
+		"content": "This will be unchanged",
+	}
+
+	out, err := Merge(payload, []byte(`{
+		"title": "Hello!",
+		"phoneNumber": "+01-123-456-7890",
+		"author": {"familyName": null},
+		"tags": ["example"]
+	}`))
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"title":       "Hello!",
+		"author":      map[string]interface{}{"givenName": "John"},
+		"tags":        []interface{}{"example"},
+		"content":     "This will be unchanged",
+		"phoneNumber": "+01-123-456-7890",
+	}, out)
+
+	// the payload isn't modified
+	assert.Equal(t, "Goodbye!", payload["title"])
+
+	_, err = Merge(payload, []byte(`{"a":`))
+	assert.ErrorIs(t, err, ErrInvalidPatch)
+}
+
+// TestInverse validates that the inverse of a merge patch undoes it
+func TestInverse(t *testing.T) {
+	payload := bson.M{
+		"log_level": "info",
+		"timeouts":  bson.M{"read": int32(5), "write": int32(10)},
+		"debug":     bson.M{"trace": false},
+		"retries":   int32(3),
+	}
+	mergePatch := []byte(`{"log_level": "debug", "timeouts": {"read": 30}, "sample_rate": 1, "retries": null, "debug": true}`)
+
+	revert, err := Inverse(payload, mergePatch)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"log_level":   "info",
+		"timeouts":    map[string]interface{}{"read": int64(5)},
+		"sample_rate": nil,
+		"retries":     int64(3),
+		"debug":       map[string]interface{}{"trace": false},
+	}, revert)
+
+	patched, err := Merge(payload, mergePatch)
+	assert.Nil(t, err)
+
+	// unrelated changes made in between are kept
+	patched.(map[string]interface{})["owner"] = "core"
+
+	revertPatch, _ := json.Marshal(revert)
+	restored, err := Merge(patched, revertPatch)
+	assert.Nil(t, err)
+	expected, _ := utils.NormalizeJSON(payload)
+	expected.(map[string]interface{})["owner"] = "core"
+	assert.Equal(t, expected, restored)
+
+	_, err = Inverse(payload, []byte(`["log_level"]`))
+	assert.ErrorIs(t, err, ErrInvalidPatch)
+}
+
+// TestRevertible validates that keys changed after a merge patch aren't
+// reverted
+func TestRevertible(t *testing.T) {
+	payload := bson.M{
+		"log_level": "info",
+		"timeouts":  bson.M{"read": int32(5), "write": int32(10)},
+		"retries":   int32(3),
+		"cache":     true,
+	}
+	mergePatch := []byte(`{"log_level": "debug", "timeouts": {"read": 30, "write": 60}, "sample_rate": 1, "retries": null, "cache": false}`)
+
+	revert, err := Inverse(payload, mergePatch)
+	assert.Nil(t, err)
+	patched, err := Merge(payload, mergePatch)
+	assert.Nil(t, err)
+
+	// nothing changed since the patch, so all of it is reverted
+	all, changed, err := Revertible(patched, mergePatch, revert)
+	assert.Nil(t, err)
+	assert.Empty(t, changed)
+	assert.Equal(t, revert, all)
+
+	// another host changed some of the keys the patch wrote
+	current := patched.(map[string]interface{})
+	current["log_level"] = "warn"
+	current["timeouts"].(map[string]interface{})["write"] = int64(90)
+	current["retries"] = int64(5)
+	current["sample_rate"] = int64(1)
+	delete(current, "cache")
+
+	partial, changed, err := Revertible(current, mergePatch, revert)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"/cache", "/log_level", "/retries", "/timeouts/write"}, changed)
+	assert.Equal(t, map[string]interface{}{
+		"timeouts":    map[string]interface{}{"read": int64(5)},
+		"sample_rate": nil,
+	}, partial)
+
+	_, _, err = Revertible(current, []byte(`["log_level"]`), revert)
+	assert.ErrorIs(t, err, ErrInvalidPatch)
+}
+
+// TestApply validates each JSON Patch operation
+func TestApply(t *testing.T) {
+	payload := bson.M{
+		"db":      bson.M{"host": "a", "port": int32(5432)},
+		"servers": bson.A{"x", "y"},
+	}
+
+	table := []struct {
+		name     string
+		patch    string
+		expected map[string]interface{}
+	}{
+		{"TestAdd", `[{"op": "add", "path": "/db/user", "value": "admin"}]`, map[string]interface{}{
+			"db": map[string]interface{}{"host": "a", "port": int64(5432), "user": "admin"}, "servers": []interface{}{"x", "y"}}},
+		{"TestAddArray", `[{"op": "add", "path": "/servers/1", "value": "z"}, {"op": "add", "path": "/servers/-", "value": "w"}]`, map[string]interface{}{
+			"db": map[string]interface{}{"host": "a", "port": int64(5432)}, "servers": []interface{}{"x", "z", "y", "w"}}},
+		{"TestRemove", `[{"op": "remove", "path": "/servers/0"}, {"op": "remove", "path": "/db/port"}]`, map[string]interface{}{
+			"db": map[string]interface{}{"host": "a"}, "servers": []interface{}{"y"}}},
+		{"TestReplace", `[{"op": "test", "path": "/db/port", "value": 5432.0}, {"op": "replace", "path": "/db/port", "value": 6432}]`, map[string]interface{}{
+			"db": map[string]interface{}{"host": "a", "port": int64(6432)}, "servers": []interface{}{"x", "y"}}},
+		{"TestMove", `[{"op": "move", "from": "/db/host", "path": "/host"}]`, map[string]interface{}{
+			"db": map[string]interface{}{"port": int64(5432)}, "host": "a", "servers": []interface{}{"x", "y"}}},
+		{"TestCopy", `[{"op": "copy", "from": "/db", "path": "/replica"}, {"op": "replace", "path": "/replica/host", "value": "b"}]`, map[string]interface{}{
+			"db": map[string]interface{}{"host": "a", "port": int64(5432)}, "replica": map[string]interface{}{"host": "b", "port": int64(5432)}, "servers": []interface{}{"x", "y"}}},
+	}
+
+	for _, tc := range table {
+		t.Run(tc.name, func(t *testing.T) {
+			out, err := Apply(payload, []byte(tc.patch))
+			assert.Nil(t, err)
+			assert.Equal(t, tc.expected, out)
+		})
+	}
+}
+
+// TestApplyErrors validates that failed patches are reported and leave the payload alone
+func TestApplyErrors(t *testing.T) {
+	payload := map[string]interface{}{"db": map[string]interface{}{"host": "a"}}
+
+	_, err := Apply(payload, []byte(`[{"op": "replace", "path": "/db/host", "value": "b"}, {"op": "test", "path": "/db/host", "value": "a"}]`))
+	assert.ErrorIs(t, err, ErrTestFailed)
+	assert.Equal(t, "a", payload["db"].(map[string]interface{})["host"])
+
+	for _, p := range []string{
+		`[{"op": "remove", "path": "/db/port"}]`,
+		`[{"op": "replace", "path": "/missing/x", "value": 1}]`,
+		`[{"op": "add", "path": "/db/host/x", "value": 1}]`,
+	} {
+		_, err := Apply(payload, []byte(p))
+		assert.ErrorIs(t, err, pointer.ErrNotFound, p)
+	}
+
+	// a test of a path that doesn't exist fails like a test of another value
+	_, err = Apply(payload, []byte(`[{"op": "test", "path": "/db/port", "value": 1}]`))
+	assert.ErrorIs(t, err, ErrTestFailed)
+	assert.NotErrorIs(t, err, pointer.ErrNotFound)
+
+	for _, p := range []string{
+		`{"op": "add"}`,
+		`[{"op": "add", "path": "/a"}]`,
+		`[{"op": "rename", "path": "/a"}]`,
+		`[{"op": "add", "path": "a", "value": 1}]`,
+		`[{"op": "move", "from": "/db", "path": "/db/inner"}]`,
+		`[{"op": "remove", "path": ""}]`,
+	} {
+		_, err := Apply(payload, []byte(p))
+		assert.ErrorIs(t, err, ErrInvalidPatch, p)
+	}
+}
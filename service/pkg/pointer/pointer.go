@@ -0,0 +1,112 @@
+// Package pointer resolves JSON pointers (RFC 6901) in configuration
+// payloads. Payloads are resolved in their JSON form, so values decoded from
+// the document store are normalized first.
+package pointer
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aeekayy/stilla/service/pkg/utils"
+)
+
+// ErrInvalidPointer returned for a pointer that isn't valid RFC 6901
+var ErrInvalidPointer = errors.New("invalid JSON pointer")
+
+// ErrNotFound returned when a pointer doesn't reference a value
+var ErrNotFound = errors.New("path not found")
+
+// Parse splits a pointer into unescaped reference tokens. The empty pointer
+// references the whole document and has no tokens
+func Parse(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("%w: %q must start with /", ErrInvalidPointer, pointer)
+	}
+
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		// ~ is only valid in the escapes ~0 and ~1
+		for j := 0; j < len(token); j++ {
+			if token[j] != '~' {
+				continue
+			}
+			if j+1 == len(token) || (token[j+1] != '0' && token[j+1] != '1') {
+				return nil, fmt.Errorf("%w: %q has an invalid escape", ErrInvalidPointer, pointer)
+			}
+			j++
+		}
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+
+	return tokens, nil
+}
+
+// Format joins reference tokens into a pointer
+func Format(tokens []string) string {
+	var b strings.Builder
+	for _, token := range tokens {
+		b.WriteByte('/')
+		b.WriteString(strings.ReplaceAll(strings.ReplaceAll(token, "~", "~0"), "/", "~1"))
+	}
+
+	return b.String()
+}
+
+// Get returns the value a pointer references in a payload, in its JSON form
+func Get(payload interface{}, pointer string) (interface{}, error) {
+	tokens, err := Parse(pointer)
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := utils.NormalizeJSON(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, token := range tokens {
+		switch t := value.(type) {
+		case map[string]interface{}:
+			child, ok := t[token]
+			if !ok {
+				return nil, fmt.Errorf("%w: %s", ErrNotFound, Format(tokens[:i+1]))
+			}
+			value = child
+		case []interface{}:
+			index, err := Index(token, len(t))
+			if err != nil || index >= len(t) {
+				return nil, fmt.Errorf("%w: %s", ErrNotFound, Format(tokens[:i+1]))
+			}
+			value = t[index]
+		default:
+			return nil, fmt.Errorf("%w: %s", ErrNotFound, Format(tokens[:i+1]))
+		}
+	}
+
+	return value, nil
+}
+
+// Index parses an array index token. - is the index after the last element
+// of an array of length n. Leading zeros aren't allowed
+func Index(token string, n int) (int, error) {
+	if token == "-" {
+		return n, nil
+	}
+
+	if token == "" || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("%w: %q isn't an array index", ErrInvalidPointer, token)
+	}
+
+	index, err := strconv.Atoi(token)
+	if err != nil || index < 0 {
+		return 0, fmt.Errorf("%w: %q isn't an array index", ErrInvalidPointer, token)
+	}
+
+	return index, nil
+}
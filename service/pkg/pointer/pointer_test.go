@@ -0,0 +1,70 @@
+package pointer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// payload a nested payload as it's decoded from the document store
+var payload = bson.M{
+	"database": bson.M{
+		"host": "db.example.com",
+		"port": int32(5432),
+	},
+	"servers": bson.A{"a", bson.M{"name": "b"}},
+	"a/b":     "slash",
+	"m~n":     "tilde",
+	"":        "empty",
+	"none":    nil,
+}
+
+// TestGet validates the examples of RFC 6901 and values from the document store
+func TestGet(t *testing.T) {
+	table := []struct {
+		pointer  string
+		expected interface{}
+	}{
+		{"/database/host", "db.example.com"},
+		{"/database/port", int64(5432)},
+		{"/servers/0", "a"},
+		{"/servers/1/name", "b"},
+		{"/a~1b", "slash"},
+		{"/m~0n", "tilde"},
+		{"/", "empty"},
+		{"/none", nil},
+		{"/database", map[string]interface{}{"host": "db.example.com", "port": int64(5432)}},
+	}
+
+	for _, tc := range table {
+		value, err := Get(payload, tc.pointer)
+		assert.Nil(t, err, tc.pointer)
+		assert.Equal(t, tc.expected, value, tc.pointer)
+	}
+
+	whole, err := Get(payload, "")
+	assert.Nil(t, err)
+	assert.Len(t, whole, len(payload))
+}
+
+// TestGetErrors validates missing paths and invalid pointers
+func TestGetErrors(t *testing.T) {
+	for _, p := range []string{"/missing", "/database/host/x", "/servers/2", "/servers/-", "/servers/01", "/servers/x"} {
+		_, err := Get(payload, p)
+		assert.ErrorIs(t, err, ErrNotFound, p)
+	}
+
+	for _, p := range []string{"database", "/a~2b", "/a~"} {
+		_, err := Get(payload, p)
+		assert.ErrorIs(t, err, ErrInvalidPointer, p)
+	}
+}
+
+// TestFormat validates that Format reverses Parse
+func TestFormat(t *testing.T) {
+	tokens, err := Parse("/a~1b/m~0n/~01")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a/b", "m~n", "~1"}, tokens)
+	assert.Equal(t, "/a~1b/m~0n/~01", Format(tokens))
+}
@@ -0,0 +1,349 @@
+// Package redact central redaction engine for audit events and logs.
+// A Redactor is built from the redaction policy in stilla.yaml and drops or
+// masks headers, JSON paths, keys and free-text values that match it.
+package redact
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/aeekayy/stilla/service/pkg/models"
+)
+
+const (
+	// ActionMask replaces a matching value with the mask
+	ActionMask = "mask"
+	// ActionDrop removes a matching value entirely
+	ActionDrop = "drop"
+
+	defaultMask = "****"
+)
+
+var (
+	defaultHeaders = []models.RedactionRule{
+		{Pattern: `(?i)^(authorization|proxy-authorization|cookie|set-cookie|x-api-key|session)$`, Action: ActionDrop},
+	}
+	defaultKeys = []models.RedactionRule{
+		{Pattern: `(?i)^(api_?key|password|passwd|secret|token|access_token|refresh_token|private_key|session_key)$`, Action: ActionMask},
+	}
+	defaultValues = []models.RedactionRule{
+		{Pattern: `(?i)bearer\s+[a-z0-9\-._~+/]+=*`, Action: ActionMask},
+	}
+)
+
+// rule a compiled redaction rule
+type rule struct {
+	pattern *regexp.Regexp
+	path    []string
+	action  string
+}
+
+// Redactor applies a redaction policy to values before they leave the service
+type Redactor struct {
+	mask    string
+	headers []rule
+	paths   []rule
+	keys    []rule
+	values  []rule
+}
+
+// New returns a Redactor for the redaction policy. The default rules are
+// applied first unless the policy disables them.
+func New(cfg models.Redaction) (*Redactor, error) {
+	r := &Redactor{mask: cfg.Mask}
+	if r.mask == "" {
+		r.mask = defaultMask
+	}
+
+	headers, keys, values := cfg.Headers, cfg.Keys, cfg.Values
+	if !cfg.DisableDefaults {
+		headers = append(append([]models.RedactionRule{}, defaultHeaders...), headers...)
+		keys = append(append([]models.RedactionRule{}, defaultKeys...), keys...)
+		values = append(append([]models.RedactionRule{}, defaultValues...), values...)
+	}
+
+	var err error
+	if r.headers, err = compileRules("header", headers); err != nil {
+		return nil, err
+	}
+	if r.keys, err = compileRules("key", keys); err != nil {
+		return nil, err
+	}
+	if r.values, err = compileRules("value", values); err != nil {
+		return nil, err
+	}
+
+	for _, p := range cfg.Paths {
+		action, err := parseAction(p.Action)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path rule %s: %s", p.Pattern, err)
+		}
+		if p.Pattern == "" {
+			return nil, fmt.Errorf("invalid path rule: empty pattern")
+		}
+		r.paths = append(r.paths, rule{path: strings.Split(p.Pattern, "."), action: action})
+	}
+
+	return r, nil
+}
+
+// Default returns a Redactor with only the default rules
+func Default() *Redactor {
+	r, _ := New(models.Redaction{})
+	return r
+}
+
+// compileRules compiles the regular expressions for a set of rules
+func compileRules(kind string, in []models.RedactionRule) ([]rule, error) {
+	var rules []rule
+	for _, v := range in {
+		action, err := parseAction(v.Action)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s rule %s: %s", kind, v.Pattern, err)
+		}
+
+		re, err := regexp.Compile(v.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s rule %s: %s", kind, v.Pattern, err)
+		}
+		rules = append(rules, rule{pattern: re, action: action})
+	}
+
+	return rules, nil
+}
+
+// parseAction validates a rule action. An empty action masks.
+func parseAction(action string) (string, error) {
+	switch strings.ToLower(action) {
+	case "", ActionMask:
+		return ActionMask, nil
+	case ActionDrop:
+		return ActionDrop, nil
+	}
+
+	return "", fmt.Errorf("unknown action %q", action)
+}
+
+// Mask returns the mask used for redacted values
+func (r *Redactor) Mask() string {
+	return r.mask
+}
+
+// Headers returns a redacted copy of the headers that is safe to
+// add to an audit event
+func (r *Redactor) Headers(h http.Header) map[string]interface{} {
+	out := make(map[string]interface{}, len(h))
+	for k, v := range h {
+		action, ok := matchRule(r.headers, k)
+		if ok && action == ActionDrop {
+			continue
+		}
+
+		if ok {
+			out[k] = r.mask
+			continue
+		}
+
+		out[k] = r.Text(strings.Join(v, ", "))
+	}
+
+	return out
+}
+
+// Field redacts an audit event field. The value is converted into its
+// JSON representation so that path and key rules can be applied to it.
+// Paths are rooted at the field name, e.g. host.apikey
+func (r *Redactor) Field(name string, v interface{}) interface{} {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return r.mask
+	}
+
+	var decoded interface{}
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		return r.mask
+	}
+
+	out, _ := r.walk([]string{name}, decoded)
+	return out
+}
+
+// Map returns a redacted copy of a map. Paths are rooted at the map
+func (r *Redactor) Map(m map[string]interface{}) map[string]interface{} {
+	if m == nil {
+		return nil
+	}
+
+	out, _ := r.walk(nil, m)
+	return out.(map[string]interface{})
+}
+
+// Value redacts a decoded JSON value found at path. The value is masked
+// when any segment of the path is a sensitive key or the path matches a
+// path rule
+func (r *Redactor) Value(path []string, v interface{}) interface{} {
+	for _, segment := range path {
+		if _, ok := matchRule(r.keys, segment); ok {
+			return r.mask
+		}
+	}
+
+	out, keep := r.walk(path, v)
+	if !keep {
+		return r.mask
+	}
+
+	return out
+}
+
+// walk redacts a decoded JSON value. The boolean is false when the
+// value should be dropped
+func (r *Redactor) walk(path []string, v interface{}) (interface{}, bool) {
+	if len(path) > 0 {
+		if action, ok := r.matchPath(path); ok {
+			return r.mask, action != ActionDrop
+		}
+	}
+
+	switch child := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(child))
+		for k, cv := range child {
+			if action, ok := matchRule(r.keys, k); ok {
+				if action == ActionMask {
+					out[k] = r.mask
+				}
+				continue
+			}
+
+			if rv, keep := r.walk(appendPath(path, k), cv); keep {
+				out[k] = rv
+			}
+		}
+		return out, true
+	case []interface{}:
+		out := make([]interface{}, 0, len(child))
+		for i, cv := range child {
+			if rv, keep := r.walk(appendPath(path, fmt.Sprintf("%d", i)), cv); keep {
+				out = append(out, rv)
+			}
+		}
+		return out, true
+	case string:
+		return r.Text(child), true
+	}
+
+	return v, true
+}
+
+// matchPath checks a path against the path rules
+func (r *Redactor) matchPath(path []string) (string, bool) {
+	for _, p := range r.paths {
+		if matchSegments(p.path, path) {
+			return p.action, true
+		}
+	}
+
+	return "", false
+}
+
+// Text masks every match of the value rules in free text
+func (r *Redactor) Text(s string) string {
+	for _, v := range r.values {
+		if v.action == ActionDrop {
+			s = v.pattern.ReplaceAllString(s, "")
+			continue
+		}
+		s = v.pattern.ReplaceAllString(s, r.mask)
+	}
+
+	return s
+}
+
+// Scrub removes user input from a log line. Each input is replaced
+// with its first three characters followed by the mask
+func (r *Redactor) Scrub(log string, input ...string) string {
+	cleanLog := log
+
+	for _, v := range input {
+		if v != "" {
+			cleanLog = strings.Replace(cleanLog, v, r.Obfuscate(v, 3), -1)
+		}
+	}
+	cleanLog = strings.Replace(cleanLog, "\n", "", -1)
+	cleanLog = strings.Replace(cleanLog, "\r", "", -1)
+
+	return r.Text(cleanLog)
+}
+
+// Sprintf formats a log line and removes the user input from it
+func (r *Redactor) Sprintf(format string, input ...string) string {
+	args := make([]interface{}, len(input))
+	for i, v := range input {
+		args[i] = v
+	}
+
+	return r.Scrub(fmt.Sprintf(format, args...), input...)
+}
+
+// Error removes user input from an error
+func (r *Redactor) Error(err error, input ...string) error {
+	return fmt.Errorf("%s", r.Scrub(err.Error(), input...))
+}
+
+// Obfuscate keeps the first char characters of the input and masks the rest.
+// Inputs of three characters or less are masked entirely
+func (r *Redactor) Obfuscate(input string, char int) string {
+	if input == "" || char < 0 || len(input) <= 3 {
+		return r.mask
+	}
+
+	if char > len(input) {
+		char = len(input)
+	}
+
+	return input[0:char] + r.mask
+}
+
+// matchRule returns the action of the first rule that matches s
+func matchRule(rules []rule, s string) (string, bool) {
+	for _, v := range rules {
+		if v.pattern.MatchString(s) {
+			return v.action, true
+		}
+	}
+
+	return "", false
+}
+
+// matchSegments matches a path against a dotted pattern. A "*" segment
+// matches exactly one segment and "**" matches any number of segments
+func matchSegments(pattern, path []string) bool {
+	if len(pattern) == 0 {
+		return len(path) == 0
+	}
+
+	switch pattern[0] {
+	case "**":
+		for i := 0; i <= len(path); i++ {
+			if matchSegments(pattern[1:], path[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(path) > 0 && matchSegments(pattern[1:], path[1:])
+	}
+
+	return len(path) > 0 && strings.EqualFold(pattern[0], path[0]) && matchSegments(pattern[1:], path[1:])
+}
+
+// appendPath returns a copy of path with the segment appended
+func appendPath(path []string, segment string) []string {
+	out := make([]string, len(path), len(path)+1)
+	copy(out, path)
+	return append(out, segment)
+}
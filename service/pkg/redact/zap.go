@@ -0,0 +1,57 @@
+package redact
+
+import (
+	"go.uber.org/zap/zapcore"
+)
+
+// core wraps a zapcore.Core and redacts entries before they are written
+type core struct {
+	zapcore.Core
+	redactor *Redactor
+}
+
+// Core wraps a zapcore.Core so that messages and fields are redacted. Use
+// it with zap.WrapCore.
+func (r *Redactor) Core(c zapcore.Core) zapcore.Core {
+	return &core{Core: c, redactor: r}
+}
+
+// With adds redacted structured context to the core
+func (c *core) With(fields []zapcore.Field) zapcore.Core {
+	return &core{Core: c.Core.With(c.redactor.fields(fields)), redactor: c.redactor}
+}
+
+// Check routes enabled entries through the redacting core
+func (c *core) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+
+	return ce
+}
+
+// Write redacts the entry message and fields before writing them
+func (c *core) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	ent.Message = c.redactor.Text(ent.Message)
+	return c.Core.Write(ent, c.redactor.fields(fields))
+}
+
+// fields applies the key and value rules to zap fields
+func (r *Redactor) fields(in []zapcore.Field) []zapcore.Field {
+	out := make([]zapcore.Field, 0, len(in))
+	for _, f := range in {
+		if action, ok := matchRule(r.keys, f.Key); ok {
+			if action == ActionMask {
+				out = append(out, zapcore.Field{Key: f.Key, Type: zapcore.StringType, String: r.mask})
+			}
+			continue
+		}
+
+		if f.Type == zapcore.StringType {
+			f.String = r.Text(f.String)
+		}
+		out = append(out, f)
+	}
+
+	return out
+}
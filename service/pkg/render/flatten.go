@@ -0,0 +1,133 @@
+package render
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf16"
+)
+
+// dotenvKey joins the path with underscores and upper cases it. Characters
+// other than letters, digits and underscores become underscores, and a key
+// that would start with a digit gets a leading underscore
+// {"db": {"host": "x"}, "servers": ["a"]} -> DB_HOST, SERVERS_0
+func dotenvKey(path []segment) string {
+	parts := make([]string, 0, len(path))
+	for _, s := range path {
+		if s.array {
+			parts = append(parts, fmt.Sprintf("%d", s.index))
+			continue
+		}
+		parts = append(parts, s.key)
+	}
+
+	key := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		}
+		return '_'
+	}, strings.Join(parts, "_"))
+
+	if key == "" || (key[0] >= '0' && key[0] <= '9') {
+		key = "_" + key
+	}
+
+	return key
+}
+
+// dotenvValue leaves plain values bare. Other strings are single quoted,
+// which dotenv parsers read literally, or double quoted with escapes when
+// they contain a single quote or a line break
+func dotenvValue(v interface{}) string {
+	s := scalar(v)
+
+	if isPlain(s) {
+		return s
+	}
+
+	if !strings.ContainsAny(s, "'\n\r") {
+		return "'" + s + "'"
+	}
+
+	return `"` + strings.NewReplacer(
+		`\`, `\\`,
+		`"`, `\"`,
+		"\n", `\n`,
+		"\r", `\r`,
+		"\t", `\t`,
+		"$", `\$`,
+	).Replace(s) + `"`
+}
+
+// isPlain returns whether a dotenv value needs no quotes
+func isPlain(s string) bool {
+	for _, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case strings.ContainsRune("_-.,/:@%+", r):
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// propertiesKey joins the path with dots. Array elements are indexed with
+// brackets, as Spring binds them
+// {"db": {"host": "x"}, "servers": ["a"]} -> db.host, servers[0]
+func propertiesKey(path []segment) string {
+	var b strings.Builder
+	for i, s := range path {
+		if s.array {
+			fmt.Fprintf(&b, "[%d]", s.index)
+			continue
+		}
+		if i > 0 {
+			b.WriteByte('.')
+		}
+		b.WriteString(escapeProperties(s.key, true))
+	}
+
+	return b.String()
+}
+
+// propertiesValue escapes a value for a properties file
+func propertiesValue(v interface{}) string {
+	return escapeProperties(scalar(v), false)
+}
+
+// escapeProperties escapes a key or value as java.util.Properties reads it.
+// The output is ASCII, so it's valid as both ISO-8859-1 and UTF-8
+func escapeProperties(s string, key bool) string {
+	var b strings.Builder
+	for i, r := range s {
+		switch {
+		case r == '\\':
+			b.WriteString(`\\`)
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\r':
+			b.WriteString(`\r`)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case r == '\f':
+			b.WriteString(`\f`)
+		case r == ' ' && (key || i == 0):
+			b.WriteString(`\ `)
+		case key && strings.ContainsRune("=:#!", r):
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < 0x20 || r > 0x7e:
+			for _, u := range utf16.Encode([]rune{r}) {
+				fmt.Fprintf(&b, `\u%04X`, u)
+			}
+		default:
+			b.WriteRune(r)
+		}
+	}
+
+	return b.String()
+}
@@ -0,0 +1,273 @@
+// Package render renders configuration payloads in the formats read by
+// applications that can't parse JSON. Payloads are converted to their JSON
+// form first, and every format writes keys in sorted order so that the same
+// payload always renders to the same bytes.
+package render
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+
+	"github.com/aeekayy/stilla/service/pkg/utils"
+)
+
+// Format an output format for configuration payloads
+type Format string
+
+const (
+	// FormatJSON the default format
+	FormatJSON Format = "json"
+	// FormatYAML YAML 1.2
+	FormatYAML Format = "yaml"
+	// FormatTOML TOML 1.0. Null values are left out
+	FormatTOML Format = "toml"
+	// FormatDotenv flattened KEY=value lines
+	FormatDotenv Format = "dotenv"
+	// FormatProperties flattened Java properties
+	FormatProperties Format = "properties"
+	// FormatText a single scalar value as plain text
+	FormatText Format = "text"
+)
+
+// ErrUnsupportedFormat returned for a format or media type that can't be rendered
+var ErrUnsupportedFormat = errors.New("unsupported format")
+
+// ErrKeyCollision returned when two paths flatten to the same key
+var ErrKeyCollision = errors.New("flattened key collision")
+
+// formats the accepted names of each format
+var formats = map[string]Format{
+	"json":       FormatJSON,
+	"yaml":       FormatYAML,
+	"yml":        FormatYAML,
+	"toml":       FormatTOML,
+	"dotenv":     FormatDotenv,
+	"env":        FormatDotenv,
+	"properties": FormatProperties,
+	"text":       FormatText,
+	"txt":        FormatText,
+}
+
+// mediaTypes the media types of each format, in order of preference. The
+// first media type of a format is its content type
+var mediaTypes = []struct {
+	mediaType string
+	format    Format
+}{
+	{"application/json", FormatJSON},
+	{"application/yaml", FormatYAML},
+	{"application/x-yaml", FormatYAML},
+	{"text/yaml", FormatYAML},
+	{"application/toml", FormatTOML},
+	{"text/x-dotenv", FormatDotenv},
+	{"text/x-java-properties", FormatProperties},
+	{"text/plain", FormatText},
+}
+
+// ParseFormat returns the format for a name such as yaml or env
+func ParseFormat(name string) (Format, error) {
+	format, ok := formats[strings.ToLower(strings.TrimSpace(name))]
+	if !ok {
+		return "", fmt.Errorf("%w: %q", ErrUnsupportedFormat, name)
+	}
+
+	return format, nil
+}
+
+// MediaTypes returns the media types that can be rendered, JSON first
+func MediaTypes() []string {
+	offered := make([]string, 0, len(mediaTypes))
+	for _, m := range mediaTypes {
+		offered = append(offered, m.mediaType)
+	}
+
+	return offered
+}
+
+// ForMediaType returns the format of a media type from MediaTypes
+func ForMediaType(mediaType string) (Format, error) {
+	for _, m := range mediaTypes {
+		if m.mediaType == mediaType {
+			return m.format, nil
+		}
+	}
+
+	return "", fmt.Errorf("%w: %q", ErrUnsupportedFormat, mediaType)
+}
+
+// ContentType returns the Content-Type header of the format
+func (f Format) ContentType() string {
+	for _, m := range mediaTypes {
+		if m.format == f {
+			return m.mediaType + "; charset=utf-8"
+		}
+	}
+
+	return "application/octet-stream"
+}
+
+// Render renders a configuration payload in the format
+func Render(format Format, payload interface{}) ([]byte, error) {
+	value, err := utils.NormalizeJSON(payload)
+	if err != nil {
+		return nil, fmt.Errorf("unable to normalize the payload: %s", err)
+	}
+
+	// formats that need an object render null as an empty one
+	if value == nil && (format == FormatTOML || format == FormatDotenv || format == FormatProperties) {
+		value = map[string]interface{}{}
+	}
+
+	switch format {
+	case FormatJSON:
+		return json.Marshal(value)
+	case FormatYAML:
+		return yaml.Marshal(value)
+	case FormatTOML:
+		root, ok := dropNulls(value).(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%w: toml needs an object at the top level", ErrUnsupportedFormat)
+		}
+		return toml.Marshal(root)
+	case FormatDotenv:
+		if _, ok := value.(map[string]interface{}); !ok {
+			return nil, fmt.Errorf("%w: dotenv needs an object at the top level", ErrUnsupportedFormat)
+		}
+		return renderLines(value, dotenvKey, dotenvValue)
+	case FormatProperties:
+		if _, ok := value.(map[string]interface{}); !ok {
+			return nil, fmt.Errorf("%w: properties needs an object at the top level", ErrUnsupportedFormat)
+		}
+		return renderLines(value, propertiesKey, propertiesValue)
+	case FormatText:
+		switch value.(type) {
+		case map[string]interface{}, []interface{}:
+			return nil, fmt.Errorf("%w: text renders single values only", ErrUnsupportedFormat)
+		}
+		return []byte(scalar(value)), nil
+	}
+
+	return nil, fmt.Errorf("%w: %q", ErrUnsupportedFormat, format)
+}
+
+// dropNulls removes null values, which TOML can't represent
+func dropNulls(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(t))
+		for k, child := range t {
+			if child != nil {
+				out[k] = dropNulls(child)
+			}
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, 0, len(t))
+		for _, child := range t {
+			if child != nil {
+				out = append(out, dropNulls(child))
+			}
+		}
+		return out
+	}
+
+	return v
+}
+
+// segment a step in the path to a value. Index is set for array elements
+type segment struct {
+	key   string
+	index int
+	array bool
+}
+
+// renderLines flattens a payload into sorted key=value lines
+func renderLines(v interface{}, key func([]segment) string, value func(interface{}) string) ([]byte, error) {
+	lines := make(map[string]string)
+	paths := make(map[string]string)
+
+	var flatten func(path []segment, v interface{}) error
+	flatten = func(path []segment, v interface{}) error {
+		switch t := v.(type) {
+		case map[string]interface{}:
+			for k, child := range t {
+				if err := flatten(append(path[:len(path):len(path)], segment{key: k}), child); err != nil {
+					return err
+				}
+			}
+			return nil
+		case []interface{}:
+			for i, child := range t {
+				if err := flatten(append(path[:len(path):len(path)], segment{index: i, array: true}), child); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		k := key(path)
+		if other, ok := paths[k]; ok {
+			return fmt.Errorf("%w: %s and %s both render as %s", ErrKeyCollision, other, pointer(path), k)
+		}
+		paths[k] = pointer(path)
+		lines[k] = value(v)
+		return nil
+	}
+
+	if err := flatten(nil, v); err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(lines))
+	for k := range lines {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	for _, k := range keys {
+		buf.WriteString(k)
+		buf.WriteByte('=')
+		buf.WriteString(lines[k])
+		buf.WriteByte('\n')
+	}
+
+	return buf.Bytes(), nil
+}
+
+// pointer the JSON pointer of a path, used in collision errors
+func pointer(path []segment) string {
+	var b strings.Builder
+	for _, s := range path {
+		b.WriteByte('/')
+		if s.array {
+			fmt.Fprintf(&b, "%d", s.index)
+			continue
+		}
+		b.WriteString(strings.NewReplacer("~", "~0", "/", "~1").Replace(s.key))
+	}
+
+	return b.String()
+}
+
+// scalar formats a scalar value. Null is empty
+func scalar(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return t
+	case float64:
+		b, _ := json.Marshal(t)
+		return string(b)
+	}
+
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,163 @@
+package render
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// payload a nested payload as it's decoded from the document store
+var payload = bson.M{
+	"db": bson.M{
+		"host":     "db.example.com",
+		"port":     int32(5432),
+		"password": "p@ss word",
+	},
+	"servers":  bson.A{"a.example.com", "b.example.com"},
+	"timeout":  1.5,
+	"replicas": int64(1000000),
+	"debug":    false,
+	"banner":   "it's\nready",
+	"empty":    nil,
+}
+
+// TestRenderYAML validates that keys are sorted and integers kept
+func TestRenderYAML(t *testing.T) {
+	out, err := Render(FormatYAML, payload)
+	assert.Nil(t, err)
+	assert.Equal(t, `banner: |-
+    it's
+    ready
+db:
+    host: db.example.com
+    password: p@ss word
+    port: 5432
+debug: false
+empty: null
+replicas: 1000000
+servers:
+    - a.example.com
+    - b.example.com
+timeout: 1.5
+`, string(out))
+}
+
+// TestRenderTOML validates that null values are left out
+func TestRenderTOML(t *testing.T) {
+	out, err := Render(FormatTOML, payload)
+	assert.Nil(t, err)
+	assert.Equal(t, `banner = "it's\nready"
+debug = false
+replicas = 1000000
+servers = ['a.example.com', 'b.example.com']
+timeout = 1.5
+
+[db]
+host = 'db.example.com'
+password = 'p@ss word'
+port = 5432
+`, string(out))
+}
+
+// TestRenderDotenv validates the flattening rules and quoting
+func TestRenderDotenv(t *testing.T) {
+	out, err := Render(FormatDotenv, payload)
+	assert.Nil(t, err)
+	assert.Equal(t, `BANNER="it's\nready"
+DB_HOST=db.example.com
+DB_PASSWORD='p@ss word'
+DB_PORT=5432
+DEBUG=false
+EMPTY=
+REPLICAS=1000000
+SERVERS_0=a.example.com
+SERVERS_1=b.example.com
+TIMEOUT=1.5
+`, string(out))
+
+	out, err = Render(FormatDotenv, bson.M{"1st-key": "$HOME"})
+	assert.Nil(t, err)
+	assert.Equal(t, "_1ST_KEY='$HOME'\n", string(out))
+}
+
+// TestRenderProperties validates the flattening rules and escaping
+func TestRenderProperties(t *testing.T) {
+	out, err := Render(FormatProperties, payload)
+	assert.Nil(t, err)
+	assert.Equal(t, `banner=it's\nready
+db.host=db.example.com
+db.password=p@ss word
+db.port=5432
+debug=false
+empty=
+replicas=1000000
+servers[0]=a.example.com
+servers[1]=b.example.com
+timeout=1.5
+`, string(out))
+
+	out, err = Render(FormatProperties, bson.M{"key=value": " café"})
+	assert.Nil(t, err)
+	assert.Equal(t, "key\\=value=\\ caf\\u00E9\n", string(out))
+}
+
+// TestRenderCollision validates that keys that flatten to the same name fail
+func TestRenderCollision(t *testing.T) {
+	_, err := Render(FormatDotenv, bson.M{"db": bson.M{"host": "a"}, "db_host": "b"})
+	assert.ErrorIs(t, err, ErrKeyCollision)
+
+	_, err = Render(FormatProperties, bson.M{"db": bson.M{"host": "a"}, "db.host": "b"})
+	assert.ErrorIs(t, err, ErrKeyCollision)
+}
+
+// TestParseFormat validates the format names and media types
+func TestParseFormat(t *testing.T) {
+	format, err := ParseFormat("YML")
+	assert.Nil(t, err)
+	assert.Equal(t, FormatYAML, format)
+
+	format, err = ParseFormat("env")
+	assert.Nil(t, err)
+	assert.Equal(t, FormatDotenv, format)
+
+	_, err = ParseFormat("xml")
+	assert.ErrorIs(t, err, ErrUnsupportedFormat)
+
+	format, err = ForMediaType("text/x-java-properties")
+	assert.Nil(t, err)
+	assert.Equal(t, FormatProperties, format)
+	assert.Equal(t, "application/yaml; charset=utf-8", FormatYAML.ContentType())
+	assert.Equal(t, "application/json", MediaTypes()[0])
+}
+
+// TestRenderText validates that single values render as plain text
+func TestRenderText(t *testing.T) {
+	table := []struct {
+		value    interface{}
+		expected string
+	}{
+		{"db.example.com", "db.example.com"},
+		{int32(5432), "5432"},
+		{1.5, "1.5"},
+		{false, "false"},
+		{nil, ""},
+	}
+
+	for _, tc := range table {
+		out, err := Render(FormatText, tc.value)
+		assert.Nil(t, err)
+		assert.Equal(t, tc.expected, string(out))
+	}
+
+	_, err := Render(FormatText, payload)
+	assert.ErrorIs(t, err, ErrUnsupportedFormat)
+
+	// flattened formats need an object
+	_, err = Render(FormatDotenv, "x")
+	assert.ErrorIs(t, err, ErrUnsupportedFormat)
+
+	format, err := ForMediaType("text/plain")
+	assert.Nil(t, err)
+	assert.Equal(t, FormatText, format)
+}
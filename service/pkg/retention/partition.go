@@ -0,0 +1,89 @@
+package retention
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// partitionName returns the name of the monthly audit partition for t
+func partitionName(t time.Time) string {
+	return fmt.Sprintf("audit_y%04dm%02d", t.Year(), t.Month())
+}
+
+// monthStart returns the first instant of the month of t in UTC
+func monthStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// EnsurePartitions creates the monthly partitions of the audit table for
+// the current and the next month. Only used with the partitioned layout
+func (a *Archiver) EnsurePartitions(ctx context.Context) error {
+	start := monthStart(a.Now())
+
+	for i := 0; i < 2; i++ {
+		from := start.AddDate(0, i, 0)
+		to := from.AddDate(0, 1, 0)
+		sql := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s PARTITION OF audit FOR VALUES FROM ('%s') TO ('%s');",
+			partitionName(from), from.Format(time.RFC3339), to.Format(time.RFC3339))
+
+		if _, err := a.DB.Exec(ctx, sql); err != nil {
+			return fmt.Errorf("unable to create partition %s: %s", partitionName(from), err)
+		}
+	}
+
+	return nil
+}
+
+// DropExpiredPartitions drops the empty monthly partitions that end
+// before the cutoff. Records are archived before partitions are dropped
+func (a *Archiver) DropExpiredPartitions(ctx context.Context, cutoff time.Time) error {
+	rows, err := a.DB.Query(ctx, "SELECT c.relname FROM pg_inherits i JOIN pg_class c ON c.oid = i.inhrelid JOIN pg_class p ON p.oid = i.inhparent WHERE p.relname = 'audit';")
+	if err != nil {
+		return fmt.Errorf("unable to list the audit partitions: %s", err)
+	}
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return fmt.Errorf("unable to list the audit partitions: %s", err)
+		}
+		names = append(names, name)
+	}
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("unable to list the audit partitions: %s", err)
+	}
+
+	for _, name := range names {
+		var year, month int
+		if _, err := fmt.Sscanf(name, "audit_y%04dm%02d", &year, &month); err != nil {
+			continue
+		}
+
+		end := time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.UTC).AddDate(0, 1, 0)
+		if end.After(cutoff) || partitionName(end.AddDate(0, -1, 0)) != name {
+			continue
+		}
+
+		var empty bool
+		if err := a.DB.QueryRow(ctx, fmt.Sprintf("SELECT NOT EXISTS (SELECT 1 FROM %s);", name)).Scan(&empty); err != nil {
+			return fmt.Errorf("unable to check partition %s: %s", name, err)
+		}
+
+		if !empty {
+			continue
+		}
+
+		if _, err := a.DB.Exec(ctx, fmt.Sprintf("DROP TABLE %s;", name)); err != nil {
+			return fmt.Errorf("unable to drop partition %s: %s", name, err)
+		}
+		a.Logger.Infof("dropped expired audit partition %s", name)
+	}
+
+	return nil
+}
@@ -0,0 +1,399 @@
+// Package retention archives and deletes expired audit records. Expired
+// records are written to gzip compressed NDJSON files before they are
+// deleted from the audit table in batches.
+package retention
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"go.uber.org/zap"
+
+	"github.com/aeekayy/stilla/service/pkg/models"
+)
+
+const (
+	defaultBatchSize  = 1000
+	defaultInterval   = 24 * time.Hour
+	defaultArchiveDir = "archive"
+	day               = 24 * time.Hour
+	// archiveLockKey the Postgres advisory lock that's held while a cycle
+	// runs, so one replica archives at a time
+	archiveLockKey int64 = 0x61726368697665
+)
+
+// ErrLocked returned by RunOnce when another run holds the archive lock
+var ErrLocked = errors.New("another run holds the archive lock")
+
+// Querier the subset of db.DBIface used by the archiver
+type Querier interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, optionsAndArgs ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, optionsAndArgs ...any) pgx.Row
+}
+
+// Locker runs a function while holding a Postgres advisory lock. Satisfied
+// by db.Conn
+type Locker interface {
+	WithAdvisoryLock(ctx context.Context, key int64, fn func(context.Context) error) (bool, error)
+}
+
+// Policy a parsed retention policy
+type Policy struct {
+	Name      string
+	FuncNames []string
+	Keep      time.Duration
+}
+
+// Result the outcome of archiving a policy
+type Result struct {
+	Policy   string    `json:"policy"`
+	Cutoff   time.Time `json:"cutoff"`
+	Files    []string  `json:"files,omitempty"`
+	Archived int64     `json:"archived"`
+}
+
+// Record an archived audit record
+type Record struct {
+	Created  *time.Time      `json:"created"`
+	FuncName *string         `json:"funcname"`
+	ID       string          `json:"id"`
+	Service  string          `json:"service"`
+	Body     json.RawMessage `json:"body"`
+}
+
+// Archiver archives expired audit records
+type Archiver struct {
+	DB          Querier
+	Locker      Locker
+	Logger      *zap.SugaredLogger
+	Now         func() time.Time
+	Dir         string
+	Policies    []Policy
+	BatchSize   int
+	Interval    time.Duration
+	Partitioned bool
+	DryRun      bool
+}
+
+// New returns an Archiver for the audit retention configuration
+func New(db Querier, logger *zap.SugaredLogger, cfg models.AuditRetention) (*Archiver, error) {
+	a := &Archiver{
+		DB:          db,
+		Logger:      logger,
+		Now:         time.Now,
+		Dir:         cfg.ArchiveDir,
+		BatchSize:   cfg.BatchSize,
+		Interval:    defaultInterval,
+		Partitioned: cfg.Partitioned,
+	}
+
+	// cycles run under the advisory lock when the database can take one
+	if locker, ok := db.(Locker); ok {
+		a.Locker = locker
+	}
+
+	if a.Dir == "" {
+		a.Dir = defaultArchiveDir
+	}
+
+	if a.BatchSize <= 0 {
+		a.BatchSize = defaultBatchSize
+	}
+
+	if cfg.Interval != "" {
+		interval, err := time.ParseDuration(cfg.Interval)
+		if err != nil {
+			return nil, fmt.Errorf("invalid retention interval %s: %s", cfg.Interval, err)
+		}
+		a.Interval = interval
+	}
+
+	if a.Interval <= 0 {
+		return nil, fmt.Errorf("the retention interval %s must be positive", cfg.Interval)
+	}
+
+	catchAll := ""
+	seen := make(map[string]string)
+	for _, p := range cfg.Policies {
+		keep, err := ParseKeep(p.Keep)
+		if err != nil {
+			return nil, fmt.Errorf("invalid retention policy %s: %s", p.Name, err)
+		}
+
+		if len(p.FuncNames) == 0 {
+			if catchAll != "" {
+				return nil, fmt.Errorf("retention policies %s and %s both apply to every record", catchAll, p.Name)
+			}
+			catchAll = p.Name
+		}
+
+		for _, f := range p.FuncNames {
+			if other, ok := seen[f]; ok {
+				return nil, fmt.Errorf("retention policies %s and %s both apply to %s", other, p.Name, f)
+			}
+			seen[f] = p.Name
+		}
+
+		a.Policies = append(a.Policies, Policy{Name: p.Name, FuncNames: p.FuncNames, Keep: keep})
+	}
+
+	return a, nil
+}
+
+// ParseKeep parses a retention period. Days (400d) and years (2y, 365 days)
+// are supported in addition to Go durations
+func ParseKeep(s string) (time.Duration, error) {
+	var d time.Duration
+	var err error
+
+	switch {
+	case s == "":
+		return 0, fmt.Errorf("the retention period is empty")
+	case strings.HasSuffix(s, "d"):
+		var n int
+		n, err = strconv.Atoi(strings.TrimSuffix(s, "d"))
+		d = time.Duration(n) * day
+	case strings.HasSuffix(s, "y"):
+		var n int
+		n, err = strconv.Atoi(strings.TrimSuffix(s, "y"))
+		d = time.Duration(n) * 365 * day
+	default:
+		d, err = time.ParseDuration(s)
+	}
+
+	if err != nil {
+		return 0, fmt.Errorf("invalid retention period %s: %s", s, err)
+	}
+
+	if d <= 0 {
+		return 0, fmt.Errorf("the retention period %s must be positive", s)
+	}
+
+	return d, nil
+}
+
+// Run archives expired records on every interval until the context is done.
+// Each cycle runs under the archive advisory lock, so only one replica of
+// the service archives at a time
+func (a *Archiver) Run(ctx context.Context) {
+	ticker := time.NewTicker(a.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := a.cycle(ctx); err != nil {
+			a.Logger.Errorf("unable to archive audit records: %s", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// cycle archives expired records once. It's skipped when another replica
+// holds the archive lock
+func (a *Archiver) cycle(ctx context.Context) error {
+	_, err := a.RunOnce(ctx)
+	if errors.Is(err, ErrLocked) {
+		a.Logger.Debugf("skipped archiving, another replica holds the lock")
+		return nil
+	}
+
+	return err
+}
+
+// RunOnce archives the expired records of every policy while holding the
+// archive lock, so it doesn't overlap a background run. It returns ErrLocked
+// without archiving when the lock is held elsewhere. A dry run only counts
+// records, so it doesn't take the lock
+func (a *Archiver) RunOnce(ctx context.Context) ([]Result, error) {
+	if a.Locker == nil || a.DryRun {
+		return a.Archive(ctx)
+	}
+
+	var results []Result
+	locked, err := a.Locker.WithAdvisoryLock(ctx, archiveLockKey, func(ctx context.Context) error {
+		var err error
+		results, err = a.Archive(ctx)
+		return err
+	})
+	if err == nil && !locked {
+		return nil, ErrLocked
+	}
+
+	return results, err
+}
+
+// Archive archives the expired records of every policy. Records are only
+// deleted after their archive file has been written and synced
+func (a *Archiver) Archive(ctx context.Context) ([]Result, error) {
+	var results []Result
+
+	if a.Partitioned && !a.DryRun {
+		if err := a.EnsurePartitions(ctx); err != nil {
+			return results, err
+		}
+	}
+
+	// funcnames that are covered by a specific policy
+	var claimed []string
+	for _, p := range a.Policies {
+		claimed = append(claimed, p.FuncNames...)
+	}
+
+	now := a.Now()
+	oldest := now
+	for _, p := range a.Policies {
+		result, err := a.archivePolicy(ctx, p, claimed, now.Add(-p.Keep))
+		results = append(results, result)
+		if err != nil {
+			return results, fmt.Errorf("unable to archive policy %s: %s", p.Name, err)
+		}
+
+		if result.Cutoff.Before(oldest) {
+			oldest = result.Cutoff
+		}
+	}
+
+	if a.Partitioned && !a.DryRun && len(a.Policies) > 0 {
+		if err := a.DropExpiredPartitions(ctx, oldest); err != nil {
+			return results, err
+		}
+	}
+
+	return results, nil
+}
+
+// policyFilter returns the SQL condition that selects the records of a policy
+func policyFilter(p Policy, claimed []string) (string, []string) {
+	if len(p.FuncNames) > 0 {
+		return "funcname = ANY($2)", p.FuncNames
+	}
+
+	if claimed == nil {
+		claimed = []string{}
+	}
+
+	return "COALESCE(funcname, '') <> ALL($2)", claimed
+}
+
+// archivePolicy archives the records of a single policy in batches
+func (a *Archiver) archivePolicy(ctx context.Context, p Policy, claimed []string, cutoff time.Time) (Result, error) {
+	result := Result{Policy: p.Name, Cutoff: cutoff}
+	filter, funcNames := policyFilter(p, claimed)
+
+	if a.DryRun {
+		err := a.DB.QueryRow(ctx, fmt.Sprintf("SELECT count(*) FROM audit WHERE created < $1 AND %s;", filter), cutoff, funcNames).Scan(&result.Archived)
+		return result, err
+	}
+
+	query := fmt.Sprintf("SELECT id, service, funcname, body, created FROM audit WHERE created < $1 AND %s ORDER BY created LIMIT $3;", filter)
+	stamp := a.Now().UTC().Format("20060102T150405Z")
+
+	for batch := 0; ; batch++ {
+		records, err := a.readBatch(ctx, query, cutoff, funcNames)
+		if err != nil {
+			return result, err
+		}
+
+		if len(records) == 0 {
+			return result, nil
+		}
+
+		file := filepath.Join(a.Dir, fmt.Sprintf("audit-%s-%s-%04d.ndjson.gz", p.Name, stamp, batch))
+		if err := writeArchive(file, records); err != nil {
+			return result, err
+		}
+		result.Files = append(result.Files, file)
+
+		ids := make([]string, len(records))
+		for i, r := range records {
+			ids[i] = r.ID
+		}
+
+		tag, err := a.DB.Exec(ctx, "DELETE FROM audit WHERE id = ANY($1);", ids)
+		if err != nil {
+			return result, fmt.Errorf("unable to delete archived records: %s", err)
+		}
+		result.Archived += tag.RowsAffected()
+
+		a.Logger.Infof("archived %d audit records for policy %s to %s", len(records), p.Name, file)
+
+		if len(records) < a.BatchSize {
+			return result, nil
+		}
+	}
+}
+
+// readBatch reads the next batch of expired records
+func (a *Archiver) readBatch(ctx context.Context, query string, cutoff time.Time, funcNames []string) ([]Record, error) {
+	rows, err := a.DB.Query(ctx, query, cutoff, funcNames, a.BatchSize)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read expired records: %s", err)
+	}
+	defer rows.Close()
+
+	var records []Record
+	for rows.Next() {
+		var r Record
+		var body []byte
+		if err := rows.Scan(&r.ID, &r.Service, &r.FuncName, &body, &r.Created); err != nil {
+			return nil, fmt.Errorf("unable to read expired records: %s", err)
+		}
+
+		if body != nil {
+			r.Body = json.RawMessage(body)
+		}
+		records = append(records, r)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("unable to read expired records: %s", err)
+	}
+
+	return records, nil
+}
+
+// writeArchive writes records to a gzip compressed NDJSON file
+func writeArchive(file string, records []Record) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0o750); err != nil {
+		return fmt.Errorf("unable to create the archive directory: %s", err)
+	}
+
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o640)
+	if err != nil {
+		return fmt.Errorf("unable to create the archive: %s", err)
+	}
+	defer f.Close()
+
+	zw := gzip.NewWriter(f)
+	enc := json.NewEncoder(zw)
+	for _, r := range records {
+		if err := enc.Encode(r); err != nil {
+			return fmt.Errorf("unable to write the archive: %s", err)
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("unable to write the archive: %s", err)
+	}
+
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("unable to sync the archive: %s", err)
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,247 @@
+package retention
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pashagolub/pgxmock/v2"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap/zaptest"
+
+	"github.com/aeekayy/stilla/service/pkg/models"
+)
+
+const (
+	selectDefault = "SELECT id, service, funcname, body, created FROM audit WHERE created < $1 AND COALESCE(funcname, '') <> ALL($2) ORDER BY created LIMIT $3;"
+	selectAuth    = "SELECT id, service, funcname, body, created FROM audit WHERE created < $1 AND funcname = ANY($2) ORDER BY created LIMIT $3;"
+	deleteRecords = "DELETE FROM audit WHERE id = ANY($1);"
+)
+
+// TestSuiteParseKeep validates retention periods
+func TestSuiteParseKeep(t *testing.T) {
+	table := []struct {
+		name      string
+		input     string
+		expected  time.Duration
+		expectErr bool
+	}{
+		{"TestParseKeepDays", "400d", 400 * day, false},
+		{"TestParseKeepYears", "2y", 730 * day, false},
+		{"TestParseKeepDuration", "36h", 36 * time.Hour, false},
+		{"TestParseKeepEmpty", "", 0, true},
+		{"TestParseKeepNegative", "-1d", 0, true},
+		{"TestParseKeepInvalid", "forever", 0, true},
+	}
+
+	for _, tc := range table {
+		t.Run(tc.name, func(t *testing.T) {
+			ans, err := ParseKeep(tc.input)
+			if tc.expectErr {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tc.expected, ans)
+		})
+	}
+}
+
+// TestNewOverlappingPolicies validates that a record is covered by one policy
+func TestNewOverlappingPolicies(t *testing.T) {
+	logger := zaptest.NewLogger(t).Sugar()
+
+	_, err := New(nil, logger, models.AuditRetention{Policies: []models.RetentionPolicy{
+		{Name: "default", Keep: "400d"},
+		{Name: "all", Keep: "2y"},
+	}})
+	assert.NotNil(t, err)
+
+	_, err = New(nil, logger, models.AuditRetention{Policies: []models.RetentionPolicy{
+		{Name: "auth", Keep: "2y", FuncNames: []string{"AuthFailure"}},
+		{Name: "login", Keep: "400d", FuncNames: []string{"AuthFailure"}},
+	}})
+	assert.NotNil(t, err)
+}
+
+// TestArchive validates that expired records are archived before they are deleted
+func TestArchive(t *testing.T) {
+	mock, err := pgxmock.NewPool(pgxmock.QueryMatcherOption(pgxmock.QueryMatcherEqual))
+	assert.Nil(t, err)
+	defer mock.Close()
+
+	dir := t.TempDir()
+	archiver, err := New(mock, zaptest.NewLogger(t).Sugar(), models.AuditRetention{
+		ArchiveDir: dir,
+		BatchSize:  2,
+		Policies: []models.RetentionPolicy{
+			{Name: "default", Keep: "400d"},
+			{Name: "auth", Keep: "2y", FuncNames: []string{"AuthFailure"}},
+		},
+	})
+	assert.Nil(t, err)
+
+	now := time.Date(2026, 10, 19, 0, 0, 0, 0, time.UTC)
+	archiver.Now = func() time.Time { return now }
+	created := now.Add(-500 * day)
+	getConfig := "GetConfig"
+	columns := []string{"id", "service", "funcname", "body", "created"}
+
+	// the default policy reads a full batch and then a partial one
+	mock.ExpectQuery(selectDefault).WithArgs(now.Add(-400*day), []string{"AuthFailure"}, 2).
+		WillReturnRows(pgxmock.NewRows(columns).
+			AddRow("a", "stilla", &getConfig, []byte(`{"request.method":"GET"}`), &created).
+			AddRow("b", "stilla", &getConfig, []byte(nil), &created))
+	mock.ExpectExec(deleteRecords).WithArgs([]string{"a", "b"}).WillReturnResult(pgxmock.NewResult("DELETE", 2))
+	mock.ExpectQuery(selectDefault).WithArgs(now.Add(-400*day), []string{"AuthFailure"}, 2).
+		WillReturnRows(pgxmock.NewRows(columns).
+			AddRow("c", "stilla", &getConfig, []byte(`{}`), &created))
+	mock.ExpectExec(deleteRecords).WithArgs([]string{"c"}).WillReturnResult(pgxmock.NewResult("DELETE", 1))
+
+	// nothing has expired for the auth policy
+	mock.ExpectQuery(selectAuth).WithArgs(now.Add(-730*day), []string{"AuthFailure"}, 2).
+		WillReturnRows(pgxmock.NewRows(columns))
+
+	results, err := archiver.Archive(context.Background())
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	assert.Len(t, results, 2)
+	assert.Equal(t, int64(3), results[0].Archived)
+	assert.Len(t, results[0].Files, 2)
+	assert.Equal(t, int64(0), results[1].Archived)
+
+	records := readArchive(t, results[0].Files[0])
+	assert.Len(t, records, 2)
+	assert.Equal(t, "a", records[0].ID)
+	assert.JSONEq(t, `{"request.method":"GET"}`, string(records[0].Body))
+	assert.Equal(t, "GetConfig", *records[0].FuncName)
+}
+
+// TestArchiveDryRun validates that a dry run only counts records
+func TestArchiveDryRun(t *testing.T) {
+	mock, err := pgxmock.NewPool(pgxmock.QueryMatcherOption(pgxmock.QueryMatcherEqual))
+	assert.Nil(t, err)
+	defer mock.Close()
+
+	archiver, err := New(mock, zaptest.NewLogger(t).Sugar(), models.AuditRetention{
+		ArchiveDir: t.TempDir(),
+		Policies:   []models.RetentionPolicy{{Name: "default", Keep: "400d"}},
+	})
+	assert.Nil(t, err)
+	archiver.DryRun = true
+
+	mock.ExpectQuery("SELECT count(*) FROM audit WHERE created < $1 AND COALESCE(funcname, '') <> ALL($2);").
+		WithArgs(pgxmock.AnyArg(), []string{}).
+		WillReturnRows(pgxmock.NewRows([]string{"count"}).AddRow(int64(42)))
+
+	results, err := archiver.Archive(context.Background())
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+	assert.Equal(t, int64(42), results[0].Archived)
+	assert.Empty(t, results[0].Files)
+}
+
+// fakeLocker a Locker that holds the lock when locked is set
+type fakeLocker struct {
+	locked bool
+	keys   []int64
+}
+
+func (f *fakeLocker) WithAdvisoryLock(ctx context.Context, key int64, fn func(context.Context) error) (bool, error) {
+	f.keys = append(f.keys, key)
+	if !f.locked {
+		return false, nil
+	}
+
+	return true, fn(ctx)
+}
+
+// TestCycleLock validates that a cycle only archives while it holds the
+// archive lock
+func TestCycleLock(t *testing.T) {
+	mock, err := pgxmock.NewPool(pgxmock.QueryMatcherOption(pgxmock.QueryMatcherEqual))
+	assert.Nil(t, err)
+	defer mock.Close()
+
+	archiver, err := New(mock, zaptest.NewLogger(t).Sugar(), models.AuditRetention{
+		ArchiveDir: t.TempDir(),
+		Policies:   []models.RetentionPolicy{{Name: "default", Keep: "400d"}},
+	})
+	assert.Nil(t, err)
+
+	// another replica holds the lock, so nothing is read
+	locker := &fakeLocker{}
+	archiver.Locker = locker
+	assert.Nil(t, archiver.cycle(context.Background()))
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	locker.locked = true
+	mock.ExpectQuery(selectDefault).WithArgs(pgxmock.AnyArg(), []string{}, defaultBatchSize).
+		WillReturnRows(pgxmock.NewRows([]string{"id", "service", "funcname", "body", "created"}))
+	assert.Nil(t, archiver.cycle(context.Background()))
+	assert.Nil(t, mock.ExpectationsWereMet())
+	assert.Equal(t, []int64{archiveLockKey, archiveLockKey}, locker.keys)
+}
+
+// TestRunOnceLocked validates that an on-demand run doesn't archive while
+// another run holds the archive lock
+func TestRunOnceLocked(t *testing.T) {
+	mock, err := pgxmock.NewPool(pgxmock.QueryMatcherOption(pgxmock.QueryMatcherEqual))
+	assert.Nil(t, err)
+	defer mock.Close()
+
+	archiver, err := New(mock, zaptest.NewLogger(t).Sugar(), models.AuditRetention{
+		ArchiveDir: t.TempDir(),
+		Policies:   []models.RetentionPolicy{{Name: "default", Keep: "400d"}},
+	})
+	assert.Nil(t, err)
+
+	locker := &fakeLocker{}
+	archiver.Locker = locker
+	results, err := archiver.RunOnce(context.Background())
+	assert.ErrorIs(t, err, ErrLocked)
+	assert.Nil(t, results)
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	locker.locked = true
+	mock.ExpectQuery(selectDefault).WithArgs(pgxmock.AnyArg(), []string{}, defaultBatchSize).
+		WillReturnRows(pgxmock.NewRows([]string{"id", "service", "funcname", "body", "created"}))
+	results, err = archiver.RunOnce(context.Background())
+	assert.Nil(t, err)
+	assert.Len(t, results, 1)
+	assert.Nil(t, mock.ExpectationsWereMet())
+	assert.Equal(t, []int64{archiveLockKey, archiveLockKey}, locker.keys)
+}
+
+// TestNewInvalidInterval validates that the interval must be positive
+func TestNewInvalidInterval(t *testing.T) {
+	for _, interval := range []string{"0s", "-1h", "daily"} {
+		_, err := New(nil, zaptest.NewLogger(t).Sugar(), models.AuditRetention{Interval: interval})
+		assert.NotNil(t, err, interval)
+	}
+}
+
+// readArchive reads the records of an archive file
+func readArchive(t *testing.T, file string) []Record {
+	f, err := os.Open(file)
+	assert.Nil(t, err)
+	defer f.Close()
+
+	zr, err := gzip.NewReader(f)
+	assert.Nil(t, err)
+
+	var records []Record
+	scanner := bufio.NewScanner(zr)
+	for scanner.Scan() {
+		var r Record
+		assert.Nil(t, json.Unmarshal(scanner.Bytes(), &r))
+		records = append(records, r)
+	}
+
+	return records
+}
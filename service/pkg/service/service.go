@@ -13,6 +13,7 @@ import (
 
 	"github.com/aeekayy/stilla/service/pkg/api"
 	"github.com/aeekayy/stilla/service/pkg/models"
+	"github.com/aeekayy/stilla/service/pkg/redact"
 )
 
 const (
@@ -55,6 +56,15 @@ func (s *Service) Start() error {
 		sugar.Errorf("There's an error retrieving the configuration: %s", err)
 	}
 
+	// redact log output with the configured redaction policy
+	redactor, err := redact.New(config.Redaction)
+	if err != nil {
+		sugar.Errorf("Invalid redaction policy, using the default policy: %s", err)
+		redactor = redact.Default()
+	}
+	logger = logger.WithOptions(zap.WrapCore(redactor.Core))
+	sugar = logger.Sugar()
+
 	// enable tracing if it's enable
 	if config.Sentry.Enabled {
 		sugar.Info("Starting Sentry")
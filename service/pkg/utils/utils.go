@@ -2,6 +2,8 @@
 package utils
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"html"
 	"os"
@@ -31,103 +33,62 @@ func MapToProtobufStruct(m map[string]interface{}) (*structpb.Struct, error) {
 // int, int64, bool, string
 func SanitizeMessageValue(i interface{}) interface{} {
 	switch v := i.(type) {
-	case int:
-	case string:
-	case int64:
-	case bool:
+	case int, string, int64, bool:
 		return v
 	default:
 		sv := fmt.Sprintf("%v", v)
 		return sv
 	}
-
-	return nil
 }
 
-// SanitizeLogMessage removes user input from the log output
-func SanitizeLogMessage(log string, input ...string) string {
-	cleanLog := log
-
-	for _, v := range input {
-		if v != "" {
-			cleanUserInput := "****"
-			if len(v) > 3 {
-				cleanUserInput = v[0:3] + "****"
-			}
-
-			//fullLog := fmt.Sprintf(log, userInput)
-			cleanLog = strings.Replace(cleanLog, v, cleanUserInput, -1)
-		}
+// GetEnv get key environment variable if exist otherwise return defalutValue
+func GetEnv(key, defaultValue string) string {
+	value := os.Getenv(key)
+	if len(value) == 0 {
+		return defaultValue
 	}
-	cleanLog = strings.Replace(cleanLog, "\n", "", -1)
-	cleanLog = strings.Replace(cleanLog, "\r", "", -1)
-
-	return cleanLog
+	return value
 }
 
-// SanitizeLogMessageF removes user input from the log output and format
-func SanitizeLogMessageF(log string, input ...string) string {
-	cleanLog := log
-
-	for _, v := range input {
-		cleanLog = fmt.Sprintf(log, v)
-
-		if v != "" {
-			cleanUserInput := "****"
-			if len(v) > 3 {
-				cleanUserInput = v[0:3] + "****"
-			}
-
-			//fullLog := fmt.Sprintf(log, userInput)
-			cleanLog = strings.Replace(cleanLog, v, cleanUserInput, -1)
+// JSONNumbers replaces the json.Number values of a decoded JSON value with
+// int64 or float64, so integers aren't stored or printed as floats
+func JSONNumbers(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, child := range t {
+			t[k] = JSONNumbers(child)
 		}
-	}
-	cleanLog = strings.Replace(cleanLog, "\n", "", -1)
-	cleanLog = strings.Replace(cleanLog, "\r", "", -1)
-
-	return cleanLog
-}
-
-// SanitizeErrorMessage removes user input from the err output
-func SanitizeErrorMessage(log error, input ...string) error {
-	cleanLog := log.Error()
-
-	for _, v := range input {
-		if v != "" {
-			cleanUserInput := "****"
-			if len(v) > 3 {
-				cleanUserInput = v[0:3] + "****"
-			}
-
-			//fullLog := fmt.Sprintf(log, userInput)
-			cleanLog = strings.Replace(cleanLog, v, cleanUserInput, -1)
+	case []interface{}:
+		for i, child := range t {
+			t[i] = JSONNumbers(child)
 		}
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			return i
+		}
+		f, _ := t.Float64()
+		return f
 	}
-	cleanLog = strings.Replace(cleanLog, "\n", "", -1)
-	cleanLog = strings.Replace(cleanLog, "\r", "", -1)
 
-	return fmt.Errorf("%s", cleanLog)
+	return v
 }
 
-// ObfuscateValue obfuscate the string
-func ObfuscateValue(input string, char int) string {
-	if input == "" || char < 0 {
-		return "****"
-	}
-
-	cleanUserInput := "****"
-	if len(input) > 3 {
-		cleanUserInput = input[0:char] + "****"
+// NormalizeJSON converts a value into its JSON form made of maps, slices,
+// strings, bools, nil, int64 and float64. Values decoded from the document
+// store, such as bson.M and bson.A, become plain maps and slices
+func NormalizeJSON(v interface{}) (interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
 	}
 
-	return cleanUserInput
-}
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
 
-// GetEnv get key environment variable if exist otherwise return defalutValue
-func GetEnv(key, defaultValue string) string {
-	value := os.Getenv(key)
-	if len(value) == 0 {
-		return defaultValue
+	var out interface{}
+	if err := decoder.Decode(&out); err != nil {
+		return nil, err
 	}
-	return value
+
+	return JSONNumbers(out), nil
 }
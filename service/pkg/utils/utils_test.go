@@ -1,7 +1,7 @@
 package utils
 
 import (
-	"fmt"
+	"encoding/json"
 	"os"
 	"reflect"
 	"testing"
@@ -24,32 +24,6 @@ func TestSanitizeMessageValueStruct(t *testing.T) {
 	}
 }
 
-// TestSuiteSanitizeMessage
-func TestSuiteSanitizeMessage(t *testing.T) {
-	userInput := "5ca9dba"
-	shortUserInput := "5c"
-	emptyUserInput := ""
-
-	table := []struct {
-		name     string
-		input    string
-		log      string
-		expected string
-	}{
-		{"TestPositiveSanitizeLogMessage", userInput, fmt.Sprintf("This is a log line with a cache key: %s", userInput), "This is a log line with a cache key: 5ca****"},
-		{"TestPositiveSanitizeLogMessageMultiple", userInput, fmt.Sprintf("This is a log line with a cache key: %s. Cache key: %s", userInput, userInput), "This is a log line with a cache key: 5ca****. Cache key: 5ca****"},
-		{"TestPositiveSanitizeLogMessageShortKey", shortUserInput, fmt.Sprintf("This is a log line with a cache key: %s", shortUserInput), "This is a log line with a cache key: ****"},
-		{"TestPositiveSanitizeLogMessageEmpty", emptyUserInput, fmt.Sprintf("This is a log line with a cache key: %s", emptyUserInput), "This is a log line with a cache key: "},
-	}
-
-	for _, tc := range table {
-		t.Run(tc.name, func(t *testing.T) {
-			ans := SanitizeLogMessage(tc.log, tc.input)
-			assert.Equal(t, ans, tc.expected, "the log outputs should match.")
-		})
-	}
-}
-
 // TestSanitizeMessageValueBool
 func TestSanitizeMessageValueBool(t *testing.T) {
 	testBool := false
@@ -91,3 +65,37 @@ func TestSuiteGetEnv(t *testing.T) {
 		})
 	}
 }
+
+func TestJSONNumbers(t *testing.T) {
+	v := JSONNumbers(map[string]interface{}{
+		"port":  json.Number("8080"),
+		"ratio": json.Number("0.5"),
+		"hosts": []interface{}{json.Number("1"), "a"},
+	})
+
+	assert.Equal(t, map[string]interface{}{
+		"port":  int64(8080),
+		"ratio": 0.5,
+		"hosts": []interface{}{int64(1), "a"},
+	}, v)
+}
+
+func TestNormalizeJSON(t *testing.T) {
+	type server struct {
+		Host string `json:"host"`
+		Port int32  `json:"port"`
+	}
+
+	v, err := NormalizeJSON(map[string]interface{}{
+		"servers": []server{{"a", 80}},
+		"ratio":   0.5,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"servers": []interface{}{map[string]interface{}{"host": "a", "port": int64(80)}},
+		"ratio":   0.5,
+	}, v)
+
+	_, err = NormalizeJSON(make(chan int))
+	assert.NotNil(t, err)
+}
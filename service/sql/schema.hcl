@@ -76,6 +76,25 @@ table "audit" {
   primary_key {
     columns = [column.id]
   }
+  index "idx_audit_created" {
+    columns = [column.created]
+  }
+  index "idx_audit_funcname_created" {
+    columns = [column.funcname, column.created]
+  }
+  # Optional time-based partitioning layout. To partition the audit table by
+  # month, make "created" NOT NULL, add it to the primary key and uncomment
+  # the partition block below. Set audit_retention.partitioned to true so the
+  # retention job creates the monthly partitions (audit_yYYYYmMM) ahead of
+  # time and drops them once every record in them has been archived.
+  #
+  # primary_key {
+  #   columns = [column.id, column.created]
+  # }
+  # partition {
+  #   type    = RANGE
+  #   columns = [column.created]
+  # }
 }
 
 table "roles" {